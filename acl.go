@@ -0,0 +1,743 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultUser        = "default"
+	DefaultAclLogLen   = 128
+	AclLogGroupSeconds = 60 // similar denials in the period are grouped in one log entry
+
+	ReplyNoAuth     = "-NOAUTH Authentication required.\r\n"
+	ReplyWrongPass  = "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+	ReplyNoPermKey  = "-NOPERM No permissions to access a key\r\n"
+	ReplyAuthNoPass = "-ERR: AUTH <password> called without any password configured for the default user. " +
+		"Are you sure your configuration is correct?\r\n"
+)
+
+var ErrNoAclFile = errors.New("This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration.")
+
+type AclCategory uint32
+
+const (
+	AclKeyspace AclCategory = 1 << iota
+	AclRead
+	AclWrite
+	AclString
+	AclSortedSet
+	AclStream
+	AclGeo
+	AclPubSub
+	AclAdmin
+	AclFast
+	AclSlow
+	AclBlocking
+	AclDangerous
+	AclConnection
+)
+
+// AclCategoryNames are the names of the categories, the index is the bit of the category.
+var AclCategoryNames = []string{
+	"keyspace", "read", "write", "string", "sortedset", "stream", "geo",
+	"pubsub", "admin", "fast", "slow", "blocking", "dangerous", "connection",
+}
+
+func aclCategory(name string) (AclCategory, bool) {
+	if strings.EqualFold(name, "all") {
+		return ^AclCategory(0), true
+	}
+	for i, catName := range AclCategoryNames {
+		if strings.EqualFold(catName, name) {
+			return 1 << i, true
+		}
+	}
+	return 0, false
+}
+
+// keyRange returns the positions of the keys in args from first to last with step,
+// a negative last counts from the end of args.
+func keyRange(first, last, step int) func(args []*Obj) []int {
+	return func(args []*Obj) []int {
+		end := last
+		if end < 0 {
+			end += len(args)
+		}
+		var keys []int
+		for i := first; i <= end && i < len(args); i += step {
+			keys = append(keys, i)
+		}
+		return keys
+	}
+}
+
+type AclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords map[string]bool // sha256 hex of the passwords
+
+	// commands are allowed if allCommands, except the ones in cmds, or only the ones in cmds if not allCommands
+	allCommands bool
+	cmds        map[string]bool
+	subcmds     map[string]bool // subcommand rules like config|get override the command rules
+
+	allKeys         bool
+	keyPatterns     []string
+	allChannels     bool
+	channelPatterns []string
+}
+
+func NewAclUser(name string) *AclUser {
+	return &AclUser{
+		name:      name,
+		passwords: make(map[string]bool),
+		cmds:      make(map[string]bool),
+		subcmds:   make(map[string]bool),
+	}
+}
+
+func hashPassword(pass string) string {
+	sum := sha256.Sum256([]byte(pass))
+	return hex.EncodeToString(sum[:])
+}
+
+func (u *AclUser) allowCommand(name string, allow bool) {
+	for sub := range u.subcmds {
+		if strings.HasPrefix(sub, name+"|") {
+			delete(u.subcmds, sub)
+		}
+	}
+	if allow == u.allCommands {
+		delete(u.cmds, name)
+	} else {
+		u.cmds[name] = true
+	}
+}
+
+func (u *AclUser) allowCategory(cat AclCategory, allow bool) {
+	for name, cmd := range CmdTable {
+		if cmd.acl&cat != 0 {
+			u.allowCommand(name, allow)
+		}
+	}
+}
+
+// SetRule applies an ACL rule like on, >password, ~pattern or +@read to the user.
+func (u *AclUser) SetRule(rule string) error {
+	lower := strings.ToLower(rule)
+	switch {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass = true
+		u.passwords = make(map[string]bool)
+	case lower == "resetpass":
+		u.nopass = false
+		u.passwords = make(map[string]bool)
+	case lower == "allkeys":
+		u.allKeys, u.keyPatterns = true, nil
+	case lower == "resetkeys":
+		u.allKeys, u.keyPatterns = false, nil
+	case lower == "allchannels":
+		u.allChannels, u.channelPatterns = true, nil
+	case lower == "resetchannels":
+		u.allChannels, u.channelPatterns = false, nil
+	case lower == "allcommands":
+		u.allCommands = true
+		u.cmds, u.subcmds = make(map[string]bool), make(map[string]bool)
+	case lower == "nocommands":
+		u.allCommands = false
+		u.cmds, u.subcmds = make(map[string]bool), make(map[string]bool)
+	case lower == "reset":
+		*u = *NewAclUser(u.name)
+	case rule[0] == '>':
+		u.passwords[hashPassword(rule[1:])] = true
+		u.nopass = false
+	case rule[0] == '<':
+		delete(u.passwords, hashPassword(rule[1:]))
+	case rule[0] == '#' || rule[0] == '!':
+		hash := strings.ToLower(rule[1:])
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		if rule[0] == '#' {
+			u.passwords[hash] = true
+			u.nopass = false
+		} else {
+			delete(u.passwords, hash)
+		}
+	case rule[0] == '~':
+		if u.allKeys {
+			return fmt.Errorf("Adding a pattern after the * pattern (or the 'allkeys' flag) is not valid and does not have any effect. Try 'resetkeys' to start with an empty list of patterns")
+		}
+		if rule == "~*" {
+			u.allKeys, u.keyPatterns = true, nil
+		} else {
+			u.keyPatterns = append(u.keyPatterns, rule[1:])
+		}
+	case rule[0] == '&':
+		if u.allChannels {
+			return fmt.Errorf("Adding a pattern after the * pattern (or the 'allchannels' flag) is not valid and does not have any effect. Try 'resetchannels' to start with an empty list of channels")
+		}
+		if rule == "&*" {
+			u.allChannels, u.channelPatterns = true, nil
+		} else {
+			u.channelPatterns = append(u.channelPatterns, rule[1:])
+		}
+	case (rule[0] == '+' || rule[0] == '-') && len(rule) > 1 && rule[1] == '@':
+		cat, ok := aclCategory(rule[2:])
+		if !ok {
+			return errors.New("Unknown command category")
+		}
+		switch {
+		case cat == ^AclCategory(0) && rule[0] == '+':
+			u.SetRule("allcommands")
+		case cat == ^AclCategory(0):
+			u.SetRule("nocommands")
+		default:
+			u.allowCategory(cat, rule[0] == '+')
+		}
+	case rule[0] == '+' || rule[0] == '-':
+		allow := rule[0] == '+'
+		name, sub, hasSub := strings.Cut(lower[1:], "|")
+		if CmdTable[name] == nil || (hasSub && sub == "") {
+			return errors.New("Unknown command")
+		}
+		if hasSub {
+			u.subcmds[name+"|"+sub] = allow
+		} else {
+			u.allowCommand(name, allow)
+		}
+	default:
+		return errors.New("Syntax error")
+	}
+	return nil
+}
+
+// SetRules applies the rules, the user is left untouched if any rule is invalid.
+func (u *AclUser) SetRules(rules []string) error {
+	tmp := u.clone()
+	for _, rule := range rules {
+		if rule == "" {
+			return fmt.Errorf("Error in ACL SETUSER modifier '': Syntax error")
+		}
+		if err := tmp.SetRule(rule); err != nil {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%v': %v", rule, err)
+		}
+	}
+	*u = *tmp
+	return nil
+}
+
+func (u *AclUser) clone() *AclUser {
+	c := *u
+	c.passwords, c.cmds, c.subcmds = make(map[string]bool), make(map[string]bool), make(map[string]bool)
+	for k, v := range u.passwords {
+		c.passwords[k] = v
+	}
+	for k, v := range u.cmds {
+		c.cmds[k] = v
+	}
+	for k, v := range u.subcmds {
+		c.subcmds[k] = v
+	}
+	c.keyPatterns = append([]string(nil), u.keyPatterns...)
+	c.channelPatterns = append([]string(nil), u.channelPatterns...)
+	return &c
+}
+
+func (u *AclUser) checkPassword(pass string) bool {
+	return u.enabled && (u.nopass || u.passwords[hashPassword(pass)])
+}
+
+// CommandAllowed reports whether the user can run the command with the subcommand args[1].
+func (u *AclUser) CommandAllowed(cmd *GodisCommand, args []*Obj) bool {
+	if len(args) > 1 && len(u.subcmds) > 0 {
+		if allow, ok := u.subcmds[cmd.name+"|"+strings.ToLower(args[1].StrVal())]; ok {
+			return allow
+		}
+	}
+	return u.allCommands != u.cmds[cmd.name]
+}
+
+func (u *AclUser) KeyAllowed(key string) bool {
+	if u.allKeys {
+		return true
+	}
+	for _, pattern := range u.keyPatterns {
+		if stringMatch(pattern, key, false) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *AclUser) ChannelAllowed(channel string) bool {
+	if u.allChannels {
+		return true
+	}
+	for _, pattern := range u.channelPatterns {
+		if stringMatch(pattern, channel, false) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *AclUser) flags() []string {
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+func (u *AclUser) commandRules() string {
+	rules := []string{"-@all"}
+	if u.allCommands {
+		rules[0] = "+@all"
+	}
+	for _, name := range sortedKeys(u.cmds) {
+		if u.allCommands {
+			rules = append(rules, "-"+name)
+		} else {
+			rules = append(rules, "+"+name)
+		}
+	}
+	for _, sub := range sortedKeys(u.subcmds) {
+		if u.subcmds[sub] {
+			rules = append(rules, "+"+sub)
+		} else {
+			rules = append(rules, "-"+sub)
+		}
+	}
+	return strings.Join(rules, " ")
+}
+
+func (u *AclUser) keyRules() string {
+	if u.allKeys {
+		return "~*"
+	}
+	rules := make([]string, len(u.keyPatterns))
+	for i, pattern := range u.keyPatterns {
+		rules[i] = "~" + pattern
+	}
+	return strings.Join(rules, " ")
+}
+
+func (u *AclUser) channelRules() string {
+	if u.allChannels {
+		return "&*"
+	}
+	rules := make([]string, len(u.channelPatterns))
+	for i, pattern := range u.channelPatterns {
+		rules[i] = "&" + pattern
+	}
+	return strings.Join(rules, " ")
+}
+
+// Describe returns the rules to create the user, like "on nopass ~* &* +@all".
+func (u *AclUser) Describe() string {
+	rules := u.flags()
+	for _, hash := range sortedKeys(u.passwords) {
+		rules = append(rules, "#"+hash)
+	}
+	if u.allKeys || len(u.keyPatterns) > 0 {
+		rules = append(rules, u.keyRules())
+	} else {
+		rules = append(rules, "resetkeys")
+	}
+	if u.allChannels || len(u.channelPatterns) > 0 {
+		rules = append(rules, u.channelRules())
+	} else {
+		rules = append(rules, "resetchannels")
+	}
+	rules = append(rules, u.commandRules())
+	return strings.Join(rules, " ")
+}
+
+type AclLogEntry struct {
+	id         int64
+	count      int64
+	reason     string // command, key, channel or auth
+	object     string
+	username   string
+	clientInfo string
+	created    time.Time
+	updated    time.Time
+}
+
+type Acl struct {
+	users  map[string]*AclUser
+	log    []*AclLogEntry // the newest first
+	nextId int64
+}
+
+func NewAcl() *Acl {
+	acl := &Acl{users: make(map[string]*AclUser)}
+	acl.users[DefaultUser] = newDefaultUser()
+	return acl
+}
+
+func newDefaultUser() *AclUser {
+	u := NewAclUser(DefaultUser)
+	u.SetRules([]string{"on", "nopass", "~*", "&*", "+@all"})
+	return u
+}
+
+func (acl *Acl) User(name string) *AclUser {
+	return acl.users[name]
+}
+
+// Authenticate returns the user if the password is right and the user is enabled.
+func (acl *Acl) Authenticate(name, pass string) *AclUser {
+	u := acl.users[name]
+	if u == nil || !u.checkPassword(pass) {
+		return nil
+	}
+	return u
+}
+
+// SetRequirePass sets the password of the default user, empty means nopass.
+func (acl *Acl) SetRequirePass(pass string) {
+	u := acl.users[DefaultUser]
+	u.SetRule("resetpass")
+	if pass == "" {
+		u.SetRule("nopass")
+	} else {
+		u.SetRule(">" + pass)
+	}
+}
+
+// AddLog adds a denial of the username to the log, or increases the count of a similar recent entry.
+func (acl *Acl) AddLog(cli *GodisClient, reason, object, username string, maxLen int) {
+	now := time.Now()
+	for _, e := range acl.log {
+		if e.reason == reason && e.object == object && e.username == username &&
+			now.Sub(e.updated) < AclLogGroupSeconds*time.Second {
+			e.count++
+			e.updated = now
+			e.clientInfo = cli.info()
+			return
+		}
+	}
+
+	entry := &AclLogEntry{
+		id:         acl.nextId,
+		count:      1,
+		reason:     reason,
+		object:     object,
+		username:   username,
+		clientInfo: cli.info(),
+		created:    now,
+		updated:    now,
+	}
+	acl.nextId++
+	acl.log = append([]*AclLogEntry{entry}, acl.log...)
+	if len(acl.log) > maxLen {
+		acl.log = acl.log[:maxLen]
+	}
+}
+
+// CheckCommand checks the permissions of the client to run cmd, returns the reason and the object
+// denied, or empty strings if it's allowed.
+func (acl *Acl) CheckCommand(cli *GodisClient, cmd *GodisCommand) (reason, object string) {
+	u := cli.user
+	if !u.CommandAllowed(cmd, cli.args) {
+		if len(cli.args) > 1 && len(u.subcmds) > 0 {
+			return "command", cmd.name + "|" + strings.ToLower(cli.args[1].StrVal())
+		}
+		return "command", cmd.name
+	}
+	if cmd.keys != nil && !u.allKeys {
+		for _, i := range cmd.keys(cli.args) {
+			if key := cli.args[i].StrVal(); !u.KeyAllowed(key) {
+				return "key", key
+			}
+		}
+	}
+	if !u.allChannels {
+		if channel := deniedChannel(u, cmd, cli.args); channel != "" {
+			return "channel", channel
+		}
+	}
+	return "", ""
+}
+
+// deniedChannel returns the first channel of the pubsub command not allowed for u,
+// the patterns of PSUBSCRIBE must be allowed literally as redis does.
+func deniedChannel(u *AclUser, cmd *GodisCommand, args []*Obj) string {
+	var channels []*Obj
+	switch cmd.name {
+	case GodisCmdPublish:
+		channels = args[1:2]
+	case GodisCmdSubscribe, GodisCmdPSubscribe:
+		channels = args[1:]
+	}
+	for _, arg := range channels {
+		channel := arg.StrVal()
+		allowed := false
+		if cmd.name == GodisCmdPSubscribe {
+			for _, pattern := range u.channelPatterns {
+				allowed = allowed || pattern == channel
+			}
+		} else {
+			allowed = u.ChannelAllowed(channel)
+		}
+		if !allowed {
+			return channel
+		}
+	}
+	return ""
+}
+
+// parseAclFile parses the lines like "user name rules..." of an ACL file.
+func parseAclFile(path string) (map[string]*AclUser, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read ACL file failed: %v", err)
+	}
+
+	users := make(map[string]*AclUser)
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		args, err := splitArgs(line)
+		if err == nil && (len(args) < 2 || args[0] != "user") {
+			err = errors.New("should start with user keyword")
+		}
+		if err == nil && users[args[1]] != nil {
+			err = fmt.Errorf("duplicate user '%v'", args[1])
+		}
+		if err == nil {
+			u := NewAclUser(args[1])
+			if err = u.SetRules(args[2:]); err == nil {
+				users[u.name] = u
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", path, i+1, err)
+		}
+	}
+	if users[DefaultUser] == nil {
+		users[DefaultUser] = newDefaultUser()
+	}
+	return users, nil
+}
+
+// LoadFile replaces all the users with the ones in the ACL file, nothing is changed if the file is invalid.
+func (acl *Acl) LoadFile(path string) error {
+	users, err := parseAclFile(path)
+	if err != nil {
+		return err
+	}
+	acl.users = users
+	return nil
+}
+
+func (acl *Acl) SaveFile(path string) error {
+	var b strings.Builder
+	for _, name := range sortedKeys(acl.users) {
+		b.WriteString("user " + quoteArg(name) + " " + acl.users[name].Describe() + "\n")
+	}
+	return writeFileAtomic(path, []byte(b.String()))
+}
+
+// auth [username] password
+func authCmd(cli *GodisClient) string {
+	args := cli.args
+	if len(args) > 3 {
+		return ReplySyntaxErr
+	}
+
+	name, pass := DefaultUser, args[1].StrVal()
+	if len(args) == 3 {
+		name, pass = args[1].StrVal(), args[2].StrVal()
+	} else if u := cli.srv.ACL().User(DefaultUser); u != nil && u.nopass {
+		// tell the client its password is unused rather than pretending it's checked
+		return ReplyAuthNoPass
+	}
+	if !authenticate(cli, name, pass, "AUTH") {
+		return ReplyWrongPass
+	}
+	return ReplyOK
+}
+
+// authenticate logs in cli as the user, the failure is logged for the command.
+func authenticate(cli *GodisClient, name, pass, cmd string) bool {
+	acl := cli.srv.ACL()
+	u := acl.Authenticate(name, pass)
+	if u == nil {
+		acl.AddLog(cli, "auth", cmd, name, cli.srv.Config().AclLogMaxLen)
+		return false
+	}
+	cli.user, cli.authenticated = u, true
+	return true
+}
+
+func replyAclLog(log []*AclLogEntry) string {
+	now := time.Now()
+	replies := make([]string, len(log))
+	for i, e := range log {
+		replies[i] = replyArray([]string{
+			replyBulk("count"), replyInt(e.count),
+			replyBulk("reason"), replyBulk(e.reason),
+			replyBulk("context"), replyBulk("toplevel"),
+			replyBulk("object"), replyBulk(e.object),
+			replyBulk("username"), replyBulk(e.username),
+			replyBulk("age-seconds"), replyBulk(strconv.FormatFloat(now.Sub(e.created).Seconds(), 'f', 3, 64)),
+			replyBulk("client-info"), replyBulk(e.clientInfo),
+			replyBulk("entry-id"), replyInt(e.id),
+			replyBulk("timestamp-created"), replyInt(e.created.UnixMilli()),
+			replyBulk("timestamp-last-updated"), replyInt(e.updated.UnixMilli()),
+		})
+	}
+	return replyArray(replies)
+}
+
+// acl SETUSER username [rule ...] | GETUSER username | DELUSER username [username ...] | LIST | USERS | WHOAMI
+// | CAT [category] | LOG [count | RESET] | LOAD | SAVE
+func aclCmd(cli *GodisClient) string {
+	args := cli.args
+	acl := cli.srv.ACL()
+	switch sub := strings.ToLower(args[1].StrVal()); {
+	case sub == "setuser" && len(args) >= 3:
+		name := args[2].StrVal()
+		u := acl.users[name]
+		if u == nil {
+			u = NewAclUser(name)
+		}
+		rules := make([]string, 0, len(args)-3)
+		for _, arg := range args[3:] {
+			rules = append(rules, arg.StrVal())
+		}
+		if err := u.SetRules(rules); err != nil {
+			return replyErr(err.Error())
+		}
+		acl.users[name] = u
+		return ReplyOK
+	case sub == "getuser" && len(args) == 3:
+		u := acl.users[args[2].StrVal()]
+		if u == nil {
+			return ReplyNil
+		}
+		return replyArray([]string{
+			replyBulk("flags"), replyBulkArray(u.flags()),
+			replyBulk("passwords"), replyBulkArray(sortedKeys(u.passwords)),
+			replyBulk("commands"), replyBulk(u.commandRules()),
+			replyBulk("keys"), replyBulk(u.keyRules()),
+			replyBulk("channels"), replyBulk(u.channelRules()),
+		})
+	case sub == "deluser" && len(args) >= 3:
+		var deleted []*AclUser
+		for _, arg := range args[2:] {
+			name := arg.StrVal()
+			if name == DefaultUser {
+				return replyErr("The 'default' user cannot be removed")
+			}
+			if u := acl.users[name]; u != nil {
+				deleted = append(deleted, u)
+				delete(acl.users, name)
+			}
+		}
+		// close the clients authenticated as the deleted users
+		var killed []*GodisClient
+		for _, c := range cli.srv.Clients() {
+			for _, u := range deleted {
+				if c.user == u {
+					killed = append(killed, c)
+				}
+			}
+		}
+		for _, c := range killed {
+			killClient(c, cli)
+		}
+		return replyInt(int64(len(deleted)))
+	case sub == "list" && len(args) == 2:
+		var lines []string
+		for _, name := range sortedKeys(acl.users) {
+			lines = append(lines, "user "+name+" "+acl.users[name].Describe())
+		}
+		return replyBulkArray(lines)
+	case sub == "users" && len(args) == 2:
+		return replyBulkArray(sortedKeys(acl.users))
+	case sub == "whoami" && len(args) == 2:
+		return replyBulk(cli.user.name)
+	case sub == "cat" && len(args) == 2:
+		return replyBulkArray(AclCategoryNames)
+	case sub == "cat" && len(args) == 3:
+		cat, ok := aclCategory(args[2].StrVal())
+		if !ok {
+			return replyErr(fmt.Sprintf("Unknown category '%v'", args[2].StrVal()))
+		}
+		var names []string
+		for name, cmd := range CmdTable {
+			if cmd.acl&cat != 0 {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return replyBulkArray(names)
+	case sub == "log" && len(args) <= 3:
+		count := len(acl.log)
+		if len(args) == 3 {
+			if strings.EqualFold(args[2].StrVal(), "reset") {
+				acl.log = nil
+				return ReplyOK
+			}
+			n, err := strconv.Atoi(args[2].StrVal())
+			if err != nil || n < 0 {
+				return ReplyNotInteger
+			}
+			count = min(count, n)
+		}
+		return replyAclLog(acl.log[:count])
+	case (sub == "load" || sub == "save") && len(args) == 2:
+		path := cli.srv.Config().AclFile
+		if path == "" {
+			return replyErr(ErrNoAclFile.Error())
+		}
+		if sub == "save" {
+			if err := acl.SaveFile(path); err != nil {
+				return replyErr(err.Error())
+			}
+			return ReplyOK
+		}
+
+		if err := acl.LoadFile(path); err != nil {
+			return replyErr(err.Error())
+		}
+		// the clients switch to the loaded users, or are closed if their users are gone,
+		// a closed client keeps its old user until it's freed
+		var killed []*GodisClient
+		for _, c := range cli.srv.Clients() {
+			if u := acl.User(c.user.name); u != nil {
+				c.user = u
+			} else {
+				killed = append(killed, c)
+			}
+		}
+		for _, c := range killed {
+			killClient(c, cli)
+		}
+		return ReplyOK
+	}
+	return replyErr(fmt.Sprintf("unknown subcommand or wrong number of arguments for 'acl|%v'", args[1].StrVal()))
+}
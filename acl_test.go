@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAclUserRules(t *testing.T) {
+	u := NewAclUser("alice")
+	assert.Equal(t, "off resetkeys resetchannels -@all", u.Describe())
+
+	assert.Nil(t, u.SetRules([]string{"on", ">secret", "~app:*", "&news.*", "+@string", "-set", "+config|get"}))
+	assert.True(t, u.checkPassword("secret"))
+	assert.False(t, u.checkPassword("wrong"))
+	assert.Equal(t, "on #"+hashPassword("secret")+" ~app:* &news.* -@all +get +config|get", u.Describe())
+
+	get, set, config := CmdTable["get"], CmdTable["set"], CmdTable["config"]
+	assert.True(t, u.CommandAllowed(get, strArgs("get", "k")))
+	assert.False(t, u.CommandAllowed(set, strArgs("set", "k", "v")))
+	assert.True(t, u.CommandAllowed(config, strArgs("config", "GET", "port")))
+	assert.False(t, u.CommandAllowed(config, strArgs("config", "set", "port", "1")))
+	assert.True(t, u.KeyAllowed("app:1"))
+	assert.False(t, u.KeyAllowed("other"))
+	assert.True(t, u.ChannelAllowed("news.tech"))
+	assert.False(t, u.ChannelAllowed("sport"))
+
+	// all or nothing
+	err := u.SetRules([]string{"off", "+nocmd"})
+	assert.Equal(t, "Error in ACL SETUSER modifier '+nocmd': Unknown command", err.Error())
+	assert.True(t, u.enabled)
+	assert.NotNil(t, u.SetRules([]string{"+@nocat"}))
+	assert.NotNil(t, u.SetRules([]string{"#abc"}))
+	assert.NotNil(t, u.SetRules([]string{"bad"}))
+
+	assert.Nil(t, u.SetRules([]string{"+@all", "-@dangerous", "allkeys", "nopass"}))
+	assert.True(t, u.checkPassword("anything"))
+	assert.True(t, u.CommandAllowed(set, strArgs("set", "k", "v")))
+	assert.False(t, u.CommandAllowed(config, strArgs("config", "get", "port")))
+	assert.True(t, u.KeyAllowed("other"))
+	assert.NotNil(t, u.SetRules([]string{"~app:*"}))
+
+	assert.Nil(t, u.SetRules([]string{"reset"}))
+	assert.Equal(t, "off resetkeys resetchannels -@all", u.Describe())
+}
+
+func TestAclFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.acl")
+	assert.Nil(t, os.WriteFile(path, []byte("# users\nuser alice on >secret ~app:* +get\n"), 0644))
+
+	acl := NewAcl()
+	assert.Nil(t, acl.LoadFile(path))
+	assert.NotNil(t, acl.Authenticate("alice", "secret"))
+	assert.Nil(t, acl.Authenticate("alice", "wrong"))
+	assert.NotNil(t, acl.Authenticate(DefaultUser, ""))
+
+	acl.users["alice"].SetRule("-get")
+	assert.Nil(t, acl.SaveFile(path))
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "user alice on #"+hashPassword("secret")+" ~app:* resetchannels -@all\n"+
+		"user default on nopass ~* &* +@all\n", string(content))
+
+	reloaded := NewAcl()
+	assert.Nil(t, reloaded.LoadFile(path))
+	assert.Equal(t, acl.users["alice"].Describe(), reloaded.users["alice"].Describe())
+
+	for _, content := range []string{"alice on\n", "user alice +nocmd\n", "user alice on\nuser alice off\n"} {
+		assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+		assert.NotNil(t, reloaded.LoadFile(path), content)
+	}
+	assert.NotNil(t, reloaded.users["alice"])
+}
+
+func TestAuthAndAclCmd(t *testing.T) {
+	srv := newTestServer(t, 0)
+	assert.Equal(t, ReplyAuthNoPass, execCmd(srv.newClient(0), "auth", "pass"))
+	srv.config.RequirePass = "pass"
+	srv.applyConfig("requirepass")
+	cli := srv.newClient(0)
+
+	assert.Equal(t, ReplyNoAuth, execCmd(cli, "get", "key"))
+	assert.Equal(t, ReplyWrongPass, execCmd(cli, "auth", "nobody", "wrong"))
+	assert.Equal(t, ReplyOK, execCmd(cli, "auth", "pass"))
+	assert.Equal(t, replyBulk(DefaultUser), execCmd(cli, "acl", "whoami"))
+
+	assert.Equal(t, ReplyOK, execCmd(cli, "acl", "setuser", "alice", "on", ">secret", "~app:*", "+@read", "+@write", "-expire"))
+	assert.Equal(t, replyBulkArray([]string{"alice", DefaultUser}), execCmd(cli, "acl", "users"))
+	assert.Equal(t, replyArray([]string{
+		replyBulk("flags"), replyBulkArray([]string{"on"}),
+		replyBulk("passwords"), replyBulkArray([]string{hashPassword("secret")}),
+		replyBulk("commands"), replyBulk("-@all +dump +geoadd +geodist +geohash +geopos +geosearch +geosearchstore +get +migrate +restore +restore-asking +set +xack +xadd +xautoclaim +xclaim +xdel +xgroup +xinfo +xlen +xpending +xrange +xread +xreadgroup +xrevrange +xtrim"),
+		replyBulk("keys"), replyBulk("~app:*"),
+		replyBulk("channels"), replyBulk(""),
+	}), execCmd(cli, "acl", "getuser", "alice"))
+	assert.Equal(t, ReplyNil, execCmd(cli, "acl", "getuser", "nobody"))
+
+	other := srv.newClient(0)
+	assert.Equal(t, ReplyOK, execCmd(other, "auth", "alice", "secret"))
+	assert.Equal(t, ReplyOK, execCmd(other, "set", "app:1", "v"))
+	assert.Equal(t, ReplyNoPermKey, execCmd(other, "set", "other", "v"))
+	assert.Equal(t, ReplyNoPermKey, execCmd(other, "set", "other", "v"))
+	assert.Equal(t, "-NOPERM User alice has no permissions to run the 'expire' command\r\n", execCmd(other, "expire", "app:1", "10"))
+	assert.Equal(t, "-NOPERM User alice has no permissions to run the 'acl' command\r\n", execCmd(other, "acl", "whoami"))
+
+	log := execCmd(cli, "acl", "log")
+	assert.True(t, strings.HasPrefix(log, "*4\r\n"))
+	assert.Contains(t, log, "$6\r\nobject\r\n$3\r\nacl\r\n")
+	assert.Contains(t, log, "$5\r\ncount\r\n:2\r\n$6\r\nreason\r\n$3\r\nkey\r\n$7\r\ncontext\r\n$8\r\ntoplevel\r\n$6\r\nobject\r\n$5\r\nother\r\n")
+	assert.Contains(t, log, "$6\r\nreason\r\n$4\r\nauth\r\n$7\r\ncontext\r\n$8\r\ntoplevel\r\n$6\r\nobject\r\n$4\r\nAUTH\r\n$8\r\nusername\r\n$6\r\nnobody\r\n")
+	assert.True(t, strings.HasPrefix(execCmd(cli, "acl", "log", "1"), "*1\r\n"))
+	assert.Equal(t, ReplyOK, execCmd(cli, "acl", "log", "reset"))
+	assert.Equal(t, "*0\r\n", execCmd(cli, "acl", "log"))
+
+	assert.Equal(t, replyErr("The 'default' user cannot be removed"), execCmd(cli, "acl", "deluser", "default"))
+	assert.Equal(t, replyInt(1), execCmd(cli, "acl", "deluser", "alice", "nobody"))
+	assert.Equal(t, ReplyWrongPass, execCmd(other, "auth", "alice", "secret"))
+	assert.Equal(t, replyErr(ErrNoAclFile.Error()), execCmd(cli, "acl", "save"))
+	assert.Equal(t, replyBulkArray([]string{"geoadd", "geodist", "geohash", "geopos", "geosearch", "geosearchstore"}),
+		execCmd(cli, "acl", "cat", "geo"))
+	assert.Contains(t, execCmd(cli, "acl", "cat", "string"), replyBulkArray([]string{"get", "set"}))
+}
+
+func TestAclKillSelfPipeline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.acl")
+	assert.Nil(t, os.WriteFile(path, []byte("user alice on >pw ~* +@all\n"), 0644))
+	srv := newTestServer(t, 0)
+	srv.config.AclFile = path
+	assert.Nil(t, srv.acl.LoadFile(path))
+
+	for _, query := range []string{"acl load\r\nget x\r\n", "acl deluser alice\r\nget x\r\n"} {
+		assert.Nil(t, srv.acl.LoadFile(path))
+		cli := srv.newClient(1)
+		srv.clients[1] = cli
+		assert.Equal(t, ReplyOK, execCmd(cli, "auth", "alice", "pw"))
+		alice := cli.user
+
+		// the user of the client is gone, the pipelined command must not run
+		assert.Nil(t, os.WriteFile(path, []byte("user default on nopass ~* &* +@all\n"), 0644))
+		readQuery(cli, query)
+		assert.Nil(t, cli.ProcessQuery())
+		assert.Equal(t, 1, len(cli.reply), query)
+		assert.True(t, cli.closeAfterReply)
+		assert.Same(t, alice, cli.user)
+
+		delete(srv.clients, 1)
+		assert.Nil(t, os.WriteFile(path, []byte("user alice on >pw ~* +@all\n"), 0644))
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"time"
+)
+
+// blockState is the keys a client is waiting for, set by a blocking command like XREAD BLOCK.
+type blockState struct {
+	keys     []string
+	deadline time.Time // zero to block forever
+	timedOut bool
+}
+
+// BlockForKeys blocks cli until one of keys is signaled ready by SignalKeyAsReady or the timeout,
+// 0 means no timeout. The command is executed again when the client is unblocked, and the deadline of
+// the first block is kept if it blocks again.
+func (srv *GodisServer) BlockForKeys(cli *GodisClient, keys []string, timeout time.Duration) {
+	if cli.bstate == nil {
+		cli.bstate = &blockState{}
+		if timeout > 0 {
+			cli.bstate.deadline = time.Now().Add(timeout)
+		}
+	}
+	cli.bstate.keys = keys
+	cli.blocked = true
+	for _, key := range keys {
+		srv.blockingKeys[key] = append(srv.blockingKeys[key], cli)
+	}
+}
+
+// SignalKeyAsReady unblocks the clients waiting for key, their commands are executed again before next epoll wait.
+func (srv *GodisServer) SignalKeyAsReady(key string) {
+	for len(srv.blockingKeys[key]) > 0 {
+		cli := srv.blockingKeys[key][0]
+		srv.removeBlockingKeys(cli)
+		srv.unblocked = append(srv.unblocked, cli)
+	}
+}
+
+// removeBlockingKeys stops cli waiting for its keys, the block state is kept until the command is executed again.
+func (srv *GodisServer) removeBlockingKeys(cli *GodisClient) {
+	for _, key := range cli.bstate.keys {
+		clients := srv.blockingKeys[key]
+		for i, c := range clients {
+			if c == cli {
+				clients = append(clients[:i], clients[i+1:]...)
+				break
+			}
+		}
+		if len(clients) == 0 {
+			delete(srv.blockingKeys, key)
+		} else {
+			srv.blockingKeys[key] = clients
+		}
+	}
+	cli.bstate.keys = nil
+}
+
+// handleBlockedTimeouts unblocks the clients whose deadline passed, they get a null reply.
+func (srv *GodisServer) handleBlockedTimeouts() {
+	now := time.Now()
+	var timedOut []*GodisClient
+	for _, clients := range srv.blockingKeys {
+		for _, cli := range clients {
+			if bs := cli.bstate; !bs.timedOut && !bs.deadline.IsZero() && now.After(bs.deadline) {
+				bs.timedOut = true
+				timedOut = append(timedOut, cli)
+			}
+		}
+	}
+	for _, cli := range timedOut {
+		srv.removeBlockingKeys(cli)
+		srv.unblocked = append(srv.unblocked, cli)
+	}
+}
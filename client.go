@@ -3,8 +3,9 @@ package main
 import (
 	"bytes"
 	"errors"
-	"log"
+	"io"
 	"strconv"
+	"time"
 )
 
 type CmdType byte
@@ -16,250 +17,568 @@ const (
 )
 
 const (
-	GodisMaxBulk   int = 1024 * 4
-	GodisMaxInline int = 1024 * 4
-	GodisIOBuffer  int = 1024 * 16
+	GodisMaxInline    int = 1024 * 64
+	GodisMaxMultiBulk int = 1024 * 1024
+	GodisIOBuffer     int = 1024 * 16
+	GodisMaxIOV       int = 1024 // IOV_MAX of linux
+
+	// bulks not smaller than GodisBigArg are read directly into their own buffer
+	GodisBigArg            int   = 1024 * 32
+	DefaultProtoMaxBulkLen int64 = 512 * 1024 * 1024
 )
 
 var (
-	ErrTooBigInlineCmd     = errors.New("too big inline cmd")
-	ErrTooBigBulkCmd       = errors.New("too big bulk cmd")
-	ErrUnknownGodisCmdType = errors.New("unknown godis command type")
-	ErrExpectedBulkLength  = errors.New("expect $ for bulk length")
-	ErrExpectedBulkEnd     = errors.New("expect CRLF for bulk end")
+	ErrTooBigInlineCmd        = errors.New("too big inline cmd")
+	ErrTooBigBulkCmd          = errors.New("too big bulk cmd")
+	ErrUnknownGodisCmdType    = errors.New("unknown godis command type")
+	ErrExpectedBulkLength     = errors.New("expect $ for bulk length")
+	ErrExpectedBulkEnd        = errors.New("expect CRLF for bulk end")
+	ErrInvalidMultiBulkLength = errors.New("invalid multibulk length")
+	ErrInvalidBulkLength      = errors.New("invalid bulk length")
 )
 
 type IGodisServer interface {
 	FreeClient(cli *GodisClient)
+	FreeClientAsync(cli *GodisClient)
+	CountOutputLimitKill()
 	RegisterSendReply(cli *GodisClient)
 	UnRegisterSendReply(cli *GodisClient)
+	ProcessCommand(cli *GodisClient) string
+	Config() *GodisConfig
+	ResetStats()
+	Info(sections ...string) string
+	Clients() map[int]*GodisClient
+	PauseClients(end time.Time, all bool)
+	UnpauseClients()
+	ACL() *Acl
+	SlowLog() *SlowLog
+	Latency() *LatencyMonitor
+	Shutdown(cli *GodisClient, save bool) bool
+	AbortShutdown() bool
+	AddMonitor(cli *GodisClient)
+	PubSub() *PubSub
+	Tracking() *Tracking
+	SlotMigrations() *SlotMigrations
+	BlockForKeys(cli *GodisClient, keys []string, timeout time.Duration)
+	SignalKeyAsReady(key string)
+}
+
+// the classes of clients for output buffer limits
+const (
+	ClientClassNormal = iota
+	ClientClassReplica
+	ClientClassPubSub
+	ClientClassCount
+)
+
+var ClientClassNames = []string{"normal", "replica", "pubsub"}
+
+// OutputBufferLimit closes a client if its pending replies exceed Hard bytes,
+// or exceed Soft bytes for more than SoftSeconds. Zero disables the limit.
+type OutputBufferLimit struct {
+	Hard        int64
+	Soft        int64
+	SoftSeconds int
+}
+
+var DefaultOutputBufferLimits = [ClientClassCount]OutputBufferLimit{
+	ClientClassNormal:  {0, 0, 0},
+	ClientClassReplica: {256 * 1024 * 1024, 64 * 1024 * 1024, 60},
+	ClientClassPubSub:  {32 * 1024 * 1024, 8 * 1024 * 1024, 60},
 }
 
 type GodisClient struct {
+	id       int64
 	fd       int
-	bulkLen  int
+	conn     Conn
+	bulkLen  int // -1 if the length of current bulk is unknown
 	bulkNum  int
 	sentLen  int
+	qbPos    int // the parsed position of queryBuf
 	queryLen int
 	queryBuf []byte
+	bigArg   []byte // the buffer of a big bulk being read
 	cmdType  CmdType
 	args     []*Obj
-	reply    *List
+	queued   [][]*Obj // commands parsed by io threads, waiting to be executed
+	reply    [][]byte // the pending replies
+	replyLen int      // bytes of the pending replies
 	db       *GodisDB
 	srv      IGodisServer
+	closed   bool
+	ioErr    error // the read or write error occurred in io threads
+	protoErr error // the protocol error occurred in io threads
+
+	maxBulkLen      int64
+	closeAfterReply bool
+	closeAsap       bool // to be freed before next epoll wait, the input and replies are dropped
+	// blocked clients don't process the input, and cli.args is executed again when unblocked
+	blocked bool
+	bstate  *blockState // the keys waited for by a blocking command, nil if not blocked for keys
+
+	addr            string // the address of the peer
+	laddr           string // the local address of the connection
+	name            string
+	ctime           time.Time
+	lastInteraction time.Time
+	lastCmd         string
+	noEvict         bool            // only shown in the flags, no client is ever evicted
+	asking          bool            // ASKING was sent, the next command is served in an importing slot
+	monitor         bool            // receiving the commands executed by the server
+	channels        map[string]bool // the subscribed channels
+	patterns        map[string]bool // the subscribed channel patterns
+	tracking        *trackingState  // nil if CLIENT TRACKING is off
+	resp            int             // the protocol version, 2 or 3 set by HELLO
+	user            *AclUser
+	authenticated   bool
+
+	softLimitTime time.Time // when the output buffer exceeded the soft limit, zero if not exceeded
+
+	pendingRead  bool
+	pendingWrite bool
 }
 
 func NewGodisClient(fd int, db *GodisDB, srv IGodisServer) *GodisClient {
 	return &GodisClient{
-		fd:       fd,
-		db:       db,
-		srv:      srv,
-		queryBuf: make([]byte, GodisIOBuffer),
-		reply:    NewList(ListType{StrEqual}),
+		fd:         fd,
+		conn:       socketConn(fd),
+		db:         db,
+		srv:        srv,
+		bulkLen:    -1,
+		queryBuf:   make([]byte, GodisIOBuffer),
+		maxBulkLen: DefaultProtoMaxBulkLen,
+		ctime:      time.Now(),
+		resp:       2,
+
+		lastInteraction: time.Now(),
 	}
 }
 
 func (cli *GodisClient) ReadQuery(lp *EventLoop, fd int, _ any) {
-	if len(cli.queryBuf)-cli.queryLen < GodisMaxBulk {
-		cli.queryBuf = append(cli.queryBuf, make([]byte, GodisMaxBulk)...)
+	// stop handling the input after a protocol error
+	if cli.closeAfterReply || cli.closeAsap {
+		return
 	}
 
-	n, err := Read(cli.fd, cli.queryBuf[cli.queryLen:])
-	if err != nil {
-		log.Printf("cli %v read failed: %v\n", fd, err)
+	if err := cli.readFromSocket(); err != nil {
+		cli.logReadError(err)
 		cli.free()
 		return
 	}
+	if cli.blocked {
+		return
+	}
 
-	cli.queryLen += n
-	err = cli.ProcessQuery()
+	if err := cli.ProcessQuery(); err != nil {
+		cli.protocolError(err)
+	}
+}
+
+// protocolError replies the error to the client and closes the client once the reply is sent.
+func (cli *GodisClient) protocolError(err error) {
+	logVerbose("cli %v protocol error: %v\n", cli.fd, err)
+	cli.AddReply(replyErr("Protocol error: " + err.Error()))
+	cli.closeAfterReply = true
+}
+
+// AddReply queues the reply, it's converted to []byte once here so writev never copies it again.
+func (cli *GodisClient) AddReply(reply string) {
+	if cli.closeAsap {
+		return
+	}
+	cli.reply = append(cli.reply, []byte(reply))
+	cli.replyLen += len(reply)
+	if cli.outputLimitReached() {
+		logWarning("cli %v closed for overcoming of output buffer limits: omem=%v", cli.fd, cli.replyLen)
+		cli.closeAsap = true
+		cli.srv.CountOutputLimitKill()
+		cli.srv.FreeClientAsync(cli)
+		return
+	}
+	cli.srv.RegisterSendReply(cli)
+}
+
+func (cli *GodisClient) userName() string {
+	if cli.user == nil {
+		return ""
+	}
+	return cli.user.name
+}
+
+// class returns the class of the client for the output buffer limits, monitors are normal clients.
+func (cli *GodisClient) class() int {
+	if cli.subscriptions() > 0 {
+		return ClientClassPubSub
+	}
+	return ClientClassNormal
+}
+
+// outputLimitReached reports whether the pending replies exceed the hard limit,
+// or exceed the soft limit for more than the soft seconds.
+func (cli *GodisClient) outputLimitReached() bool {
+	limit := cli.srv.Config().ClientOutputBufferLimits[cli.class()]
+	used := int64(cli.replyLen)
+	if limit.Hard > 0 && used >= limit.Hard {
+		return true
+	}
+	if limit.Soft == 0 || used < limit.Soft {
+		cli.softLimitTime = time.Time{}
+		return false
+	}
+
+	now := time.Now()
+	if cli.softLimitTime.IsZero() {
+		cli.softLimitTime = now
+		return false
+	}
+	return now.Sub(cli.softLimitTime) > time.Duration(limit.SoftSeconds)*time.Second
+}
+
+func (cli *GodisClient) logReadError(err error) {
+	if err == io.EOF {
+		logVerbose("cli %v closed connection\n", cli.fd)
+	} else {
+		logWarning("cli %v read failed: %v\n", cli.fd, err)
+	}
+}
+
+// readFromSocket reads what is available in the non-blocking socket into the query buffer,
+// or into the buffer of the big bulk being read.
+func (cli *GodisClient) readFromSocket() error {
+	cli.lastInteraction = time.Now()
+	if cli.bigArg != nil {
+		n, err := cli.conn.Read(cli.bigArg[len(cli.bigArg):cap(cli.bigArg)])
+		if err != nil {
+			return err
+		}
+		cli.bigArg = cli.bigArg[:len(cli.bigArg)+n]
+		return nil
+	}
+
+	// move the unparsed data to the front instead of reallocating
+	if cli.qbPos > 0 {
+		cli.queryLen = copy(cli.queryBuf, cli.queryBuf[cli.qbPos:cli.queryLen])
+		cli.qbPos = 0
+	}
+	if cli.queryLen == 0 && len(cli.queryBuf) > 4*GodisIOBuffer {
+		cli.queryBuf = make([]byte, GodisIOBuffer)
+	}
+	if len(cli.queryBuf)-cli.queryLen < GodisIOBuffer/4 {
+		cli.queryBuf = append(cli.queryBuf, make([]byte, GodisIOBuffer)...)
+	}
+
+	n, err := cli.conn.Read(cli.queryBuf[cli.queryLen:])
 	if err != nil {
-		cli.free()
+		return err
 	}
+	cli.queryLen += n
+	return nil
 }
 
-func (cli *GodisClient) ProcessQuery() (err error) {
-	for cli.queryLen > 0 {
-		if cli.cmdType == CmdUnknown {
-			if cli.queryBuf[0] == '*' {
-				cli.cmdType = CmdBulk
-			} else {
-				cli.cmdType = CmdInline
-			}
+func (cli *GodisClient) ProcessQuery() error {
+	for {
+		ok, err := cli.parseCommand()
+		if err != nil || !ok {
+			return err
 		}
 
-		ok := false
-		if cli.cmdType == CmdInline {
-			ok, err = cli.handleInlineBuf()
-		} else {
-			ok, err = cli.handleBulkBuf()
+		if !cli.execCommand() {
+			return nil
 		}
+		cli.reset()
+		// the commands after one closing the client, like ACL DELUSER of its own user, are dropped
+		if cli.blocked || cli.closeAsap || cli.closeAfterReply {
+			return nil
+		}
+	}
+}
 
+// parseQuery parses all the complete commands in the query buffer into the queue without executing them,
+// it may run in an io thread so it must not touch anything outside the client.
+func (cli *GodisClient) parseQuery() error {
+	for {
+		ok, err := cli.parseCommand()
 		if err != nil || !ok {
-			return
+			return err
 		}
 
 		if len(cli.args) > 0 {
-			// handle "quit" special command
-			if cli.args[0].StrVal() == GodisCmdQuit {
-				cli.free()
-				return
-			}
-
-			reply := processCmd(cli.args, cli.db)
-			cli.reply.Append(NewObject(String, reply))
-			cli.srv.RegisterSendReply(cli)
+			cli.queued = append(cli.queued, cli.args)
+			cli.args = nil
 		}
 		cli.reset()
 	}
-	return nil
 }
 
+// processQueued executes the commands parsed by parseQuery.
+func (cli *GodisClient) processQueued() {
+	for !cli.blocked && !cli.closeAsap && !cli.closeAfterReply && len(cli.queued) > 0 {
+		cli.freeArgs()
+		cli.args = cli.queued[0]
+		cli.queued = cli.queued[1:]
+		if !cli.execCommand() {
+			return
+		}
+	}
+}
+
+// parseCommand parses one command from the query buffer into cli.args.
+func (cli *GodisClient) parseCommand() (bool, error) {
+	if cli.qbPos == cli.queryLen && cli.bigArg == nil {
+		return false, nil
+	}
+
+	if cli.cmdType == CmdUnknown {
+		if cli.queryBuf[cli.qbPos] == '*' {
+			cli.cmdType = CmdBulk
+		} else {
+			cli.cmdType = CmdInline
+		}
+	}
+
+	if cli.cmdType == CmdInline {
+		return cli.handleInlineBuf()
+	}
+	return cli.handleBulkBuf()
+}
+
+// execCommand executes cli.args and queues the reply, returns false if the client is freed.
+func (cli *GodisClient) execCommand() bool {
+	if len(cli.args) == 0 {
+		return true
+	}
+
+	// handle "quit" special command
+	if cli.args[0].StrVal() == GodisCmdQuit {
+		cli.free()
+		return false
+	}
+
+	// an empty reply means the command replies nothing, like SHUTDOWN
+	reply := cli.srv.ProcessCommand(cli)
+	if !cli.blocked && reply != "" {
+		cli.AddReply(reply)
+	}
+	return true
+}
+
+// handleInlineBuf parses a command line like redis-cli does, the line may end with LF only.
 func (cli *GodisClient) handleInlineBuf() (bool, error) {
-	idx := bytes.Index(cli.queryBuf[:cli.queryLen], []byte("\r\n"))
+	idx := bytes.IndexByte(cli.queryBuf[cli.qbPos:cli.queryLen], '\n')
 	if idx < 0 {
-		if cli.queryLen > GodisMaxInline {
+		if cli.queryLen-cli.qbPos > GodisMaxInline {
 			return false, ErrTooBigInlineCmd
-		} else {
-			return false, nil
 		}
+		return false, nil
+	}
+
+	line := cli.queryBuf[cli.qbPos : cli.qbPos+idx]
+	cli.qbPos += idx + 1
+	parts, err := splitArgs(string(bytes.TrimSuffix(line, []byte("\r"))))
+	if err != nil {
+		return false, err
 	}
 
-	parts := bytes.Split(cli.queryBuf[:idx], []byte(" "))
-	cli.queryBuf = cli.queryBuf[idx+2:]
-	cli.queryLen -= idx + 2
+	cli.freeArgs()
 	cli.args = make([]*Obj, len(parts))
 	for i, part := range parts {
-		cli.args[i] = NewObject(String, string(part))
+		cli.args[i] = NewObject(String, part)
 	}
 	return true, nil
 }
 
 func (cli *GodisClient) handleBulkBuf() (bool, error) {
 	if cli.bulkNum == 0 {
-		idx, err := cli.findLineInQuery()
-		if idx < 0 || err != nil {
+		line, ok, err := cli.readLine()
+		if !ok {
 			return false, err
 		}
 
-		num, err := cli.getNumInQuery(1, idx)
-		if err != nil {
-			return false, err
+		num, err := strconv.Atoi(string(line[1:]))
+		if err != nil || num > GodisMaxMultiBulk {
+			return false, ErrInvalidMultiBulkLength
 		}
-		if num == 0 {
+		cli.freeArgs()
+		if num <= 0 {
 			return true, nil
 		}
 
 		cli.bulkNum = num
-		cli.args = make([]*Obj, num)
+		cli.args = make([]*Obj, 0, min(num, 1024))
 	}
 
 	for cli.bulkNum > 0 {
-		if cli.bulkLen == 0 {
-			idx, err := cli.findLineInQuery()
-			if idx < 0 {
+		if cli.bulkLen < 0 {
+			line, ok, err := cli.readLine()
+			if !ok {
 				return false, err
 			}
 
-			if cli.queryBuf[0] != '$' {
+			if len(line) == 0 || line[0] != '$' {
 				return false, ErrExpectedBulkLength
 			}
 
-			blen, err := cli.getNumInQuery(1, idx)
-			if err != nil || blen == 0 {
-				return false, err
+			blen, err := strconv.ParseInt(string(line[1:]), 10, 64)
+			if err != nil || blen < 0 {
+				return false, ErrInvalidBulkLength
 			}
-
-			if blen > GodisMaxBulk {
+			if blen > cli.maxBulkLen {
 				return false, ErrTooBigBulkCmd
 			}
-			cli.bulkLen = blen
+			cli.bulkLen = int(blen)
+
+			// read the rest of a big bulk into its own buffer, so the query buffer is not grown and copied
+			if cli.bulkLen >= GodisBigArg {
+				n := min(cli.queryLen-cli.qbPos, cli.bulkLen+2)
+				cli.bigArg = make([]byte, 0, cli.bulkLen+2)
+				cli.bigArg = append(cli.bigArg, cli.queryBuf[cli.qbPos:cli.qbPos+n]...)
+				cli.qbPos += n
+			}
 		}
-		if cli.queryLen < cli.bulkLen+2 {
-			return false, nil
+
+		var bulk []byte
+		if cli.bigArg != nil {
+			if len(cli.bigArg) < cap(cli.bigArg) {
+				return false, nil
+			}
+			bulk = cli.bigArg
+			cli.bigArg = nil
+		} else {
+			if cli.queryLen-cli.qbPos < cli.bulkLen+2 {
+				return false, nil
+			}
+			bulk = cli.queryBuf[cli.qbPos : cli.qbPos+cli.bulkLen+2]
+			cli.qbPos += cli.bulkLen + 2
 		}
-		idx := cli.bulkLen
-		if cli.queryBuf[idx] != '\r' || cli.queryBuf[idx+1] != '\n' {
+
+		if bulk[cli.bulkLen] != '\r' || bulk[cli.bulkLen+1] != '\n' {
 			return false, ErrExpectedBulkEnd
 		}
-		cli.args[len(cli.args)-cli.bulkNum] = NewObject(String, string(cli.queryBuf[:idx]))
-		cli.queryBuf = cli.queryBuf[idx+2:]
-		cli.queryLen -= idx + 2
-		cli.bulkLen = 0
+		cli.args = append(cli.args, NewObject(String, string(bulk[:cli.bulkLen])))
+		cli.bulkLen = -1
 		cli.bulkNum--
 	}
 	return true, nil
 }
 
-func (cli *GodisClient) findLineInQuery() (int, error) {
-	idx := bytes.Index(cli.queryBuf[:cli.queryLen], []byte("\r\n"))
-	if idx < 0 && cli.queryLen > GodisMaxInline {
-		return idx, ErrTooBigInlineCmd
+// readLine returns the next line without CRLF in the query buffer, ok is false if the line is incomplete.
+func (cli *GodisClient) readLine() (line []byte, ok bool, err error) {
+	idx := bytes.Index(cli.queryBuf[cli.qbPos:cli.queryLen], []byte("\r\n"))
+	if idx < 0 {
+		if cli.queryLen-cli.qbPos > GodisMaxInline {
+			return nil, false, ErrTooBigInlineCmd
+		}
+		return nil, false, nil
 	}
-	return idx, nil
-}
 
-func (cli *GodisClient) getNumInQuery(start, end int) (int, error) {
-	num, err := strconv.Atoi(string(cli.queryBuf[start:end]))
-	cli.queryBuf = cli.queryBuf[end+2:]
-	cli.queryLen -= end + 2
-	return num, err
+	line = cli.queryBuf[cli.qbPos : cli.qbPos+idx]
+	cli.qbPos += idx + 2
+	return line, true, nil
 }
 
 func (cli *GodisClient) SendReply(lp *EventLoop, fd int, _ any) {
-	for cli.reply.length > 0 {
-		first := cli.reply.First()
-		buf := []byte(first.Val.StrVal())
-		bufLen := len(buf)
-		if cli.sentLen < bufLen {
-			n, err := Write(fd, buf[cli.sentLen:])
-			if err != nil {
-				log.Printf("send reply failed: %v\n", err)
-				cli.free()
-				return
-			}
+	if err := cli.writeToSocket(); err != nil {
+		logWarning("send reply failed: %v\n", err)
+		cli.free()
+		return
+	}
+
+	if !cli.hasPendingReplies() {
+		cli.srv.UnRegisterSendReply(cli)
+		if cli.closeAfterReply {
+			cli.free()
+		}
+	}
+}
 
-			cli.sentLen += n
-			if cli.sentLen < bufLen {
-				return
+// writeToSocket writes the pending replies with writev until all sent or the socket is full,
+// it may run in an io thread so it must not touch anything outside the client.
+func (cli *GodisClient) writeToSocket() error {
+	// the data buffered by the connection is sent before the replies
+	if err := cli.conn.Flush(); err != nil {
+		return err
+	}
+	for len(cli.reply) > 0 {
+		iovs := make([][]byte, 0, min(len(cli.reply), GodisMaxIOV))
+		total := 0
+		for i := 0; i < len(cli.reply) && len(iovs) < cap(iovs); i++ {
+			buf := cli.reply[i]
+			if i == 0 {
+				buf = buf[cli.sentLen:]
 			}
+			iovs = append(iovs, buf)
+			total += len(buf)
+		}
+
+		n, err := cli.conn.Writev(iovs)
+		if err != nil {
+			return err
+		}
+		cli.replyLen -= n
+		if n > 0 {
+			cli.lastInteraction = time.Now()
+		}
 
-			cli.reply.DelNode(first)
-			first.Val.DecrRefCount()
+		// drop the replies which have been sent completely
+		for left := n; len(cli.reply) > 0; {
+			remain := len(cli.reply[0]) - cli.sentLen
+			if left < remain {
+				cli.sentLen += left
+				break
+			}
+			left -= remain
+			cli.reply[0] = nil
+			cli.reply = cli.reply[1:]
 			cli.sentLen = 0
 		}
-	}
 
-	if cli.reply.length == 0 {
-		cli.sentLen = 0
-		cli.srv.UnRegisterSendReply(cli)
+		if n < total {
+			return nil
+		}
 	}
+	return nil
 }
 
+// reset prepares for parsing next command, the args of last command are kept until then.
 func (cli *GodisClient) reset() {
-	cli.freeArgs()
 	cli.cmdType = CmdUnknown
-	cli.bulkLen = 0
+	cli.bulkLen = -1
 	cli.bulkNum = 0
 }
 
 func (cli *GodisClient) free() {
+	if cli.closed {
+		return
+	}
+	cli.closed = true
 	cli.freeArgs()
-	cli.freeReplyList()
+	for _, args := range cli.queued {
+		for _, arg := range args {
+			arg.DecrRefCount()
+		}
+	}
+	cli.queued = nil
+	cli.freeReplies()
 	cli.srv.FreeClient(cli)
-	Close(cli.fd)
+	cli.conn.Close()
 }
 
-func (cli *GodisClient) freeReplyList() {
-	for cli.reply.length != 0 {
-		n := cli.reply.First()
-		cli.reply.DelNode(n)
-		n.Val.DecrRefCount()
-	}
+// hasPendingReplies reports whether some replies are not sent, including the data buffered by the connection.
+func (cli *GodisClient) hasPendingReplies() bool {
+	return len(cli.reply) > 0 || cli.conn.Buffered() > 0
+}
+
+func (cli *GodisClient) freeReplies() {
+	cli.reply = nil
+	cli.replyLen = 0
 }
 
 func (cli *GodisClient) freeArgs() {
 	for _, arg := range cli.args {
-		arg.DecrRefCount()
+		// args may be partially parsed
+		if arg != nil {
+			arg.DecrRefCount()
+		}
 	}
+	cli.args = nil
 }
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ReplyNoSuchClient  = replyErr("No such client")
+	ReplyBadClientName = replyErr("Client names cannot contain spaces, newlines or special characters.")
+	ReplyNoProto       = "-NOPROTO unsupported protocol version\r\n"
+	ReplyHelloNoAuth   = "-NOAUTH HELLO must be called with the client already authenticated, otherwise the " +
+		"HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time\r\n"
+)
+
+// flags returns the flags of the client in CLIENT LIST, N if there is none.
+func (cli *GodisClient) flags() string {
+	var flags strings.Builder
+	if cli.blocked {
+		flags.WriteByte('b')
+	}
+	if cli.closeAfterReply {
+		flags.WriteByte('c')
+	}
+	if cli.noEvict {
+		flags.WriteByte('e')
+	}
+	if cli.monitor {
+		flags.WriteByte('O')
+	}
+	if cli.subscriptions() > 0 {
+		flags.WriteByte('P')
+	}
+	if cli.tracking != nil {
+		flags.WriteByte('t')
+		if cli.tracking.bcast {
+			flags.WriteByte('B')
+		}
+		if cli.tracking.redirect != nil && cli.tracking.redirect.closed {
+			flags.WriteByte('R')
+		}
+	}
+	if flags.Len() == 0 {
+		return "N"
+	}
+	return flags.String()
+}
+
+// info returns the line of the client in CLIENT LIST.
+func (cli *GodisClient) info() string {
+	now := time.Now()
+	return fmt.Sprintf("id=%d addr=%v laddr=%v fd=%d name=%v age=%d idle=%d flags=%v db=0 qbuf=%d qbuf-free=%d oll=%d omem=%d cmd=%v user=%v",
+		cli.id, cli.addr, cli.laddr, cli.fd, cli.name,
+		int64(now.Sub(cli.ctime).Seconds()), int64(now.Sub(cli.lastInteraction).Seconds()), cli.flags(),
+		cli.queryLen-cli.qbPos+len(cli.bigArg), len(cli.queryBuf)-cli.queryLen, len(cli.reply), cli.replyLen, cli.lastCmd, cli.userName())
+}
+
+// typeName returns the type of the client for the TYPE filter, monitors are normal clients as redis does.
+// There are no replicas or masters without replication.
+func (cli *GodisClient) typeName() string {
+	if cli.subscriptions() > 0 {
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// parseClientType parses the type of TYPE, slave is the same as replica.
+func parseClientType(name string) (string, string) {
+	switch typ := strings.ToLower(name); typ {
+	case "normal", "pubsub", "replica", "master":
+		return typ, ""
+	case "slave":
+		return "replica", ""
+	}
+	return "", replyErr(fmt.Sprintf("Unknown client type '%v'", name))
+}
+
+// clientFilter matches the clients of CLIENT KILL, zero fields match any client.
+type clientFilter struct {
+	id     int64
+	addr   string
+	laddr  string
+	user   string
+	typ    string
+	skipMe bool
+	maxAge int64 // seconds
+}
+
+func (f *clientFilter) match(cli, self *GodisClient) bool {
+	return (f.id == 0 || cli.id == f.id) &&
+		(f.typ == "" || cli.typeName() == f.typ) &&
+		(f.addr == "" || cli.addr == f.addr) &&
+		(f.laddr == "" || cli.laddr == f.laddr) &&
+		(f.user == "" || cli.userName() == f.user) &&
+		!(f.skipMe && cli == self) &&
+		(f.maxAge == 0 || time.Since(cli.ctime).Seconds() >= float64(f.maxAge))
+}
+
+// parseClientFilter parses the filters of CLIENT KILL like ID 1 ADDR ip:port TYPE pubsub SKIPME no.
+func parseClientFilter(args []*Obj) (*clientFilter, string) {
+	f := &clientFilter{skipMe: true}
+	if len(args)%2 != 0 {
+		return nil, ReplySyntaxErr
+	}
+	for i := 0; i < len(args); i += 2 {
+		val := args[i+1].StrVal()
+		switch strings.ToLower(args[i].StrVal()) {
+		case "id":
+			id, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || id <= 0 {
+				return nil, replyErr("client-id should be greater than 0")
+			}
+			f.id = id
+		case "addr":
+			f.addr = val
+		case "laddr":
+			f.laddr = val
+		case "user":
+			f.user = val
+		case "type":
+			var errReply string
+			if f.typ, errReply = parseClientType(val); errReply != "" {
+				return nil, errReply
+			}
+		case "skipme":
+			switch strings.ToLower(val) {
+			case "yes":
+				f.skipMe = true
+			case "no":
+				f.skipMe = false
+			default:
+				return nil, ReplySyntaxErr
+			}
+		case "maxage":
+			age, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || age <= 0 {
+				return nil, ReplyNotInteger
+			}
+			f.maxAge = age
+		default:
+			return nil, ReplySyntaxErr
+		}
+	}
+	return f, ""
+}
+
+// killClient closes the client, the current client is closed after the reply is sent.
+func killClient(cli, self *GodisClient) {
+	if cli == self {
+		cli.closeAfterReply = true
+	} else {
+		cli.free()
+	}
+}
+
+// client LIST [TYPE type | ID id ...] | INFO | ID | SETNAME name | GETNAME | KILL ip:port | KILL filter value [filter value ...]
+// | PAUSE timeout [WRITE|ALL] | UNPAUSE | NO-EVICT ON|OFF
+//
+// NO-EVICT is only accepted for compatibility, there is no client eviction to exempt the client from.
+func clientCmd(cli *GodisClient) string {
+	args := cli.args
+	clients := cli.srv.Clients()
+	switch sub := strings.ToLower(args[1].StrVal()); {
+	case sub == "list":
+		var ids map[int64]bool
+		var typ string
+		if len(args) == 4 && strings.EqualFold(args[2].StrVal(), "type") {
+			var errReply string
+			if typ, errReply = parseClientType(args[3].StrVal()); errReply != "" {
+				return errReply
+			}
+		} else if len(args) > 2 {
+			if len(args) < 4 || strings.ToLower(args[2].StrVal()) != "id" {
+				return ReplySyntaxErr
+			}
+			ids = make(map[int64]bool)
+			for _, arg := range args[3:] {
+				id, err := strconv.ParseInt(arg.StrVal(), 10, 64)
+				if err != nil || id <= 0 {
+					return replyErr("Invalid client ID")
+				}
+				ids[id] = true
+			}
+		}
+
+		var lines []string
+		for _, c := range sortedClients(clients) {
+			if (ids == nil || ids[c.id]) && (typ == "" || c.typeName() == typ) {
+				lines = append(lines, c.info()+"\n")
+			}
+		}
+		return replyBulk(strings.Join(lines, ""))
+	case sub == "info" && len(args) == 2:
+		return replyBulk(cli.info() + "\n")
+	case sub == "id" && len(args) == 2:
+		return replyInt(cli.id)
+	case sub == "setname" && len(args) == 3:
+		name := args[2].StrVal()
+		if !validClientName(name) {
+			return ReplyBadClientName
+		}
+		cli.name = name
+		return ReplyOK
+	case sub == "getname" && len(args) == 2:
+		if cli.name == "" {
+			return ReplyNil
+		}
+		return replyBulk(cli.name)
+	case sub == "kill" && len(args) == 3:
+		addr := args[2].StrVal()
+		for _, c := range clients {
+			if c.addr == addr {
+				killClient(c, cli)
+				return ReplyOK
+			}
+		}
+		return ReplyNoSuchClient
+	case sub == "kill" && len(args) > 3:
+		f, errReply := parseClientFilter(args[2:])
+		if f == nil {
+			return errReply
+		}
+		var killed []*GodisClient
+		for _, c := range clients {
+			if f.match(c, cli) {
+				killed = append(killed, c)
+			}
+		}
+		// free after the iteration, freed clients are removed from the map
+		for _, c := range killed {
+			killClient(c, cli)
+		}
+		return replyInt(int64(len(killed)))
+	case sub == "pause" && (len(args) == 3 || len(args) == 4):
+		timeout, err := strconv.ParseInt(args[2].StrVal(), 10, 64)
+		if err != nil || timeout < 0 {
+			return replyErr("timeout is not an integer or out of range")
+		}
+		all := true
+		if len(args) == 4 {
+			switch strings.ToLower(args[3].StrVal()) {
+			case "all":
+			case "write":
+				all = false
+			default:
+				return ReplySyntaxErr
+			}
+		}
+		cli.srv.PauseClients(time.Now().Add(time.Duration(timeout)*time.Millisecond), all)
+		return ReplyOK
+	case sub == "unpause" && len(args) == 2:
+		cli.srv.UnpauseClients()
+		return ReplyOK
+	case sub == "tracking" && len(args) >= 3:
+		switch strings.ToLower(args[2].StrVal()) {
+		case "on":
+			state, errReply := parseTracking(cli, args[3:])
+			if state == nil {
+				return errReply
+			}
+			cli.srv.Tracking().Enable(cli, state)
+		case "off":
+			if len(args) > 3 {
+				return ReplySyntaxErr
+			}
+			cli.srv.Tracking().Disable(cli)
+		default:
+			return ReplySyntaxErr
+		}
+		return ReplyOK
+	case sub == "caching" && len(args) == 3:
+		state := cli.tracking
+		if state == nil || !state.optin && !state.optout {
+			return replyErr("CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")
+		}
+		switch strings.ToLower(args[2].StrVal()) {
+		case "yes":
+			if !state.optin {
+				return replyErr("CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+			}
+		case "no":
+			if !state.optout {
+				return replyErr("CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+			}
+		default:
+			return ReplySyntaxErr
+		}
+		state.caching = true
+		return ReplyOK
+	case sub == "getredir" && len(args) == 2:
+		switch {
+		case cli.tracking == nil:
+			return replyInt(-1)
+		case cli.tracking.redirect == nil:
+			return replyInt(0)
+		}
+		return replyInt(cli.tracking.redirect.id)
+	case sub == "trackinginfo" && len(args) == 2:
+		return trackingInfo(cli)
+	case sub == "no-evict" && len(args) == 3:
+		switch strings.ToLower(args[2].StrVal()) {
+		case "on":
+			cli.noEvict = true
+		case "off":
+			cli.noEvict = false
+		default:
+			return ReplySyntaxErr
+		}
+		return ReplyOK
+	}
+	return replyErr(fmt.Sprintf("unknown subcommand or wrong number of arguments for 'client|%v'", args[1].StrVal()))
+}
+
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// hello [protover [AUTH username password] [SETNAME clientname]]
+func helloCmd(cli *GodisClient) string {
+	args := cli.args
+	resp := cli.resp
+	if len(args) > 1 {
+		ver, err := strconv.Atoi(args[1].StrVal())
+		if err != nil {
+			return replyErr("Protocol version is not an integer or out of range")
+		}
+		if ver < 2 || ver > 3 {
+			return ReplyNoProto
+		}
+		resp = ver
+	}
+
+	var user, pass, name string
+	var auth, setName bool
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i].StrVal()); {
+		case opt == "auth" && i+2 < len(args):
+			auth, user, pass = true, args[i+1].StrVal(), args[i+2].StrVal()
+			i += 2
+		case opt == "setname" && i+1 < len(args):
+			setName, name = true, args[i+1].StrVal()
+			if !validClientName(name) {
+				return ReplyBadClientName
+			}
+			i++
+		default:
+			return replyErr(fmt.Sprintf("Syntax error in HELLO option '%v'", args[i].StrVal()))
+		}
+	}
+	if auth && !authenticate(cli, user, pass, "HELLO") {
+		return ReplyWrongPass
+	}
+	if !cli.authenticated {
+		return ReplyHelloNoAuth
+	}
+	if setName {
+		cli.name = name
+	}
+
+	cli.resp = resp
+	return replyMap(cli, []string{
+		replyBulk("server"), replyBulk("godis"),
+		replyBulk("version"), replyBulk(GodisVersion),
+		replyBulk("proto"), replyInt(int64(resp)),
+		replyBulk("id"), replyInt(cli.id),
+		replyBulk("mode"), replyBulk("standalone"),
+		replyBulk("role"), replyBulk("master"),
+		replyBulk("modules"), replyArray(nil),
+	})
+}
+
+// sortedClients returns the clients sorted by id.
+func sortedClients(clients map[int]*GodisClient) []*GodisClient {
+	list := make([]*GodisClient, 0, len(clients))
+	for _, c := range clients {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	return list
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientCmd(t *testing.T) {
+	port := 6686
+	srv := newTestServer(t, port)
+	startServer(t, srv)
+	defer stopServer(srv)
+
+	fd1, err := Connect([4]byte{127, 0, 0, 1}, port)
+	assert.Nil(t, err)
+	defer Close(fd1)
+	fd2, err := Connect([4]byte{127, 0, 0, 1}, port)
+	assert.Nil(t, err)
+	defer Close(fd2)
+
+	roundTrip(t, fd1, "client id\r\n", replyInt(1))
+	roundTrip(t, fd2, "client id\r\n", replyInt(2))
+	roundTrip(t, fd1, "client getname\r\n", ReplyNil)
+	roundTrip(t, fd1, "client setname \"bad name\"\r\n", ReplyBadClientName)
+	roundTrip(t, fd1, "client setname conn1\r\n", ReplyOK)
+	roundTrip(t, fd1, "client getname\r\n", replyBulk("conn1"))
+	roundTrip(t, fd1, "client no-evict on\r\n", ReplyOK)
+
+	line := query(t, fd1, "client info\r\n")
+	assert.Regexp(t, fmt.Sprintf(`^\$\d+\r\nid=1 addr=127\.0\.0\.1:\d+ laddr=127\.0\.0\.1:%d fd=\d+ name=conn1 age=0 idle=0 flags=e db=0 `, port), line)
+	assert.True(t, strings.HasSuffix(line, " cmd=client user=default\n\r\n"))
+	addr := strings.Fields(line)[2][len("addr="):]
+
+	list := query(t, fd1, "client list\r\n")
+	assert.Contains(t, list, "\nid=1 addr="+addr+" ")
+	assert.Contains(t, list, "\nid=2 addr=")
+	list = query(t, fd1, "client list id 2 3\r\n")
+	assert.NotContains(t, list, "id=1 ")
+	assert.Contains(t, list, "\nid=2 addr=")
+
+	// the subscribers are pubsub clients
+	fd3, err := Connect([4]byte{127, 0, 0, 1}, port)
+	assert.Nil(t, err)
+	defer Close(fd3)
+	query(t, fd3, "subscribe ch\r\n")
+	list = query(t, fd1, "client list type pubsub\r\n")
+	assert.NotContains(t, list, "id=1 ")
+	assert.Contains(t, list, "\nid=3 addr=")
+	list = query(t, fd1, "client list type normal\r\n")
+	assert.Contains(t, list, "\nid=1 addr=")
+	assert.NotContains(t, list, "id=3 ")
+	roundTrip(t, fd1, "client list type master\r\n", replyBulk(""))
+	roundTrip(t, fd1, "client list type bad\r\n", replyErr("Unknown client type 'bad'"))
+	roundTrip(t, fd1, "client kill type bad\r\n", replyErr("Unknown client type 'bad'"))
+	roundTrip(t, fd1, "client kill type slave\r\n", replyInt(0))
+	roundTrip(t, fd1, "client kill type pubsub\r\n", replyInt(1))
+	_, err = Read(fd3, make([]byte, 16))
+	assert.Equal(t, io.EOF, err)
+
+	roundTrip(t, fd1, "client kill 1.2.3.4:5\r\n", ReplyNoSuchClient)
+	roundTrip(t, fd1, "client kill id 1\r\n", replyInt(0))
+	roundTrip(t, fd1, "client kill id 0\r\n", replyErr("client-id should be greater than 0"))
+	roundTrip(t, fd1, "client kill id 2 skipme no\r\n", replyInt(1))
+	_, err = Read(fd2, make([]byte, 16))
+	assert.Equal(t, io.EOF, err)
+
+	roundTrip(t, fd1, "client kill addr "+addr+" skipme no\r\n", replyInt(1))
+	_, err = Read(fd1, make([]byte, 16))
+	assert.Equal(t, io.EOF, err)
+}
+
+// query sends q and returns the reply, which is small enough to be read at once.
+func query(t *testing.T, fd int, q string) string {
+	_, err := Write(fd, []byte(q))
+	assert.Nil(t, err)
+	buf := make([]byte, 4096)
+	n, err := Read(fd, buf)
+	assert.Nil(t, err)
+	return string(buf[:n])
+}
+
+func TestClientPause(t *testing.T) {
+	port := 6687
+	srv := newTestServer(t, port)
+	startServer(t, srv)
+	defer stopServer(srv)
+
+	fd1, err := Connect([4]byte{127, 0, 0, 1}, port)
+	assert.Nil(t, err)
+	defer Close(fd1)
+	fd2, err := Connect([4]byte{127, 0, 0, 1}, port)
+	assert.Nil(t, err)
+	defer Close(fd2)
+	assert.Nil(t, SetTimeout(fd2, 100))
+
+	roundTrip(t, fd1, "set key val\r\n", ReplyOK)
+	roundTrip(t, fd1, "client pause 10000 write\r\n", ReplyOK)
+	roundTrip(t, fd2, "get key\r\n", replyBulk("val"))
+
+	// the write and the commands after it wait for the end of the pause
+	_, err = Write(fd2, []byte("set key val2\r\nget key\r\n"))
+	assert.Nil(t, err)
+	n, _ := Read(fd2, make([]byte, 16))
+	assert.Equal(t, 0, n)
+	roundTrip(t, fd1, "get key\r\n", replyBulk("val"))
+
+	roundTrip(t, fd1, "client unpause\r\n", ReplyOK)
+	roundTrip(t, fd2, "", ReplyOK+replyBulk("val2"))
+
+	// the pause ends by itself
+	roundTrip(t, fd1, "client pause 100\r\n", ReplyOK)
+	start := time.Now()
+	roundTrip(t, fd1, "get key\r\n", replyBulk("val2"))
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+}
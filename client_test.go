@@ -1,16 +1,108 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 )
 
-type MockIGodisServer struct{}
+type MockIGodisServer struct {
+	config   *GodisConfig
+	acl      *Acl
+	slowlog  *SlowLog
+	latency  *LatencyMonitor
+	pubsub   *PubSub
+	tracking *Tracking
+	slots    *SlotMigrations
+}
 
 func (srv *MockIGodisServer) FreeClient(cli *GodisClient)          {}
+func (srv *MockIGodisServer) FreeClientAsync(cli *GodisClient)     {}
+func (srv *MockIGodisServer) CountOutputLimitKill()                {}
 func (srv *MockIGodisServer) RegisterSendReply(cli *GodisClient)   {}
 func (srv *MockIGodisServer) UnRegisterSendReply(cil *GodisClient) {}
+func (srv *MockIGodisServer) ResetStats()                          {}
+func (srv *MockIGodisServer) Info(sections ...string) string       { return "" }
+func (srv *MockIGodisServer) Clients() map[int]*GodisClient        { return nil }
+func (srv *MockIGodisServer) PauseClients(end time.Time, all bool) {}
+func (srv *MockIGodisServer) UnpauseClients()                      {}
+func (srv *MockIGodisServer) Shutdown(_ *GodisClient, _ bool) bool { return false }
+func (srv *MockIGodisServer) AbortShutdown() bool                  { return false }
+func (srv *MockIGodisServer) AddMonitor(cli *GodisClient)          {}
+func (srv *MockIGodisServer) SignalKeyAsReady(key string)          {}
+
+func (srv *MockIGodisServer) BlockForKeys(cli *GodisClient, keys []string, timeout time.Duration) {}
+
+func (srv *MockIGodisServer) ProcessCommand(cli *GodisClient) string {
+	return processCmd(cli)
+}
+
+func (srv *MockIGodisServer) ACL() *Acl {
+	if srv.acl == nil {
+		srv.acl = NewAcl()
+	}
+	return srv.acl
+}
+
+func (srv *MockIGodisServer) SlowLog() *SlowLog {
+	if srv.slowlog == nil {
+		srv.slowlog = NewSlowLog(DefaultSlowLogMaxLen)
+	}
+	return srv.slowlog
+}
+
+func (srv *MockIGodisServer) Latency() *LatencyMonitor {
+	if srv.latency == nil {
+		srv.latency = NewLatencyMonitor()
+	}
+	return srv.latency
+}
+
+func (srv *MockIGodisServer) PubSub() *PubSub {
+	if srv.pubsub == nil {
+		srv.pubsub = NewPubSub()
+	}
+	return srv.pubsub
+}
+
+func (srv *MockIGodisServer) Tracking() *Tracking {
+	if srv.tracking == nil {
+		srv.tracking = NewTracking()
+	}
+	return srv.tracking
+}
+
+func (srv *MockIGodisServer) SlotMigrations() *SlotMigrations {
+	if srv.slots == nil {
+		srv.slots = NewSlotMigrations()
+	}
+	return srv.slots
+}
+
+func (srv *MockIGodisServer) Config() *GodisConfig {
+	if srv.config == nil {
+		srv.config = NewGodisConfig()
+	}
+	return srv.config
+}
+
+func strArgs(args ...string) []*Obj {
+	objs := make([]*Obj, len(args))
+	for i, arg := range args {
+		objs[i] = NewObject(String, arg)
+	}
+	return objs
+}
+
+// execCmd executes a command for the client directly.
+func execCmd(cli *GodisClient, args ...string) string {
+	cli.args = strArgs(args...)
+	return cli.srv.ProcessCommand(cli)
+}
 
 func readQuery(cli *GodisClient, query string) {
 	for _, b := range []byte(query) {
@@ -84,8 +176,8 @@ func TestProcessQuery(t *testing.T) {
 	key := NewObject(String, "key")
 	val := db.Lookup(key)
 	assert.Equal(t, "val", val.StrVal())
-    assert.Equal(t, 1, cli.reply.length)
-    assert.Equal(t, ReplyOK, cli.reply.First().Val.StrVal())
+	assert.Equal(t, 1, len(cli.reply))
+	assert.Equal(t, ReplyOK, string(cli.reply[0]))
 
 	readQuery(cli, "set key val2\r\n")
 	err = cli.ProcessQuery()
@@ -93,6 +185,121 @@ func TestProcessQuery(t *testing.T) {
 	assert.Equal(t, 3, len(cli.args))
 	val2 := db.Lookup(key)
 	assert.Equal(t, "val2", val2.StrVal())
-    assert.Equal(t, 2, cli.reply.length)
-    assert.Equal(t, ReplyOK, cli.reply.Last().Val.StrVal())
+	assert.Equal(t, 2, len(cli.reply))
+	assert.Equal(t, ReplyOK, string(cli.reply[len(cli.reply)-1]))
+}
+
+func TestWriteToSocket(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	defer Close(fds[0])
+	defer Close(fds[1])
+
+	cli := NewGodisClient(fds[0], nil, &MockIGodisServer{})
+	var expected string
+	for i := 0; i < 2*GodisMaxIOV; i++ {
+		reply := replyInt(int64(i))
+		expected += reply
+		cli.reply = append(cli.reply, []byte(reply))
+	}
+	cli.sentLen = 1
+
+	assert.Nil(t, cli.writeToSocket())
+	assert.Equal(t, 0, len(cli.reply))
+	assert.Equal(t, 0, cli.sentLen)
+
+	buf := make([]byte, len(expected))
+	n, err := Read(fds[1], buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected[1:], string(buf[:n]))
+}
+
+func TestEmptyAndBigBulk(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_NONBLOCK, 0)
+	assert.Nil(t, err)
+	defer Close(fds[0])
+	defer Close(fds[1])
+
+	cli := NewGodisClient(fds[0], nil, &MockIGodisServer{})
+	readQuery(cli, "*2\r\n$0\r\n\r\n")
+	ok, err := cli.handleBulkBuf()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	big := strings.Repeat("x", 3*GodisBigArg)
+	readQuery(cli, fmt.Sprintf("$%d\r\n%v", len(big), big[:100]))
+	ok, err = cli.handleBulkBuf()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 100, len(cli.bigArg))
+	assert.Equal(t, cli.queryLen, cli.qbPos)
+
+	for _, end := range []int{GodisBigArg, len(big) + 2} {
+		_, err = Write(fds[1], []byte((big + "\r\n")[len(cli.bigArg):end]))
+		assert.Nil(t, err)
+		for len(cli.bigArg) < end {
+			assert.Nil(t, cli.readFromSocket())
+		}
+		ok, err = cli.handleBulkBuf()
+		assert.Nil(t, err)
+	}
+	assert.True(t, ok)
+	assert.Nil(t, cli.bigArg)
+	assert.Equal(t, 2, len(cli.args))
+	assert.Equal(t, "", cli.args[0].StrVal())
+	assert.Equal(t, big, cli.args[1].StrVal())
+}
+
+func TestBulkProtocolError(t *testing.T) {
+	for query, expected := range map[string]error{
+		"*x\r\n":                 ErrInvalidMultiBulkLength,
+		"*1\r\n$-1\r\n":          ErrInvalidBulkLength,
+		"*1\r\n:1\r\n":           ErrExpectedBulkLength,
+		"*1\r\n$1\r\nab\r\n":     ErrExpectedBulkEnd,
+		"*1\r\n$1025\r\n":        ErrTooBigBulkCmd,
+		"*1\r\n$1024\r\nabc\r\n": nil,
+	} {
+		cli := NewGodisClient(0, nil, &MockIGodisServer{})
+		cli.maxBulkLen = 1024
+		readQuery(cli, query)
+		_, err := cli.handleBulkBuf()
+		assert.Equal(t, expected, err, query)
+	}
+}
+
+func TestInlineQuotes(t *testing.T) {
+	cli := NewGodisClient(0, nil, nil)
+	readQuery(cli, "set \"hello world\" 'a b'\n")
+	ok, err := cli.handleInlineBuf()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "hello world", cli.args[1].StrVal())
+	assert.Equal(t, "a b", cli.args[2].StrVal())
+
+	readQuery(cli, "set \"key\r\n")
+	_, err = cli.handleInlineBuf()
+	assert.Equal(t, ErrUnbalancedQuotes, err)
+}
+
+func TestOutputLimitReached(t *testing.T) {
+	srv := &MockIGodisServer{}
+	srv.Config().ClientOutputBufferLimits[ClientClassNormal] = OutputBufferLimit{Hard: 100, Soft: 50, SoftSeconds: 1}
+	cli := NewGodisClient(0, NewGodisDB(), srv)
+
+	cli.AddReply(strings.Repeat("a", 60))
+	assert.False(t, cli.closeAsap)
+	assert.False(t, cli.softLimitTime.IsZero())
+
+	// over the soft limit for more than 1 second
+	cli.softLimitTime = time.Now().Add(-2 * time.Second)
+	cli.AddReply("b")
+	assert.True(t, cli.closeAsap)
+	cli.AddReply("c")
+	assert.Equal(t, 61, cli.replyLen)
+
+	cli = NewGodisClient(0, NewGodisDB(), srv)
+	cli.AddReply(strings.Repeat("a", 99))
+	assert.False(t, cli.closeAsap)
+	cli.AddReply("b")
+	assert.True(t, cli.closeAsap)
 }
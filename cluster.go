@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	ClusterSlots = 16384
+
+	ReplyCrossSlot = "-CROSSSLOT Keys in request don't hash to the same slot\r\n"
+	ReplyTryAgain  = "-TRYAGAIN Multiple keys request during rehashing of slot\r\n"
+)
+
+// SlotMigrations records the slots being resharded by CLUSTER SETSLOT. The instance doesn't run
+// in cluster mode and has no node table, so a node is named by the host:port the clients are
+// redirected to, and the keys of the other slots are served whatever their slot is.
+type SlotMigrations struct {
+	importing map[int]string // slot -> the node the slot is imported from
+	migrating map[int]string // slot -> the node the slot is migrated to
+}
+
+func NewSlotMigrations() *SlotMigrations {
+	return &SlotMigrations{
+		importing: make(map[int]string),
+		migrating: make(map[int]string),
+	}
+}
+
+// Importing returns the node the slot is imported from, "" if the slot is not importing.
+func (sm *SlotMigrations) Importing(slot int) string {
+	return sm.importing[slot]
+}
+
+// Migrating returns the node the slot is migrated to, "" if the slot is not migrating.
+func (sm *SlotMigrations) Migrating(slot int) string {
+	return sm.migrating[slot]
+}
+
+func (sm *SlotMigrations) SetImporting(slot int, node string) {
+	delete(sm.migrating, slot)
+	sm.importing[slot] = node
+}
+
+func (sm *SlotMigrations) SetMigrating(slot int, node string) {
+	delete(sm.importing, slot)
+	sm.migrating[slot] = node
+}
+
+// SetStable clears the importing and migrating state of the slot.
+func (sm *SlotMigrations) SetStable(slot int) {
+	delete(sm.importing, slot)
+	delete(sm.migrating, slot)
+}
+
+func (sm *SlotMigrations) resharding(slot int) bool {
+	return sm.importing[slot] != "" || sm.migrating[slot] != ""
+}
+
+// Redirect returns the error redirecting cmd to the other node when its keys are in a slot being
+// resharded, "" if it runs here. asking is whether the client sent ASKING right before cmd.
+func (sm *SlotMigrations) Redirect(db *GodisDB, cmd *GodisCommand, args []*Obj, asking bool) string {
+	if cmd.keys == nil || len(sm.importing)+len(sm.migrating) == 0 {
+		return ""
+	}
+	keys := cmd.keys(args)
+	if len(keys) == 0 {
+		return ""
+	}
+
+	slot := KeyHashSlot(args[keys[0]].StrVal())
+	for _, i := range keys[1:] {
+		// the keys of other slots may be mixed freely, as there is no cluster mode
+		if other := KeyHashSlot(args[i].StrVal()); other != slot && (sm.resharding(slot) || sm.resharding(other)) {
+			return ReplyCrossSlot
+		}
+	}
+	// MIGRATE moves the keys out of the slot, so it runs here whatever the state is
+	if !sm.resharding(slot) || cmd.name == GodisCmdMigrate {
+		return ""
+	}
+
+	missing := 0
+	for _, i := range keys {
+		if !db.Exists(args[i]) {
+			missing++
+		}
+	}
+	switch node := sm.migrating[slot]; {
+	case node != "" && missing == 0:
+		return ""
+	case node != "" && missing == len(keys):
+		// the keys have been migrated or are new, both are served by the target
+		return fmt.Sprintf("-ASK %d %v\r\n", slot, node)
+	case node != "":
+		return ReplyTryAgain
+	case asking || cmd.flags&CmdAsking != 0:
+		if len(keys) > 1 && missing > 0 {
+			return ReplyTryAgain
+		}
+		return ""
+	default:
+		return fmt.Sprintf("-MOVED %d %v\r\n", slot, sm.importing[slot])
+	}
+}
+
+// KeyHashSlot returns the slot of key, only the part inside the first non-empty {...} is hashed if any.
+func KeyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) & (ClusterSlots - 1))
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum the slots are hashed with.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// keysInSlot returns at most count keys of db hashed to slot.
+func keysInSlot(db *GodisDB, slot int, count int) []string {
+	var keys []string
+	db.data.ForEach(func(entry *Entry) {
+		if len(keys) < count && KeyHashSlot(entry.Key.StrVal()) == slot {
+			keys = append(keys, entry.Key.StrVal())
+		}
+	})
+	return keys
+}
+
+func parseSlot(arg *Obj) (int, bool) {
+	slot, err := strconv.Atoi(arg.StrVal())
+	return slot, err == nil && slot >= 0 && slot < ClusterSlots
+}
+
+// CLUSTER SETSLOT <slot> IMPORTING <host:port> | MIGRATING <host:port> | STABLE
+// CLUSTER KEYSLOT <key>
+// CLUSTER COUNTKEYSINSLOT <slot>
+// CLUSTER GETKEYSINSLOT <slot> <count>
+func clusterCmd(cli *GodisClient) string {
+	args := cli.args
+	switch subcmd := strings.ToLower(args[1].StrVal()); {
+	case subcmd == "setslot" && len(args) >= 4:
+		return clusterSetSlot(cli)
+	case subcmd == "keyslot" && len(args) == 3:
+		return replyInt(int64(KeyHashSlot(args[2].StrVal())))
+	case subcmd == "countkeysinslot" && len(args) == 3:
+		slot, ok := parseSlot(args[2])
+		if !ok {
+			return replyErr("Invalid slot")
+		}
+		return replyInt(int64(len(keysInSlot(cli.db, slot, int(cli.db.KeyCount())))))
+	case subcmd == "getkeysinslot" && len(args) == 4:
+		slot, ok := parseSlot(args[2])
+		if !ok {
+			return replyErr("Invalid slot")
+		}
+		count, err := strconv.Atoi(args[3].StrVal())
+		if err != nil || count < 0 {
+			return replyErr("Invalid number of keys")
+		}
+		return replyBulkArray(keysInSlot(cli.db, slot, count))
+	}
+	return replyErr(fmt.Sprintf("unknown subcommand or wrong number of arguments for 'cluster|%v'", args[1].StrVal()))
+}
+
+func clusterSetSlot(cli *GodisClient) string {
+	args := cli.args
+	slot, ok := parseSlot(args[2])
+	if !ok {
+		return replyErr("Invalid or out of range slot")
+	}
+	sm := cli.srv.SlotMigrations()
+	switch state := strings.ToLower(args[3].StrVal()); {
+	case (state == "importing" || state == "migrating") && len(args) == 5:
+		// the clients are redirected to the node, so it must be an address
+		node := args[4].StrVal()
+		if _, _, err := net.SplitHostPort(node); err != nil {
+			return replyErr(fmt.Sprintf("Invalid node address %v, host:port expected", node))
+		}
+		if state == "importing" {
+			sm.SetImporting(slot, node)
+		} else {
+			sm.SetMigrating(slot, node)
+		}
+	case state == "stable" && len(args) == 4:
+		sm.SetStable(slot)
+	default:
+		return ReplySyntaxErr
+	}
+	return ReplyOK
+}
+
+// asking makes the next command served in an importing slot
+func askingCmd(cli *GodisClient) string {
+	cli.asking = true
+	return ReplyOK
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyHashSlot(t *testing.T) {
+	assert.Equal(t, 12739, KeyHashSlot("123456789"))
+	assert.Equal(t, 12182, KeyHashSlot("foo"))
+	assert.Equal(t, 11058, KeyHashSlot("somekey"))
+
+	// only the hash tag is hashed
+	assert.Equal(t, KeyHashSlot("user1000"), KeyHashSlot("{user1000}.following"))
+	assert.Equal(t, KeyHashSlot("bar"), KeyHashSlot("foo{bar}{zap}"))
+	assert.Equal(t, KeyHashSlot("{bar"), KeyHashSlot("foo{{bar}}zap"))
+	assert.Equal(t, int(crc16("foo{}{bar}")&(ClusterSlots-1)), KeyHashSlot("foo{}{bar}"))
+}
+
+func TestClusterSetSlot(t *testing.T) {
+	srv := &MockIGodisServer{}
+	cli := NewGodisClient(0, NewGodisDB(), srv)
+	sm := srv.SlotMigrations()
+
+	assert.Equal(t, ReplyOK, execCmd(cli, "cluster", "setslot", "100", "importing", "127.0.0.1:6380"))
+	assert.Equal(t, "127.0.0.1:6380", sm.Importing(100))
+	assert.Equal(t, "", sm.Migrating(100))
+
+	assert.Equal(t, ReplyOK, execCmd(cli, "cluster", "SETSLOT", "100", "MIGRATING", "[::1]:6381"))
+	assert.Equal(t, "", sm.Importing(100))
+	assert.Equal(t, "[::1]:6381", sm.Migrating(100))
+
+	assert.Equal(t, ReplyOK, execCmd(cli, "cluster", "setslot", "100", "stable"))
+	assert.Equal(t, "", sm.Migrating(100))
+
+	assert.Equal(t, replyErr("Invalid node address node-a, host:port expected"),
+		execCmd(cli, "cluster", "setslot", "1", "migrating", "node-a"))
+	assert.Equal(t, replyErr("Invalid or out of range slot"), execCmd(cli, "cluster", "setslot", "16384", "stable"))
+	assert.Equal(t, replyErr("Invalid or out of range slot"), execCmd(cli, "cluster", "setslot", "x", "stable"))
+	assert.Equal(t, ReplySyntaxErr, execCmd(cli, "cluster", "setslot", "1", "importing"))
+	assert.Equal(t, ReplySyntaxErr, execCmd(cli, "cluster", "setslot", "1", "node", "127.0.0.1:6380"))
+	assert.Equal(t, replyErr("unknown subcommand or wrong number of arguments for 'cluster|nodes'"), execCmd(cli, "cluster", "nodes"))
+}
+
+func TestClusterKeysInSlot(t *testing.T) {
+	cli := NewGodisClient(0, NewGodisDB(), &MockIGodisServer{})
+	for _, key := range []string{"{a}1", "{a}2", "{a}3", "b"} {
+		execCmd(cli, "set", key, "v")
+	}
+
+	assert.Equal(t, replyInt(15495), execCmd(cli, "cluster", "keyslot", "{a}1"))
+	assert.Equal(t, replyInt(3), execCmd(cli, "cluster", "countkeysinslot", "15495"))
+	assert.Equal(t, replyInt(0), execCmd(cli, "cluster", "countkeysinslot", "0"))
+	assert.Equal(t, replyErr("Invalid slot"), execCmd(cli, "cluster", "countkeysinslot", "-1"))
+
+	reply := execCmd(cli, "cluster", "getkeysinslot", "15495", "2")
+	assert.Regexp(t, `^\*2\r\n\$4\r\n\{a\}\d\r\n\$4\r\n\{a\}\d\r\n$`, reply)
+	assert.Equal(t, "*0\r\n", execCmd(cli, "cluster", "getkeysinslot", "15495", "0"))
+	assert.Equal(t, replyErr("Invalid number of keys"), execCmd(cli, "cluster", "getkeysinslot", "15495", "-1"))
+}
+
+func TestSlotRedirect(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli := srv.newClient(0)
+	assert.Equal(t, 15495, KeyHashSlot("a"))
+	execCmd(cli, "set", "{a}1", "v1")
+	execCmd(cli, "set", "b", "v")
+
+	// the keys still here are served, the others are asked to the target
+	assert.Equal(t, ReplyOK, execCmd(cli, "cluster", "setslot", "15495", "migrating", "127.0.0.1:6380"))
+	assert.Equal(t, replyBulk("v1"), execCmd(cli, "get", "{a}1"))
+	assert.Equal(t, "-ASK 15495 127.0.0.1:6380\r\n", execCmd(cli, "get", "{a}2"))
+	assert.Equal(t, "-ASK 15495 127.0.0.1:6380\r\n", execCmd(cli, "set", "{a}2", "v2"))
+	assert.Equal(t, ReplyTryAgain, execCmd(cli, "geosearchstore", "{a}2", "{a}1", "frommember", "m", "byradius", "1", "m"))
+	assert.Equal(t, ReplyCrossSlot, execCmd(cli, "geosearchstore", "b", "{a}1", "frommember", "m", "byradius", "1", "m"))
+	assert.Equal(t, replyBulk("v"), execCmd(cli, "get", "b"))
+
+	// the importing slot is only served after ASKING
+	assert.Equal(t, ReplyOK, execCmd(cli, "cluster", "setslot", "15495", "importing", "127.0.0.1:6381"))
+	assert.Equal(t, "-MOVED 15495 127.0.0.1:6381\r\n", execCmd(cli, "get", "{a}1"))
+	assert.Equal(t, ReplyOK, execCmd(cli, "asking"))
+	assert.Equal(t, replyBulk("v1"), execCmd(cli, "get", "{a}1"))
+	assert.Equal(t, "-MOVED 15495 127.0.0.1:6381\r\n", execCmd(cli, "get", "{a}1"))
+	assert.Equal(t, ReplyOK, execCmd(cli, "restore-asking", "{a}2", "0", string(DumpObject(NewObject(String, "v2")))))
+
+	assert.Equal(t, ReplyOK, execCmd(cli, "cluster", "setslot", "15495", "stable"))
+	assert.Equal(t, replyBulk("v2"), execCmd(cli, "get", "{a}2"))
+}
+
+func TestAskingKeptWhilePaused(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli, other := srv.newClient(0), srv.newClient(0)
+	assert.Equal(t, ReplyOK, execCmd(cli, "cluster", "setslot", "15495", "importing", "127.0.0.1:6381"))
+
+	// the paused write runs after the pause with the ASKING sent before it
+	assert.Equal(t, ReplyOK, execCmd(other, "client", "pause", "10000", "write"))
+	assert.Equal(t, ReplyOK, execCmd(cli, "asking"))
+	assert.Equal(t, "", execCmd(cli, "set", "{a}1", "v1"))
+	assert.True(t, cli.blocked)
+	assert.Equal(t, ReplyOK, execCmd(other, "client", "unpause"))
+	srv.handleUnblockedClients()
+	assert.False(t, cli.blocked)
+	assert.Equal(t, ReplyOK, string(cli.reply[len(cli.reply)-1]))
+	assert.False(t, cli.asking)
+	assert.Equal(t, "-MOVED 15495 127.0.0.1:6381\r\n", execCmd(cli, "get", "{a}1"))
+}
@@ -2,81 +2,255 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
-	GodisCmdGet    = "get"
-	GodisCmdSet    = "set"
-	GodisCmdExpire = "expire"
-	GodisCmdQuit   = "quit"
+	GodisCmdGet           = "get"
+	GodisCmdSet           = "set"
+	GodisCmdExpire        = "expire"
+	GodisCmdDump          = "dump"
+	GodisCmdRestore       = "restore"
+	GodisCmdRestoreAsking = "restore-asking"
+	GodisCmdMigrate       = "migrate"
+	GodisCmdCluster       = "cluster"
+	GodisCmdAsking        = "asking"
+	GodisCmdConfig        = "config"
+	GodisCmdInfo          = "info"
+	GodisCmdClient        = "client"
+	GodisCmdAuth          = "auth"
+	GodisCmdAcl           = "acl"
+	GodisCmdQuit          = "quit"
+	GodisCmdShutdown      = "shutdown"
+	GodisCmdSlowLog       = "slowlog"
+	GodisCmdLatency       = "latency"
+	GodisCmdMonitor       = "monitor"
+
+	GodisCmdSubscribe    = "subscribe"
+	GodisCmdUnsubscribe  = "unsubscribe"
+	GodisCmdPSubscribe   = "psubscribe"
+	GodisCmdPUnsubscribe = "punsubscribe"
+	GodisCmdPublish      = "publish"
+	GodisCmdPubSub       = "pubsub"
+	GodisCmdHello        = "hello"
+
+	GodisCmdXAdd      = "xadd"
+	GodisCmdXRange    = "xrange"
+	GodisCmdXRevRange = "xrevrange"
+	GodisCmdXLen      = "xlen"
+	GodisCmdXDel      = "xdel"
+	GodisCmdXTrim     = "xtrim"
+	GodisCmdXRead     = "xread"
+
+	GodisCmdXGroup     = "xgroup"
+	GodisCmdXReadGroup = "xreadgroup"
+	GodisCmdXAck       = "xack"
+	GodisCmdXPending   = "xpending"
+	GodisCmdXClaim     = "xclaim"
+	GodisCmdXAutoClaim = "xautoclaim"
+	GodisCmdXInfo      = "xinfo"
+
+	GodisCmdGeoAdd         = "geoadd"
+	GodisCmdGeoDist        = "geodist"
+	GodisCmdGeoPos         = "geopos"
+	GodisCmdGeoHash        = "geohash"
+	GodisCmdGeoSearch      = "geosearch"
+	GodisCmdGeoSearchStore = "geosearchstore"
 
 	ReplyWrongType         = "-ERR: wrong type\r\n"
-	ReplyMinusOne          = "-1\r\n"
+	ReplyNil               = "$-1\r\n"
+	ReplyNilArray          = "*-1\r\n"
 	ReplyOK                = "+OK\r\n"
 	ReplyUnknownCmd        = "-ERR: unknow command\r\n"
 	ReplyWrongNumberOfArgs = "-ERR: wrong number of args\r\n"
+	ReplySyntaxErr         = "-ERR: syntax error\r\n"
+	ReplyNotInteger        = "-ERR: value is not an integer or out of range\r\n"
+)
+
+type CmdFlag uint32
+
+const (
+	CmdWrite   CmdFlag = 1 << iota // may modify the keyspace
+	CmdDenyOOM                     // may increase memory usage, rejected when out of memory
+	CmdNoAuth                      // allowed before authentication and by any ACL user
+	CmdPubSub                      // allowed in the subscribe context
+	CmdAsking                      // served in an importing slot like after ASKING
 )
 
-var CmdTable = map[string]*GodisCommand{
-	GodisCmdGet:    &GodisCommand{GodisCmdGet, getCmd, 2},
-	GodisCmdSet:    &GodisCommand{GodisCmdSet, setCmd, 3},
-	GodisCmdExpire: &GodisCommand{GodisCmdExpire, expireCmd, 3},
+var CmdTable map[string]*GodisCommand
+
+// the table is filled in init, as ACL commands refer to it
+func init() {
+	CmdTable = map[string]*GodisCommand{
+		GodisCmdGet:           &GodisCommand{GodisCmdGet, getCmd, 2, 0, AclRead | AclString | AclFast, keyRange(1, 1, 1)},
+		GodisCmdSet:           &GodisCommand{GodisCmdSet, setCmd, 3, CmdWrite | CmdDenyOOM, AclWrite | AclString | AclSlow, keyRange(1, 1, 1)},
+		GodisCmdExpire:        &GodisCommand{GodisCmdExpire, expireCmd, 3, CmdWrite, AclWrite | AclKeyspace | AclFast, keyRange(1, 1, 1)},
+		GodisCmdDump:          &GodisCommand{GodisCmdDump, dumpCmd, 2, 0, AclRead | AclKeyspace | AclSlow, keyRange(1, 1, 1)},
+		GodisCmdRestore:       &GodisCommand{GodisCmdRestore, restoreCmd, -4, CmdWrite | CmdDenyOOM, AclWrite | AclKeyspace | AclSlow | AclDangerous, keyRange(1, 1, 1)},
+		GodisCmdRestoreAsking: &GodisCommand{GodisCmdRestoreAsking, restoreCmd, -4, CmdWrite | CmdDenyOOM | CmdAsking, AclWrite | AclKeyspace | AclSlow | AclDangerous, keyRange(1, 1, 1)},
+		GodisCmdMigrate:       &GodisCommand{GodisCmdMigrate, migrateCmd, -6, CmdWrite, AclWrite | AclKeyspace | AclSlow | AclDangerous, migrateKeys},
+		GodisCmdCluster:       &GodisCommand{GodisCmdCluster, clusterCmd, -2, 0, AclAdmin | AclSlow | AclDangerous, nil},
+		GodisCmdAsking:        &GodisCommand{GodisCmdAsking, askingCmd, 1, 0, AclFast | AclConnection, nil},
+		GodisCmdConfig:        &GodisCommand{GodisCmdConfig, configCmd, -2, 0, AclAdmin | AclSlow | AclDangerous, nil},
+		GodisCmdInfo:          &GodisCommand{GodisCmdInfo, infoCmd, -1, 0, AclSlow | AclDangerous, nil},
+		GodisCmdClient:        &GodisCommand{GodisCmdClient, clientCmd, -2, 0, AclAdmin | AclSlow | AclDangerous | AclConnection, nil},
+		GodisCmdAuth:          &GodisCommand{GodisCmdAuth, authCmd, -2, CmdNoAuth, AclFast | AclConnection, nil},
+		GodisCmdAcl:           &GodisCommand{GodisCmdAcl, aclCmd, -2, 0, AclAdmin | AclSlow | AclDangerous, nil},
+		GodisCmdShutdown:      &GodisCommand{GodisCmdShutdown, shutdownCmd, -1, 0, AclAdmin | AclSlow | AclDangerous, nil},
+		GodisCmdSlowLog:       &GodisCommand{GodisCmdSlowLog, slowlogCmd, -2, 0, AclAdmin | AclSlow | AclDangerous, nil},
+		GodisCmdLatency:       &GodisCommand{GodisCmdLatency, latencyCmd, -2, 0, AclAdmin | AclSlow | AclDangerous, nil},
+		GodisCmdMonitor:       &GodisCommand{GodisCmdMonitor, monitorCmd, 1, 0, AclAdmin | AclSlow | AclDangerous, nil},
+
+		GodisCmdSubscribe:    &GodisCommand{GodisCmdSubscribe, subscribeCmd, -2, CmdPubSub, AclPubSub | AclSlow, nil},
+		GodisCmdUnsubscribe:  &GodisCommand{GodisCmdUnsubscribe, unsubscribeCmd, -1, CmdPubSub, AclPubSub | AclSlow, nil},
+		GodisCmdPSubscribe:   &GodisCommand{GodisCmdPSubscribe, subscribeCmd, -2, CmdPubSub, AclPubSub | AclSlow, nil},
+		GodisCmdPUnsubscribe: &GodisCommand{GodisCmdPUnsubscribe, unsubscribeCmd, -1, CmdPubSub, AclPubSub | AclSlow, nil},
+		GodisCmdPublish:      &GodisCommand{GodisCmdPublish, publishCmd, 3, 0, AclPubSub | AclFast, nil},
+		GodisCmdPubSub:       &GodisCommand{GodisCmdPubSub, pubsubCmd, -2, 0, AclPubSub | AclSlow, nil},
+		GodisCmdHello:        &GodisCommand{GodisCmdHello, helloCmd, -1, CmdNoAuth | CmdPubSub, AclFast | AclConnection, nil},
+
+		GodisCmdXAdd:      &GodisCommand{GodisCmdXAdd, xaddCmd, -5, CmdWrite | CmdDenyOOM, AclWrite | AclStream | AclFast, keyRange(1, 1, 1)},
+		GodisCmdXRange:    &GodisCommand{GodisCmdXRange, xrangeCmd, -4, 0, AclRead | AclStream | AclSlow, keyRange(1, 1, 1)},
+		GodisCmdXRevRange: &GodisCommand{GodisCmdXRevRange, xrangeCmd, -4, 0, AclRead | AclStream | AclSlow, keyRange(1, 1, 1)},
+		GodisCmdXLen:      &GodisCommand{GodisCmdXLen, xlenCmd, 2, 0, AclRead | AclStream | AclFast, keyRange(1, 1, 1)},
+		GodisCmdXDel:      &GodisCommand{GodisCmdXDel, xdelCmd, -3, CmdWrite, AclWrite | AclStream | AclFast, keyRange(1, 1, 1)},
+		GodisCmdXTrim:     &GodisCommand{GodisCmdXTrim, xtrimCmd, -4, CmdWrite, AclWrite | AclStream | AclSlow, keyRange(1, 1, 1)},
+		GodisCmdXRead:     &GodisCommand{GodisCmdXRead, xreadCmd, -4, 0, AclRead | AclStream | AclSlow | AclBlocking, xreadKeys},
+
+		GodisCmdXGroup:     &GodisCommand{GodisCmdXGroup, xgroupCmd, -2, CmdWrite | CmdDenyOOM, AclWrite | AclStream | AclSlow, keyRange(2, 2, 1)},
+		GodisCmdXReadGroup: &GodisCommand{GodisCmdXReadGroup, xreadCmd, -7, CmdWrite, AclWrite | AclStream | AclSlow | AclBlocking, xreadKeys},
+		GodisCmdXAck:       &GodisCommand{GodisCmdXAck, xackCmd, -4, CmdWrite, AclWrite | AclStream | AclFast, keyRange(1, 1, 1)},
+		GodisCmdXPending:   &GodisCommand{GodisCmdXPending, xpendingCmd, -3, 0, AclRead | AclStream | AclSlow, keyRange(1, 1, 1)},
+		GodisCmdXClaim:     &GodisCommand{GodisCmdXClaim, xclaimCmd, -6, CmdWrite, AclWrite | AclStream | AclFast, keyRange(1, 1, 1)},
+		GodisCmdXAutoClaim: &GodisCommand{GodisCmdXAutoClaim, xautoclaimCmd, -6, CmdWrite, AclWrite | AclStream | AclFast, keyRange(1, 1, 1)},
+		GodisCmdXInfo:      &GodisCommand{GodisCmdXInfo, xinfoCmd, -2, 0, AclRead | AclStream | AclSlow, keyRange(2, 2, 1)},
+
+		GodisCmdGeoAdd:         &GodisCommand{GodisCmdGeoAdd, geoaddCmd, -5, CmdWrite | CmdDenyOOM, AclWrite | AclGeo | AclSortedSet | AclSlow, keyRange(1, 1, 1)},
+		GodisCmdGeoDist:        &GodisCommand{GodisCmdGeoDist, geodistCmd, -4, 0, AclRead | AclGeo | AclSortedSet | AclSlow, keyRange(1, 1, 1)},
+		GodisCmdGeoPos:         &GodisCommand{GodisCmdGeoPos, geoposCmd, -2, 0, AclRead | AclGeo | AclSortedSet | AclSlow, keyRange(1, 1, 1)},
+		GodisCmdGeoHash:        &GodisCommand{GodisCmdGeoHash, geohashCmd, -2, 0, AclRead | AclGeo | AclSortedSet | AclSlow, keyRange(1, 1, 1)},
+		GodisCmdGeoSearch:      &GodisCommand{GodisCmdGeoSearch, geosearchCmd, -7, 0, AclRead | AclGeo | AclSortedSet | AclSlow, keyRange(1, 1, 1)},
+		GodisCmdGeoSearchStore: &GodisCommand{GodisCmdGeoSearchStore, geosearchstoreCmd, -8, CmdWrite | CmdDenyOOM, AclWrite | AclGeo | AclSortedSet | AclSlow, keyRange(1, 2, 1)},
+	}
 }
 
 type GodisCommand struct {
 	name  string
-	proc  func(args []*Obj, db *GodisDB) string
-	arity int // the number of arguments
+	proc  func(cli *GodisClient) string
+	arity int // the number of arguments, -N means at least N
+	flags CmdFlag
+	acl   AclCategory
+	keys  func(args []*Obj) []int // returns the positions of the keys in args, nil if no key
+}
+
+func replyErr(msg string) string {
+	return fmt.Sprintf("-ERR: %v\r\n", msg)
+}
+
+func replyInt(n int64) string {
+	return fmt.Sprintf(":%d\r\n", n)
+}
+
+func replyBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%v\r\n", len(s), s)
+}
+
+func replyStatus(s string) string {
+	return fmt.Sprintf("+%v\r\n", s)
+}
+
+// replyArray joins the replies as an array.
+func replyArray(replies []string) string {
+	return fmt.Sprintf("*%d\r\n", len(replies)) + strings.Join(replies, "")
 }
 
-func getCmd(args []*Obj, db *GodisDB) string {
-	key := args[1]
-	val := db.Lookup(key)
+// replyMap replies the key value pairs as a map in RESP3, or a flat array in RESP2.
+func replyMap(cli *GodisClient, pairs []string) string {
+	if cli.resp == 3 {
+		return fmt.Sprintf("%%%d\r\n", len(pairs)/2) + strings.Join(pairs, "")
+	}
+	return replyArray(pairs)
+}
+
+// replyPush replies an out of band message like pubsub messages, as a push in RESP3 or an array in RESP2.
+func replyPush(cli *GodisClient, replies []string) string {
+	if cli.resp == 3 {
+		return fmt.Sprintf(">%d\r\n", len(replies)) + strings.Join(replies, "")
+	}
+	return replyArray(replies)
+}
+
+func replyBulkArray(strs []string) string {
+	replies := make([]string, len(strs))
+	for i, s := range strs {
+		replies[i] = replyBulk(s)
+	}
+	return replyArray(replies)
+}
+
+func getCmd(cli *GodisClient) string {
+	key := cli.args[1]
+	val := cli.db.Lookup(key)
 	if val == nil {
-		return ReplyMinusOne
+		return ReplyNil
 	}
 	if val.Type != String {
 		return ReplyWrongType
 	}
-	valStr := val.StrVal()
-	return fmt.Sprintf("$%d%v\r\n", len(valStr), valStr)
+	return replyBulk(val.StrVal())
 }
 
-func setCmd(args []*Obj, db *GodisDB) string {
-	key, val := args[1], args[2]
+func setCmd(cli *GodisClient) string {
+	key, val := cli.args[1], cli.args[2]
 	if val.Type != String {
 		return ReplyWrongType
 	}
-	db.Set(key, val)
+	cli.db.Set(key, val)
+	cli.db.Notify(NotifyString, "set", key)
 	return ReplyOK
 }
 
-func expireCmd(args []*Obj, db *GodisDB) string {
-	key, val := args[1], args[2]
+func expireCmd(cli *GodisClient) string {
+	key, val := cli.args[1], cli.args[2]
 	if val.Type != String {
 		return ReplyWrongType
 	}
+	seconds, err := strconv.ParseInt(val.StrVal(), 10, 64)
+	if err != nil {
+		return ReplyNotInteger
+	}
+	// a missing key gets no expire and no notification
+	if !cli.db.Exists(key) {
+		return ReplyOK
+	}
 
-	expire := time.Now().UnixMilli() + val.IntVal()*1000
+	expire := time.Now().UnixMilli() + seconds*1000
 	expObj := NewObjectInt(expire)
-	db.Expire(key, expObj)
+	cli.db.Expire(key, expObj)
 	expObj.DecrRefCount()
+	cli.db.Notify(NotifyGeneric, "expire", key)
 	return ReplyOK
 }
 
-func processCmd(args []*Obj, db *GodisDB) string {
-	cmdStr := args[0].StrVal()
-	log.Printf("process command: cmd = %v", cmdStr)
-	var reply string
-	switch cmd := CmdTable[cmdStr]; {
+// lookupCommand finds the command of args and checks its arity, returns the error reply if failed.
+func lookupCommand(args []*Obj) (*GodisCommand, string) {
+	logDebug("process command: cmd = %v", args[0].StrVal())
+	cmd := CmdTable[strings.ToLower(args[0].StrVal())]
+	switch {
 	case cmd == nil:
-		reply = ReplyUnknownCmd
-	case cmd.arity != len(args):
-		reply = ReplyWrongNumberOfArgs
-	default:
-		reply = cmd.proc(args, db)
+		return nil, ReplyUnknownCmd
+	case cmd.arity > 0 && cmd.arity != len(args), len(args) < -cmd.arity:
+		return nil, ReplyWrongNumberOfArgs
+	}
+	return cmd, ""
+}
+
+func processCmd(cli *GodisClient) string {
+	cmd, errReply := lookupCommand(cli.args)
+	if cmd == nil {
+		return errReply
 	}
-	return reply
+	return cmd.proc(cli)
 }
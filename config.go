@@ -0,0 +1,562 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var ErrNoConfigFile = errors.New("the server is running without a config file")
+
+// configParam is a parameter in the config registry, its value is kept in a field of GodisConfig.
+type configParam struct {
+	name      string
+	immutable bool // can't be changed by CONFIG SET
+	defVal    string
+	get       func() string
+	set       func(val string) error
+}
+
+type GodisConfig struct {
+	Port            int
+	Bind            string // the ipv4 or ipv6 addresses to listen on, separated by spaces
+	UnixSocket      string // the path of the unix socket, empty disables it
+	UnixSocketPerm  uint32 // the permissions of the unix socket file, 0 keeps the default
+	MaxClients      int
+	IOThreads       int
+	EpollBatch      int
+	TcpKeepAlive    int // seconds, 0 disables keepalive
+	ProtoMaxBulkLen int64
+	LogLevel        string
+	LogFile         string
+	Timeout         int // seconds of idle before a client is closed, 0 disables it
+
+	ClientOutputBufferLimits [ClientClassCount]OutputBufferLimit
+
+	RequirePass  string // the password of the default user
+	AclFile      string
+	AclLogMaxLen int
+
+	MaxMemory        int64 // bytes, 0 means no limit
+	MaxMemoryPolicy  string
+	MaxMemorySamples int
+	LFULogFactor     int
+	LFUDecayTime     int // minutes
+
+	SlowLogSlowerThan int // us, negative disables the slow log
+	SlowLogMaxLen     int
+
+	LatencyMonitorThreshold int // ms, 0 disables the latency monitor
+
+	Dir             string // the working directory of the db file
+	DbFilename      string
+	SaveOnShutdown  bool // whether SHUTDOWN and the signals save the db by default
+	ShutdownTimeout int  // seconds to wait for the pending replies before exit
+
+	TlsPort        int // 0 disables tls
+	TlsCertFile    string
+	TlsKeyFile     string
+	TlsCaCertFile  string // the ca to verify the client certificates
+	TlsAuthClients string
+
+	MetricsPort int // the http port serving /metrics, 0 disables it
+
+	NotifyKeyspaceEvents int // the classes of keyspace events to publish, see notify.go
+	TrackingTableMaxKeys int // the max keys remembered for client side caching, 0 means no limit
+	StreamNodeMaxEntries int // the max entries of a stream node
+
+	file     string // the loaded config file, rewritten by CONFIG REWRITE
+	params   map[string]*configParam
+	names    []string                // names of params in registration order
+	onChange func(name string) error // called after a param is changed by CONFIG SET
+}
+
+func NewGodisConfig() *GodisConfig {
+	c := &GodisConfig{params: make(map[string]*configParam)}
+	c.addInt("port", &c.Port, 6666, 0, 65535, true)
+	c.addString("bind", &c.Bind, "0.0.0.0", true, func(val string) error {
+		addrs := strings.Fields(val)
+		if len(addrs) == 0 {
+			return errors.New("at least one address is required")
+		}
+		for _, addr := range addrs {
+			if net.ParseIP(addr) == nil {
+				return fmt.Errorf("invalid ip address %v", addr)
+			}
+		}
+		return nil
+	})
+	c.addString("unixsocket", &c.UnixSocket, "", true, nil)
+	c.addOctal("unixsocketperm", &c.UnixSocketPerm, 0, true)
+	c.addInt("maxclients", &c.MaxClients, 1000, 1, math.MaxInt32, false)
+	c.addInt("io-threads", &c.IOThreads, 1, 1, 128, true)
+	c.addInt("epoll-batch", &c.EpollBatch, DefaultEpollBatch, 1, 1024*1024, false)
+	c.addInt("tcp-keepalive", &c.TcpKeepAlive, DefaultTcpKeepAlive, 0, math.MaxInt32, false)
+	c.addMemory("proto-max-bulk-len", &c.ProtoMaxBulkLen, DefaultProtoMaxBulkLen, 1024, math.MaxInt64, false)
+	c.addEnum("loglevel", &c.LogLevel, "notice", LogLevelNames, false)
+	c.addString("logfile", &c.LogFile, "", false, nil)
+	c.addInt("timeout", &c.Timeout, 0, 0, math.MaxInt32, false)
+	c.addOutputBufferLimits("client-output-buffer-limit", &c.ClientOutputBufferLimits)
+	c.addString("requirepass", &c.RequirePass, "", false, nil)
+	c.addString("aclfile", &c.AclFile, "", true, nil)
+	c.addInt("acllog-max-len", &c.AclLogMaxLen, DefaultAclLogLen, 0, math.MaxInt32, false)
+	c.addMemory("maxmemory", &c.MaxMemory, 0, 0, math.MaxInt64, false)
+	c.addEnum("maxmemory-policy", &c.MaxMemoryPolicy, PolicyNoEviction, EvictPolicies, false)
+	c.addInt("maxmemory-samples", &c.MaxMemorySamples, DefaultMaxMemSamples, 1, 64, false)
+	c.addInt("lfu-log-factor", &c.LFULogFactor, DefaultLFULogFactor, 0, math.MaxInt32, false)
+	c.addInt("lfu-decay-time", &c.LFUDecayTime, DefaultLFUDecayTime, 0, math.MaxInt32, false)
+	c.addInt("slowlog-log-slower-than", &c.SlowLogSlowerThan, DefaultSlowLogSlowerThan, -1, math.MaxInt32, false)
+	c.addInt("slowlog-max-len", &c.SlowLogMaxLen, DefaultSlowLogMaxLen, 0, math.MaxInt32, false)
+	c.addInt("latency-monitor-threshold", &c.LatencyMonitorThreshold, 0, 0, math.MaxInt32, false)
+	c.addString("dir", &c.Dir, ".", false, func(val string) error {
+		if info, err := os.Stat(val); err != nil || !info.IsDir() {
+			return fmt.Errorf("no such directory %v", val)
+		}
+		return nil
+	})
+	c.addString("dbfilename", &c.DbFilename, "dump.gdb", false, func(val string) error {
+		if val == "" || strings.ContainsRune(val, '/') {
+			return errors.New("dbfilename can't be a path, just a filename")
+		}
+		return nil
+	})
+	c.addBool("save-on-shutdown", &c.SaveOnShutdown, false, false)
+	c.addInt("shutdown-timeout", &c.ShutdownTimeout, DefaultShutdownTimeout, 0, math.MaxInt32, false)
+	c.addInt("tls-port", &c.TlsPort, 0, 0, 65535, true)
+	c.addString("tls-cert-file", &c.TlsCertFile, "", false, nil)
+	c.addString("tls-key-file", &c.TlsKeyFile, "", false, nil)
+	c.addString("tls-ca-cert-file", &c.TlsCaCertFile, "", false, nil)
+	c.addEnum("tls-auth-clients", &c.TlsAuthClients, TlsAuthYes, TlsAuthClients, false)
+	c.addInt("metrics-port", &c.MetricsPort, 0, 0, 65535, true)
+	c.addNotifyFlags("notify-keyspace-events", &c.NotifyKeyspaceEvents)
+	c.addInt("tracking-table-max-keys", &c.TrackingTableMaxKeys, DefaultTrackingTableMaxKeys, 0, math.MaxInt32, false)
+	c.addInt("stream-node-max-entries", &c.StreamNodeMaxEntries, DefaultStreamNodeMaxEntries, 1, math.MaxInt32, false)
+	return c
+}
+
+func (c *GodisConfig) add(p *configParam) {
+	p.defVal = p.get()
+	c.params[p.name] = p
+	c.names = append(c.names, p.name)
+}
+
+func (c *GodisConfig) addInt(name string, ptr *int, def, min, max int, immutable bool) {
+	*ptr = def
+	c.add(&configParam{
+		name:      name,
+		immutable: immutable,
+		get:       func() string { return strconv.Itoa(*ptr) },
+		set: func(val string) error {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			if n < min || n > max {
+				return fmt.Errorf("argument must be between %d and %d inclusive", min, max)
+			}
+			*ptr = n
+			return nil
+		},
+	})
+}
+
+// addMemory adds a param of bytes, the value can be like 1024, 100kb or 1gb.
+func (c *GodisConfig) addMemory(name string, ptr *int64, def, min, max int64, immutable bool) {
+	*ptr = def
+	c.add(&configParam{
+		name:      name,
+		immutable: immutable,
+		get:       func() string { return strconv.FormatInt(*ptr, 10) },
+		set: func(val string) error {
+			n, err := parseMemory(val)
+			if err != nil {
+				return err
+			}
+			if n < min || n > max {
+				return fmt.Errorf("argument must be between %d and %d inclusive", min, max)
+			}
+			*ptr = n
+			return nil
+		},
+	})
+}
+
+// addOctal adds a param of octal number like file permissions.
+func (c *GodisConfig) addOctal(name string, ptr *uint32, def uint32, immutable bool) {
+	*ptr = def
+	c.add(&configParam{
+		name:      name,
+		immutable: immutable,
+		get:       func() string { return strconv.FormatUint(uint64(*ptr), 8) },
+		set: func(val string) error {
+			n, err := strconv.ParseUint(val, 8, 32)
+			if err != nil {
+				return errors.New("argument couldn't be parsed into an octal number")
+			}
+			*ptr = uint32(n)
+			return nil
+		},
+	})
+}
+
+func (c *GodisConfig) addString(name string, ptr *string, def string, immutable bool, validate func(val string) error) {
+	*ptr = def
+	c.add(&configParam{
+		name:      name,
+		immutable: immutable,
+		get:       func() string { return *ptr },
+		set: func(val string) error {
+			if validate != nil {
+				if err := validate(val); err != nil {
+					return err
+				}
+			}
+			*ptr = val
+			return nil
+		},
+	})
+}
+
+func (c *GodisConfig) addEnum(name string, ptr *string, def string, values []string, immutable bool) {
+	c.addString(name, ptr, def, immutable, func(val string) error {
+		for _, v := range values {
+			if v == val {
+				return nil
+			}
+		}
+		return fmt.Errorf("argument must be one of the following: %v", strings.Join(values, ", "))
+	})
+}
+
+func (c *GodisConfig) addBool(name string, ptr *bool, def bool, immutable bool) {
+	*ptr = def
+	c.add(&configParam{
+		name:      name,
+		immutable: immutable,
+		get: func() string {
+			if *ptr {
+				return "yes"
+			}
+			return "no"
+		},
+		set: func(val string) error {
+			switch strings.ToLower(val) {
+			case "yes":
+				*ptr = true
+			case "no":
+				*ptr = false
+			default:
+				return errors.New("argument must be 'yes' or 'no'")
+			}
+			return nil
+		},
+	})
+}
+
+// addNotifyFlags adds the param of keyspace event classes like "KEA".
+func (c *GodisConfig) addNotifyFlags(name string, ptr *int) {
+	c.add(&configParam{
+		name: name,
+		get:  func() string { return notifyFlagsString(*ptr) },
+		set: func(val string) error {
+			flags, err := parseNotifyFlags(val)
+			if err != nil {
+				return err
+			}
+			*ptr = flags
+			return nil
+		},
+	})
+}
+
+// addOutputBufferLimits adds the param of limits like "normal 0 0 0 pubsub 32mb 8mb 60",
+// setting it only changes the classes given.
+func (c *GodisConfig) addOutputBufferLimits(name string, limits *[ClientClassCount]OutputBufferLimit) {
+	*limits = DefaultOutputBufferLimits
+	c.add(&configParam{
+		name: name,
+		get: func() string {
+			var fields []string
+			for class, limit := range limits {
+				fields = append(fields, ClientClassNames[class], strconv.FormatInt(limit.Hard, 10),
+					strconv.FormatInt(limit.Soft, 10), strconv.Itoa(limit.SoftSeconds))
+			}
+			return strings.Join(fields, " ")
+		},
+		set: func(val string) error {
+			fields := strings.Fields(val)
+			if len(fields) == 0 || len(fields)%4 != 0 {
+				return errors.New("wrong number of arguments in buffer limit configuration")
+			}
+
+			newLimits := *limits
+			for i := 0; i < len(fields); i += 4 {
+				class := -1
+				for j, className := range ClientClassNames {
+					if strings.EqualFold(fields[i], className) || (j == ClientClassReplica && strings.EqualFold(fields[i], "slave")) {
+						class = j
+					}
+				}
+				hard, hardErr := parseMemory(fields[i+1])
+				soft, softErr := parseMemory(fields[i+2])
+				seconds, secondsErr := strconv.Atoi(fields[i+3])
+				if class < 0 || hardErr != nil || softErr != nil || secondsErr != nil || seconds < 0 {
+					return errors.New("invalid client class or limits in buffer limit configuration")
+				}
+				newLimits[class] = OutputBufferLimit{Hard: hard, Soft: soft, SoftSeconds: seconds}
+			}
+			*limits = newLimits
+			return nil
+		},
+	})
+}
+
+// parseMemory parses bytes like 1024, 1k (1000), 1kb (1024), 1m, 1mb, 1g or 1gb.
+func parseMemory(val string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+	}
+
+	lower := strings.ToLower(val)
+	mul := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower, mul = strings.TrimSuffix(lower, unit.suffix), unit.mul
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/mul {
+		return 0, errors.New("argument must be a memory value")
+	}
+	return n * mul, nil
+}
+
+// load sets a param while loading the config, immutable params are allowed.
+func (c *GodisConfig) load(name, val string) error {
+	p := c.params[strings.ToLower(name)]
+	if p == nil {
+		return fmt.Errorf("unknown config %v", name)
+	}
+	if err := p.set(val); err != nil {
+		return fmt.Errorf("invalid argument '%v' for config '%v': %v", val, p.name, err)
+	}
+	return nil
+}
+
+// LoadFile loads a redis.conf style file, each line is a param name followed by its value,
+// lines starting with # are comments.
+func (c *GodisConfig) LoadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file failed: %v", err)
+	}
+
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		args, err := splitArgs(line)
+		if err == nil && len(args) < 2 {
+			err = errors.New("wrong number of arguments")
+		}
+		if err == nil {
+			err = c.load(args[0], strings.Join(args[1:], " "))
+		}
+		if err != nil {
+			return fmt.Errorf("config file %v line %d: %v", path, i+1, err)
+		}
+	}
+	c.file = path
+	return nil
+}
+
+// Set changes params at runtime, params are all set or none of them is set. If a change fails to take
+// effect, the old values are restored and applied again.
+func (c *GodisConfig) Set(pairs ...string) error {
+	var changed []*configParam
+	var olds []string
+	var err error
+	seen := make(map[*configParam]bool)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		p := c.params[strings.ToLower(pairs[i])]
+		if p == nil {
+			err = fmt.Errorf("unknown option or number of arguments for CONFIG SET - '%v'", pairs[i])
+			break
+		}
+		if p.immutable {
+			err = fmt.Errorf("CONFIG SET failed (possibly related to argument '%v') - can't set immutable config", p.name)
+			break
+		}
+		if seen[p] {
+			err = fmt.Errorf("CONFIG SET failed (possibly related to argument '%v') - duplicate parameter", p.name)
+			break
+		}
+		seen[p] = true
+
+		old := p.get()
+		if err = p.set(pairs[i+1]); err != nil {
+			err = fmt.Errorf("CONFIG SET failed (possibly related to argument '%v') - %v", p.name, err)
+			break
+		}
+		changed = append(changed, p)
+		olds = append(olds, old)
+	}
+
+	var applied []*configParam
+	if err == nil && c.onChange != nil {
+		for _, p := range changed {
+			applied = append(applied, p)
+			if applyErr := c.onChange(p.name); applyErr != nil {
+				err = fmt.Errorf("CONFIG SET failed (possibly related to argument '%v') - %v", p.name, applyErr)
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		for i := len(changed) - 1; i >= 0; i-- {
+			changed[i].set(olds[i])
+		}
+		for _, p := range applied {
+			if applyErr := c.onChange(p.name); applyErr != nil {
+				logWarning("restore config %v failed: %v", p.name, applyErr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// Get returns the name and value pairs of params matching the glob pattern.
+func (c *GodisConfig) Get(pattern string) []string {
+	var pairs []string
+	for _, name := range c.names {
+		if stringMatch(pattern, name, true) {
+			pairs = append(pairs, name, c.params[name].get())
+		}
+	}
+	return pairs
+}
+
+// Rewrite writes the current values back to the config file. Comments and unknown lines are kept,
+// lines of known params are updated in place, and changed params not in the file are appended.
+func (c *GodisConfig) Rewrite() error {
+	if c.file == "" {
+		return ErrNoConfigFile
+	}
+
+	content, err := os.ReadFile(c.file)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read config file failed: %v", err)
+	}
+
+	var lines []string
+	rewritten := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed[0] == '#' {
+			lines = append(lines, line)
+			continue
+		}
+
+		args, err := splitArgs(trimmed)
+		if err != nil || len(args) == 0 || c.params[strings.ToLower(args[0])] == nil {
+			lines = append(lines, line)
+			continue
+		}
+
+		p := c.params[strings.ToLower(args[0])]
+		if !rewritten[p.name] {
+			rewritten[p.name] = true
+			lines = append(lines, p.name+" "+quoteArg(p.get()))
+		}
+	}
+
+	generated := false
+	for _, name := range c.names {
+		p := c.params[name]
+		if rewritten[name] || p.get() == p.defVal {
+			continue
+		}
+		if !generated {
+			generated = true
+			lines = append(lines, "", "# Generated by CONFIG REWRITE")
+		}
+		lines = append(lines, p.name+" "+quoteArg(p.get()))
+	}
+
+	return writeFileAtomic(c.file, []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// writeFileAtomic writes data to a temp file and renames it to path,
+// so path is never left half written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// config GET pattern [pattern ...] | SET param value [param value ...] | REWRITE | RESETSTAT
+func configCmd(cli *GodisClient) string {
+	args := cli.args
+	config := cli.srv.Config()
+	switch sub := strings.ToLower(args[1].StrVal()); {
+	case sub == "get" && len(args) >= 3:
+		var pairs []string
+		seen := make(map[string]bool)
+		for _, pattern := range args[2:] {
+			matched := config.Get(pattern.StrVal())
+			for i := 0; i < len(matched); i += 2 {
+				if !seen[matched[i]] {
+					seen[matched[i]] = true
+					pairs = append(pairs, matched[i], matched[i+1])
+				}
+			}
+		}
+		return replyBulkArray(pairs)
+	case sub == "set" && len(args) >= 4 && len(args)%2 == 0:
+		pairs := make([]string, 0, len(args)-2)
+		for _, arg := range args[2:] {
+			pairs = append(pairs, arg.StrVal())
+		}
+		if err := config.Set(pairs...); err != nil {
+			return replyErr(err.Error())
+		}
+		return ReplyOK
+	case sub == "rewrite" && len(args) == 2:
+		if err := config.Rewrite(); err != nil {
+			return replyErr(err.Error())
+		}
+		return ReplyOK
+	case sub == "resetstat" && len(args) == 2:
+		cli.srv.ResetStats()
+		return ReplyOK
+	}
+	return replyErr(fmt.Sprintf("unknown subcommand or wrong number of arguments for 'config|%v'", args[1].StrVal()))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMemory(t *testing.T) {
+	cases := map[string]int64{"1024": 1024, "1k": 1000, "1kb": 1024, "2MB": 2 * 1024 * 1024, "1g": 1000 * 1000 * 1000}
+	for val, expected := range cases {
+		n, err := parseMemory(val)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, n)
+	}
+
+	for _, val := range []string{"", "kb", "-1", "1tb", "1.5mb"} {
+		_, err := parseMemory(val)
+		assert.NotNil(t, err, val)
+	}
+}
+
+func TestConfigSetGet(t *testing.T) {
+	config := NewGodisConfig()
+	var changed []string
+	config.onChange = func(name string) error {
+		changed = append(changed, name)
+		if name == "logfile" && config.LogFile == "/bad" {
+			return errors.New("can't open")
+		}
+		return nil
+	}
+
+	assert.Equal(t, []string{"maxclients", "1000"}, config.Get("maxclients"))
+	assert.Equal(t, []string{"port", "6666"}, config.Get("P?rt"))
+	assert.Equal(t, []string{"loglevel", "notice", "logfile", ""}, config.Get("log*"))
+
+	assert.Nil(t, config.Set("maxclients", "10", "proto-max-bulk-len", "1mb"))
+	assert.Equal(t, 10, config.MaxClients)
+	assert.Equal(t, int64(1024*1024), config.ProtoMaxBulkLen)
+	assert.Equal(t, []string{"maxclients", "proto-max-bulk-len"}, changed)
+
+	// all or nothing
+	assert.NotNil(t, config.Set("maxclients", "20", "loglevel", "bad"))
+	assert.Equal(t, 10, config.MaxClients)
+	assert.Equal(t, "notice", config.LogLevel)
+
+	assert.NotNil(t, config.Set("port", "7777"))
+	assert.NotNil(t, config.Set("maxclients", "abc"))
+	assert.NotNil(t, config.Set("unknown", "1"))
+	assert.Equal(t, 2, len(changed))
+
+	// a param can't be set twice in one call
+	assert.EqualError(t, config.Set("maxclients", "1", "maxclients", "2", "bogus", "x"),
+		"CONFIG SET failed (possibly related to argument 'maxclients') - duplicate parameter")
+	assert.Equal(t, 10, config.MaxClients)
+
+	// the changes are restored and applied again if one fails to take effect
+	changed = nil
+	assert.EqualError(t, config.Set("maxclients", "30", "logfile", "/bad"),
+		"CONFIG SET failed (possibly related to argument 'logfile') - can't open")
+	assert.Equal(t, 10, config.MaxClients)
+	assert.Equal(t, "", config.LogFile)
+	assert.Equal(t, []string{"maxclients", "logfile", "maxclients", "logfile"}, changed)
+}
+
+func TestConfigRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godis.conf")
+	content := "# godis config\nport 7777\nmaxclients 100\n\n# keep me\nmaxclients 200\n"
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+
+	config := NewGodisConfig()
+	assert.Nil(t, config.LoadFile(path))
+	assert.Equal(t, 7777, config.Port)
+	assert.Equal(t, 200, config.MaxClients)
+
+	assert.Nil(t, config.Set("maxclients", "300", "logfile", "/tmp/godis log"))
+	assert.Nil(t, config.Rewrite())
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	expected := "# godis config\nport 7777\nmaxclients 300\n\n# keep me\n\n" +
+		"# Generated by CONFIG REWRITE\nlogfile \"/tmp/godis log\"\n"
+	assert.Equal(t, expected, string(data))
+
+	reloaded := NewGodisConfig()
+	assert.Nil(t, reloaded.LoadFile(path))
+	assert.Equal(t, 300, reloaded.MaxClients)
+	assert.Equal(t, "/tmp/godis log", reloaded.LogFile)
+
+	assert.Equal(t, ErrNoConfigFile, NewGodisConfig().Rewrite())
+}
+
+func TestConfigCmd(t *testing.T) {
+	cli := NewGodisClient(0, NewGodisDB(), &MockIGodisServer{})
+	assert.Equal(t, replyBulkArray([]string{"maxclients", "1000"}), execCmd(cli, "config", "get", "maxclients", "maxc*"))
+	assert.Equal(t, ReplyOK, execCmd(cli, "CONFIG", "SET", "maxclients", "5"))
+	assert.Equal(t, replyBulkArray([]string{"maxclients", "5"}), execCmd(cli, "config", "get", "maxclients"))
+	assert.Equal(t, replyErr(ErrNoConfigFile.Error()), execCmd(cli, "config", "rewrite"))
+	assert.Equal(t, ReplyOK, execCmd(cli, "config", "resetstat"))
+	assert.Equal(t, replyErr("unknown subcommand or wrong number of arguments for 'config|set'"), execCmd(cli, "config", "set", "maxclients"))
+}
+
+func TestOutputBufferLimitsConfig(t *testing.T) {
+	config := NewGodisConfig()
+	assert.Equal(t, []string{"client-output-buffer-limit", "normal 0 0 0 replica 268435456 67108864 60 pubsub 33554432 8388608 60"},
+		config.Get("client-output-buffer-limit"))
+
+	assert.Nil(t, config.Set("client-output-buffer-limit", "normal 1mb 512kb 10 slave 1 2 3"))
+	assert.Equal(t, OutputBufferLimit{1024 * 1024, 512 * 1024, 10}, config.ClientOutputBufferLimits[ClientClassNormal])
+	assert.Equal(t, OutputBufferLimit{1, 2, 3}, config.ClientOutputBufferLimits[ClientClassReplica])
+	assert.Equal(t, DefaultOutputBufferLimits[ClientClassPubSub], config.ClientOutputBufferLimits[ClientClassPubSub])
+
+	for _, val := range []string{"normal 1 2", "master 1 2 3", "normal 1 2 -1", "normal x 0 0"} {
+		assert.NotNil(t, config.Set("client-output-buffer-limit", val), val)
+	}
+	assert.Equal(t, OutputBufferLimit{1024 * 1024, 512 * 1024, 10}, config.ClientOutputBufferLimits[ClientClassNormal])
+}
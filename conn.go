@@ -0,0 +1,44 @@
+package main
+
+// Conn is the transport of a client, all the methods are non-blocking.
+type Conn interface {
+	// Read returns 0 bytes without error if there is nothing to read, io.EOF if the peer closed the connection.
+	Read(buf []byte) (int, error)
+	// Writev returns the bytes of bufs accepted, 0 bytes without error if the connection is full.
+	Writev(bufs [][]byte) (int, error)
+	// Flush sends the data buffered by the connection as much as possible.
+	Flush() error
+	// Buffered returns the bytes accepted by Writev but not sent yet.
+	Buffered() int
+	// HasPendingData reports whether some input has been read from the socket but not returned by Read,
+	// epoll doesn't report it so it must be read before next epoll wait.
+	HasPendingData() bool
+	Close()
+}
+
+// socketConn is a plain tcp connection.
+type socketConn int
+
+func (c socketConn) Read(buf []byte) (int, error) {
+	return Read(int(c), buf)
+}
+
+func (c socketConn) Writev(bufs [][]byte) (int, error) {
+	return Writev(int(c), bufs)
+}
+
+func (c socketConn) Flush() error {
+	return nil
+}
+
+func (c socketConn) Buffered() int {
+	return 0
+}
+
+func (c socketConn) HasPendingData() bool {
+	return false
+}
+
+func (c socketConn) Close() {
+	Close(int(c))
+}
@@ -1,18 +1,35 @@
 package main
 
 import (
-    "time"
+	"time"
 )
 
 type GodisDB struct {
 	data   *Dict
 	expire *Dict
+
+	hits        int64 // lookups of existing keys
+	misses      int64 // lookups of missing keys
+	expiredKeys int64
+	dirty       int64 // changes since the server started
+	memory      int64 // estimated bytes of the keys, values and expires
+
+	// access tracking and eviction, set from the maxmemory config
+	lfu          bool
+	lfuLogFactor int
+	lfuDecayTime int
+	evictionPool []evictionPoolEntry
+
+	notify func(class int, event string, key *Obj) // the keyspace events receiver, nil if none
 }
 
 func NewGodisDB() *GodisDB {
 	return &GodisDB{
-		data:   NewDict(DictType{HashFunc: StrHash, EqualFunc: StrEqual}),
-		expire: NewDict(DictType{HashFunc: StrHash, EqualFunc: StrEqual}),
+		data:         NewDict(DictType{HashFunc: StrHash, EqualFunc: StrEqual}),
+		expire:       NewDict(DictType{HashFunc: StrHash, EqualFunc: StrEqual}),
+		lfuLogFactor: DefaultLFULogFactor,
+		lfuDecayTime: DefaultLFUDecayTime,
+		evictionPool: make([]evictionPoolEntry, 0, EvictionPoolSize),
 	}
 }
 
@@ -20,11 +37,21 @@ func (db *GodisDB) Lookup(key *Obj) *Obj {
 	db.expireIfNeeded(key)
 	entry := db.data.Lookup(key)
 	if entry != nil {
+		db.hits++
+		db.touch(entry.Val)
 		return entry.Val
 	}
+	db.misses++
+	db.Notify(NotifyKeyMiss, "keymiss", key)
 	return nil
 }
 
+// Exists reports whether key exists, unlike Lookup it isn't counted as an access.
+func (db *GodisDB) Exists(key *Obj) bool {
+	db.expireIfNeeded(key)
+	return db.data.Lookup(key) != nil
+}
+
 func (db *GodisDB) expireIfNeeded(key *Obj) {
 	entry := db.expire.Lookup(key)
 	if entry == nil {
@@ -36,27 +63,104 @@ func (db *GodisDB) expireIfNeeded(key *Obj) {
 		return
 	}
 
-	db.data.Pop(key)
-	db.expire.Pop(key)
+	db.remove(key)
+	db.expiredKeys++
+	db.Notify(NotifyExpired, "expired", key)
 }
 
 func (db *GodisDB) Set(key, val *Obj) {
+	if entry := db.data.Lookup(key); entry != nil {
+		db.memory -= objSize(entry.Val)
+	} else {
+		db.memory += DictEntryOverhead + objSize(key)
+		defer db.Notify(NotifyNew, "new", key)
+	}
+	db.memory += objSize(val)
+	db.initAccess(val)
 	db.data.Insert(key, val)
-	db.expire.Pop(key)
+	db.removeExpire(key)
+	db.dirty++
+}
+
+// Modified records the in place change of val like appending to a stream, oldSize is objSize(val) before the change.
+func (db *GodisDB) Modified(val *Obj, oldSize int64) {
+	db.memory += objSize(val) - oldSize
+	db.dirty++
+}
+
+func (db *GodisDB) Delete(key *Obj) bool {
+	return db.remove(key)
+}
+
+// remove deletes key and its expire, returns false if key doesn't exist.
+func (db *GodisDB) remove(key *Obj) bool {
+	entry := db.data.Lookup(key)
+	if entry != nil {
+		db.memory -= DictEntryOverhead + objSize(entry.Key) + objSize(entry.Val)
+		db.data.Pop(key)
+		db.dirty++
+	}
+	// key may be the one in the expire dict, so pop it at last
+	db.removeExpire(key)
+	return entry != nil
+}
+
+func (db *GodisDB) removeExpire(key *Obj) {
+	if entry := db.expire.Lookup(key); entry != nil {
+		db.memory -= DictEntryOverhead + objSize(entry.Val)
+		db.expire.Pop(key)
+	}
 }
 
 func (db *GodisDB) Expire(key, val *Obj) {
+	if entry := db.expire.Lookup(key); entry != nil {
+		db.memory -= objSize(entry.Val)
+	} else {
+		db.memory += DictEntryOverhead
+	}
+	db.memory += objSize(val)
 	db.expire.Insert(key, val)
+	db.dirty++
+}
+
+// ExpireAt returns the expire time of key in unix ms, -1 if the key has no expire.
+func (db *GodisDB) ExpireAt(key *Obj) int64 {
+	entry := db.expire.Lookup(key)
+	if entry == nil {
+		return -1
+	}
+	return entry.Val.IntVal()
+}
+
+func (db *GodisDB) KeyCount() int64 {
+	return db.data.KeyCount()
+}
+
+func (db *GodisDB) ExpireCount() int64 {
+	return db.expire.KeyCount()
+}
+
+// ResetStats resets the hits, misses and expired keys, dirty is kept.
+func (db *GodisDB) ResetStats() {
+	db.hits, db.misses, db.expiredKeys = 0, 0, 0
 }
 
 func (db *GodisDB) Cron() {
 	keyCount := db.expire.KeyCount()
 	cnt := min(100, keyCount)
+	now := time.Now().UnixMilli()
 	for i := int64(0); i < cnt; i++ {
 		entry := db.expire.RandomGet()
-		if entry.Val.IntVal() < time.Now().Unix() {
-			db.data.Pop(entry.Key)
-			db.expire.Pop(entry.Key)
+		if entry == nil {
+			break
+		}
+		if entry.Val.IntVal() < now {
+			key := entry.Key
+			key.IncrRefCount()
+			db.remove(key)
+			db.expiredKeys++
+			db.Notify(NotifyExpired, "expired", key)
+			key.DecrRefCount()
 		}
 	}
 }
@@ -91,14 +91,17 @@ func (h *HTable) RandomGet() *Entry {
 		return nil
 	}
 
-	var bucketIndexes []int64
-	for i := int64(0); i < h.size; i++ {
-		if h.buckets[i] != nil {
-			bucketIndexes = append(bucketIndexes, i)
+	// probe random buckets, it takes size/used probes on average. The probes are bounded by size
+	// for a sparse table, then the first non-empty bucket from a random start is taken.
+	idx := rand.Int63n(h.size)
+	for probes := int64(1); h.buckets[idx] == nil; probes++ {
+		if probes < h.size {
+			idx = rand.Int63n(h.size)
+		} else {
+			idx = (idx + 1) & h.mask
 		}
 	}
 
-	idx := bucketIndexes[rand.Int63n(int64(len(bucketIndexes)))]
 	var listLen int64
 	for p := h.buckets[idx]; p != nil; p = p.Next {
 		listLen++
@@ -231,7 +234,7 @@ func (d *Dict) Pop(key *Obj) *Entry {
 }
 
 func (d *Dict) RandomGet() *Entry {
-	if d.tab1 == nil {
+	if d.KeyCount() == 0 {
 		return nil
 	}
 
@@ -259,3 +262,17 @@ func (d *Dict) KeyCount() int64 {
 	}
 	return cnt
 }
+
+// ForEach calls fn with every entry, the dict must not be changed by fn.
+func (d *Dict) ForEach(fn func(entry *Entry)) {
+	for _, tab := range []*HTable{d.tab1, d.tab2} {
+		if tab == nil {
+			continue
+		}
+		for _, head := range tab.buckets {
+			for entry := head; entry != nil; entry = entry.Next {
+				fn(entry)
+			}
+		}
+	}
+}
@@ -62,6 +62,11 @@ func TestRehash(t *testing.T) {
 	assert.Equal(t, InitSize, dict.tab2.size)
 	assert.Equal(t, InitSize*2, dict.tab1.size)
 
+	// both tables are iterated while resizing
+	seen := make(map[string]bool)
+	dict.ForEach(func(entry *Entry) { seen[entry.Key.StrVal()] = true })
+	assert.Equal(t, num+1, len(seen))
+
 	for i := 0; i <= int(InitSize); i++ {
 		dict.RandomGet()
 	}
@@ -75,3 +80,13 @@ func TestRehash(t *testing.T) {
 		assert.Equal(t, fmt.Sprintf("v%v", i), entry.Val.StrVal())
 	}
 }
+
+func TestRandomGetSparse(t *testing.T) {
+	// a single entry in a large table is still found once the random probes run out
+	h := NewHTable(1<<16, DictType{HashFunc: StrHash, EqualFunc: StrEqual})
+	key := NewObject(String, "k")
+	h.Insert(key, NewObject(String, "v"))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, key, h.RandomGet().Key)
+	}
+}
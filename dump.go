@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// DUMP payload layout:
+//
+//	| type (1 byte) | value | version (2 bytes LE) | crc64 of the preceding bytes (8 bytes LE) |
+//
+// integers in the value are encoded as uvarint, strings as uvarint length + raw bytes.
+// Version 2 adds the consumer groups of streams, version 3 adds sorted sets.
+const (
+	DumpVersion   uint16 = 3
+	dumpFooterLen int    = 10
+
+	ReplyBusyKey      = "-BUSYKEY Target key name already exists.\r\n"
+	ReplyNoKey        = "+NOKEY\r\n"
+	ReplyDbOutOfRange = "-ERR: DB index is out of range\r\n"
+)
+
+var (
+	ErrDumpPayload = errors.New("DUMP payload version or checksum are wrong")
+	ErrDumpFormat  = errors.New("bad data format")
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+type dumpWriter struct {
+	buf []byte
+}
+
+func (w *dumpWriter) writeUint(u uint64) {
+	w.buf = binary.AppendUvarint(w.buf, u)
+}
+
+func (w *dumpWriter) writeString(s string) {
+	w.writeUint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *dumpWriter) writeObject(val *Obj) {
+	w.buf = append(w.buf, byte(val.Type))
+	switch val.Type {
+	case String:
+		w.writeString(val.StrVal())
+	case Stream:
+		w.writeStream(val.Val.(*StreamLog))
+	case ZSet:
+		w.writeZSet(val.Val.(*SortedSet))
+	}
+}
+
+func (w *dumpWriter) writeStreamID(id StreamID) {
+	w.writeUint(id.ms)
+	w.writeUint(id.seq)
+}
+
+func (w *dumpWriter) writeTime(t time.Time) {
+	if t.IsZero() {
+		w.writeUint(0)
+	} else {
+		w.writeUint(uint64(t.UnixMilli()))
+	}
+}
+
+// writeStream writes the ids of the stream, the entries each of which is the id and the fields,
+// and then the groups with their consumers and pending entries.
+func (w *dumpWriter) writeStream(s *StreamLog) {
+	w.writeStreamID(s.lastId)
+	w.writeStreamID(s.maxDeletedId)
+	w.writeUint(uint64(s.entriesAdded))
+	w.writeUint(uint64(s.length))
+	for _, e := range s.Range(StreamMinID, StreamMaxID, 0, false) {
+		w.writeStreamID(e.id)
+		w.writeUint(uint64(len(e.fields)))
+		for _, f := range e.fields {
+			w.writeString(f)
+		}
+	}
+
+	w.writeUint(uint64(len(s.groups)))
+	for _, name := range sortedKeys(s.groups) {
+		g := s.groups[name]
+		w.writeString(name)
+		w.writeStreamID(g.lastId)
+		w.writeUint(uint64(g.entriesRead + 1)) // -1 if unknown
+		w.writeUint(uint64(len(g.consumers)))
+		for _, cname := range sortedKeys(g.consumers) {
+			c := g.consumers[cname]
+			w.writeString(cname)
+			w.writeTime(c.seenTime)
+			w.writeTime(c.activeTime)
+		}
+		w.writeUint(uint64(len(g.pel)))
+		for _, nack := range g.pel {
+			w.writeStreamID(nack.id)
+			w.writeString(nack.consumer.name)
+			w.writeTime(nack.deliveryTime)
+			w.writeUint(uint64(nack.deliveryCount))
+		}
+	}
+}
+
+// writeZSet writes the members in order, each of which is the member and the bits of the score.
+func (w *dumpWriter) writeZSet(z *SortedSet) {
+	w.writeUint(uint64(z.Len()))
+	z.RangeByScore(math.Inf(-1), math.Inf(1), func(member string, score float64) bool {
+		w.writeString(member)
+		w.writeUint(math.Float64bits(score))
+		return true
+	})
+}
+
+type dumpReader struct {
+	buf     []byte
+	err     error
+	version uint16 // the version of the payload
+}
+
+func (r *dumpReader) readUint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	u, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = ErrDumpFormat
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return u
+}
+
+func (r *dumpReader) readString() string {
+	n := r.readUint()
+	if r.err != nil {
+		return ""
+	}
+	if uint64(len(r.buf)) < n {
+		r.err = ErrDumpFormat
+		return ""
+	}
+	s := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return s
+}
+
+func (r *dumpReader) readObject() (*Obj, error) {
+	if len(r.buf) == 0 {
+		return nil, ErrDumpFormat
+	}
+	typ := ObjType(r.buf[0])
+	r.buf = r.buf[1:]
+
+	var val *Obj
+	switch typ {
+	case String:
+		val = NewObject(String, r.readString())
+	case Stream:
+		s := r.readStream()
+		if s == nil {
+			return nil, ErrDumpFormat
+		}
+		val = NewObject(Stream, s)
+	case ZSet:
+		z := r.readZSet()
+		if z == nil {
+			return nil, ErrDumpFormat
+		}
+		val = NewObject(ZSet, z)
+	default:
+		return nil, ErrDumpFormat
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return val, nil
+}
+
+func (r *dumpReader) readStreamID() StreamID {
+	return StreamID{r.readUint(), r.readUint()}
+}
+
+// readStream reads the stream written by writeStream, returns nil if the entries are malformed.
+func (r *dumpReader) readStream() *StreamLog {
+	s := NewStreamLog()
+	lastId, maxDeletedId := r.readStreamID(), r.readStreamID()
+	entriesAdded, length := r.readUint(), r.readUint()
+	for i := uint64(0); i < length && r.err == nil; i++ {
+		id := r.readStreamID()
+		n := r.readUint()
+		if s.length > 0 && !s.lastId.Less(id) || n == 0 || n%2 != 0 || n > uint64(len(r.buf)) {
+			return nil
+		}
+		fields := make([]string, n)
+		for j := range fields {
+			fields[j] = r.readString()
+		}
+		s.Add(id, fields, DefaultStreamNodeMaxEntries)
+	}
+	if r.err != nil || lastId.Less(s.lastId) {
+		return nil
+	}
+	s.lastId, s.maxDeletedId, s.entriesAdded = lastId, maxDeletedId, int64(entriesAdded)
+	if r.version >= 2 && !r.readGroups(s) {
+		return nil
+	}
+	return s
+}
+
+func (r *dumpReader) readTime() time.Time {
+	if ms := r.readUint(); ms > 0 {
+		return time.UnixMilli(int64(ms))
+	}
+	return time.Time{}
+}
+
+// readGroups reads the groups written by writeStream, returns false if they are malformed.
+func (r *dumpReader) readGroups(s *StreamLog) bool {
+	groups := r.readUint()
+	for i := uint64(0); i < groups && r.err == nil; i++ {
+		g := s.CreateGroup(r.readString(), r.readStreamID(), int64(r.readUint())-1)
+		if g == nil {
+			return false
+		}
+		consumers := r.readUint()
+		for j := uint64(0); j < consumers && r.err == nil; j++ {
+			c, created := g.Consumer(r.readString())
+			if !created {
+				return false
+			}
+			c.seenTime, c.activeTime = r.readTime(), r.readTime()
+		}
+		pending := r.readUint()
+		for j := uint64(0); j < pending && r.err == nil; j++ {
+			id := r.readStreamID()
+			c := g.consumers[r.readString()]
+			if c == nil || len(g.pel) > 0 && !g.pel[len(g.pel)-1].id.Less(id) {
+				return false
+			}
+			nack := g.addPending(id, c)
+			nack.deliveryTime, nack.deliveryCount = r.readTime(), int64(r.readUint())
+		}
+	}
+	return r.err == nil
+}
+
+// readZSet reads the sorted set written by writeZSet, returns nil if the members are malformed.
+func (r *dumpReader) readZSet() *SortedSet {
+	z := NewSortedSet()
+	n := r.readUint()
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		member := r.readString()
+		score := math.Float64frombits(r.readUint())
+		if math.IsNaN(score) || !z.Add(member, score) {
+			return nil
+		}
+	}
+	return z
+}
+
+// DumpObject serializes val into a self-contained payload which can be restored by RestoreObject.
+func DumpObject(val *Obj) []byte {
+	w := &dumpWriter{}
+	w.writeObject(val)
+	w.buf = binary.LittleEndian.AppendUint16(w.buf, DumpVersion)
+	return binary.LittleEndian.AppendUint64(w.buf, crc64.Checksum(w.buf, crcTable))
+}
+
+func verifyDumpPayload(payload []byte) error {
+	if len(payload) < dumpFooterLen {
+		return ErrDumpPayload
+	}
+
+	footer := payload[len(payload)-dumpFooterLen:]
+	version := binary.LittleEndian.Uint16(footer)
+	if version > DumpVersion {
+		return ErrDumpPayload
+	}
+
+	crc := binary.LittleEndian.Uint64(footer[2:])
+	if crc64.Checksum(payload[:len(payload)-8], crcTable) != crc {
+		return ErrDumpPayload
+	}
+	return nil
+}
+
+func RestoreObject(payload []byte) (*Obj, error) {
+	if err := verifyDumpPayload(payload); err != nil {
+		return nil, err
+	}
+
+	footer := payload[len(payload)-dumpFooterLen:]
+	r := &dumpReader{buf: payload[:len(payload)-dumpFooterLen], version: binary.LittleEndian.Uint16(footer)}
+	val, err := r.readObject()
+	if err != nil {
+		return nil, err
+	}
+	if len(r.buf) != 0 {
+		return nil, ErrDumpFormat
+	}
+	return val, nil
+}
+
+func dumpCmd(cli *GodisClient) string {
+	val := cli.db.Lookup(cli.args[1])
+	if val == nil {
+		return ReplyNil
+	}
+	return replyBulk(string(DumpObject(val)))
+}
+
+// restore key ttl payload [REPLACE] [ABSTTL]
+func restoreCmd(cli *GodisClient) string {
+	args, db := cli.args, cli.db
+	key := args[1]
+	var replace, absTTL bool
+	for _, arg := range args[4:] {
+		switch strings.ToLower(arg.StrVal()) {
+		case "replace":
+			replace = true
+		case "absttl":
+			absTTL = true
+		default:
+			return ReplySyntaxErr
+		}
+	}
+
+	ttl, err := strconv.ParseInt(args[2].StrVal(), 10, 64)
+	if err != nil {
+		return ReplyNotInteger
+	}
+	if ttl < 0 {
+		return replyErr("invalid TTL value, must be >= 0")
+	}
+
+	if !replace && db.Lookup(key) != nil {
+		return ReplyBusyKey
+	}
+
+	val, err := RestoreObject([]byte(args[3].StrVal()))
+	if err != nil {
+		return replyErr(err.Error())
+	}
+	defer val.DecrRefCount()
+
+	now := time.Now().UnixMilli()
+	if ttl > 0 && !absTTL {
+		ttl += now
+	}
+	if ttl > 0 && ttl <= now {
+		// the key would be expired immediately
+		if db.Delete(key) {
+			db.Notify(NotifyGeneric, "del", key)
+		}
+		return ReplyOK
+	}
+
+	db.Set(key, val)
+	if ttl > 0 {
+		expObj := NewObjectInt(ttl)
+		db.Expire(key, expObj)
+		expObj.DecrRefCount()
+	}
+	db.Notify(NotifyGeneric, "restore", key)
+	return ReplyOK
+}
+
+// appendCommand encodes a command as RESP multi bulk.
+func appendCommand(buf []byte, parts ...string) []byte {
+	buf = append(buf, fmt.Sprintf("*%d\r\n", len(parts))...)
+	for _, part := range parts {
+		buf = append(buf, replyBulk(part)...)
+	}
+	return buf
+}
+
+// migrateKeys returns the positions of the keys of MIGRATE, either the key or the ones after KEYS.
+func migrateKeys(args []*Obj) []int {
+	for i := 6; i < len(args); i++ {
+		if strings.EqualFold(args[i].StrVal(), "keys") {
+			return keyRange(i+1, -1, 1)(args)
+		}
+	}
+	return []int{3}
+}
+
+// migrate host port key|"" destination-db timeout [COPY] [REPLACE] [KEYS key [key ...]]
+func migrateCmd(cli *GodisClient) string {
+	args, db := cli.args, cli.db
+	port, err := strconv.Atoi(args[2].StrVal())
+	if err != nil {
+		return ReplyNotInteger
+	}
+	destDb, err := strconv.Atoi(args[4].StrVal())
+	if err != nil {
+		return ReplyNotInteger
+	}
+	// there is only db 0 and no SELECT
+	if destDb != 0 {
+		return ReplyDbOutOfRange
+	}
+	timeout, err := strconv.ParseInt(args[5].StrVal(), 10, 64)
+	if err != nil {
+		return ReplyNotInteger
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+
+	var copyKeys, replace bool
+	keys := args[3:4]
+	for i := 6; i < len(args); i++ {
+		switch strings.ToLower(args[i].StrVal()) {
+		case "copy":
+			copyKeys = true
+		case "replace":
+			replace = true
+		case "keys":
+			if args[3].StrVal() != "" {
+				return replyErr("when using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			keys = args[i+1:]
+			i = len(args)
+		default:
+			return ReplySyntaxErr
+		}
+	}
+
+	var buf []byte
+	var sent []*Obj
+	now := time.Now().UnixMilli()
+	for _, key := range keys {
+		val := db.Lookup(key)
+		if val == nil {
+			continue
+		}
+
+		ttl := int64(0)
+		if when := db.ExpireAt(key); when != -1 {
+			ttl = max(when-now, 1)
+		}
+
+		// the target serves a key of the slot being migrated only with RESTORE-ASKING
+		restore := GodisCmdRestore
+		if cli.srv.SlotMigrations().Migrating(KeyHashSlot(key.StrVal())) != "" {
+			restore = GodisCmdRestoreAsking
+		}
+		parts := []string{restore, key.StrVal(), strconv.FormatInt(ttl, 10), string(DumpObject(val))}
+		if replace {
+			parts = append(parts, "replace")
+		}
+		buf = appendCommand(buf, parts...)
+		sent = append(sent, key)
+	}
+	if len(sent) == 0 {
+		return ReplyNoKey
+	}
+
+	replies, err := migrateSend(args[1].StrVal(), port, timeout, buf, len(sent))
+	if err != nil {
+		return replyErr(fmt.Sprintf("IOERR error or timeout migrating to target instance: %v", err))
+	}
+
+	// only the keys acknowledged by the target are removed from the source
+	var errMsg string
+	for i, reply := range replies {
+		if strings.HasPrefix(reply, "-") {
+			errMsg = reply[1:]
+			continue
+		}
+		if !copyKeys && db.Delete(sent[i]) {
+			db.Notify(NotifyGeneric, "del", sent[i])
+		}
+	}
+	if errMsg != "" {
+		return replyErr("Target instance replied with error: " + errMsg)
+	}
+	return ReplyOK
+}
+
+// migrateSend writes the pipelined commands to the target instance and waits for n single line replies.
+func migrateSend(host string, port int, timeout int64, buf []byte, n int) ([]string, error) {
+	addr, err := ResolveHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := ConnectTimeout(addr, port, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer Close(fd)
+
+	// the socket is non-blocking, so the whole exchange is bounded by a single deadline
+	deadline := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	for len(buf) > 0 {
+		m, err := Write(fd, buf)
+		if err != nil {
+			return nil, err
+		}
+		if m == 0 {
+			if err = WaitFd(fd, unix.POLLOUT, deadline); err != nil {
+				return nil, fmt.Errorf("write %v", err)
+			}
+		}
+		buf = buf[m:]
+	}
+
+	var resp []byte
+	rbuf := make([]byte, GodisIOBuffer)
+	for bytes.Count(resp, []byte("\r\n")) < n {
+		m, err := Read(fd, rbuf)
+		if err != nil {
+			return nil, err
+		}
+		if m == 0 {
+			if err = WaitFd(fd, unix.POLLIN, deadline); err != nil {
+				return nil, fmt.Errorf("read %v", err)
+			}
+		}
+		resp = append(resp, rbuf[:m]...)
+	}
+	return strings.SplitN(string(resp), "\r\n", n+1)[:n], nil
+}
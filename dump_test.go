@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpRestoreObject(t *testing.T) {
+	val := NewObject(String, "hello\r\nworld")
+	payload := DumpObject(val)
+
+	restored, err := RestoreObject(payload)
+	assert.Nil(t, err)
+	assert.Equal(t, String, restored.Type)
+	assert.Equal(t, "hello\r\nworld", restored.StrVal())
+
+	payload[1] ^= 0xff
+	_, err = RestoreObject(payload)
+	assert.Equal(t, ErrDumpPayload, err)
+
+	_, err = RestoreObject([]byte("short"))
+	assert.Equal(t, ErrDumpPayload, err)
+}
+
+func TestRestoreCmd(t *testing.T) {
+	db := NewGodisDB()
+	cli := NewGodisClient(0, db, &MockIGodisServer{})
+	key := NewObject(String, "key")
+	payload := string(DumpObject(NewObject(String, "val")))
+
+	reply := execCmd(cli, "restore", "key", "0", payload)
+	assert.Equal(t, ReplyOK, reply)
+	assert.Equal(t, "val", db.Lookup(key).StrVal())
+	assert.Equal(t, int64(-1), db.ExpireAt(key))
+
+	reply = execCmd(cli, "restore", "key", "0", payload)
+	assert.Equal(t, ReplyBusyKey, reply)
+
+	reply = execCmd(cli, "restore", "key", "10000", payload, "REPLACE")
+	assert.Equal(t, ReplyOK, reply)
+	assert.Greater(t, db.ExpireAt(key), time.Now().UnixMilli())
+
+	reply = execCmd(cli, "restore", "key", "1000", payload, "replace", "absttl")
+	assert.Equal(t, ReplyOK, reply)
+	assert.Nil(t, db.Lookup(key))
+
+	reply = execCmd(cli, "restore", "key", "0", "bad payload")
+	assert.Equal(t, replyErr(ErrDumpPayload.Error()), reply)
+
+	reply = execCmd(cli, "dump", "key")
+	assert.Equal(t, ReplyNil, reply)
+	db.Set(key, NewObject(String, "val"))
+	reply = execCmd(cli, "dump", "key")
+	assert.Equal(t, replyBulk(payload), reply)
+}
+
+func TestMigrateCmd(t *testing.T) {
+	port := 6680
+	target := newTestServer(t, port)
+	// the slot is only served after ASKING by the target
+	target.slots.SetImporting(KeyHashSlot("{mig}k"), "127.0.0.1:6379")
+	startServer(t, target)
+
+	db := NewGodisDB()
+	cli := NewGodisClient(0, db, &MockIGodisServer{})
+	db.Set(NewObject(String, "k1"), NewObject(String, "v1"))
+	db.Set(NewObject(String, "k2"), NewObject(String, "v2"))
+	db.Set(NewObject(String, "k3"), NewObject(String, "v3"))
+
+	reply := execCmd(cli, "migrate", "127.0.0.1", "6680", "k1", "0", "1000")
+	assert.Equal(t, ReplyOK, reply)
+	assert.Nil(t, db.Lookup(NewObject(String, "k1")))
+
+	reply = execCmd(cli, "migrate", "127.0.0.1", "6680", "", "0", "1000", "COPY", "KEYS", "k2", "k3", "nokey")
+	assert.Equal(t, ReplyOK, reply)
+	assert.Equal(t, "v2", db.Lookup(NewObject(String, "k2")).StrVal())
+
+	reply = execCmd(cli, "migrate", "127.0.0.1", "6680", "k2", "0", "1000")
+	assert.Equal(t, replyErr("Target instance replied with error: BUSYKEY Target key name already exists."), reply)
+	assert.NotNil(t, db.Lookup(NewObject(String, "k2")))
+
+	reply = execCmd(cli, "migrate", "127.0.0.1", "6680", "k2", "0", "1000", "replace")
+	assert.Equal(t, ReplyOK, reply)
+	assert.Nil(t, db.Lookup(NewObject(String, "k2")))
+
+	reply = execCmd(cli, "migrate", "127.0.0.1", "6680", "nokey", "0", "1000")
+	assert.Equal(t, ReplyNoKey, reply)
+
+	// there is no other db to select on the target
+	reply = execCmd(cli, "migrate", "127.0.0.1", "6680", "k3", "1", "1000")
+	assert.Equal(t, ReplyDbOutOfRange, reply)
+	assert.NotNil(t, db.Lookup(NewObject(String, "k3")))
+
+	// the keys of a migrating slot are sent with RESTORE-ASKING
+	cli.srv.SlotMigrations().SetMigrating(KeyHashSlot("{mig}k"), "127.0.0.1:6680")
+	db.Set(NewObject(String, "{mig}k"), NewObject(String, "vmig"))
+	reply = execCmd(cli, "migrate", "127.0.0.1", "6680", "{mig}k", "0", "1000")
+	assert.Equal(t, ReplyOK, reply)
+	assert.Equal(t, "vmig", target.db.Lookup(NewObject(String, "{mig}k")).StrVal())
+
+	for _, key := range []string{"k1", "k2", "k3"} {
+		assert.Equal(t, "v"+key[1:], target.db.Lookup(NewObject(String, key)).StrVal())
+	}
+	stopServer(target)
+}
+
+func TestMigrateTimeout(t *testing.T) {
+	db := NewGodisDB()
+	cli := NewGodisClient(0, db, &MockIGodisServer{})
+	db.Set(NewObject(String, "k1"), NewObject(String, "v1"))
+
+	// nobody listens on the port
+	port := freePort(t)
+	reply := execCmd(cli, "migrate", "127.0.0.1", strconv.Itoa(port), "k1", "0", "100")
+	assert.Contains(t, reply, "IOERR")
+
+	// the target accepts the connection but never replies
+	sfd, err := TcpServer(port)
+	assert.Nil(t, err)
+	defer Close(sfd)
+	start := time.Now()
+	reply = execCmd(cli, "migrate", "127.0.0.1", strconv.Itoa(port), "k1", "0", "100")
+	assert.Contains(t, reply, "IOERR")
+	assert.Less(t, time.Since(start), time.Second)
+	assert.NotNil(t, db.Lookup(NewObject(String, "k1")))
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"container/heap"
 	"fmt"
-	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -30,15 +32,27 @@ const (
 	TE_ONCE
 )
 
+// DefaultEpollBatch is the default max number of events returned by one epoll wait.
+const DefaultEpollBatch = 128
+
 type FileProc func(lp *EventLoop, fd int, arg any)
 type TimeProc func(lp *EventLoop, id int, arg any)
 
+// LatencyProc receives the latency of a class of events of the loop.
+type LatencyProc func(event string, latency time.Duration)
+
+// the event classes reported to the LatencyProc
+const (
+	LatencyEventLoop      = "event-loop"      // the events and beforeSleep of an iteration
+	LatencyEpollOvershoot = "epoll-overshoot" // epoll wait returned later than its timeout
+	LatencyTimeEvents     = "time-events"
+)
+
 type FileEvent struct {
 	fd   int
 	mask FeType
 	proc FileProc
 	arg  any
-	next *FileEvent
 }
 
 type TimeEvent struct {
@@ -48,15 +62,53 @@ type TimeEvent struct {
 	interval int64 // ms
 	proc     TimeProc
 	arg      any
-	next     *TimeEvent
+	index    int // index in the time heap, -1 if not in the heap
+}
+
+// timeHeap is a min-heap of time events ordered by when.
+type timeHeap []*TimeEvent
+
+func (h timeHeap) Len() int           { return len(h) }
+func (h timeHeap) Less(i, j int) bool { return h[i].when < h[j].when }
+
+func (h timeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timeHeap) Push(x any) {
+	te := x.(*TimeEvent)
+	te.index = len(*h)
+	*h = append(*h, te)
+}
+
+func (h *timeHeap) Pop() any {
+	old := *h
+	n := len(old)
+	te := old[n-1]
+	old[n-1] = nil
+	te.index = -1
+	*h = old[:n-1]
+	return te
 }
 
 type EventLoop struct {
-	FileEvents *FileEvent
-	TimeEvents *TimeEvent
-	fd         int
-	nextId     int
-	stop       bool
+	fileEvents  [][2]*FileEvent // indexed by fd and mask
+	timeEvents  timeHeap
+	timeIndex   map[int]*TimeEvent // indexed by id
+	events      []unix.EpollEvent
+	fd          int
+	nextId      int
+	stop        atomic.Bool
+	beforeSleep func(lp *EventLoop)
+	latencyProc LatencyProc
+
+	// procs posted by other goroutines, the eventfd wakes up the epoll wait
+	wakeFd int
+	postMu sync.Mutex
+	posted []func()
+	closed bool // the eventfd is closed, guarded by postMu
 }
 
 func NewEventLoop() (*EventLoop, error) {
@@ -65,33 +117,83 @@ func NewEventLoop() (*EventLoop, error) {
 		return nil, fmt.Errorf("create epoll fd failed: %v", err)
 	}
 
-	return &EventLoop{
-		fd:     epollFd,
-		nextId: 1,
-	}, nil
+	wakeFd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		unix.Close(epollFd)
+		return nil, fmt.Errorf("create eventfd failed: %v", err)
+	}
+
+	lp := &EventLoop{
+		timeIndex: make(map[int]*TimeEvent),
+		events:    make([]unix.EpollEvent, DefaultEpollBatch),
+		fd:        epollFd,
+		nextId:    1,
+		wakeFd:    wakeFd,
+	}
+	lp.AddFileEvent(wakeFd, FE_READABLE, lp.runPosted, nil)
+	return lp, nil
+}
+
+// Post wakes up the loop to run proc in its goroutine, it's safe to call from other goroutines.
+// It returns false and drops proc if the loop is closed.
+func (lp *EventLoop) Post(proc func()) bool {
+	lp.postMu.Lock()
+	defer lp.postMu.Unlock()
+	if lp.closed {
+		return false
+	}
+	lp.posted = append(lp.posted, proc)
+
+	// any non-zero counter makes the eventfd readable
+	var buf [8]byte
+	buf[0] = 1
+	unix.Write(lp.wakeFd, buf[:])
+	return true
+}
+
+func (lp *EventLoop) runPosted(_ *EventLoop, fd int, _ any) {
+	var buf [8]byte
+	unix.Read(fd, buf[:])
+
+	lp.postMu.Lock()
+	procs := lp.posted
+	lp.posted = nil
+	lp.postMu.Unlock()
+	for _, proc := range procs {
+		proc()
+	}
+}
+
+// Close closes the epoll fd and the eventfd, the loop can't be used anymore.
+func (lp *EventLoop) Close() {
+	unix.Close(lp.fd)
+	// the eventfd may be reused once closed, so no more procs are posted to it
+	lp.postMu.Lock()
+	lp.closed = true
+	unix.Close(lp.wakeFd)
+	lp.postMu.Unlock()
+}
+
+// SetEpollBatch sets the max number of events returned by one epoll wait.
+func (lp *EventLoop) SetEpollBatch(n int) {
+	if n > 0 {
+		lp.events = make([]unix.EpollEvent, n)
+	}
 }
 
 func (lp *EventLoop) nearestTime() int64 {
 	nearest := time.Now().UnixMilli() + 1000
-	p := lp.TimeEvents
-	for p != nil {
-		if p.when != 0 && p.when < nearest {
-			nearest = p.when
-		}
-		p = p.next
+	if len(lp.timeEvents) > 0 && lp.timeEvents[0].when < nearest {
+		nearest = lp.timeEvents[0].when
 	}
 	return nearest
 }
 
 func (lp *EventLoop) searchFileEvent(fd int, mask FeType) *FileEvent {
-	p := lp.FileEvents
-	for p != nil {
-		if p.fd == fd && p.mask == mask {
-			return p
-		}
-		p = p.next
+	if fd < 0 || fd >= len(lp.fileEvents) {
+		return nil
 	}
-	return nil
+	return lp.fileEvents[fd][mask]
 }
 
 func (lp *EventLoop) getRegisteredEpollEvent(fd int) uint32 {
@@ -121,22 +223,27 @@ func (lp *EventLoop) AddFileEvent(fd int, mask FeType, proc FileProc, arg any) {
 	epollEvent |= mask.ToEpollEvent()
 	err := unix.EpollCtl(lp.fd, op, fd, &unix.EpollEvent{Fd: int32(fd), Events: epollEvent})
 	if err != nil {
-		log.Println("epoll ctl failed: ", err)
+		logWarning("epoll ctl failed: %v", err)
 		return
 	}
 
-	fe := &FileEvent{
+	if fd >= len(lp.fileEvents) {
+		lp.fileEvents = append(lp.fileEvents, make([][2]*FileEvent, fd+1-len(lp.fileEvents))...)
+	}
+	lp.fileEvents[fd][mask] = &FileEvent{
 		fd:   fd,
 		mask: mask,
 		proc: proc,
 		arg:  arg,
-		next: lp.FileEvents,
 	}
-	lp.FileEvents = fe
-	log.Printf("add file event, fd = %v, mask = %v", fd, mask)
+	logDebug("add file event, fd = %v, mask = %v", fd, mask)
 }
 
 func (lp *EventLoop) RemoveFileEvent(fd int, mask FeType) {
+	if lp.searchFileEvent(fd, mask) == nil {
+		return
+	}
+
 	op := unix.EPOLL_CTL_DEL
 	epollEvent := lp.getRegisteredEpollEvent(fd)
 	epollEvent &= ^mask.ToEpollEvent()
@@ -146,21 +253,9 @@ func (lp *EventLoop) RemoveFileEvent(fd int, mask FeType) {
 
 	err := unix.EpollCtl(lp.fd, op, fd, &unix.EpollEvent{Fd: int32(fd), Events: epollEvent})
 	if err != nil {
-		log.Println("epoll del failed:", err)
-	}
-
-	var prev, curr *FileEvent = nil, lp.FileEvents
-	for curr != nil && (curr.fd != fd || curr.mask != mask) {
-		prev, curr = curr, curr.next
-	}
-
-	if curr != nil {
-		if prev == nil {
-			lp.FileEvents = curr.next
-		} else {
-			prev.next = curr.next
-		}
+		logWarning("epoll del failed: %v", err)
 	}
+	lp.fileEvents[fd][mask] = nil
 }
 
 func (lp *EventLoop) AddTimeEvent(mask TeType, interval int64, proc TimeProc, extra any) int {
@@ -171,27 +266,23 @@ func (lp *EventLoop) AddTimeEvent(mask TeType, interval int64, proc TimeProc, ex
 		interval: interval,
 		proc:     proc,
 		arg:      extra,
-		next:     lp.TimeEvents,
 	}
-	lp.TimeEvents = te
+	heap.Push(&lp.timeEvents, te)
+	lp.timeIndex[te.id] = te
 	lp.nextId++
-	log.Printf("add time event, id = %v, mask = %v\n", te.id, mask)
+	logDebug("add time event, id = %v, mask = %v\n", te.id, mask)
 	return te.id
 }
 
 func (lp *EventLoop) RemoveTimeEvent(id int) {
-	curr := lp.TimeEvents
-	var prev *TimeEvent
-	for curr != nil && curr.id != id {
-		prev, curr = curr, curr.next
+	te := lp.timeIndex[id]
+	if te == nil {
+		return
 	}
 
-	if curr != nil {
-		if prev == nil {
-			lp.TimeEvents = curr.next
-		} else {
-			prev.next = curr.next
-		}
+	delete(lp.timeIndex, id)
+	if te.index >= 0 {
+		heap.Remove(&lp.timeEvents, te.index)
 	}
 }
 
@@ -201,11 +292,19 @@ func (lp *EventLoop) WaitEvents() (fileEvents []*FileEvent, timeEvents []*TimeEv
 		timeout = 10
 	}
 
-	var events [128]unix.EpollEvent
+	events := lp.events
 	// log.Printf("start to epoll wait, timeout = %v\n", timeout)
-	n, err := unix.EpollWait(lp.fd, events[:], int(timeout))
+	start := time.Now()
+	n, err := unix.EpollWait(lp.fd, events, int(timeout))
+	if err == unix.EINTR {
+		// interrupted by a signal like the preemption of the go runtime, just wait again
+		return nil, nil
+	}
 	if err != nil {
-		log.Printf("epoll wait warnning: %v\n", err)
+		logWarning("epoll wait failed: %v", err)
+	}
+	if overshoot := time.Since(start) - time.Duration(timeout)*time.Millisecond; overshoot > 0 {
+		lp.reportLatency(LatencyEpollOvershoot, overshoot)
 	}
 
 	for i := 0; i < n; i++ {
@@ -223,13 +322,10 @@ func (lp *EventLoop) WaitEvents() (fileEvents []*FileEvent, timeEvents []*TimeEv
 		}
 	}
 
+	// due time events are popped from the heap, and pushed back by ProcessEvents if periodic
 	now := time.Now().UnixMilli()
-	p := lp.TimeEvents
-	for p != nil {
-		if p.when < now {
-			timeEvents = append(timeEvents, p)
-		}
-		p = p.next
+	for len(lp.timeEvents) > 0 && lp.timeEvents[0].when < now {
+		timeEvents = append(timeEvents, heap.Pop(&lp.timeEvents).(*TimeEvent))
 	}
 
 	// log.Printf("finished collect events, file events = %v, time events = %v", len(fileEvents), len(timeEvents))
@@ -237,23 +333,63 @@ func (lp *EventLoop) WaitEvents() (fileEvents []*FileEvent, timeEvents []*TimeEv
 }
 
 func (lp *EventLoop) ProcessEvents(fileEvents []*FileEvent, timeEvents []*TimeEvent) {
+	start := time.Now()
 	for _, event := range timeEvents {
 		event.proc(lp, event.id, event.arg)
 		if event.mask == TE_ONCE {
 			lp.RemoveTimeEvent(event.id)
-		} else {
+		} else if lp.timeIndex[event.id] == event {
 			event.when = time.Now().UnixMilli() + event.interval
+			heap.Push(&lp.timeEvents, event)
 		}
 	}
+	if len(timeEvents) > 0 {
+		lp.reportLatency(LatencyTimeEvents, time.Since(start))
+	}
 
 	for _, event := range fileEvents {
+		// the event may be removed by a previous proc
+		if lp.searchFileEvent(event.fd, event.mask) != event {
+			continue
+		}
 		event.proc(lp, event.fd, event.arg)
 	}
 }
 
+// SetBeforeSleep sets the proc called before each epoll wait.
+func (lp *EventLoop) SetBeforeSleep(proc func(lp *EventLoop)) {
+	lp.beforeSleep = proc
+}
+
+// SetLatencyProc sets the proc receiving the latency of the loop.
+func (lp *EventLoop) SetLatencyProc(proc LatencyProc) {
+	lp.latencyProc = proc
+}
+
+func (lp *EventLoop) reportLatency(event string, latency time.Duration) {
+	if lp.latencyProc != nil {
+		lp.latencyProc(event, latency)
+	}
+}
+
+// Stop makes Run return after the current iteration, it's safe to call from other goroutines.
+func (lp *EventLoop) Stop() {
+	lp.stop.Store(true)
+}
+
 func (lp *EventLoop) Run() {
-	for !lp.stop {
+	// the busy time of an iteration is the events processed plus the following beforeSleep
+	var busy time.Duration
+	for !lp.stop.Load() {
+		start := time.Now()
+		if lp.beforeSleep != nil {
+			lp.beforeSleep(lp)
+		}
+		lp.reportLatency(LatencyEventLoop, busy+time.Since(start))
+
 		fileEvents, timeEvents := lp.WaitEvents()
+		start = time.Now()
 		lp.ProcessEvents(fileEvents, timeEvents)
+		busy = time.Since(start)
 	}
 }
@@ -2,8 +2,10 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 )
 
 func WriteProc(lp *EventLoop, fd int, arg any) {
@@ -51,6 +53,10 @@ func TestEventLoop(t *testing.T) {
 	assert.Nil(t, err)
 
 	loop.AddFileEvent(sfd, FE_READABLE, AcceptProc, nil)
+	// the events are added before the loop runs, since the loop is only touched on its own goroutine
+	loop.AddTimeEvent(TE_ONCE, 10, OnceProc, t)
+	end := make(chan struct{}, 2)
+	loop.AddTimeEvent(TE_PERIODIC, 10, NormalProc, end)
 	go loop.Run()
 
 	host := [4]byte{0, 0, 0, 0}
@@ -67,10 +73,99 @@ func TestEventLoop(t *testing.T) {
 	assert.Equal(t, 10, n)
 	assert.Equal(t, msg, string(buf))
 
-	loop.AddTimeEvent(TE_ONCE, 10, OnceProc, t)
-	end := make(chan struct{}, 2)
-	loop.AddTimeEvent(TE_PERIODIC, 10, NormalProc, end)
 	<-end
 	<-end
-	loop.stop = true
+	loop.Stop()
+}
+
+func TestFileEventTable(t *testing.T) {
+	loop, err := NewEventLoop()
+	assert.Nil(t, err)
+
+	var fds [2]int
+	assert.Nil(t, unix.Pipe(fds[:]))
+	r, w := fds[0], fds[1]
+
+	loop.AddFileEvent(r, FE_READABLE, ReadProc, nil)
+	loop.AddFileEvent(w, FE_WRITABLE, WriteProc, nil)
+	assert.NotNil(t, loop.searchFileEvent(r, FE_READABLE))
+	assert.Nil(t, loop.searchFileEvent(r, FE_WRITABLE))
+	assert.Equal(t, uint32(unix.EPOLLOUT), loop.getRegisteredEpollEvent(w))
+	assert.Nil(t, loop.searchFileEvent(w+100, FE_READABLE))
+
+	loop.RemoveFileEvent(w, FE_WRITABLE)
+	assert.Nil(t, loop.searchFileEvent(w, FE_WRITABLE))
+	assert.Equal(t, uint32(0), loop.getRegisteredEpollEvent(w))
+	Close(r)
+	Close(w)
+}
+
+func TestTimeEventHeap(t *testing.T) {
+	loop, err := NewEventLoop()
+	assert.Nil(t, err)
+
+	var fired []int
+	proc := func(lp *EventLoop, id int, _ any) {
+		fired = append(fired, id)
+	}
+
+	id1 := loop.AddTimeEvent(TE_ONCE, 30, proc, nil)
+	id2 := loop.AddTimeEvent(TE_ONCE, 10, proc, nil)
+	id3 := loop.AddTimeEvent(TE_ONCE, 20, proc, nil)
+	id4 := loop.AddTimeEvent(TE_PERIODIC, 15, proc, nil)
+	assert.Equal(t, loop.timeIndex[id2].when, loop.nearestTime())
+
+	loop.RemoveTimeEvent(id3)
+	assert.Equal(t, 3, len(loop.timeEvents))
+
+	time.Sleep(50 * time.Millisecond)
+	loop.ProcessEvents(loop.WaitEvents())
+	assert.Equal(t, []int{id2, id4, id1}, fired)
+	assert.Equal(t, 1, len(loop.timeEvents))
+	assert.Equal(t, id4, loop.timeEvents[0].id)
+}
+
+func TestPost(t *testing.T) {
+	loop, err := NewEventLoop()
+	assert.Nil(t, err)
+	go loop.Run()
+
+	done := make(chan int)
+	for i := 0; i < 3; i++ {
+		i := i
+		go loop.Post(func() { done <- i })
+	}
+	var got []int
+	for i := 0; i < 3; i++ {
+		select {
+		case n := <-done:
+			got = append(got, n)
+		case <-time.After(time.Second):
+			t.Fatal("posted proc not run")
+		}
+	}
+	assert.ElementsMatch(t, []int{0, 1, 2}, got)
+	loop.Stop()
+
+	// the procs posted to a closed loop are dropped
+	closed, err := NewEventLoop()
+	assert.Nil(t, err)
+	closed.Close()
+	assert.False(t, closed.Post(func() { t.Fatal("posted proc run after close") }))
+}
+
+func TestLatencyProc(t *testing.T) {
+	loop, err := NewEventLoop()
+	assert.Nil(t, err)
+
+	latency := make(map[string]time.Duration)
+	loop.SetLatencyProc(func(event string, d time.Duration) {
+		latency[event] = max(latency[event], d)
+	})
+	loop.AddTimeEvent(TE_ONCE, 0, func(lp *EventLoop, id int, _ any) {
+		time.Sleep(20 * time.Millisecond)
+	}, nil)
+	time.Sleep(time.Millisecond)
+	loop.ProcessEvents(loop.WaitEvents())
+	assert.GreaterOrEqual(t, latency[LatencyTimeEvents], 20*time.Millisecond)
 }
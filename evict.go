@@ -0,0 +1,236 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	PolicyNoEviction     = "noeviction"
+	PolicyAllKeysLRU     = "allkeys-lru"
+	PolicyAllKeysLFU     = "allkeys-lfu"
+	PolicyAllKeysRandom  = "allkeys-random"
+	PolicyVolatileLRU    = "volatile-lru"
+	PolicyVolatileLFU    = "volatile-lfu"
+	PolicyVolatileRandom = "volatile-random"
+	PolicyVolatileTTL    = "volatile-ttl"
+
+	EvictionPoolSize     = 16
+	DefaultMaxMemSamples = 5
+
+	LRUClockMax         = 1<<24 - 1 // the lru clock of objects is 24 bits of seconds
+	LFUInitVal          = 5
+	DefaultLFULogFactor = 10
+	DefaultLFUDecayTime = 1 // minutes
+
+	ReplyOOM = "-OOM command not allowed when used memory > 'maxmemory'.\r\n"
+)
+
+var EvictPolicies = []string{
+	PolicyNoEviction, PolicyAllKeysLRU, PolicyAllKeysLFU, PolicyAllKeysRandom,
+	PolicyVolatileLRU, PolicyVolatileLFU, PolicyVolatileRandom, PolicyVolatileTTL,
+}
+
+// Estimated sizes for memory accounting, see objSize.
+const (
+	ObjOverhead       = 64 // Obj with the boxed string header
+	DictEntryOverhead = 32 // Entry and its bucket slot
+)
+
+// objSize estimates the bytes used by o.
+func objSize(o *Obj) int64 {
+	switch o.Type {
+	case Stream:
+		return ObjOverhead + o.Val.(*StreamLog).memory
+	case ZSet:
+		return ObjOverhead + o.Val.(*SortedSet).memory
+	}
+	return ObjOverhead + int64(len(o.StrVal()))
+}
+
+// lruClock returns the current lru clock, which is in seconds and wraps around every 194 days.
+func lruClock() uint32 {
+	return uint32(time.Now().Unix()) & LRUClockMax
+}
+
+// lruIdle returns the idle seconds of an object with the lru clock.
+func lruIdle(lru uint32) uint64 {
+	return uint64((lruClock() - lru) & LRUClockMax)
+}
+
+// In LFU mode the 24 bits lru of an object is split into 16 bits of the last decrement time
+// in minutes and 8 bits of the logarithmic access counter.
+
+func lfuTime() uint32 {
+	return uint32(time.Now().Unix()/60) & math.MaxUint16
+}
+
+// lfuDecr returns the counter decremented by the minutes elapsed since the last decrement.
+func lfuDecr(lru uint32, decayTime int) uint32 {
+	counter := lru & 0xff
+	if decayTime == 0 {
+		return counter
+	}
+	elapsed := (lfuTime() - lru>>8) & math.MaxUint16
+	periods := elapsed / uint32(decayTime)
+	if periods >= counter {
+		return 0
+	}
+	return counter - periods
+}
+
+// lfuLogIncr increments the counter with a probability getting lower as the counter gets higher.
+func lfuLogIncr(counter uint32, logFactor int) uint32 {
+	if counter == 255 {
+		return counter
+	}
+	base := float64(counter) - LFUInitVal
+	if base < 0 {
+		base = 0
+	}
+	if rand.Float64() < 1/(base*float64(logFactor)+1) {
+		counter++
+	}
+	return counter
+}
+
+type evictionPoolEntry struct {
+	idle uint64 // the higher the better to evict
+	key  string
+}
+
+// touch updates the access clock or frequency of val.
+func (db *GodisDB) touch(val *Obj) {
+	if db.lfu {
+		counter := lfuDecr(val.lru, db.lfuDecayTime)
+		counter = lfuLogIncr(counter, db.lfuLogFactor)
+		val.lru = lfuTime()<<8 | counter
+	} else {
+		val.lru = lruClock()
+	}
+}
+
+// initAccess sets the access clock or frequency of val added to the db.
+func (db *GodisDB) initAccess(val *Obj) {
+	if db.lfu {
+		val.lru = lfuTime()<<8 | LFUInitVal
+	} else {
+		val.lru = lruClock()
+	}
+}
+
+// evictionScore returns how good the key is to be evicted under the policy.
+func (db *GodisDB) evictionScore(entry *Entry, policy string) uint64 {
+	if policy == PolicyVolatileTTL {
+		return math.MaxUint64 - uint64(entry.Val.IntVal())
+	}
+
+	val := entry.Val
+	if policy == PolicyVolatileLRU || policy == PolicyVolatileLFU {
+		dataEntry := db.data.Lookup(entry.Key)
+		if dataEntry == nil {
+			return math.MaxUint64
+		}
+		val = dataEntry.Val
+	}
+	if policy == PolicyAllKeysLFU || policy == PolicyVolatileLFU {
+		return 255 - uint64(lfuDecr(val.lru, db.lfuDecayTime))
+	}
+	return lruIdle(val.lru)
+}
+
+// poolPopulate samples keys of dict into the eviction pool, which is sorted by idle ascending.
+func (db *GodisDB) poolPopulate(dict *Dict, policy string, samples int) {
+	for i := 0; i < samples; i++ {
+		entry := dict.RandomGet()
+		if entry == nil {
+			return
+		}
+		idle := db.evictionScore(entry, policy)
+		key := entry.Key.StrVal()
+
+		pos := 0
+		for pos < len(db.evictionPool) && db.evictionPool[pos].idle < idle {
+			pos++
+		}
+		duplicated := false
+		for _, e := range db.evictionPool {
+			duplicated = duplicated || e.key == key
+		}
+		if duplicated || (pos == 0 && len(db.evictionPool) == EvictionPoolSize) {
+			continue
+		}
+
+		pe := evictionPoolEntry{idle: idle, key: key}
+		if len(db.evictionPool) < EvictionPoolSize {
+			db.evictionPool = append(db.evictionPool, evictionPoolEntry{})
+			copy(db.evictionPool[pos+1:], db.evictionPool[pos:])
+			db.evictionPool[pos] = pe
+		} else {
+			// the pool is full, drop the worst one at the head
+			copy(db.evictionPool, db.evictionPool[1:pos])
+			db.evictionPool[pos-1] = pe
+		}
+	}
+}
+
+// EvictKey evicts one key under the policy, returns false if there is no key to evict.
+func (db *GodisDB) EvictKey(policy string, samples int) bool {
+	dict := db.data
+	switch policy {
+	case PolicyNoEviction:
+		return false
+	case PolicyVolatileLRU, PolicyVolatileLFU, PolicyVolatileRandom, PolicyVolatileTTL:
+		dict = db.expire
+	}
+	if dict.KeyCount() == 0 {
+		return false
+	}
+
+	if policy == PolicyAllKeysRandom || policy == PolicyVolatileRandom {
+		key := dict.RandomGet().Key
+		key.IncrRefCount()
+		db.remove(key)
+		db.Notify(NotifyEvicted, "evicted", key)
+		key.DecrRefCount()
+		return true
+	}
+
+	for dict.KeyCount() > 0 {
+		db.poolPopulate(dict, policy, samples)
+		for len(db.evictionPool) > 0 {
+			best := db.evictionPool[len(db.evictionPool)-1]
+			db.evictionPool = db.evictionPool[:len(db.evictionPool)-1]
+
+			// the key in the pool may be deleted or lose its expire since it was sampled
+			key := NewObject(String, best.key)
+			found := dict.Lookup(key) != nil && db.remove(key)
+			if found {
+				db.Notify(NotifyEvicted, "evicted", key)
+			}
+			key.DecrRefCount()
+			if found {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// freeMemoryIfNeeded evicts keys until the used memory is under maxmemory,
+// returns false if it's still over maxmemory.
+func (srv *GodisServer) freeMemoryIfNeeded() bool {
+	// keys must not change while writes are paused
+	if srv.clientsPaused() {
+		return true
+	}
+	maxMemory := srv.config.MaxMemory
+	for maxMemory > 0 && srv.db.memory > maxMemory {
+		if !srv.db.EvictKey(srv.config.MaxMemoryPolicy, srv.config.MaxMemorySamples) {
+			return false
+		}
+		srv.stats.evictedKeys++
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryAccounting(t *testing.T) {
+	db := NewGodisDB()
+	key, val := NewObject(String, "key"), NewObject(String, "val")
+	db.Set(key, val)
+	size := db.memory
+	assert.Equal(t, int64(DictEntryOverhead+2*ObjOverhead+6), size)
+
+	db.Set(key, NewObject(String, "longer value"))
+	assert.Equal(t, size+9, db.memory)
+
+	db.Expire(key, NewObjectInt(time.Now().UnixMilli()+1000))
+	assert.Greater(t, db.memory, size+9)
+	db.Set(key, val)
+	assert.Equal(t, size, db.memory)
+
+	db.Expire(key, NewObjectInt(time.Now().UnixMilli()-1))
+	assert.Nil(t, db.Lookup(key))
+	assert.Equal(t, int64(0), db.memory)
+	assert.False(t, db.Delete(key))
+}
+
+func TestLFUCounter(t *testing.T) {
+	counter := uint32(LFUInitVal)
+	for i := 0; i < 100; i++ {
+		counter = lfuLogIncr(counter, 0)
+	}
+	assert.Equal(t, uint32(LFUInitVal+100), counter)
+	assert.Equal(t, uint32(255), lfuLogIncr(255, 0))
+
+	now := lfuTime()
+	assert.Equal(t, uint32(10), lfuDecr(now<<8|10, 1))
+	assert.Equal(t, uint32(7), lfuDecr((now-3)<<8|10, 1))
+	assert.Equal(t, uint32(0), lfuDecr((now-30)<<8|10, 1))
+	assert.Equal(t, uint32(10), lfuDecr((now-30)<<8|10, 0))
+}
+
+func newEvictServer(t *testing.T, policy string) (*GodisServer, *GodisClient) {
+	srv := newTestServer(t, 0)
+	srv.config.MaxMemoryPolicy = policy
+	srv.applyEvictConfig()
+	return srv, srv.newClient(0)
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	for _, policy := range []string{PolicyAllKeysLRU, PolicyAllKeysLFU, PolicyAllKeysRandom} {
+		srv, cli := newEvictServer(t, policy)
+		for i := 0; i < 100; i++ {
+			assert.Equal(t, ReplyOK, execCmd(cli, "set", fmt.Sprintf("key%d", i), "val"))
+		}
+		srv.config.MaxMemory = srv.db.memory / 2
+		// keys are evicted before the command, so the new key may exceed the limit
+		assert.Equal(t, ReplyOK, execCmd(cli, "set", "key", "val"))
+		assert.True(t, srv.freeMemoryIfNeeded())
+		assert.LessOrEqual(t, srv.db.memory, srv.config.MaxMemory, policy)
+		assert.Greater(t, srv.stats.evictedKeys, int64(40), policy)
+		assert.Equal(t, srv.stats.evictedKeys+srv.db.KeyCount(), int64(101), policy)
+	}
+}
+
+func TestEvictionPool(t *testing.T) {
+	// few keys and many samples, so every key is sampled
+	srv, cli := newEvictServer(t, PolicyAllKeysLRU)
+	srv.config.MaxMemorySamples = 64
+	for i := 0; i < 3; i++ {
+		execCmd(cli, "set", fmt.Sprintf("key%d", i), "val")
+	}
+	// key0 is the least recently used
+	srv.db.data.Lookup(NewObject(String, "key0")).Val.lru = lruClock() - 100
+	assert.True(t, srv.db.EvictKey(srv.config.MaxMemoryPolicy, srv.config.MaxMemorySamples))
+	assert.Nil(t, srv.db.data.Lookup(NewObject(String, "key0")))
+
+	srv, cli = newEvictServer(t, PolicyVolatileTTL)
+	srv.config.MaxMemorySamples = 64
+	assert.False(t, srv.db.EvictKey(srv.config.MaxMemoryPolicy, srv.config.MaxMemorySamples))
+	for i := 0; i < 10; i++ {
+		execCmd(cli, "set", fmt.Sprintf("key%d", i), "val")
+	}
+	execCmd(cli, "expire", "key3", "100")
+	execCmd(cli, "expire", "key5", "10")
+	assert.True(t, srv.db.EvictKey(srv.config.MaxMemoryPolicy, srv.config.MaxMemorySamples))
+	assert.Nil(t, srv.db.data.Lookup(NewObject(String, "key5")))
+	assert.True(t, srv.db.EvictKey(srv.config.MaxMemoryPolicy, srv.config.MaxMemorySamples))
+	assert.Nil(t, srv.db.data.Lookup(NewObject(String, "key3")))
+	assert.False(t, srv.db.EvictKey(srv.config.MaxMemoryPolicy, srv.config.MaxMemorySamples))
+	assert.Equal(t, int64(8), srv.db.KeyCount())
+}
+
+func TestNoEviction(t *testing.T) {
+	srv, cli := newEvictServer(t, PolicyNoEviction)
+	execCmd(cli, "set", "key", "val")
+	srv.config.MaxMemory = 1
+	assert.Equal(t, ReplyOOM, execCmd(cli, "set", "key", "val"))
+	assert.Equal(t, replyBulk("val"), execCmd(cli, "get", "key"))
+	assert.Equal(t, ReplyOK, execCmd(cli, "expire", "key", "10"))
+
+	assert.Equal(t, ReplyOK, execCmd(cli, "config", "set", "maxmemory-policy", "allkeys-random"))
+	assert.Equal(t, ReplyOK, execCmd(cli, "config", "set", "maxmemory", "1mb"))
+	assert.Equal(t, ReplyOK, execCmd(cli, "set", "key", "val"))
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ReplyNotFloat    = replyErr("value is not a valid float")
+	ReplyInvalidUnit = replyErr("unsupported unit provided. please use M, KM, FT, MI")
+)
+
+// GeoUnits are the meters of the distance units.
+var GeoUnits = map[string]float64{"m": 1, "km": 1000, "ft": 0.3048, "mi": 1609.34}
+
+// lookupZSet looks up the sorted set of key, returns the error reply if key holds another type.
+func lookupZSet(cli *GodisClient, key *Obj) (*Obj, string) {
+	val := cli.db.Lookup(key)
+	if val != nil && val.Type != ZSet {
+		return nil, ReplyWrongType
+	}
+	return val, ""
+}
+
+// parseLongLat parses the longitude and the latitude from args[i] and args[i+1].
+func parseLongLat(args []*Obj, i int) (long, lat float64, errReply string) {
+	long, err1 := strconv.ParseFloat(args[i].StrVal(), 64)
+	lat, err2 := strconv.ParseFloat(args[i+1].StrVal(), 64)
+	if err1 != nil || err2 != nil {
+		return 0, 0, ReplyNotFloat
+	}
+	if !geoValid(long, lat) {
+		return 0, 0, replyErr(fmt.Sprintf("invalid longitude,latitude pair %f,%f", long, lat))
+	}
+	return long, lat, ""
+}
+
+func parseGeoUnit(s string) (float64, string) {
+	unit, ok := GeoUnits[strings.ToLower(s)]
+	if !ok {
+		return 0, ReplyInvalidUnit
+	}
+	return unit, ""
+}
+
+func formatGeoFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func replyGeoDist(dist float64) string {
+	return replyBulk(strconv.FormatFloat(dist, 'f', 4, 64))
+}
+
+func replyGeoCoord(long, lat float64) string {
+	return replyArray([]string{replyBulk(formatGeoFloat(long)), replyBulk(formatGeoFloat(lat))})
+}
+
+// geoadd key [NX|XX] [CH] longitude latitude member [longitude latitude member ...]
+func geoaddCmd(cli *GodisClient) string {
+	args := cli.args
+	nx, xx, ch := false, false, false
+	i := 2
+	for ; i < len(args); i++ {
+		opt := strings.ToLower(args[i].StrVal())
+		if opt == "nx" {
+			nx = true
+		} else if opt == "xx" {
+			xx = true
+		} else if opt == "ch" {
+			ch = true
+		} else {
+			break
+		}
+	}
+	if nx && xx {
+		return replyErr("XX and NX options at the same time are not compatible")
+	}
+	if len(args) == i || (len(args)-i)%3 != 0 {
+		return ReplySyntaxErr
+	}
+
+	// all the coordinates are checked before adding any of them
+	members := make([]string, 0, (len(args)-i)/3)
+	scores := make([]float64, 0, (len(args)-i)/3)
+	for ; i < len(args); i += 3 {
+		long, lat, errReply := parseLongLat(args, i)
+		if errReply != "" {
+			return errReply
+		}
+		members = append(members, args[i+2].StrVal())
+		scores = append(scores, float64(geohashEncode(long, lat, GeoStepMax).bits))
+	}
+
+	key := args[1]
+	val, errReply := lookupZSet(cli, key)
+	if errReply != "" {
+		return errReply
+	}
+	created := val == nil
+	if created {
+		val = NewObject(ZSet, NewSortedSet())
+		defer val.DecrRefCount()
+	}
+	z := val.Val.(*SortedSet)
+
+	oldSize := objSize(val)
+	var added, changed int64
+	for j, member := range members {
+		old, exists := z.Score(member)
+		if nx && exists || xx && !exists {
+			continue
+		}
+		if z.Add(member, scores[j]) {
+			added++
+		} else if old != scores[j] {
+			changed++
+		}
+	}
+	if added+changed > 0 {
+		if created {
+			cli.db.Set(key, val)
+		} else {
+			cli.db.Modified(val, oldSize)
+		}
+		cli.db.Notify(NotifyZset, "zadd", key)
+	}
+	if ch {
+		return replyInt(added + changed)
+	}
+	return replyInt(added)
+}
+
+// geodist key member1 member2 [M|KM|FT|MI]
+func geodistCmd(cli *GodisClient) string {
+	args := cli.args
+	unit := 1.0
+	if len(args) == 5 {
+		var errReply string
+		if unit, errReply = parseGeoUnit(args[4].StrVal()); errReply != "" {
+			return errReply
+		}
+	} else if len(args) > 5 {
+		return ReplySyntaxErr
+	}
+
+	val, errReply := lookupZSet(cli, args[1])
+	if errReply != "" {
+		return errReply
+	}
+	if val == nil {
+		return ReplyNil
+	}
+	z := val.Val.(*SortedSet)
+	score1, ok1 := z.Score(args[2].StrVal())
+	score2, ok2 := z.Score(args[3].StrVal())
+	if !ok1 || !ok2 {
+		return ReplyNil
+	}
+	long1, lat1 := geoDecodeScore(score1)
+	long2, lat2 := geoDecodeScore(score2)
+	return replyGeoDist(geoDistance(long1, lat1, long2, lat2) / unit)
+}
+
+// geoMembersReply replies fn of the score of each member in args[2:], or null of the missing members.
+func geoMembersReply(cli *GodisClient, null string, fn func(score float64) string) string {
+	val, errReply := lookupZSet(cli, cli.args[1])
+	if errReply != "" {
+		return errReply
+	}
+	replies := make([]string, 0, len(cli.args)-2)
+	for _, member := range cli.args[2:] {
+		reply := null
+		if val != nil {
+			if score, ok := val.Val.(*SortedSet).Score(member.StrVal()); ok {
+				reply = fn(score)
+			}
+		}
+		replies = append(replies, reply)
+	}
+	return replyArray(replies)
+}
+
+// geopos key [member ...]
+func geoposCmd(cli *GodisClient) string {
+	return geoMembersReply(cli, ReplyNilArray, func(score float64) string {
+		return replyGeoCoord(geoDecodeScore(score))
+	})
+}
+
+// geohash key [member ...]
+func geohashCmd(cli *GodisClient) string {
+	return geoMembersReply(cli, ReplyNil, func(score float64) string {
+		return replyBulk(geohashString(geoDecodeScore(score)))
+	})
+}
+
+// geoSearch is the options of GEOSEARCH and GEOSEARCHSTORE.
+type geoSearch struct {
+	shape      GeoShape
+	unit       float64 // the meters of the unit of the shape, which is also the unit of the distances replied
+	fromMember *Obj    // the center is the coordinates of the member if not nil
+	fromLonLat bool
+	sort       int // 1 for ASC, -1 for DESC, 0 for unsorted
+	count      int // 0 means no limit
+	any        bool
+	withCoord  bool
+	withDist   bool
+	withHash   bool
+	storeDist  bool
+}
+
+// parseGeoSearch parses the options of GEOSEARCH from args[i], store is set for GEOSEARCHSTORE.
+func parseGeoSearch(args []*Obj, i int, store bool) (*geoSearch, string) {
+	q := &geoSearch{}
+	name := strings.ToUpper(args[0].StrVal())
+	byRadius := false
+	for ; i < len(args); i++ {
+		opt := strings.ToLower(args[i].StrVal())
+		left := len(args) - i - 1
+		var errReply string
+		switch {
+		case opt == "frommember" && left >= 1:
+			if q.fromMember != nil || q.fromLonLat {
+				return nil, replyErr(fmt.Sprintf("exactly one of FROMMEMBER or FROMLONLAT can be specified for %v", name))
+			}
+			q.fromMember = args[i+1]
+			i++
+		case opt == "fromlonlat" && left >= 2:
+			if q.fromMember != nil || q.fromLonLat {
+				return nil, replyErr(fmt.Sprintf("exactly one of FROMMEMBER or FROMLONLAT can be specified for %v", name))
+			}
+			if q.shape.long, q.shape.lat, errReply = parseLongLat(args, i+1); errReply != "" {
+				return nil, errReply
+			}
+			q.fromLonLat = true
+			i += 2
+		case opt == "byradius" && left >= 2:
+			if byRadius || q.shape.byBox {
+				return nil, replyErr(fmt.Sprintf("exactly one of BYRADIUS and BYBOX can be specified for %v", name))
+			}
+			radius, err := strconv.ParseFloat(args[i+1].StrVal(), 64)
+			if err != nil {
+				return nil, ReplyNotFloat
+			}
+			if radius < 0 {
+				return nil, replyErr("radius cannot be negative")
+			}
+			if q.unit, errReply = parseGeoUnit(args[i+2].StrVal()); errReply != "" {
+				return nil, errReply
+			}
+			q.shape.radius = radius * q.unit
+			byRadius = true
+			i += 2
+		case opt == "bybox" && left >= 3:
+			if byRadius || q.shape.byBox {
+				return nil, replyErr(fmt.Sprintf("exactly one of BYRADIUS and BYBOX can be specified for %v", name))
+			}
+			width, err1 := strconv.ParseFloat(args[i+1].StrVal(), 64)
+			height, err2 := strconv.ParseFloat(args[i+2].StrVal(), 64)
+			if err1 != nil || err2 != nil {
+				return nil, ReplyNotFloat
+			}
+			if width < 0 || height < 0 {
+				return nil, replyErr("height or width cannot be negative")
+			}
+			if q.unit, errReply = parseGeoUnit(args[i+3].StrVal()); errReply != "" {
+				return nil, errReply
+			}
+			q.shape.width, q.shape.height = width*q.unit, height*q.unit
+			q.shape.byBox = true
+			i += 3
+		case opt == "asc":
+			q.sort = 1
+		case opt == "desc":
+			q.sort = -1
+		case opt == "count" && left >= 1:
+			count, err := strconv.Atoi(args[i+1].StrVal())
+			if err != nil {
+				return nil, ReplyNotInteger
+			}
+			if count <= 0 {
+				return nil, replyErr("COUNT must be > 0")
+			}
+			q.count = count
+			i++
+			if i+1 < len(args) && strings.EqualFold(args[i+1].StrVal(), "any") {
+				q.any = true
+				i++
+			}
+		case opt == "withcoord" && !store:
+			q.withCoord = true
+		case opt == "withdist" && !store:
+			q.withDist = true
+		case opt == "withhash" && !store:
+			q.withHash = true
+		case opt == "storedist" && store:
+			q.storeDist = true
+		default:
+			return nil, ReplySyntaxErr
+		}
+	}
+
+	if q.fromMember == nil && !q.fromLonLat {
+		return nil, replyErr(fmt.Sprintf("exactly one of FROMMEMBER or FROMLONLAT can be specified for %v", name))
+	}
+	if !byRadius && !q.shape.byBox {
+		return nil, replyErr(fmt.Sprintf("exactly one of BYRADIUS and BYBOX can be specified for %v", name))
+	}
+	// the nearest ones are returned with COUNT
+	if q.count > 0 && !q.any && q.sort == 0 {
+		q.sort = 1
+	}
+	return q, ""
+}
+
+// geoPoint is a member found by GEOSEARCH, dist is in meters.
+type geoPoint struct {
+	member    string
+	score     float64
+	long, lat float64
+	dist      float64
+}
+
+// search returns the members in the shape, at most count of them are collected with ANY.
+func (q *geoSearch) search(z *SortedSet) []*geoPoint {
+	var points []*geoPoint
+	full := func() bool { return q.any && len(points) >= q.count }
+	for _, cell := range q.shape.Cells() {
+		min := float64(geohashAlign(cell))
+		max := float64(geohashAlign(GeoHash{bits: cell.bits + 1, step: cell.step}))
+		z.RangeByScore(min, max, func(member string, score float64) bool {
+			if score >= max {
+				return false
+			}
+			long, lat := geoDecodeScore(score)
+			if dist, ok := q.shape.Contains(long, lat); ok {
+				points = append(points, &geoPoint{member, score, long, lat, dist})
+			}
+			return !full()
+		})
+		if full() {
+			break
+		}
+	}
+
+	if q.sort != 0 {
+		sort.SliceStable(points, func(i, j int) bool {
+			if q.sort > 0 {
+				return points[i].dist < points[j].dist
+			}
+			return points[i].dist > points[j].dist
+		})
+	}
+	if q.count > 0 && len(points) > q.count {
+		points = points[:q.count]
+	}
+	return points
+}
+
+// run finds the center of the shape and searches the sorted set of key, returns the error reply if failed.
+func (q *geoSearch) run(cli *GodisClient, key *Obj) ([]*geoPoint, string) {
+	val, errReply := lookupZSet(cli, key)
+	if errReply != "" || val == nil {
+		return nil, errReply
+	}
+	z := val.Val.(*SortedSet)
+	if q.fromMember != nil {
+		score, ok := z.Score(q.fromMember.StrVal())
+		if !ok {
+			return nil, replyErr("could not decode requested zset member")
+		}
+		q.shape.long, q.shape.lat = geoDecodeScore(score)
+	}
+	return q.search(z), ""
+}
+
+func (q *geoSearch) reply(points []*geoPoint) string {
+	replies := make([]string, len(points))
+	for i, p := range points {
+		if !q.withDist && !q.withHash && !q.withCoord {
+			replies[i] = replyBulk(p.member)
+			continue
+		}
+		item := []string{replyBulk(p.member)}
+		if q.withDist {
+			item = append(item, replyGeoDist(p.dist/q.unit))
+		}
+		if q.withHash {
+			item = append(item, replyInt(int64(p.score)))
+		}
+		if q.withCoord {
+			item = append(item, replyGeoCoord(p.long, p.lat))
+		}
+		replies[i] = replyArray(item)
+	}
+	return replyArray(replies)
+}
+
+// geosearch key FROMMEMBER member|FROMLONLAT longitude latitude BYRADIUS radius unit|BYBOX width height unit
+// [ASC|DESC] [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH]
+func geosearchCmd(cli *GodisClient) string {
+	q, errReply := parseGeoSearch(cli.args, 2, false)
+	if errReply != "" {
+		return errReply
+	}
+	points, errReply := q.run(cli, cli.args[1])
+	if errReply != "" {
+		return errReply
+	}
+	return q.reply(points)
+}
+
+// geosearchstore destination source FROMMEMBER member|FROMLONLAT longitude latitude
+// BYRADIUS radius unit|BYBOX width height unit [ASC|DESC] [COUNT count [ANY]] [STOREDIST]
+func geosearchstoreCmd(cli *GodisClient) string {
+	q, errReply := parseGeoSearch(cli.args, 3, true)
+	if errReply != "" {
+		return errReply
+	}
+	points, errReply := q.run(cli, cli.args[2])
+	if errReply != "" {
+		return errReply
+	}
+
+	dst := cli.args[1]
+	if len(points) == 0 {
+		if cli.db.Delete(dst) {
+			cli.db.Notify(NotifyGeneric, "del", dst)
+		}
+		return replyInt(0)
+	}
+	z := NewSortedSet()
+	for _, p := range points {
+		if q.storeDist {
+			z.Add(p.member, p.dist/q.unit)
+		} else {
+			z.Add(p.member, p.score)
+		}
+	}
+	val := NewObject(ZSet, z)
+	cli.db.Set(dst, val)
+	val.DecrRefCount()
+	cli.db.Notify(NotifyZset, "geosearchstore", dst)
+	return replyInt(int64(len(points)))
+}
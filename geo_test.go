@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeohash(t *testing.T) {
+	hash := geohashEncode(13.361389, 38.115556, GeoStepMax)
+	assert.Equal(t, uint64(3479099956230698), hash.bits)
+	long, lat := geoDecodeScore(float64(hash.bits))
+	assert.InDelta(t, 13.361389, long, 1e-5)
+	assert.InDelta(t, 38.115556, lat, 1e-5)
+	assert.Equal(t, "sqc8b49rny0", geohashString(13.361389, 38.115556))
+
+	// the neighbors wrap around at the bounds
+	cell := geohashEncode(179.9, 0, 4)
+	east := cell.Move(1, 0).Decode()
+	assert.Equal(t, -180.0, east.longMin)
+	assert.Equal(t, cell, cell.Move(1, 0).Move(-1, 0))
+
+	assert.InDelta(t, 166274.26, geoDistance(13.361389, 38.115556, 15.087269, 37.502669), 0.01)
+	assert.Equal(t, uint(GeoStepMax), geoEstimateStep(0, 0))
+	assert.Greater(t, geoEstimateStep(1000, 0), geoEstimateStep(100000, 0))
+	assert.Less(t, geoEstimateStep(1000, 85), geoEstimateStep(1000, 0))
+}
+
+func TestGeoAddAndQuery(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli := srv.newClient(0)
+
+	assert.Equal(t, replyInt(2), execCmd(cli, "geoadd", "sicily", "13.361389", "38.115556", "Palermo",
+		"15.087269", "37.502669", "Catania"))
+	assert.Equal(t, replyInt(0), execCmd(cli, "geoadd", "sicily", "nx", "13", "38", "Palermo"))
+	assert.Equal(t, replyInt(0), execCmd(cli, "geoadd", "sicily", "xx", "13", "38", "Rome"))
+	assert.Equal(t, replyInt(1), execCmd(cli, "geoadd", "sicily", "xx", "ch", "13", "38", "Palermo"))
+	assert.Equal(t, replyInt(0), execCmd(cli, "geoadd", "sicily", "13.361389", "38.115556", "Palermo"))
+	assert.Equal(t, "-ERR: XX and NX options at the same time are not compatible\r\n",
+		execCmd(cli, "geoadd", "sicily", "nx", "xx", "13", "38", "Palermo"))
+	assert.Equal(t, "-ERR: invalid longitude,latitude pair 13.000000,86.000000\r\n",
+		execCmd(cli, "geoadd", "sicily", "13", "86", "North"))
+	assert.Equal(t, ReplyNotFloat, execCmd(cli, "geoadd", "sicily", "x", "38", "Palermo"))
+	assert.Equal(t, ReplySyntaxErr, execCmd(cli, "geoadd", "sicily", "13", "38", "Palermo", "15"))
+	execCmd(cli, "set", "str", "v")
+	assert.Equal(t, ReplyWrongType, execCmd(cli, "geoadd", "str", "13", "38", "Palermo"))
+
+	assert.Equal(t, replyBulk("166274.1516"), execCmd(cli, "geodist", "sicily", "Palermo", "Catania"))
+	assert.Equal(t, replyBulk("166.2742"), execCmd(cli, "geodist", "sicily", "Palermo", "Catania", "km"))
+	assert.Equal(t, replyBulk("103.3182"), execCmd(cli, "geodist", "sicily", "Palermo", "Catania", "MI"))
+	assert.Equal(t, ReplyNil, execCmd(cli, "geodist", "sicily", "Palermo", "Rome"))
+	assert.Equal(t, ReplyInvalidUnit, execCmd(cli, "geodist", "sicily", "Palermo", "Catania", "yd"))
+
+	assert.Equal(t, replyArray([]string{replyBulk("sqc8b49rny0"), replyBulk("sqdtr74hyu0"), ReplyNil}),
+		execCmd(cli, "geohash", "sicily", "Palermo", "Catania", "Rome"))
+	assert.Equal(t, replyArray([]string{ReplyNil}), execCmd(cli, "geohash", "nokey", "Palermo"))
+	assert.Equal(t, replyArray([]string{replyGeoCoord(13.361389338970184, 38.1155563954963), ReplyNilArray}),
+		execCmd(cli, "geopos", "sicily", "Palermo", "Rome"))
+
+	// the memory is updated by the changes in place
+	val := srv.db.Lookup(NewObject(String, "sicily"))
+	size, memory := objSize(val), srv.db.memory
+	execCmd(cli, "geoadd", "sicily", "13.583333", "37.316667", "Agrigento")
+	assert.Greater(t, objSize(val), size)
+	assert.Equal(t, memory-size+objSize(val), srv.db.memory)
+}
+
+func TestGeoSearch(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli := srv.newClient(0)
+	execCmd(cli, "geoadd", "sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania",
+		"12.758489", "38.788135", "edge1", "17.241510", "38.788135", "edge2")
+
+	assert.Equal(t, replyBulkArray([]string{"Catania", "Palermo"}),
+		execCmd(cli, "geosearch", "sicily", "fromlonlat", "15", "37", "byradius", "200", "km", "asc"))
+	assert.Equal(t, replyBulkArray([]string{"Palermo", "Catania"}),
+		execCmd(cli, "geosearch", "sicily", "fromlonlat", "15", "37", "byradius", "200", "km", "desc"))
+	assert.Equal(t, replyArray([]string{
+		replyArray([]string{replyBulk("Catania"), replyBulk("56.4413")}),
+		replyArray([]string{replyBulk("Palermo"), replyBulk("190.4424")}),
+		replyArray([]string{replyBulk("edge2"), replyBulk("279.7403")}),
+		replyArray([]string{replyBulk("edge1"), replyBulk("279.7405")}),
+	}), execCmd(cli, "geosearch", "sicily", "fromlonlat", "15", "37", "bybox", "400", "400", "km", "asc", "withdist"))
+
+	// the nearest ones with COUNT, any ones with ANY
+	assert.Equal(t, replyBulkArray([]string{"Catania"}),
+		execCmd(cli, "geosearch", "sicily", "fromlonlat", "15", "37", "bybox", "400", "400", "km", "count", "1"))
+	assert.Contains(t, []string{"*1\r\n$7\r\nCatania\r\n", "*1\r\n$7\r\nPalermo\r\n", "*1\r\n$5\r\nedge1\r\n", "*1\r\n$5\r\nedge2\r\n"},
+		execCmd(cli, "geosearch", "sicily", "fromlonlat", "15", "37", "bybox", "400", "400", "km", "count", "1", "any"))
+
+	assert.Equal(t, replyArray([]string{
+		replyArray([]string{replyBulk("Palermo"), replyBulk("0.0000"), replyInt(3479099956230698),
+			replyGeoCoord(13.361389338970184, 38.1155563954963)}),
+	}), execCmd(cli, "geosearch", "sicily", "frommember", "Palermo", "byradius", "10", "km", "withcoord", "withhash", "withdist"))
+	assert.Equal(t, replyArray(nil),
+		execCmd(cli, "geosearch", "nokey", "frommember", "Palermo", "byradius", "10", "km"))
+
+	assert.Equal(t, "-ERR: could not decode requested zset member\r\n",
+		execCmd(cli, "geosearch", "sicily", "frommember", "Rome", "byradius", "10", "km"))
+	assert.Equal(t, "-ERR: exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH\r\n",
+		execCmd(cli, "geosearch", "sicily", "frommember", "Palermo", "fromlonlat", "15", "37", "byradius", "10", "km"))
+	assert.Equal(t, "-ERR: exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH\r\n",
+		execCmd(cli, "geosearch", "sicily", "frommember", "Palermo", "asc", "count", "1"))
+	assert.Equal(t, ReplySyntaxErr,
+		execCmd(cli, "geosearch", "sicily", "frommember", "Palermo", "byradius", "10", "km", "any"))
+	assert.Equal(t, "-ERR: COUNT must be > 0\r\n",
+		execCmd(cli, "geosearch", "sicily", "frommember", "Palermo", "byradius", "10", "km", "count", "0"))
+	assert.Equal(t, ReplyInvalidUnit, execCmd(cli, "geosearch", "sicily", "frommember", "Palermo", "byradius", "10", "yd"))
+	assert.Equal(t, ReplySyntaxErr, execCmd(cli, "geosearch", "sicily", "frommember", "Palermo", "byradius", "10", "km", "storedist"))
+}
+
+func TestGeoSearchStore(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli := srv.newClient(0)
+	execCmd(cli, "geoadd", "sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania")
+
+	assert.Equal(t, replyInt(2),
+		execCmd(cli, "geosearchstore", "dst", "sicily", "fromlonlat", "15", "37", "byradius", "200", "km"))
+	assert.Equal(t, replyBulk("166274.1516"), execCmd(cli, "geodist", "dst", "Palermo", "Catania"))
+
+	assert.Equal(t, replyInt(1),
+		execCmd(cli, "geosearchstore", "dists", "sicily", "fromlonlat", "15", "37", "byradius", "100", "km", "storedist"))
+	z := srv.db.Lookup(NewObject(String, "dists")).Val.(*SortedSet)
+	score, ok := z.Score("Catania")
+	assert.True(t, ok)
+	assert.InDelta(t, 56.4413, score, 1e-4)
+
+	// the destination is deleted if nothing is found
+	assert.Equal(t, replyInt(0),
+		execCmd(cli, "geosearchstore", "dst", "sicily", "fromlonlat", "0", "0", "byradius", "1", "km"))
+	assert.Nil(t, srv.db.Lookup(NewObject(String, "dst")))
+	assert.Equal(t, ReplySyntaxErr,
+		execCmd(cli, "geosearchstore", "dst", "sicily", "fromlonlat", "15", "37", "byradius", "200", "km", "withdist"))
+}
+
+func TestGeoDump(t *testing.T) {
+	z := NewSortedSet()
+	z.Add("Palermo", 3479099956230698)
+	z.Add("Catania", 3479447370796909)
+	val, err := RestoreObject(DumpObject(NewObject(ZSet, z)))
+	assert.Nil(t, err)
+	restored := val.Val.(*SortedSet)
+	assert.Equal(t, []string{"Palermo", "Catania"}, zsetMembers(restored, 0, 1<<52))
+	assert.Equal(t, z.memory, restored.memory)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"math"
+)
+
+// The coordinates are encoded as 52 bits geohash, which interleaves 26 bits of the latitude and the longitude,
+// so it's exact as the score of a sorted set. The latitude is limited as EPSG:3857.
+const (
+	GeoStepMax       = 26
+	GeoLatMin        = -85.05112878
+	GeoLatMax        = 85.05112878
+	GeoLongMin       = -180.0
+	GeoLongMax       = 180.0
+	GeoEarthRadius   = 6372797.560856 // in meters, the same as Redis
+	GeoMercatorMax   = 20037726.37
+	GeoHashAlphabet  = "0123456789bcdefghjkmnpqrstuvwxyz"
+	GeoHashStrLength = 11
+)
+
+// GeoHash is a cell of the grid whose size depends on step, its bits are the step*2 bits interleaved.
+type GeoHash struct {
+	bits uint64
+	step uint
+}
+
+// GeoArea is the bounds of a geohash cell.
+type GeoArea struct {
+	longMin, longMax float64
+	latMin, latMax   float64
+}
+
+func degRad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func radDeg(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
+
+// interleave puts the bits of x at the even positions and y at the odd ones.
+func interleave(x, y uint32) uint64 {
+	var bits uint64
+	for i := 0; i < 32; i++ {
+		bits |= uint64(x>>i&1)<<(2*i) | uint64(y>>i&1)<<(2*i+1)
+	}
+	return bits
+}
+
+func deinterleave(bits uint64) (x, y uint32) {
+	for i := 0; i < 32; i++ {
+		x |= uint32(bits>>(2*i)&1) << i
+		y |= uint32(bits>>(2*i+1)&1) << i
+	}
+	return x, y
+}
+
+func geoValid(long, lat float64) bool {
+	return long >= GeoLongMin && long <= GeoLongMax && lat >= GeoLatMin && lat <= GeoLatMax
+}
+
+// geohashEncodeRange encodes the coordinates in the ranges of the longitude and the latitude.
+func geohashEncodeRange(long, lat, longMin, longMax, latMin, latMax float64, step uint) GeoHash {
+	latOffset := (lat - latMin) / (latMax - latMin) * float64(uint64(1)<<step)
+	longOffset := (long - longMin) / (longMax - longMin) * float64(uint64(1)<<step)
+	return GeoHash{bits: interleave(uint32(latOffset), uint32(longOffset)), step: step}
+}
+
+// geohashEncode encodes valid coordinates, the max step is the score of a sorted set.
+func geohashEncode(long, lat float64, step uint) GeoHash {
+	return geohashEncodeRange(long, lat, GeoLongMin, GeoLongMax, GeoLatMin, GeoLatMax, step)
+}
+
+// geohashAlign returns the bits of hash at the max step, which is the min score of the members in the cell.
+func geohashAlign(hash GeoHash) uint64 {
+	return hash.bits << (GeoStepMax*2 - hash.step*2)
+}
+
+// Decode returns the area of the cell.
+func (hash GeoHash) Decode() GeoArea {
+	latIdx, longIdx := deinterleave(hash.bits)
+	scale := float64(uint64(1) << hash.step)
+	return GeoArea{
+		latMin:  GeoLatMin + float64(latIdx)/scale*(GeoLatMax-GeoLatMin),
+		latMax:  GeoLatMin + float64(latIdx+1)/scale*(GeoLatMax-GeoLatMin),
+		longMin: GeoLongMin + float64(longIdx)/scale*(GeoLongMax-GeoLongMin),
+		longMax: GeoLongMin + float64(longIdx+1)/scale*(GeoLongMax-GeoLongMin),
+	}
+}
+
+// Center returns the coordinates of the center of the area.
+func (area GeoArea) Center() (long, lat float64) {
+	long = math.Max(GeoLongMin, math.Min(GeoLongMax, (area.longMin+area.longMax)/2))
+	lat = math.Max(GeoLatMin, math.Min(GeoLatMax, (area.latMin+area.latMax)/2))
+	return long, lat
+}
+
+// geoDecodeScore returns the coordinates of a member of the score.
+func geoDecodeScore(score float64) (long, lat float64) {
+	return GeoHash{bits: uint64(score), step: GeoStepMax}.Decode().Center()
+}
+
+// Move returns the cell moved dx cells east and dy cells north, which wraps around at the bounds.
+func (hash GeoHash) Move(dx, dy int) GeoHash {
+	latIdx, longIdx := deinterleave(hash.bits)
+	mask := uint32(1)<<hash.step - 1
+	latIdx = uint32(int(latIdx)+dy) & mask
+	longIdx = uint32(int(longIdx)+dx) & mask
+	return GeoHash{bits: interleave(latIdx, longIdx), step: hash.step}
+}
+
+// geohashString returns the standard 11 characters geohash of the coordinates, whose latitude range is [-90, 90].
+func geohashString(long, lat float64) string {
+	hash := geohashEncodeRange(long, lat, -180, 180, -90, 90, GeoStepMax)
+	buf := make([]byte, GeoHashStrLength)
+	for i := range buf {
+		// the last character is beyond the 52 bits
+		var idx uint64
+		if i < GeoHashStrLength-1 {
+			idx = hash.bits >> (52 - (i+1)*5) & 0x1f
+		}
+		buf[i] = GeoHashAlphabet[idx]
+	}
+	return string(buf)
+}
+
+// geoLatDistance returns the distance in meters between two latitudes on a meridian.
+func geoLatDistance(lat1, lat2 float64) float64 {
+	return GeoEarthRadius * math.Abs(degRad(lat2)-degRad(lat1))
+}
+
+// geoDistance returns the distance in meters between two coordinates with the haversine formula.
+func geoDistance(long1, lat1, long2, lat2 float64) float64 {
+	lat1r, lat2r := degRad(lat1), degRad(lat2)
+	v := math.Sin((degRad(long2) - degRad(long1)) / 2)
+	if v == 0 {
+		return geoLatDistance(lat1, lat2)
+	}
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2 * GeoEarthRadius * math.Asin(math.Sqrt(a))
+}
+
+// geoEstimateStep returns the step whose cell is about the size of radius meters at lat.
+func geoEstimateStep(radius, lat float64) uint {
+	if radius == 0 {
+		return GeoStepMax
+	}
+	step := 1
+	for radius < GeoMercatorMax {
+		radius *= 2
+		step++
+	}
+	// the cells are narrower near the poles
+	step -= 2
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+	return uint(max(1, min(step, GeoStepMax)))
+}
+
+// GeoShape is the search area of GEOSEARCH, a circle of radius or a box of width and height around the center.
+// The sizes are in meters.
+type GeoShape struct {
+	long, lat     float64
+	byBox         bool
+	radius        float64
+	width, height float64
+}
+
+// boundingBox returns the bounds of the shape.
+func (shape *GeoShape) boundingBox() GeoArea {
+	height, width := shape.radius, shape.radius
+	if shape.byBox {
+		height, width = shape.height/2, shape.width/2
+	}
+	latDelta := radDeg(height / GeoEarthRadius)
+	longDeltaTop := radDeg(width / GeoEarthRadius / math.Cos(degRad(shape.lat+latDelta)))
+	longDeltaBottom := radDeg(width / GeoEarthRadius / math.Cos(degRad(shape.lat-latDelta)))
+	// the wider delta is at the side nearer to the equator
+	longDelta := longDeltaTop
+	if shape.lat < 0 {
+		longDelta = longDeltaBottom
+	}
+	return GeoArea{
+		longMin: shape.long - longDelta,
+		longMax: shape.long + longDelta,
+		latMin:  shape.lat - latDelta,
+		latMax:  shape.lat + latDelta,
+	}
+}
+
+// Contains returns the distance in meters from the center to the coordinates, false if they're out of the shape.
+func (shape *GeoShape) Contains(long, lat float64) (float64, bool) {
+	if !shape.byBox {
+		dist := geoDistance(shape.long, shape.lat, long, lat)
+		return dist, dist <= shape.radius
+	}
+	// the latitude distance is cheaper, so check it first
+	if geoLatDistance(lat, shape.lat) > shape.height/2 ||
+		geoDistance(long, lat, shape.long, lat) > shape.width/2 {
+		return 0, false
+	}
+	return geoDistance(shape.long, shape.lat, long, lat), true
+}
+
+// Cells returns the cells covering the shape, which are the cell of the center and its neighbors
+// without the ones out of the bounding box.
+func (shape *GeoShape) Cells() []GeoHash {
+	radius := shape.radius
+	if shape.byBox {
+		radius = math.Sqrt(shape.width*shape.width/4 + shape.height*shape.height/4)
+	}
+	bounds := shape.boundingBox()
+	step := geoEstimateStep(radius, shape.lat)
+	center := geohashEncode(shape.long, shape.lat, step)
+
+	// the step is decreased if the neighbors don't cover the bounding box
+	if step > 1 {
+		north, south := center.Move(0, 1).Decode(), center.Move(0, -1).Decode()
+		east, west := center.Move(1, 0).Decode(), center.Move(-1, 0).Decode()
+		if north.latMax < bounds.latMax || south.latMin > bounds.latMin ||
+			east.longMax < bounds.longMax || west.longMin > bounds.longMin {
+			step--
+			center = geohashEncode(shape.long, shape.lat, step)
+		}
+	}
+
+	area := center.Decode()
+	cells := make([]GeoHash, 0, 9)
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			if step >= 2 && (dy < 0 && area.latMin < bounds.latMin || dy > 0 && area.latMax > bounds.latMax ||
+				dx < 0 && area.longMin < bounds.longMin || dx > 0 && area.longMax > bounds.longMax) {
+				continue
+			}
+			cell := center.Move(dx, dy)
+			dup := false
+			for _, c := range cells {
+				dup = dup || c == cell
+			}
+			if !dup {
+				cells = append(cells, cell)
+			}
+		}
+	}
+	return cells
+}
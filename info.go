@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"strings"
+	"time"
+)
+
+const (
+	GodisVersion = "0.1.0"
+
+	StatsMetricSamples = 16
+)
+
+// InfoSections are the sections of INFO in order, commandstats is only shown when asked.
+var InfoSections = []string{"server", "clients", "memory", "persistence", "stats", "keyspace", "commandstats"}
+
+// CommandLatencyBuckets are the upper bounds in us of the latency histogram of commands.
+var CommandLatencyBuckets = [...]int64{10, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 25000, 50000, 100000, 250000, 500000, 1000000}
+
+type CommandStats struct {
+	calls    int64
+	usec     int64
+	rejected int64 // calls rejected before execution, like by ACL or OOM
+	failed   int64 // calls executed with an error reply
+	// the calls per latency bucket, the last one counts the calls slower than all the buckets
+	hist [len(CommandLatencyBuckets) + 1]int64
+}
+
+func (stats *CommandStats) track(duration time.Duration, failed bool) {
+	us := duration.Microseconds()
+	stats.calls++
+	stats.usec += us
+	if failed {
+		stats.failed++
+	}
+	i := 0
+	for i < len(CommandLatencyBuckets) && us > CommandLatencyBuckets[i] {
+		i++
+	}
+	stats.hist[i]++
+}
+
+// metricSamples keeps the recent rates of a counter to compute the instantaneous rate.
+type metricSamples struct {
+	samples   [StatsMetricSamples]int64
+	idx       int
+	lastTime  time.Time
+	lastCount int64
+}
+
+func (m *metricSamples) track(count int64, now time.Time) {
+	if !m.lastTime.IsZero() {
+		if elapsed := now.Sub(m.lastTime).Milliseconds(); elapsed > 0 {
+			m.samples[m.idx] = (count - m.lastCount) * 1000 / elapsed
+			m.idx = (m.idx + 1) % StatsMetricSamples
+		}
+	}
+	m.lastTime, m.lastCount = now, count
+}
+
+func (m *metricSamples) average() int64 {
+	var sum int64
+	for _, sample := range m.samples {
+		sum += sample
+	}
+	return sum / StatsMetricSamples
+}
+
+var memoryMetrics = []metrics.Sample{
+	{Name: "/memory/classes/heap/objects:bytes"},
+	{Name: "/memory/classes/total:bytes"},
+}
+
+// usedMemory returns the bytes of live heap objects and the total bytes mapped by the go runtime,
+// unlike runtime.ReadMemStats it doesn't stop the world.
+func usedMemory() (used, sys int64) {
+	metrics.Read(memoryMetrics)
+	return int64(memoryMetrics[0].Value.Uint64()), int64(memoryMetrics[1].Value.Uint64())
+}
+
+// bytesToHuman formats bytes like 1.50M.
+func bytesToHuman(n int64) string {
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%dB", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.2fK", float64(n)/1024)
+	case n < 1024*1024*1024:
+		return fmt.Sprintf("%.2fM", float64(n)/(1024*1024))
+	default:
+		return fmt.Sprintf("%.2fG", float64(n)/(1024*1024*1024))
+	}
+}
+
+// Info generates the INFO text of the sections, default sections if none is given.
+// "all" means all the sections except commandstats, "everything" means all the sections.
+func (srv *GodisServer) Info(sections ...string) string {
+	wanted := make(map[string]bool)
+	if len(sections) == 0 {
+		sections = []string{"default"}
+	}
+	for _, section := range sections {
+		switch section = strings.ToLower(section); section {
+		case "default", "all":
+			for _, name := range InfoSections[:len(InfoSections)-1] {
+				wanted[name] = true
+			}
+		case "everything":
+			for _, name := range InfoSections {
+				wanted[name] = true
+			}
+		default:
+			wanted[section] = true
+		}
+	}
+
+	var b strings.Builder
+	for _, name := range InfoSections {
+		if !wanted[name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %v\r\n", strings.ToUpper(name[:1])+name[1:])
+		for _, field := range srv.infoSection(name) {
+			b.WriteString(field[0] + ":" + field[1] + "\r\n")
+		}
+	}
+	return b.String()
+}
+
+func (srv *GodisServer) infoSection(name string) [][2]string {
+	var fields [][2]string
+	add := func(key string, val any) {
+		fields = append(fields, [2]string{key, fmt.Sprint(val)})
+	}
+
+	switch name {
+	case "server":
+		uptime := time.Since(srv.startTime)
+		executable, _ := os.Executable()
+		add("godis_version", GodisVersion)
+		add("go_version", runtime.Version())
+		add("os", runtime.GOOS+" "+runtime.GOARCH)
+		add("multiplexing_api", "epoll")
+		add("process_id", os.Getpid())
+		add("tcp_port", srv.config.Port)
+		add("server_time_usec", time.Now().UnixMicro())
+		add("uptime_in_seconds", int64(uptime.Seconds()))
+		add("uptime_in_days", int64(uptime.Hours()/24))
+		add("io_threads_active", srv.config.IOThreads)
+		add("executable", executable)
+		add("config_file", srv.config.file)
+	case "clients":
+		maxInput, maxOutput, blocked := 0, 0, 0
+		for _, cli := range srv.clients {
+			maxInput = max(maxInput, cli.queryLen+len(cli.bigArg))
+			maxOutput = max(maxOutput, cli.replyLen)
+			if cli.blocked {
+				blocked++
+			}
+		}
+		add("connected_clients", len(srv.clients))
+		add("maxclients", srv.config.MaxClients)
+		add("client_biggest_input_buf", maxInput)
+		add("client_biggest_output_buf", maxOutput)
+		add("blocked_clients", blocked)
+		add("tracking_clients", srv.tracking.Clients())
+	case "memory":
+		used, sys := usedMemory()
+		srv.stats.peakMemory = max(srv.stats.peakMemory, used)
+		add("used_memory", used)
+		add("used_memory_human", bytesToHuman(used))
+		add("used_memory_peak", srv.stats.peakMemory)
+		add("used_memory_peak_human", bytesToHuman(srv.stats.peakMemory))
+		add("used_memory_sys", sys)
+		add("used_memory_sys_human", bytesToHuman(sys))
+		add("used_memory_dataset", srv.db.memory)
+		add("used_memory_dataset_human", bytesToHuman(srv.db.memory))
+		add("maxmemory", srv.config.MaxMemory)
+		add("maxmemory_human", bytesToHuman(srv.config.MaxMemory))
+		add("maxmemory_policy", srv.config.MaxMemoryPolicy)
+	case "persistence":
+		add("loading", 0)
+		add("changes_since_start", srv.db.dirty)
+	case "stats":
+		add("total_connections_received", srv.stats.numConnections)
+		add("total_commands_processed", srv.stats.numCommands)
+		add("instantaneous_ops_per_sec", srv.stats.opsSamples.average())
+		add("rejected_connections", srv.stats.rejectedConnections)
+		add("client_output_buffer_limit_disconnections", srv.stats.outputLimitKills)
+		add("expired_keys", srv.db.expiredKeys)
+		add("evicted_keys", srv.stats.evictedKeys)
+		add("keyspace_hits", srv.db.hits)
+		add("keyspace_misses", srv.db.misses)
+		add("tracking_total_keys", srv.tracking.TotalKeys())
+		add("tracking_total_prefixes", srv.tracking.TotalPrefixes())
+	case "keyspace":
+		if keys := srv.db.KeyCount(); keys > 0 {
+			add("db0", fmt.Sprintf("keys=%d,expires=%d", keys, srv.db.ExpireCount()))
+		}
+	case "commandstats":
+		for _, cmdName := range sortedKeys(srv.cmdStats) {
+			stats := srv.cmdStats[cmdName]
+			usecPerCall := 0.0
+			if stats.calls > 0 {
+				usecPerCall = float64(stats.usec) / float64(stats.calls)
+			}
+			add("cmdstat_"+cmdName, fmt.Sprintf("calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d",
+				stats.calls, stats.usec, usecPerCall, stats.rejected, stats.failed))
+		}
+	}
+	return fields
+}
+
+// info [section [section ...]]
+func infoCmd(cli *GodisClient) string {
+	sections := make([]string, 0, len(cli.args)-1)
+	for _, arg := range cli.args[1:] {
+		sections = append(sections, arg.StrVal())
+	}
+	return replyBulk(cli.srv.Info(sections...))
+}
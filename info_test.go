@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricSamples(t *testing.T) {
+	var m metricSamples
+	now := time.Now()
+	for i := 0; i <= StatsMetricSamples; i++ {
+		m.track(int64(i*100), now.Add(time.Duration(i)*100*time.Millisecond))
+	}
+	assert.Equal(t, int64(1000), m.average())
+}
+
+func TestBytesToHuman(t *testing.T) {
+	assert.Equal(t, "100B", bytesToHuman(100))
+	assert.Equal(t, "1.50K", bytesToHuman(1536))
+	assert.Equal(t, "2.00M", bytesToHuman(2*1024*1024))
+	assert.Equal(t, "1.00G", bytesToHuman(1024*1024*1024))
+}
+
+func TestInfo(t *testing.T) {
+	srv := newTestServer(t, 6685)
+	cli := srv.newClient(0)
+	execCmd(cli, "set", "k1", "v1")
+	execCmd(cli, "set", "k2", "v2")
+	execCmd(cli, "expire", "k2", "100")
+	execCmd(cli, "get", "k1")
+	execCmd(cli, "get", "nokey")
+	execCmd(cli, "nocmd")
+
+	info := srv.Info()
+	assert.True(t, strings.HasPrefix(info, "# Server\r\ngodis_version:"+GodisVersion+"\r\n"))
+	for _, field := range []string{
+		"# Clients\r\n", "# Memory\r\n", "# Persistence\r\n", "# Stats\r\n", "# Keyspace\r\n",
+		"tcp_port:6685\r\n", "total_commands_processed:5\r\n",
+		"keyspace_hits:1\r\n", "keyspace_misses:1\r\n", "db0:keys=2,expires=1\r\n",
+	} {
+		assert.Contains(t, info, field)
+	}
+	assert.NotContains(t, info, "# Commandstats")
+
+	info = srv.Info("STATS", "commandstats")
+	assert.True(t, strings.HasPrefix(info, "# Stats\r\n"))
+	assert.Contains(t, info, "\r\n\r\n# Commandstats\r\ncmdstat_expire:calls=1,")
+	assert.Contains(t, info, "cmdstat_set:calls=2,")
+	assert.NotContains(t, info, "# Server")
+
+	assert.Contains(t, srv.Info("everything"), "# Commandstats")
+	assert.Equal(t, "", srv.Info("nosection"))
+
+	assert.Equal(t, ReplyOK, execCmd(cli, "config", "resetstat"))
+	info = srv.Info("stats", "commandstats")
+	// the CONFIG RESETSTAT itself is counted
+	assert.Contains(t, info, "total_commands_processed:1\r\n")
+	assert.Contains(t, info, "keyspace_hits:0\r\n")
+	assert.NotContains(t, info, "cmdstat_set")
+
+	assert.Equal(t, replyBulk(srv.Info("keyspace")), execCmd(cli, "info", "keyspace"))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+)
+
+// IOThreads reads, parses and writes for clients in parallel, while commands are still
+// executed one by one in the event loop goroutine. The caller goroutine works as thread 0.
+type IOThreads struct {
+	jobs []chan ioJob
+	wg   sync.WaitGroup
+}
+
+type ioJob struct {
+	clients []*GodisClient
+	proc    func(cli *GodisClient)
+}
+
+func NewIOThreads(n int) *IOThreads {
+	t := &IOThreads{jobs: make([]chan ioJob, n-1)}
+	for i := range t.jobs {
+		t.jobs[i] = make(chan ioJob)
+		go t.loop(t.jobs[i])
+	}
+	return t
+}
+
+func (t *IOThreads) loop(jobs chan ioJob) {
+	for job := range jobs {
+		for _, cli := range job.clients {
+			job.proc(cli)
+		}
+		t.wg.Done()
+	}
+}
+
+// Run calls proc for every client across the io threads and waits for all of them.
+func (t *IOThreads) Run(clients []*GodisClient, proc func(cli *GodisClient)) {
+	n := len(t.jobs) + 1
+	buckets := make([][]*GodisClient, n)
+	for i, cli := range clients {
+		buckets[i%n] = append(buckets[i%n], cli)
+	}
+
+	for i, ch := range t.jobs {
+		if len(buckets[i+1]) > 0 {
+			t.wg.Add(1)
+			ch <- ioJob{clients: buckets[i+1], proc: proc}
+		}
+	}
+
+	for _, cli := range buckets[0] {
+		proc(cli)
+	}
+	t.wg.Wait()
+}
+
+func (t *IOThreads) Stop() {
+	for _, ch := range t.jobs {
+		close(ch)
+	}
+}
+
+// PostponeRead queues the client to be read by io threads before next epoll wait.
+func (srv *GodisServer) PostponeRead(lp *EventLoop, fd int, arg any) {
+	cli := arg.(*GodisClient)
+	if !cli.pendingRead && !cli.closeAfterReply && !cli.closeAsap {
+		cli.pendingRead = true
+		srv.pendingRead = append(srv.pendingRead, cli)
+	}
+}
+
+func (srv *GodisServer) handleClientsWithPendingReads() {
+	clients := srv.pendingRead
+	srv.pendingRead = nil
+	if len(clients) == 0 {
+		return
+	}
+
+	srv.io.Run(clients, func(cli *GodisClient) {
+		// the parser can't go on after a protocol error
+		if cli.ioErr = cli.readFromSocket(); cli.ioErr == nil && cli.protoErr == nil {
+			cli.protoErr = cli.parseQuery()
+		}
+	})
+
+	for _, cli := range clients {
+		cli.pendingRead = false
+		if cli.closed {
+			continue
+		}
+		if cli.ioErr != nil {
+			cli.logReadError(cli.ioErr)
+			cli.free()
+			continue
+		}
+		cli.processQueued()
+		if !cli.closed && !cli.blocked && cli.protoErr != nil {
+			cli.protocolError(cli.protoErr)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const LatencyTsLen = 160 // samples kept per event
+
+// the event classes of the server, besides the ones of the event loop
+const (
+	LatencyCommand       = "command"      // commands not in the @fast category
+	LatencyFastCommand   = "fast-command" // commands in the @fast category
+	LatencyExpireCycle   = "expire-cycle"
+	LatencySnapshotWrite = "snapshot-write" // writing the db file, including the fsync
+)
+
+type latencySample struct {
+	time    int64 // unix seconds
+	latency int64 // ms
+}
+
+// latencyTimeSeries is a ring of the latest samples of an event.
+type latencyTimeSeries struct {
+	idx     int   // the index of the next sample
+	max     int64 // the max latency of all time
+	samples [LatencyTsLen]latencySample
+}
+
+// LatencyMonitor records the latency spikes per event class.
+type LatencyMonitor struct {
+	events map[string]*latencyTimeSeries
+}
+
+func NewLatencyMonitor() *LatencyMonitor {
+	return &LatencyMonitor{events: make(map[string]*latencyTimeSeries)}
+}
+
+// Add records a sample of event, the samples in the same second are merged keeping the max.
+func (lm *LatencyMonitor) Add(event string, latency time.Duration, now time.Time) {
+	ts := lm.events[event]
+	if ts == nil {
+		ts = &latencyTimeSeries{}
+		lm.events[event] = ts
+	}
+	ms := latency.Milliseconds()
+	ts.max = max(ts.max, ms)
+
+	prev := &ts.samples[(ts.idx+LatencyTsLen-1)%LatencyTsLen]
+	if prev.time == now.Unix() {
+		prev.latency = max(prev.latency, ms)
+		return
+	}
+	ts.samples[ts.idx] = latencySample{now.Unix(), ms}
+	ts.idx = (ts.idx + 1) % LatencyTsLen
+}
+
+// History returns the samples of event, the oldest first.
+func (lm *LatencyMonitor) History(event string) []latencySample {
+	ts := lm.events[event]
+	if ts == nil {
+		return nil
+	}
+	var samples []latencySample
+	for i := 0; i < LatencyTsLen; i++ {
+		if s := ts.samples[(ts.idx+i)%LatencyTsLen]; s.time != 0 {
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
+
+// Reset removes the samples of the events, or all the events if none is given.
+// It returns the number of events reset.
+func (lm *LatencyMonitor) Reset(events ...string) int {
+	if len(events) == 0 {
+		n := len(lm.events)
+		lm.events = make(map[string]*latencyTimeSeries)
+		return n
+	}
+	n := 0
+	for _, event := range events {
+		if lm.events[event] != nil {
+			delete(lm.events, event)
+			n++
+		}
+	}
+	return n
+}
+
+// addLatency records the latency of event if it reaches latency-monitor-threshold.
+func (srv *GodisServer) addLatency(event string, latency time.Duration) {
+	threshold := srv.config.LatencyMonitorThreshold
+	if threshold > 0 && latency.Milliseconds() >= int64(threshold) {
+		srv.latency.Add(event, latency, time.Now())
+	}
+}
+
+// latencyAdvices explains the spikes of the event classes.
+var latencyAdvices = map[string]string{
+	LatencyCommand:        "Slow commands are blocking the server, check SLOWLOG GET for the commands to avoid or split.",
+	LatencyFastCommand:    "Even O(1) commands are slow, the host may be overloaded or the process swapped out.",
+	LatencyExpireCycle:    "Many keys expired at the same time, spread their TTLs with some randomness.",
+	LatencySnapshotWrite:  "The disk is slow to write and fsync the db file.",
+	LatencyEventLoop:      "An iteration of the event loop took long, check the other events for the cause.",
+	LatencyEpollOvershoot: "The process was not scheduled in time after epoll wait, the CPU of the host may be saturated.",
+	LatencyTimeEvents:     "The periodic tasks are slow, check expire-cycle and the number of clients.",
+}
+
+// latencyDoctor returns a human readable report of the latency spikes with advices.
+func latencyDoctor(lm *LatencyMonitor, threshold int) string {
+	if threshold == 0 {
+		return "The latency monitor is disabled, enable it with CONFIG SET latency-monitor-threshold <milliseconds>.\n"
+	}
+	if len(lm.events) == 0 {
+		return "No latency spike was observed since the server started, the latency is fine.\n"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Latency spikes above %v ms were observed:\n\n", threshold)
+	for i, event := range sortedKeys(lm.events) {
+		samples := lm.History(event)
+		var sum int64
+		for _, s := range samples {
+			sum += s.latency
+		}
+		avg := float64(sum) / float64(len(samples))
+		var dev float64
+		for _, s := range samples {
+			dev += math.Abs(float64(s.latency) - avg)
+		}
+		dev /= float64(len(samples))
+		period := float64(samples[len(samples)-1].time-samples[0].time) / float64(len(samples))
+
+		fmt.Fprintf(&b, "%d. %v: %d latency spikes (average %.0fms, mean deviation %.0fms, period %.2f sec). "+
+			"Worst all time event %dms.\n", i+1, event, len(samples), avg, dev, period, lm.events[event].max)
+		if advice := latencyAdvices[event]; advice != "" {
+			fmt.Fprintf(&b, "   %v\n", advice)
+		}
+	}
+	return b.String()
+}
+
+// latency LATEST | HISTORY event | RESET [event ...] | DOCTOR
+func latencyCmd(cli *GodisClient) string {
+	args := cli.args
+	lm := cli.srv.Latency()
+	switch sub := strings.ToLower(args[1].StrVal()); {
+	case sub == "latest" && len(args) == 2:
+		var replies []string
+		for _, event := range sortedKeys(lm.events) {
+			ts := lm.events[event]
+			last := ts.samples[(ts.idx+LatencyTsLen-1)%LatencyTsLen]
+			replies = append(replies, replyArray([]string{
+				replyBulk(event), replyInt(last.time), replyInt(last.latency), replyInt(ts.max),
+			}))
+		}
+		return replyArray(replies)
+	case sub == "history" && len(args) == 3:
+		samples := lm.History(args[2].StrVal())
+		replies := make([]string, len(samples))
+		for i, s := range samples {
+			replies[i] = replyArray([]string{replyInt(s.time), replyInt(s.latency)})
+		}
+		return replyArray(replies)
+	case sub == "reset":
+		events := make([]string, len(args)-2)
+		for i, arg := range args[2:] {
+			events[i] = arg.StrVal()
+		}
+		return replyInt(int64(lm.Reset(events...)))
+	case sub == "doctor" && len(args) == 2:
+		return replyBulk(latencyDoctor(lm, cli.srv.Config().LatencyMonitorThreshold))
+	}
+	return replyErr(fmt.Sprintf("unknown subcommand or wrong number of arguments for 'latency|%v'", args[1].StrVal()))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyMonitor(t *testing.T) {
+	lm := NewLatencyMonitor()
+	now := time.Unix(1000, 0)
+	lm.Add("command", 10*time.Millisecond, now)
+	lm.Add("command", 30*time.Millisecond, now)
+	lm.Add("command", 20*time.Millisecond, now.Add(time.Second))
+	assert.Equal(t, []latencySample{{1000, 30}, {1001, 20}}, lm.History("command"))
+
+	// the oldest samples are overwritten
+	for i := 0; i < LatencyTsLen; i++ {
+		lm.Add("command", 5*time.Millisecond, now.Add(time.Duration(i+2)*time.Second))
+	}
+	samples := lm.History("command")
+	assert.Equal(t, LatencyTsLen, len(samples))
+	assert.Equal(t, latencySample{1002, 5}, samples[0])
+	assert.Equal(t, int64(30), lm.events["command"].max)
+
+	lm.Add("expire-cycle", 10*time.Millisecond, now)
+	assert.Equal(t, 1, lm.Reset("expire-cycle", "unknown"))
+	assert.Nil(t, lm.History("expire-cycle"))
+	assert.Equal(t, 1, lm.Reset())
+}
+
+func TestLatencyCmd(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli := srv.newClient(0)
+
+	assert.Contains(t, execCmd(cli, "latency", "doctor"), "disabled")
+	srv.addLatency(LatencyCommand, time.Second)
+	assert.Equal(t, "*0\r\n", execCmd(cli, "latency", "latest"))
+
+	assert.Equal(t, ReplyOK, execCmd(cli, "config", "set", "latency-monitor-threshold", "100"))
+	assert.Contains(t, execCmd(cli, "latency", "doctor"), "No latency spike")
+	srv.addLatency(LatencyCommand, 50*time.Millisecond)
+	srv.addLatency(LatencyExpireCycle, 200*time.Millisecond)
+	now := time.Now().Unix()
+	assert.Equal(t, replyArray([]string{
+		replyArray([]string{replyBulk(LatencyExpireCycle), replyInt(now), replyInt(200), replyInt(200)}),
+	}), execCmd(cli, "latency", "latest"))
+	assert.Equal(t, replyArray([]string{replyArray([]string{replyInt(now), replyInt(200)})}),
+		execCmd(cli, "latency", "history", LatencyExpireCycle))
+
+	doctor := execCmd(cli, "latency", "doctor")
+	assert.Contains(t, doctor, "1. expire-cycle: 1 latency spikes (average 200ms")
+	assert.Contains(t, doctor, latencyAdvices[LatencyExpireCycle])
+
+	assert.Equal(t, replyInt(1), execCmd(cli, "latency", "reset"))
+	assert.Equal(t, "*0\r\n", execCmd(cli, "latency", "history", LatencyExpireCycle))
+	assert.True(t, strings.HasPrefix(execCmd(cli, "latency", "foo"), "-ERR: unknown subcommand"))
+}
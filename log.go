@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+type LogLevel uint8
+
+const (
+	LogDebug LogLevel = iota
+	LogVerbose
+	LogNotice
+	LogWarning
+)
+
+var LogLevelNames = []string{"debug", "verbose", "notice", "warning"}
+
+// logLevel is the min level of messages to log, it's set from the loglevel config.
+// It's atomic since the messages may be logged out of the event loop, like by the io threads.
+var logLevel atomic.Int32
+
+func init() {
+	logLevel.Store(int32(LogNotice))
+}
+
+var logFile *os.File
+
+func SetLogLevel(name string) error {
+	for i, levelName := range LogLevelNames {
+		if levelName == name {
+			logLevel.Store(int32(i))
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level %v", name)
+}
+
+// SetLogFile redirects the log to path, empty path means stderr.
+func SetLogFile(path string) error {
+	var f *os.File
+	if path == "" {
+		log.SetOutput(os.Stderr)
+	} else {
+		var err error
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("open log file failed: %v", err)
+		}
+		log.SetOutput(f)
+	}
+
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = f
+	return nil
+}
+
+func logAt(level LogLevel, format string, v ...any) {
+	if level >= LogLevel(logLevel.Load()) {
+		log.Printf(format, v...)
+	}
+}
+
+func logDebug(format string, v ...any) {
+	logAt(LogDebug, format, v...)
+}
+
+func logVerbose(format string, v ...any) {
+	logAt(LogVerbose, format, v...)
+}
+
+func logNotice(format string, v ...any) {
+	logAt(LogNotice, format, v...)
+}
+
+func logWarning(format string, v ...any) {
+	logAt(LogWarning, format, v...)
+}
@@ -2,18 +2,49 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"os"
 )
 
 func main() {
-    var port, limit int
-    flag.IntVar(&port, "port", 6666, "port number")
-    flag.IntVar(&limit, "limit", 1000, "max client limit")
-    flag.Parse()
+	config := NewGodisConfig()
 
-    srv := NewGodisServer(port, limit)
+	// every config param can be overridden by a flag with the same name, like -port 6379
+	var overrides [][2]string
+	for _, name := range config.names {
+		name := name
+		flag.Func(name, fmt.Sprintf("config %v (default %q)", name, config.params[name].defVal), func(val string) error {
+			overrides = append(overrides, [2]string{name, val})
+			return nil
+		})
+	}
+	flag.Func("limit", "alias of -maxclients", func(val string) error {
+		overrides = append(overrides, [2]string{"maxclients", val})
+		return nil
+	})
+	configFile := flag.String("config", "", "path of the config file")
+	flag.Parse()
+
+	if *configFile == "" && flag.NArg() > 0 {
+		*configFile = flag.Arg(0)
+	}
+	if *configFile != "" {
+		if err := config.LoadFile(*configFile); err != nil {
+			log.Println("load config failed:", err)
+			os.Exit(1)
+		}
+	}
+	for _, kv := range overrides {
+		if err := config.load(kv[0], kv[1]); err != nil {
+			log.Println("invalid flag:", err)
+			os.Exit(1)
+		}
+	}
+
+	srv := NewGodisServer(config)
 	if err := srv.Run(); err != nil {
 		log.Println("run server failed:", err)
+		os.Exit(1)
 	}
 }
-
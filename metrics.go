@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const MetricsTimeout = 5 * time.Second // the max time to wait for the event loop to collect the metrics
+
+// startMetrics serves /metrics in the prometheus text format on metrics-port of the bind addresses.
+// The metrics are collected in the event loop, so the http goroutines never touch the server state.
+// It returns the func stopping the http server.
+func (srv *GodisServer) startMetrics() (func(), error) {
+	fds, err := srv.listen(srv.config.MetricsPort)
+	if err != nil {
+		return nil, err
+	}
+	var listeners []net.Listener
+	for _, fd := range fds {
+		f := os.NewFile(uintptr(fd), "metrics")
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("listen for metrics failed: %v", err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", srv.serveMetrics)
+	hs := &http.Server{Handler: mux, ReadHeaderTimeout: MetricsTimeout}
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			if err := hs.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logWarning("metrics server failed: %v", err)
+			}
+		}(l)
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		hs.Shutdown(ctx)
+	}, nil
+}
+
+func (srv *GodisServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	text := make(chan string, 1)
+	srv.lp.Post(func() {
+		text <- srv.metrics()
+	})
+	select {
+	case t := <-text:
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write([]byte(t))
+	case <-time.After(MetricsTimeout):
+		http.Error(w, "the server is busy", http.StatusServiceUnavailable)
+	case <-r.Context().Done():
+	}
+}
+
+// metricsWriter writes the metrics in the prometheus text format.
+type metricsWriter struct {
+	strings.Builder
+}
+
+func (w *metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+}
+
+// sample writes a sample of name, labels are pairs of label names and values.
+func (w *metricsWriter) sample(name string, val any, labels ...string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%v=%v", labels[i], strconv.Quote(labels[i+1]))
+		}
+		w.WriteByte('}')
+	}
+	fmt.Fprintf(w, " %v\n", val)
+}
+
+func (w *metricsWriter) single(name, typ, help string, val any) {
+	w.header(name, typ, help)
+	w.sample(name, val)
+}
+
+// metrics returns the metrics of the server in the prometheus text format.
+func (srv *GodisServer) metrics() string {
+	var w metricsWriter
+	used, sys := usedMemory()
+	w.single("godis_uptime_seconds", "gauge", "Seconds since the server started.", int64(time.Since(srv.startTime).Seconds()))
+	w.single("godis_connected_clients", "gauge", "Number of connected clients.", len(srv.clients))
+	w.single("godis_connections_received_total", "counter", "Total connections accepted.", srv.stats.numConnections)
+	w.single("godis_rejected_connections_total", "counter", "Connections rejected by maxclients.", srv.stats.rejectedConnections)
+	w.single("godis_memory_used_bytes", "gauge", "Bytes of the live heap objects.", used)
+	w.single("godis_memory_sys_bytes", "gauge", "Bytes mapped by the go runtime.", sys)
+	w.single("godis_memory_dataset_bytes", "gauge", "Estimated bytes of the keys and values.", srv.db.memory)
+	w.single("godis_memory_max_bytes", "gauge", "The maxmemory config, 0 means no limit.", srv.config.MaxMemory)
+	w.single("godis_expired_keys_total", "counter", "Keys deleted by expiration.", srv.db.expiredKeys)
+	w.single("godis_evicted_keys_total", "counter", "Keys evicted by maxmemory.", srv.stats.evictedKeys)
+	w.single("godis_keyspace_hits_total", "counter", "Successful lookups of keys.", srv.db.hits)
+	w.single("godis_keyspace_misses_total", "counter", "Failed lookups of keys.", srv.db.misses)
+
+	w.header("godis_db_keys", "gauge", "Number of keys per db.")
+	w.sample("godis_db_keys", srv.db.KeyCount(), "db", "0")
+	w.header("godis_db_keys_expiring", "gauge", "Number of keys with an expire per db.")
+	w.sample("godis_db_keys_expiring", srv.db.ExpireCount(), "db", "0")
+
+	names := sortedKeys(srv.cmdStats)
+	w.header("godis_commands_total", "counter", "Commands processed by name and status.")
+	for _, name := range names {
+		stats := srv.cmdStats[name]
+		w.sample("godis_commands_total", stats.calls-stats.failed, "cmd", name, "status", "ok")
+		w.sample("godis_commands_total", stats.failed, "cmd", name, "status", "failed")
+		w.sample("godis_commands_total", stats.rejected, "cmd", name, "status", "rejected")
+	}
+	w.header("godis_command_duration_seconds", "histogram", "Latency of the executed commands.")
+	for _, name := range names {
+		stats := srv.cmdStats[name]
+		var count int64
+		for i, bound := range CommandLatencyBuckets {
+			count += stats.hist[i]
+			w.sample("godis_command_duration_seconds_bucket", count, "cmd", name, "le", strconv.FormatFloat(float64(bound)/1e6, 'f', -1, 64))
+		}
+		w.sample("godis_command_duration_seconds_bucket", stats.calls, "cmd", name, "le", "+Inf")
+		w.sample("godis_command_duration_seconds_sum", strconv.FormatFloat(float64(stats.usec)/1e6, 'f', -1, 64), "cmd", name)
+		w.sample("godis_command_duration_seconds_count", stats.calls, "cmd", name)
+	}
+	return w.String()
+}
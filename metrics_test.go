@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandStatsTrack(t *testing.T) {
+	var stats CommandStats
+	stats.track(5*time.Microsecond, false)
+	stats.track(10*time.Microsecond, true)
+	stats.track(11*time.Microsecond, false)
+	stats.track(2*time.Second, false)
+	assert.Equal(t, int64(4), stats.calls)
+	assert.Equal(t, int64(1), stats.failed)
+	assert.Equal(t, int64(2), stats.hist[0])
+	assert.Equal(t, int64(1), stats.hist[1])
+	assert.Equal(t, int64(1), stats.hist[len(CommandLatencyBuckets)])
+}
+
+func TestMetrics(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli := srv.newClient(0)
+	execCmd(cli, "set", "key", "val")
+	execCmd(cli, "get", "key")
+	execCmd(cli, "restore", "key2", "0", "bad payload")
+	cli.authenticated = false
+	execCmd(cli, "get", "key")
+
+	metrics := srv.metrics()
+	assert.Contains(t, metrics, "# TYPE godis_connected_clients gauge\ngodis_connected_clients 0\n")
+	assert.Contains(t, metrics, "godis_db_keys{db=\"0\"} 1\n")
+	assert.Contains(t, metrics, "godis_commands_total{cmd=\"get\",status=\"ok\"} 1\n")
+	assert.Contains(t, metrics, "godis_commands_total{cmd=\"get\",status=\"rejected\"} 1\n")
+	assert.Contains(t, metrics, "godis_commands_total{cmd=\"restore\",status=\"failed\"} 1\n")
+	assert.Contains(t, metrics, "# TYPE godis_command_duration_seconds histogram\n")
+	assert.Contains(t, metrics, "godis_command_duration_seconds_bucket{cmd=\"set\",le=\"+Inf\"} 1\n")
+	assert.Contains(t, metrics, "godis_command_duration_seconds_count{cmd=\"set\"} 1\n")
+	assert.Contains(t, srv.Info("commandstats"), "cmdstat_get:calls=1,")
+	assert.Contains(t, srv.Info("commandstats"), "rejected_calls=1,failed_calls=0")
+}
+
+func TestMetricsServer(t *testing.T) {
+	port, metricsPort := 6695, 6696
+	srv := newTestServer(t, port)
+	srv.config.MetricsPort = metricsPort
+	startServer(t, srv)
+	defer stopServer(srv)
+
+	fd, err := Connect([4]byte{127, 0, 0, 1}, port)
+	assert.Nil(t, err)
+	defer Close(fd)
+	roundTrip(t, fd, "set key val\r\n", ReplyOK)
+
+	resp, err := http.Get("http://127.0.0.1:6696/metrics")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), "godis_connected_clients 1\n")
+	assert.Contains(t, string(body), "godis_commands_total{cmd=\"set\",status=\"ok\"} 1\n")
+
+	resp, err = http.Get("http://127.0.0.1:6696/foo")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
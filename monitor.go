@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ReplyMonitorKeyspace = replyErr("monitor clients can't interact with the keyspace")
+
+// AddMonitor makes cli receive every command executed by the server.
+func (srv *GodisServer) AddMonitor(cli *GodisClient) {
+	srv.monitors = append(srv.monitors, cli)
+}
+
+func (srv *GodisServer) removeMonitor(cli *GodisClient) {
+	for i, m := range srv.monitors {
+		if m == cli {
+			srv.monitors = append(srv.monitors[:i], srv.monitors[i+1:]...)
+			return
+		}
+	}
+}
+
+// feedMonitors sends the command of cli to the monitors, admin commands are not fed like redis does.
+func (srv *GodisServer) feedMonitors(cli *GodisClient, cmd *GodisCommand) {
+	if len(srv.monitors) == 0 || cmd.acl&AclAdmin != 0 {
+		return
+	}
+	line := monitorLine(cli, cmd, time.Now())
+	for _, m := range srv.monitors {
+		m.AddReply(line)
+	}
+}
+
+// monitorLine formats the command like redis, e.g. +1339518083.107412 [0 127.0.0.1:60866] "keys" "*"
+func monitorLine(cli *GodisClient, cmd *GodisCommand, now time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "+%d.%06d [0 %v]", now.Unix(), now.Nanosecond()/1000, cli.addr)
+	for i, arg := range cli.args {
+		b.WriteByte(' ')
+		if argRedacted(cmd, cli.args, i) {
+			b.WriteString(reprArg("(redacted)"))
+		} else {
+			b.WriteString(reprArg(arg.StrVal()))
+		}
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// monitor
+func monitorCmd(cli *GodisClient) string {
+	if !cli.monitor {
+		cli.monitor = true
+		cli.srv.AddMonitor(cli)
+	}
+	return ReplyOK
+}
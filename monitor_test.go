@@ -0,0 +1,52 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMonitorLine(t *testing.T) {
+	cli := NewGodisClient(0, nil, &MockIGodisServer{})
+	cli.addr = "127.0.0.1:1234"
+	now := time.Unix(1339518083, 107412000)
+
+	cli.args = strArgs("set", "key", "a \"b\"\n\x01")
+	assert.Equal(t, "+1339518083.107412 [0 127.0.0.1:1234] \"set\" \"key\" \"a \\\"b\\\"\\n\\x01\"\r\n",
+		monitorLine(cli, CmdTable[GodisCmdSet], now))
+	cli.args = strArgs("auth", "user", "pass")
+	assert.Equal(t, "+1339518083.107412 [0 127.0.0.1:1234] \"auth\" \"(redacted)\" \"(redacted)\"\r\n",
+		monitorLine(cli, CmdTable[GodisCmdAuth], now))
+	cli.args = strArgs("hello", "3", "auth", "user", "pass")
+	assert.Equal(t, "+1339518083.107412 [0 127.0.0.1:1234] \"hello\" \"3\" \"auth\" \"(redacted)\" \"(redacted)\"\r\n",
+		monitorLine(cli, CmdTable[GodisCmdHello], now))
+}
+
+func TestMonitorCmd(t *testing.T) {
+	srv := newTestServer(t, 0)
+	m := srv.newClient(0)
+	cli := srv.newClient(1)
+	cli.addr = "127.0.0.1:1234"
+
+	assert.Equal(t, ReplyOK, execCmd(m, "monitor"))
+	assert.Equal(t, ReplyOK, execCmd(m, "monitor"))
+	assert.Equal(t, 1, len(srv.monitors))
+	assert.Equal(t, "O", m.flags())
+	assert.Equal(t, ClientClassNormal, m.class())
+	assert.Equal(t, ReplyMonitorKeyspace, execCmd(m, "get", "key"))
+
+	execCmd(cli, "set", "key", "val")
+	assert.Equal(t, 1, len(m.reply))
+	assert.Regexp(t, regexp.MustCompile(`^\+\d+\.\d{6} \[0 127\.0\.0\.1:1234\] "set" "key" "val"\r\n$`),
+		string(m.reply[len(m.reply)-1]))
+
+	// admin commands are not fed
+	execCmd(cli, "config", "get", "maxclients")
+	assert.Equal(t, 1, len(m.reply))
+
+	srv.removeMonitor(m)
+	execCmd(cli, "get", "key")
+	assert.Equal(t, 1, len(m.reply))
+}
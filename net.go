@@ -1,19 +1,58 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
 	"golang.org/x/sys/unix"
 )
 
 const Backlog = 64
 
+var ErrTimeout = errors.New("timeout")
+
+// TcpServer creates a non-blocking listening socket on all the ipv4 interfaces.
 func TcpServer(port int) (int, error) {
-	// create ipv4 tcp socket
-	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	return ListenTcp("0.0.0.0", port)
+}
+
+// ListenTcp creates a non-blocking listening socket on the ipv4 or ipv6 address bind.
+func ListenTcp(bind string, port int) (int, error) {
+	ip := net.ParseIP(bind)
+	if ip == nil {
+		return -1, fmt.Errorf("invalid ip address %v", bind)
+	}
+
+	var sa unix.Sockaddr
+	family := unix.AF_INET
+	if ip4 := ip.To4(); ip4 != nil {
+		addr := &unix.SockaddrInet4{Port: port}
+		copy(addr.Addr[:], ip4)
+		sa = addr
+	} else {
+		addr := &unix.SockaddrInet6{Port: port}
+		copy(addr.Addr[:], ip)
+		sa, family = addr, unix.AF_INET6
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
 	if err != nil {
 		return -1, fmt.Errorf("init socket failed: %v", err)
 	}
 
+	// an ipv6 socket on :: accepts ipv4 connections by default, which conflicts with binding 0.0.0.0
+	if family == unix.AF_INET6 {
+		if err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 1); err != nil {
+			unix.Close(fd)
+			return -1, fmt.Errorf("set IPV6_V6ONLY failed: %v", err)
+		}
+	}
+
 	// the SO_REUSEPORT option allows multiple sockets on the same host to bind to the same port,
 	// and is intended to improve the performance of multithreaded network server applications running on top of multicore systems.
 	err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, port)
@@ -22,12 +61,8 @@ func TcpServer(port int) (int, error) {
 		return -1, fmt.Errorf("set SO_REUSEPORT failed: %v", err)
 	}
 
-	var addr unix.SockaddrInet4
-	addr.Port = port
-
-	// golang will set addr.Addr = any(0)
 	// golang will handle htons
-	err = unix.Bind(fd, &addr)
+	err = unix.Bind(fd, sa)
 	if err != nil {
 		unix.Close(fd)
 		return -1, fmt.Errorf("bind addr failed: %v", err)
@@ -42,10 +77,42 @@ func TcpServer(port int) (int, error) {
 	return fd, err
 }
 
+// ListenUnix creates a non-blocking listening unix socket at path, replacing the stale socket file if any.
+// The permissions of the file are changed to perm unless it's 0.
+func ListenUnix(path string, perm os.FileMode) (int, error) {
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("init socket failed: %v", err)
+	}
+
+	unix.Unlink(path)
+	if err = unix.Bind(fd, &unix.SockaddrUnix{Name: path}); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("bind unix socket %v failed: %v", path, err)
+	}
+	if perm != 0 {
+		if err = os.Chmod(path, perm); err != nil {
+			unix.Close(fd)
+			return -1, fmt.Errorf("chmod unix socket %v failed: %v", path, err)
+		}
+	}
+	if err = unix.Listen(fd, Backlog); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("listen socket failed: %v", err)
+	}
+	return fd, nil
+}
+
+// Accept returns a non-blocking client socket, unix.EAGAIN if there is no pending connection.
 func Accept(fd int) (int, error) {
-	// ignore client addr
-	nfd, _, err := unix.Accept(fd)
-	return nfd, err
+	for {
+		// ignore client addr
+		nfd, _, err := unix.Accept4(fd, unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		if err == unix.EINTR {
+			continue
+		}
+		return nfd, err
+	}
 }
 
 func Connect(host [4]byte, port int) (int, error) {
@@ -65,14 +132,177 @@ func Connect(host [4]byte, port int) (int, error) {
 	return fd, nil
 }
 
+// ConnectTimeout connects a non-blocking socket to host, giving up after ms milliseconds.
+func ConnectTimeout(host [4]byte, port int, ms int64) (int, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		return -1, fmt.Errorf("init socket failed: %v", err)
+	}
+
+	var addr unix.SockaddrInet4
+	addr.Addr = host
+	addr.Port = port
+	err = unix.Connect(fd, &addr)
+	if err == unix.EINPROGRESS {
+		err = WaitFd(fd, unix.POLLOUT, time.Now().Add(time.Duration(ms)*time.Millisecond))
+		if err == nil {
+			var errno int
+			errno, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+			if err == nil && errno != 0 {
+				err = unix.Errno(errno)
+			}
+		}
+	}
+	if err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("connect failed: %v", err)
+	}
+	return fd, nil
+}
+
+// WaitFd polls the socket for events, returning ErrTimeout if none happened before the deadline.
+func WaitFd(fd int, events int16, deadline time.Time) error {
+	for {
+		timeout := time.Until(deadline).Milliseconds()
+		if timeout <= 0 {
+			return ErrTimeout
+		}
+		n, err := unix.Poll([]unix.PollFd{{Fd: int32(fd), Events: events}}, int(timeout))
+		switch {
+		case err == unix.EINTR:
+			continue
+		case err != nil:
+			return err
+		case n == 0:
+			return ErrTimeout
+		}
+		return nil
+	}
+}
+
+// ResolveHost returns the first ipv4 address of host.
+func ResolveHost(host string) ([4]byte, error) {
+	var addr [4]byte
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return addr, fmt.Errorf("resolve host failed: %v", err)
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			copy(addr[:], ip4)
+			return addr, nil
+		}
+	}
+	return addr, fmt.Errorf("no ipv4 address for host %v", host)
+}
+
+// Read returns 0 bytes without error if the socket has nothing to read, io.EOF if the peer closed the connection.
 func Read(fd int, buf []byte) (int, error) {
-	return unix.Read(fd, buf)
+	for {
+		n, err := unix.Read(fd, buf)
+		switch {
+		case err == unix.EINTR:
+			continue
+		case err == unix.EAGAIN:
+			return 0, nil
+		case err != nil:
+			return 0, err
+		case n == 0 && len(buf) > 0:
+			return 0, io.EOF
+		}
+		return n, nil
+	}
 }
 
+// Write returns 0 bytes without error if the socket is full.
 func Write(fd int, buf []byte) (int, error) {
-	return unix.Write(fd, buf)
+	for {
+		n, err := unix.Write(fd, buf)
+		switch {
+		case err == unix.EINTR:
+			continue
+		case err == unix.EAGAIN:
+			return 0, nil
+		case err != nil:
+			return 0, err
+		}
+		return n, nil
+	}
+}
+
+// Writev writes bufs with a single syscall, returns 0 bytes without error if the socket is full.
+func Writev(fd int, bufs [][]byte) (int, error) {
+	for {
+		n, err := unix.Writev(fd, bufs)
+		switch {
+		case err == unix.EINTR:
+			continue
+		case err == unix.EAGAIN:
+			return 0, nil
+		case err != nil:
+			return 0, err
+		}
+		return n, nil
+	}
+}
+
+// SetTcpNoDelay disables the Nagle's algorithm, so small replies are sent immediately.
+func SetTcpNoDelay(fd int) error {
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1); err != nil {
+		return fmt.Errorf("set TCP_NODELAY failed: %v", err)
+	}
+	return nil
+}
+
+// SetKeepAlive enables tcp keepalive, the connection is closed if the peer doesn't answer
+// 3 probes after being idle for interval seconds.
+func SetKeepAlive(fd int, interval int) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1); err != nil {
+		return fmt.Errorf("set SO_KEEPALIVE failed: %v", err)
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, interval); err != nil {
+		return fmt.Errorf("set TCP_KEEPIDLE failed: %v", err)
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, max(interval/3, 1)); err != nil {
+		return fmt.Errorf("set TCP_KEEPINTVL failed: %v", err)
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, 3); err != nil {
+		return fmt.Errorf("set TCP_KEEPCNT failed: %v", err)
+	}
+	return nil
+}
+
+// formatSockaddr formats sa like ip:port, or path:0 for unix sockets.
+func formatSockaddr(sa unix.Sockaddr) string {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *unix.SockaddrInet6:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *unix.SockaddrUnix:
+		return sa.Name + ":0"
+	}
+	return "?"
+}
+
+// PeerName returns the address of the remote side of the socket.
+func PeerName(fd int) string {
+	sa, err := unix.Getpeername(fd)
+	if err != nil {
+		return "?"
+	}
+	return formatSockaddr(sa)
+}
+
+// SockName returns the local address of the socket.
+func SockName(fd int) string {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return "?"
+	}
+	return formatSockaddr(sa)
 }
 
 func Close(fd int) {
-    unix.Close(fd)
+	unix.Close(fd)
 }
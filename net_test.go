@@ -1,9 +1,14 @@
 package main
 
 import (
+	"io"
+	"net"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 )
 
 func EchoServer(port int, ready chan struct{}, logf func(string, ...any)) {
@@ -13,7 +18,12 @@ func EchoServer(port int, ready chan struct{}, logf func(string, ...any)) {
 		return
 	}
 	ready <- struct{}{}
+	// the listening socket is non-blocking
 	cfd, err := Accept(sfd)
+	for err == unix.EAGAIN {
+		time.Sleep(time.Millisecond)
+		cfd, err = Accept(sfd)
+	}
 	if err != nil {
 		logf("accept failed: %v", err)
 		return
@@ -21,10 +31,13 @@ func EchoServer(port int, ready chan struct{}, logf func(string, ...any)) {
 
 	logf("accept conn: cfd = %v", cfd)
 	buf := make([]byte, 10)
-	_, err = Read(cfd, buf)
-	if err != nil {
-		logf("read failed: %v", err)
-		return
+	for n := 0; n < len(buf); {
+		m, err := Read(cfd, buf[n:])
+		if err != nil {
+			logf("read failed: %v", err)
+			return
+		}
+		n += m
 	}
 	_, err = Write(cfd, buf)
 	if err != nil {
@@ -53,3 +66,58 @@ func TestEchoServer(t *testing.T) {
 	assert.Equal(t, 10, n)
 	assert.Equal(t, msg, string(buf))
 }
+
+func TestNonBlockingReadWrite(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_NONBLOCK, 0)
+	assert.Nil(t, err)
+	defer Close(fds[0])
+
+	buf := make([]byte, 1024)
+	n, err := Read(fds[0], buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// fill the socket buffer until it would block
+	total := 0
+	for {
+		n, err = Write(fds[1], buf)
+		assert.Nil(t, err)
+		if n == 0 {
+			break
+		}
+		total += n
+	}
+	assert.Greater(t, total, 0)
+
+	Close(fds[1])
+	for total > 0 {
+		n, err = Read(fds[0], buf)
+		assert.Nil(t, err)
+		total -= n
+	}
+	_, err = Read(fds[0], buf)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestListenAddrs(t *testing.T) {
+	_, err := ListenTcp("localhost", 6692)
+	assert.NotNil(t, err)
+
+	for _, bind := range []string{"127.0.0.1", "::1"} {
+		fd, err := ListenTcp(bind, 6692)
+		if !assert.Nil(t, err, bind) {
+			continue
+		}
+		assert.Equal(t, net.JoinHostPort(bind, "6692"), SockName(fd))
+		Close(fd)
+	}
+
+	// the stale socket file is replaced
+	path := filepath.Join(t.TempDir(), "godis.sock")
+	for i := 0; i < 2; i++ {
+		fd, err := ListenUnix(path, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, path+":0", SockName(fd))
+		Close(fd)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// the classes of keyspace events, enabled by the flags of notify-keyspace-events like redis
+const (
+	NotifyKeyspace = 1 << iota // K, published to __keyspace@<db>__:<key>
+	NotifyKeyevent             // E, published to __keyevent@<db>__:<event>
+	NotifyGeneric              // g, commands like del and expire
+	NotifyString               // $
+	NotifyList                 // l
+	NotifySet                  // s
+	NotifyHash                 // h
+	NotifyZset                 // z
+	NotifyExpired              // x
+	NotifyEvicted              // e
+	NotifyStream               // t
+	NotifyKeyMiss              // m, not included in A
+	NotifyModule               // d
+	NotifyNew                  // n, not included in A
+
+	NotifyAll = NotifyGeneric | NotifyString | NotifyList | NotifySet | NotifyHash | NotifyZset |
+		NotifyExpired | NotifyEvicted | NotifyStream | NotifyModule // A
+)
+
+var notifyFlagChars = []struct {
+	char  byte
+	class int
+}{
+	{'g', NotifyGeneric}, {'$', NotifyString}, {'l', NotifyList}, {'s', NotifySet},
+	{'h', NotifyHash}, {'z', NotifyZset}, {'x', NotifyExpired}, {'e', NotifyEvicted},
+	{'t', NotifyStream}, {'m', NotifyKeyMiss}, {'d', NotifyModule}, {'n', NotifyNew},
+	{'K', NotifyKeyspace}, {'E', NotifyKeyevent},
+}
+
+// parseNotifyFlags parses the flags like "KEA" into the event classes.
+func parseNotifyFlags(s string) (int, error) {
+	flags := 0
+outer:
+	for i := 0; i < len(s); i++ {
+		if s[i] == 'A' {
+			flags |= NotifyAll
+			continue
+		}
+		for _, f := range notifyFlagChars {
+			if f.char == s[i] {
+				flags |= f.class
+				continue outer
+			}
+		}
+		return 0, errors.New("Invalid event class character. Use 'Ag$lshzxetmdnKE'.")
+	}
+	return flags, nil
+}
+
+// notifyFlagsString formats the flags like redis, A is used if all the classes of it are enabled.
+func notifyFlagsString(flags int) string {
+	var b strings.Builder
+	all := flags&NotifyAll == NotifyAll
+	if all {
+		b.WriteByte('A')
+	}
+	for _, f := range notifyFlagChars {
+		if flags&f.class != 0 && !(all && f.class&NotifyAll != 0) {
+			b.WriteByte(f.char)
+		}
+	}
+	return b.String()
+}
+
+// notifyKeyspaceEvent publishes the event of key if its class is enabled by notify-keyspace-events,
+// the modified key is also invalidated for the clients caching it.
+func (srv *GodisServer) notifyKeyspaceEvent(class int, event string, key *Obj) {
+	switch class {
+	case NotifyKeyMiss:
+	case NotifyExpired, NotifyEvicted:
+		// deleted by the server even if it's found by a command
+		srv.tracking.Invalidate(key.StrVal(), nil)
+	default:
+		srv.tracking.Invalidate(key.StrVal(), srv.currentClient)
+	}
+	flags := srv.config.NotifyKeyspaceEvents
+	if flags&class == 0 {
+		return
+	}
+	if flags&NotifyKeyspace != 0 {
+		srv.pubsub.Publish("__keyspace@0__:"+key.StrVal(), event)
+	}
+	if flags&NotifyKeyevent != 0 {
+		srv.pubsub.Publish("__keyevent@0__:"+event, key.StrVal())
+	}
+}
+
+// Notify reports the event of key to the server, it's a no-op for a db without server.
+func (db *GodisDB) Notify(class int, event string, key *Obj) {
+	if db.notify != nil {
+		db.notify(class, event, key)
+	}
+}
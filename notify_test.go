@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifyFlags(t *testing.T) {
+	for s, expected := range map[string]string{
+		"":      "",
+		"KEA":   "AKE",
+		"Ex":    "xE",
+		"Kg$xe": "g$xeK",
+		"AmnK":  "AmnK",
+	} {
+		flags, err := parseNotifyFlags(s)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, notifyFlagsString(flags), s)
+	}
+	_, err := parseNotifyFlags("KEy")
+	assert.NotNil(t, err)
+}
+
+func TestKeyspaceEvents(t *testing.T) {
+	srv := newTestServer(t, 0)
+	sub, cli := srv.newClient(0), srv.newClient(1)
+	execCmd(sub, "psubscribe", "__key*__:*")
+	events := func() []string {
+		var events []string
+		for len(sub.reply) > 0 {
+			events = append(events, string(sub.reply[len(sub.reply)-1]))
+			sub.reply = sub.reply[:len(sub.reply)-1]
+		}
+		// oldest first
+		for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+			events[i], events[j] = events[j], events[i]
+		}
+		return events
+	}
+	keyspace := func(key, event string) string {
+		return message("pmessage", "__key*__:*", "__keyspace@0__:"+key, event)
+	}
+	keyevent := func(event, key string) string {
+		return message("pmessage", "__key*__:*", "__keyevent@0__:"+event, key)
+	}
+
+	// disabled by default
+	execCmd(cli, "set", "key", "val")
+	assert.Nil(t, events())
+
+	assert.Equal(t, ReplyOK, execCmd(cli, "config", "set", "notify-keyspace-events", "KEA"))
+	assert.Equal(t, replyBulkArray([]string{"notify-keyspace-events", "AKE"}),
+		execCmd(cli, "config", "get", "notify-keyspace-events"))
+	execCmd(cli, "set", "key", "val2")
+	execCmd(cli, "expire", "key", "100")
+	assert.Equal(t, ReplyOK, execCmd(cli, "expire", "nokey", "100"))
+	assert.Equal(t, ReplyNotInteger, execCmd(cli, "expire", "key", "ten"))
+	assert.Equal(t, []string{keyspace("key", "set"), keyevent("set", "key"),
+		keyspace("key", "expire"), keyevent("expire", "key")}, events())
+	assert.Equal(t, int64(1), srv.db.ExpireCount())
+
+	assert.Equal(t, ReplyOK, execCmd(cli, "config", "set", "notify-keyspace-events", "Exn"))
+	execCmd(cli, "set", "key2", "val")
+	execCmd(cli, "expire", "key2", "-1")
+	assert.Equal(t, ReplyNil, execCmd(cli, "get", "key2"))
+	assert.Equal(t, []string{keyevent("new", "key2"), keyevent("expired", "key2")}, events())
+
+	// expired by the cron cycle
+	execCmd(cli, "set", "key3", "val")
+	execCmd(cli, "expire", "key3", "-1")
+	events()
+	time.Sleep(time.Millisecond)
+	for srv.db.ExpireCount() > 1 {
+		srv.db.Cron()
+	}
+	assert.Equal(t, []string{keyevent("expired", "key3")}, events())
+
+	assert.Equal(t, ReplyOK, execCmd(cli, "config", "set", "notify-keyspace-events", "Eem"))
+	assert.Equal(t, ReplyNil, execCmd(cli, "get", "missing"))
+	srv.config.MaxMemory, srv.config.MaxMemoryPolicy = 1, PolicyAllKeysRandom
+	srv.freeMemoryIfNeeded()
+	assert.Equal(t, []string{keyevent("keymiss", "missing"), keyevent("evicted", "key")}, events())
+}
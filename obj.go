@@ -9,12 +9,15 @@ type ObjType uint8
 
 const (
 	String ObjType = iota
+	Stream
+	ZSet
 )
 
 type Obj struct {
 	Type     ObjType
 	Val      any
 	refCount int
+	lru      uint32 // the lru clock or the lfu time and counter, see evict.go
 }
 
 func NewObject(type_ ObjType, ptr any) *Obj {
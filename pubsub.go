@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var ReplyNoPermChannel = "-NOPERM No permissions to access a channel\r\n"
+
+type pubsubPattern struct {
+	pattern string
+	cli     *GodisClient
+}
+
+// PubSub keeps the subscribers of the channels and the patterns, in the order of subscription.
+type PubSub struct {
+	channels map[string][]*GodisClient
+	patterns []pubsubPattern
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{channels: make(map[string][]*GodisClient)}
+}
+
+// Subscribe subscribes cli to channel, returns false if it's already subscribed.
+func (ps *PubSub) Subscribe(cli *GodisClient, channel string) bool {
+	if cli.channels[channel] {
+		return false
+	}
+	if cli.channels == nil {
+		cli.channels = make(map[string]bool)
+	}
+	cli.channels[channel] = true
+	ps.channels[channel] = append(ps.channels[channel], cli)
+	return true
+}
+
+// Unsubscribe unsubscribes cli from channel, returns false if it's not subscribed.
+func (ps *PubSub) Unsubscribe(cli *GodisClient, channel string) bool {
+	if !cli.channels[channel] {
+		return false
+	}
+	delete(cli.channels, channel)
+	clients := ps.channels[channel]
+	for i, c := range clients {
+		if c == cli {
+			clients = append(clients[:i], clients[i+1:]...)
+			break
+		}
+	}
+	if len(clients) == 0 {
+		delete(ps.channels, channel)
+	} else {
+		ps.channels[channel] = clients
+	}
+	return true
+}
+
+func (ps *PubSub) PSubscribe(cli *GodisClient, pattern string) bool {
+	if cli.patterns[pattern] {
+		return false
+	}
+	if cli.patterns == nil {
+		cli.patterns = make(map[string]bool)
+	}
+	cli.patterns[pattern] = true
+	ps.patterns = append(ps.patterns, pubsubPattern{pattern, cli})
+	return true
+}
+
+func (ps *PubSub) PUnsubscribe(cli *GodisClient, pattern string) bool {
+	if !cli.patterns[pattern] {
+		return false
+	}
+	delete(cli.patterns, pattern)
+	for i, p := range ps.patterns {
+		if p.cli == cli && p.pattern == pattern {
+			ps.patterns = append(ps.patterns[:i], ps.patterns[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// UnsubscribeAll removes all the subscriptions of cli, called when it's freed.
+func (ps *PubSub) UnsubscribeAll(cli *GodisClient) {
+	for channel := range cli.channels {
+		ps.Unsubscribe(cli, channel)
+	}
+	for pattern := range cli.patterns {
+		ps.PUnsubscribe(cli, pattern)
+	}
+}
+
+// Publish sends message to the subscribers of channel and the matched patterns,
+// returns the number of clients received it.
+func (ps *PubSub) Publish(channel, message string) int {
+	receivers := 0
+	for _, cli := range ps.channels[channel] {
+		cli.AddReply(replyPush(cli, []string{replyBulk("message"), replyBulk(channel), replyBulk(message)}))
+		receivers++
+	}
+	for _, p := range ps.patterns {
+		if stringMatch(p.pattern, channel, false) {
+			p.cli.AddReply(replyPush(p.cli, []string{replyBulk("pmessage"), replyBulk(p.pattern), replyBulk(channel), replyBulk(message)}))
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// Channels returns the active channels matching pattern, all of them if pattern is empty.
+func (ps *PubSub) Channels(pattern string) []string {
+	var channels []string
+	for _, channel := range sortedKeys(ps.channels) {
+		if pattern == "" || stringMatch(pattern, channel, false) {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+func (ps *PubSub) NumSub(channel string) int {
+	return len(ps.channels[channel])
+}
+
+func (ps *PubSub) NumPat() int {
+	return len(ps.patterns)
+}
+
+// subscriptions returns the number of channels and patterns cli subscribed.
+func (cli *GodisClient) subscriptions() int {
+	return len(cli.channels) + len(cli.patterns)
+}
+
+// replySubscription replies the (un)subscription of a channel or pattern with the subscriptions left of cli,
+// the name is nil if cli unsubscribed all while subscribing nothing.
+func replySubscription(cli *GodisClient, kind string, name *string) string {
+	nameReply := ReplyNil
+	if name != nil {
+		nameReply = replyBulk(*name)
+	}
+	return replyPush(cli, []string{replyBulk(kind), nameReply, replyInt(int64(cli.subscriptions()))})
+}
+
+// subscribe channel [channel ...], or psubscribe pattern [pattern ...]
+func subscribeCmd(cli *GodisClient) string {
+	ps := cli.srv.PubSub()
+	kind := strings.ToLower(cli.args[0].StrVal())
+	var b strings.Builder
+	for _, arg := range cli.args[1:] {
+		name := arg.StrVal()
+		if kind == GodisCmdSubscribe {
+			ps.Subscribe(cli, name)
+		} else {
+			ps.PSubscribe(cli, name)
+		}
+		b.WriteString(replySubscription(cli, kind, &name))
+	}
+	return b.String()
+}
+
+// unsubscribe [channel ...], or punsubscribe [pattern ...], all of them are unsubscribed if none is given
+func unsubscribeCmd(cli *GodisClient) string {
+	ps := cli.srv.PubSub()
+	kind := strings.ToLower(cli.args[0].StrVal())
+	subscribed := cli.channels
+	if kind == GodisCmdPUnsubscribe {
+		subscribed = cli.patterns
+	}
+	names := make([]string, 0, len(cli.args)-1)
+	for _, arg := range cli.args[1:] {
+		names = append(names, arg.StrVal())
+	}
+	if len(names) == 0 {
+		names = sortedKeys(subscribed)
+		if len(names) == 0 {
+			return replySubscription(cli, kind, nil)
+		}
+	}
+
+	var b strings.Builder
+	for _, name := range names {
+		if kind == GodisCmdUnsubscribe {
+			ps.Unsubscribe(cli, name)
+		} else {
+			ps.PUnsubscribe(cli, name)
+		}
+		name := name
+		b.WriteString(replySubscription(cli, kind, &name))
+	}
+	return b.String()
+}
+
+// publish channel message
+func publishCmd(cli *GodisClient) string {
+	return replyInt(int64(cli.srv.PubSub().Publish(cli.args[1].StrVal(), cli.args[2].StrVal())))
+}
+
+// pubsub CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT
+func pubsubCmd(cli *GodisClient) string {
+	args := cli.args
+	ps := cli.srv.PubSub()
+	switch sub := strings.ToLower(args[1].StrVal()); {
+	case sub == "channels" && len(args) <= 3:
+		pattern := ""
+		if len(args) == 3 {
+			pattern = args[2].StrVal()
+		}
+		return replyBulkArray(ps.Channels(pattern))
+	case sub == "numsub":
+		replies := make([]string, 0, 2*(len(args)-2))
+		for _, arg := range args[2:] {
+			replies = append(replies, replyBulk(arg.StrVal()), replyInt(int64(ps.NumSub(arg.StrVal()))))
+		}
+		return replyArray(replies)
+	case sub == "numpat" && len(args) == 2:
+		return replyInt(int64(ps.NumPat()))
+	}
+	return replyErr(fmt.Sprintf("unknown subcommand or wrong number of arguments for 'pubsub|%v'", args[1].StrVal()))
+}
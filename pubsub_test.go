@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func message(kind string, parts ...string) string {
+	return replyBulkArray(append([]string{kind}, parts...))
+}
+
+func TestPubSub(t *testing.T) {
+	srv := newTestServer(t, 0)
+	sub, pub := srv.newClient(0), srv.newClient(1)
+
+	assert.Equal(t, subscription("subscribe", strPtr("ch1"), 1)+subscription("subscribe", strPtr("ch2"), 2),
+		execCmd(sub, "subscribe", "ch1", "ch2"))
+	assert.Equal(t, subscription("psubscribe", strPtr("ch*"), 3), execCmd(sub, "psubscribe", "ch*"))
+	assert.Equal(t, "P", sub.flags())
+	assert.Equal(t, ClientClassPubSub, sub.class())
+	assert.Equal(t, replyErr("Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / QUIT are allowed in this context"),
+		execCmd(sub, "get", "key"))
+
+	assert.Equal(t, replyInt(2), execCmd(pub, "publish", "ch1", "hello"))
+	assert.Equal(t, replyInt(1), execCmd(pub, "publish", "chx", "hi"))
+	assert.Equal(t, replyInt(0), execCmd(pub, "publish", "other", "hi"))
+	assert.Equal(t, 3, len(sub.reply))
+	assert.Equal(t, message("message", "ch1", "hello"), string(sub.reply[0]))
+	assert.Equal(t, message("pmessage", "ch*", "chx", "hi"), string(sub.reply[len(sub.reply)-1]))
+
+	assert.Equal(t, replyBulkArray([]string{"ch1", "ch2"}), execCmd(pub, "pubsub", "channels"))
+	assert.Equal(t, replyBulkArray([]string{"ch2"}), execCmd(pub, "pubsub", "channels", "*2"))
+	assert.Equal(t, replyArray([]string{replyBulk("ch1"), replyInt(1), replyBulk("foo"), replyInt(0)}),
+		execCmd(pub, "pubsub", "numsub", "ch1", "foo"))
+	assert.Equal(t, replyInt(1), execCmd(pub, "pubsub", "numpat"))
+
+	assert.Equal(t, subscription("unsubscribe", strPtr("ch1"), 2)+subscription("unsubscribe", strPtr("ch2"), 1),
+		execCmd(sub, "unsubscribe"))
+	assert.Equal(t, subscription("unsubscribe", nil, 1), execCmd(sub, "unsubscribe"))
+	assert.Equal(t, subscription("punsubscribe", strPtr("ch*"), 0), execCmd(sub, "punsubscribe", "ch*"))
+	assert.Equal(t, ReplyNil, execCmd(sub, "get", "key"))
+	assert.Equal(t, replyInt(0), execCmd(pub, "publish", "ch1", "hello"))
+
+	// the subscriptions are removed with the client
+	execCmd(sub, "subscribe", "ch1")
+	srv.lp, _ = NewEventLoop()
+	defer srv.lp.Close()
+	srv.FreeClient(sub)
+	assert.Equal(t, replyInt(0), execCmd(pub, "publish", "ch1", "hello"))
+}
+
+func TestPubSubAcl(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli := srv.newClient(0)
+	assert.Equal(t, ReplyOK, execCmd(cli, "acl", "setuser", "u", "on", "nopass", "+@all", "&news.*"))
+	assert.Equal(t, ReplyOK, execCmd(cli, "auth", "u", "x"))
+
+	assert.Equal(t, replyInt(0), execCmd(cli, "publish", "news.sport", "hi"))
+	assert.Equal(t, ReplyNoPermChannel, execCmd(cli, "publish", "other", "hi"))
+	assert.Equal(t, ReplyNoPermChannel, execCmd(cli, "subscribe", "news.1", "other"))
+	assert.Equal(t, ReplyNoPermChannel, execCmd(cli, "psubscribe", "news.1*"))
+	assert.Equal(t, subscription("psubscribe", strPtr("news.*"), 1), execCmd(cli, "psubscribe", "news.*"))
+}
+
+// subscription is the reply of (un)subscription in RESP2.
+func subscription(kind string, name *string, count int) string {
+	nameReply := ReplyNil
+	if name != nil {
+		nameReply = replyBulk(*name)
+	}
+	return replyArray([]string{replyBulk(kind), nameReply, replyInt(int64(count))})
+}
+
+func strPtr(s string) *string {
+	return &s
+}
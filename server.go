@@ -1,85 +1,720 @@
 package main
 
 import (
-	"log"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"golang.org/x/exp/constraints"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	MaxAcceptsPerCall   = 1000
+	CronHz              = 10  // times of Cron per second
+	DefaultTcpKeepAlive = 300 // seconds
+
+	ReplyMaxClients = "-ERR: max number of clients reached\r\n"
 )
 
 type GodisServer struct {
-	fd             int
-	port           int
-	maxClientLimit int
-	lp             *EventLoop
-	db             *GodisDB
-	clients        map[int]*GodisClient
+	fds          []int // the listening tcp sockets, one per bind address
+	unixFd       int
+	config       *GodisConfig
+	lp           *EventLoop
+	db           *GodisDB
+	clients      map[int]*GodisClient
+	io           *IOThreads
+	pendingRead  []*GodisClient
+	pendingWrite []*GodisClient
+	startTime    time.Time
+	stats        GodisStats
+	cmdStats     map[string]*CommandStats
+	nextClientId int64
+
+	// clients are paused by CLIENT PAUSE until pauseEnd, pauseAll pauses all the commands instead of only writes.
+	// The writes are also paused by a shutdown in progress.
+	pauseEnd      time.Time
+	pauseAll      bool
+	pausedClients []*GodisClient
+	unblocked     []*GodisClient            // clients to execute the blocked command again before next epoll wait
+	blockingKeys  map[string][]*GodisClient // the clients blocked for the keys, see BlockForKeys
+	monitors      []*GodisClient
+
+	clientsToClose []*GodisClient
+	cronLoops      int64
+
+	acl      *Acl
+	slowlog  *SlowLog
+	latency  *LatencyMonitor
+	pubsub   *PubSub
+	tracking *Tracking
+	slots    *SlotMigrations
+	// the client executing a command, nil if the keys are modified by the server like expiration
+	currentClient *GodisClient
+
+	tlsFds        []int
+	tlsConfig     *tls.Config // nil if tls is disabled
+	tlsClients    map[int]*GodisClient
+	tlsHandshakes int // the tls connections accepted but not handshaked yet
+
+	// the shutdown in progress, the deadline is zero if not shutting down
+	shutdownDeadline time.Time
+	shutdownSave     bool
+	shutdownClient   *GodisClient
 }
 
-func NewGodisServer(port, maxClientLimit int) *GodisServer {
-	return &GodisServer{
-		port:           port,
-		maxClientLimit: maxClientLimit,
-		db:             NewGodisDB(),
-		clients:        make(map[int]*GodisClient),
+type GodisStats struct {
+	numConnections      int64 // total connections accepted
+	numCommands         int64 // total commands processed
+	rejectedConnections int64 // connections rejected by maxclients
+	outputLimitKills    int64 // clients closed by the output buffer limits
+	evictedKeys         int64
+	peakMemory          int64
+	opsSamples          metricSamples
+}
+
+func NewGodisServer(config *GodisConfig) *GodisServer {
+	srv := &GodisServer{
+		config:    config,
+		db:        NewGodisDB(),
+		clients:   make(map[int]*GodisClient),
+		startTime: time.Now(),
+		cmdStats:  make(map[string]*CommandStats),
+		acl:       NewAcl(),
+		slowlog:   NewSlowLog(config.SlowLogMaxLen),
+		latency:   NewLatencyMonitor(),
+		pubsub:    NewPubSub(),
+		tracking:  NewTracking(),
+		slots:     NewSlotMigrations(),
+
+		blockingKeys: make(map[string][]*GodisClient),
+
+		tlsClients: make(map[int]*GodisClient),
+	}
+	if config.RequirePass != "" {
+		srv.acl.SetRequirePass(config.RequirePass)
 	}
+	config.onChange = srv.applyConfig
+	srv.db.notify = srv.notifyKeyspaceEvent
+	srv.applyEvictConfig()
+	return srv
 }
 
 func (srv *GodisServer) Run() (err error) {
-	srv.fd, err = TcpServer(srv.port)
-	if err != nil {
+	if err = SetLogLevel(srv.config.LogLevel); err != nil {
+		return err
+	}
+	if err = SetLogFile(srv.config.LogFile); err != nil {
+		return err
+	}
+
+	if srv.config.AclFile != "" {
+		if err = srv.acl.LoadFile(srv.config.AclFile); err != nil {
+			return err
+		}
+	}
+
+	if err = srv.loadSnapshot(); err != nil {
 		return err
 	}
 
+	if srv.fds, err = srv.listen(srv.config.Port); err != nil {
+		return err
+	}
+	if srv.config.TlsPort > 0 {
+		if srv.tlsConfig, err = loadTlsConfig(srv.config); err != nil {
+			return err
+		}
+		if srv.tlsFds, err = srv.listen(srv.config.TlsPort); err != nil {
+			return err
+		}
+	}
+	if srv.config.UnixSocket != "" {
+		srv.unixFd, err = ListenUnix(srv.config.UnixSocket, os.FileMode(srv.config.UnixSocketPerm))
+		if err != nil {
+			return err
+		}
+	}
+
 	srv.lp, err = NewEventLoop()
 	if err != nil {
 		return err
 	}
+	srv.lp.SetEpollBatch(srv.config.EpollBatch)
 
-	srv.lp.AddFileEvent(srv.fd, FE_READABLE, srv.AcceptHandler, nil)
-	srv.lp.AddTimeEvent(TE_PERIODIC, 100, srv.Cron, nil)
+	if srv.config.IOThreads > 1 {
+		srv.io = NewIOThreads(srv.config.IOThreads)
+		defer srv.io.Stop()
+		logNotice("io threads enabled, threads = %v", srv.config.IOThreads)
+	}
+	srv.lp.SetBeforeSleep(srv.beforeSleep)
+	srv.lp.SetLatencyProc(srv.addLatency)
+	defer srv.lp.Close()
+	defer srv.handleSignals()()
+	if srv.config.MetricsPort > 0 {
+		stopMetrics, err := srv.startMetrics()
+		if err != nil {
+			return err
+		}
+		defer stopMetrics()
+		logNotice("metrics are served on %v port %v", srv.config.Bind, srv.config.MetricsPort)
+	}
+
+	srv.addAcceptHandlers()
+	srv.lp.AddTimeEvent(TE_PERIODIC, 1000/CronHz, srv.Cron, nil)
+	logNotice("server is ready to accept connections on %v port %v", srv.config.Bind, srv.config.Port)
+	if srv.tlsConfig != nil {
+		logNotice("server is ready to accept tls connections on %v port %v", srv.config.Bind, srv.config.TlsPort)
+	}
+	if srv.config.UnixSocket != "" {
+		logNotice("server is ready to accept connections at %v", srv.config.UnixSocket)
+	}
 	srv.lp.Run()
 	return
 }
 
-func (srv *GodisServer) AcceptHandler(lp *EventLoop, fd int, _ any) {
-	cfd, err := Accept(fd)
+// applyConfig makes the param changed by CONFIG SET take effect.
+func (srv *GodisServer) applyConfig(name string) error {
+	var err error
+	switch name {
+	case "epoll-batch":
+		srv.lp.SetEpollBatch(srv.config.EpollBatch)
+	case "proto-max-bulk-len":
+		for _, cli := range srv.clients {
+			cli.maxBulkLen = srv.config.ProtoMaxBulkLen
+		}
+	case "loglevel":
+		err = SetLogLevel(srv.config.LogLevel)
+	case "logfile":
+		err = SetLogFile(srv.config.LogFile)
+	case "maxmemory":
+		srv.freeMemoryIfNeeded()
+	case "maxmemory-policy", "lfu-log-factor", "lfu-decay-time":
+		srv.applyEvictConfig()
+	case "requirepass":
+		srv.acl.SetRequirePass(srv.config.RequirePass)
+	case "slowlog-max-len":
+		srv.slowlog.SetMaxLen(srv.config.SlowLogMaxLen)
+	case "tls-cert-file", "tls-key-file", "tls-ca-cert-file", "tls-auth-clients":
+		// the new certificates are used by the connections accepted later
+		if srv.tlsConfig != nil {
+			var config *tls.Config
+			if config, err = loadTlsConfig(srv.config); err == nil {
+				srv.tlsConfig = config
+			}
+		}
+	}
+	return err
+}
+
+func (srv *GodisServer) applyEvictConfig() {
+	policy := srv.config.MaxMemoryPolicy
+	srv.db.lfu = policy == PolicyAllKeysLFU || policy == PolicyVolatileLFU
+	srv.db.lfuLogFactor = srv.config.LFULogFactor
+	srv.db.lfuDecayTime = srv.config.LFUDecayTime
+	// the scores in the pool are meaningless under another policy
+	srv.db.evictionPool = srv.db.evictionPool[:0]
+}
+
+func (srv *GodisServer) ACL() *Acl {
+	return srv.acl
+}
+
+func (srv *GodisServer) SlowLog() *SlowLog {
+	return srv.slowlog
+}
+
+func (srv *GodisServer) Latency() *LatencyMonitor {
+	return srv.latency
+}
+
+func (srv *GodisServer) PubSub() *PubSub {
+	return srv.pubsub
+}
+
+func (srv *GodisServer) Tracking() *Tracking {
+	return srv.tracking
+}
+
+func (srv *GodisServer) SlotMigrations() *SlotMigrations {
+	return srv.slots
+}
+
+func (srv *GodisServer) Config() *GodisConfig {
+	return srv.config
+}
+
+func (srv *GodisServer) ResetStats() {
+	srv.stats = GodisStats{}
+	srv.cmdStats = make(map[string]*CommandStats)
+	srv.db.ResetStats()
+}
+
+// ProcessCommand executes the command of the client with the server side bookkeeping.
+func (srv *GodisServer) ProcessCommand(cli *GodisClient) string {
+	cmd, errReply := lookupCommand(cli.args)
+	defer func() {
+		// ASKING only applies to the command right after it, which keeps it while paused or blocked
+		if !cli.blocked && (cmd == nil || cmd.name != GodisCmdAsking) {
+			cli.asking = false
+		}
+	}()
+	if cmd == nil {
+		return errReply
+	}
+	cli.lastCmd = cmd.name
+	if reply := srv.rejectCommand(cli, cmd); reply != "" {
+		srv.commandStats(cmd.name).rejected++
+		return reply
+	}
+	if reply := srv.slots.Redirect(cli.db, cmd, cli.args, cli.asking); reply != "" {
+		srv.commandStats(cmd.name).rejected++
+		return reply
+	}
+	if srv.pausedFor(cmd) {
+		cli.blocked = true
+		srv.pausedClients = append(srv.pausedClients, cli)
+		return ""
+	}
+	if cmd.flags&CmdWrite != 0 && !srv.freeMemoryIfNeeded() && cmd.flags&CmdDenyOOM != 0 {
+		srv.commandStats(cmd.name).rejected++
+		return ReplyOOM
+	}
+
+	srv.feedMonitors(cli, cmd)
+	start := time.Now()
+	srv.currentClient = cli
+	reply := cmd.proc(cli)
+	srv.currentClient = nil
+	srv.stats.numCommands++
+	duration := time.Since(start)
+	if cli.tracking != nil {
+		srv.tracking.afterCommand(cli, cmd)
+	}
+	srv.commandStats(cmd.name).track(duration, strings.HasPrefix(reply, "-"))
+	if cmd.acl&AclFast != 0 {
+		srv.addLatency(LatencyFastCommand, duration)
+	} else {
+		srv.addLatency(LatencyCommand, duration)
+	}
+	if threshold := srv.config.SlowLogSlowerThan; threshold >= 0 && duration.Microseconds() >= int64(threshold) {
+		srv.slowlog.Add(cli, cmd, duration)
+	}
+	return reply
+}
+
+// rejectCommand returns the error reply if cli isn't allowed to execute cmd.
+func (srv *GodisServer) rejectCommand(cli *GodisClient, cmd *GodisCommand) string {
+	if !cli.authenticated && cmd.flags&CmdNoAuth == 0 {
+		return ReplyNoAuth
+	}
+	if cmd.flags&CmdNoAuth == 0 {
+		if reason, object := srv.acl.CheckCommand(cli, cmd); reason != "" {
+			srv.acl.AddLog(cli, reason, object, cli.user.name, srv.config.AclLogMaxLen)
+			switch reason {
+			case "key":
+				return ReplyNoPermKey
+			case "channel":
+				return ReplyNoPermChannel
+			}
+			return fmt.Sprintf("-NOPERM User %v has no permissions to run the '%v' command\r\n", cli.user.name, object)
+		}
+	}
+	if cli.monitor && cmd.keys != nil {
+		return ReplyMonitorKeyspace
+	}
+	if cli.resp == 2 && cli.subscriptions() > 0 && cmd.flags&CmdPubSub == 0 {
+		return replyErr(fmt.Sprintf("Can't execute '%v': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / QUIT are allowed in this context", cmd.name))
+	}
+	return ""
+}
+
+func (srv *GodisServer) commandStats(name string) *CommandStats {
+	stats := srv.cmdStats[name]
+	if stats == nil {
+		stats = &CommandStats{}
+		srv.cmdStats[name] = stats
+	}
+	return stats
+}
+
+// AcceptHandler drains the pending connections of the listening socket, arg is the func accepting a connection.
+func (srv *GodisServer) AcceptHandler(lp *EventLoop, fd int, arg any) {
+	accept := arg.(func(cfd int))
+	for i := 0; i < MaxAcceptsPerCall; i++ {
+		cfd, err := Accept(fd)
+		if err != nil {
+			if err != unix.EAGAIN {
+				logWarning("accept failed: %v", err)
+			}
+			return
+		}
+		accept(cfd)
+	}
+}
+
+// saveSnapshot writes the db into the db file atomically.
+func (srv *GodisServer) saveSnapshot() error {
+	path := filepath.Join(srv.config.Dir, srv.config.DbFilename)
+	data := EncodeSnapshot(srv.db)
+	start := time.Now()
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("save db on %v failed: %v", path, err)
+	}
+	srv.addLatency(LatencySnapshotWrite, time.Since(start))
+	return nil
+}
+
+// loadSnapshot loads the db saved by a previous shutdown if any.
+func (srv *GodisServer) loadSnapshot() error {
+	path := filepath.Join(srv.config.Dir, srv.config.DbFilename)
+	start := time.Now()
+	n, err := LoadSnapshot(srv.db, path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
 	if err != nil {
-		log.Println("accept failed: ", err)
-		return
+		return fmt.Errorf("load db from %v failed: %v", path, err)
 	}
+	srv.db.dirty = 0
+	logNotice("db loaded from disk: %v keys in %.3f seconds", n, time.Since(start).Seconds())
+	return nil
+}
 
-	if len(srv.clients) >= srv.maxClientLimit {
-		log.Println("exceed max client limit, close conn...")
-		Close(fd)
-		return
+func (srv *GodisServer) addAcceptHandlers() {
+	for _, fd := range srv.fds {
+		srv.lp.AddFileEvent(fd, FE_READABLE, srv.AcceptHandler, srv.acceptTcp)
+	}
+	for _, fd := range srv.tlsFds {
+		srv.lp.AddFileEvent(fd, FE_READABLE, srv.AcceptHandler, srv.acceptTls)
+	}
+	if srv.config.UnixSocket != "" {
+		srv.lp.AddFileEvent(srv.unixFd, FE_READABLE, srv.AcceptHandler, srv.acceptUnix)
 	}
+}
+
+func (srv *GodisServer) removeAcceptHandlers() {
+	for _, fd := range append(srv.fds, srv.tlsFds...) {
+		srv.lp.RemoveFileEvent(fd, FE_READABLE)
+	}
+	if srv.config.UnixSocket != "" {
+		srv.lp.RemoveFileEvent(srv.unixFd, FE_READABLE)
+	}
+}
 
-	cli := NewGodisClient(cfd, srv.db, srv)
+// listen creates a listening socket on port for every bind address.
+func (srv *GodisServer) listen(port int) ([]int, error) {
+	var fds []int
+	for _, bind := range strings.Fields(srv.config.Bind) {
+		fd, err := ListenTcp(bind, port)
+		if err != nil {
+			for _, fd := range fds {
+				Close(fd)
+			}
+			return nil, fmt.Errorf("listen on %v port %v failed: %v", bind, port, err)
+		}
+		fds = append(fds, fd)
+	}
+	return fds, nil
+}
+
+func (srv *GodisServer) acceptTcp(cfd int) {
+	srv.setTcpOptions(cfd)
+	srv.acceptClient(cfd, socketConn(cfd))
+}
+
+// acceptUnix accepts a connection of the unix socket, whose peer has no address so the path is used.
+func (srv *GodisServer) acceptUnix(cfd int) {
+	if cli := srv.acceptClient(cfd, socketConn(cfd)); cli != nil {
+		cli.addr = cli.laddr
+	}
+}
+
+func (srv *GodisServer) setTcpOptions(cfd int) {
+	if err := SetTcpNoDelay(cfd); err != nil {
+		logWarning("cli %v: %v\n", cfd, err)
+	}
+	if srv.config.TcpKeepAlive > 0 {
+		if err := SetKeepAlive(cfd, srv.config.TcpKeepAlive); err != nil {
+			logWarning("cli %v: %v\n", cfd, err)
+		}
+	}
+}
+
+// acceptClient creates the client of the connection, nil if it's rejected.
+func (srv *GodisServer) acceptClient(cfd int, conn Conn) *GodisClient {
+	srv.stats.numConnections++
+	if srv.numClients() >= srv.config.MaxClients {
+		srv.stats.rejectedConnections++
+		logWarning("exceed max client limit, close conn...")
+		// best effort, the connection is new so the error reply fits in the buffer
+		conn.Writev([][]byte{[]byte(ReplyMaxClients)})
+		conn.Close()
+		return nil
+	}
+
+	logVerbose("accepted cli %v", cfd)
+	cli := srv.newClient(cfd)
+	cli.conn = conn
+	cli.addr, cli.laddr = PeerName(cfd), SockName(cfd)
 	srv.clients[cfd] = cli
-	srv.lp.AddFileEvent(cfd, FE_READABLE, cli.ReadQuery, nil)
+	if srv.io != nil {
+		srv.lp.AddFileEvent(cfd, FE_READABLE, srv.PostponeRead, cli)
+	} else {
+		srv.lp.AddFileEvent(cfd, FE_READABLE, cli.ReadQuery, nil)
+	}
+	return cli
+}
+
+// numClients returns the clients counted by maxclients.
+func (srv *GodisServer) numClients() int {
+	return len(srv.clients) + srv.tlsHandshakes
+}
+
+// newClient creates a client of the server authenticated as the default user if it has no password.
+func (srv *GodisServer) newClient(fd int) *GodisClient {
+	cli := NewGodisClient(fd, srv.db, srv)
+	srv.nextClientId++
+	cli.id = srv.nextClientId
+	cli.user = srv.acl.User(DefaultUser)
+	cli.authenticated = cli.user.nopass && cli.user.enabled
+	cli.maxBulkLen = srv.config.ProtoMaxBulkLen
+	return cli
 }
 
 func (srv *GodisServer) Cron(lp *EventLoop, id int, _ any) {
-	srv.db.Cron()
+	// keys must not change while writes are paused
+	if !srv.clientsPaused() {
+		start := time.Now()
+		srv.db.Cron()
+		srv.addLatency(LatencyExpireCycle, time.Since(start))
+	}
+
+	now := time.Now()
+	srv.stats.opsSamples.track(srv.stats.numCommands, now)
+	used, _ := usedMemory()
+	srv.stats.peakMemory = max(srv.stats.peakMemory, used)
+
+	if srv.cronLoops%CronHz == 0 {
+		srv.clientsCron(now)
+	}
+	srv.cronLoops++
+}
+
+// clientsCron closes the clients idle for more than the timeout config.
+func (srv *GodisServer) clientsCron(now time.Time) {
+	timeout := time.Duration(srv.config.Timeout) * time.Second
+	if timeout == 0 {
+		return
+	}
+
+	var idle []*GodisClient
+	for _, cli := range srv.clients {
+		// blocked clients are waiting for the server, subscribers and monitors for the messages
+		if cli.blocked || cli.subscriptions() > 0 || cli.monitor {
+			continue
+		}
+		if now.Sub(cli.lastInteraction) > timeout {
+			idle = append(idle, cli)
+		}
+	}
+	for _, cli := range idle {
+		logVerbose("closing idle client %v", cli.fd)
+		cli.free()
+	}
+}
+
+// CountOutputLimitKill counts a client closed by the output buffer limits.
+func (srv *GodisServer) CountOutputLimitKill() {
+	srv.stats.outputLimitKills++
+}
+
+// FreeClientAsync frees the client before next epoll wait, it's used when the client
+// can't be freed immediately, like in the middle of executing its commands.
+func (srv *GodisServer) FreeClientAsync(cli *GodisClient) {
+	srv.clientsToClose = append(srv.clientsToClose, cli)
+}
+
+func (srv *GodisServer) freeClientsInAsyncFreeQueue() {
+	for _, cli := range srv.clientsToClose {
+		cli.free()
+	}
+	srv.clientsToClose = nil
 }
 
 func (srv *GodisServer) FreeClient(cli *GodisClient) {
 	delete(srv.clients, cli.fd)
+	delete(srv.tlsClients, cli.fd)
+	if cli.monitor {
+		srv.removeMonitor(cli)
+	}
+	srv.pubsub.UnsubscribeAll(cli)
+	srv.tracking.Disable(cli)
+	if cli.bstate != nil {
+		srv.removeBlockingKeys(cli)
+	}
 	srv.lp.RemoveFileEvent(cli.fd, FE_READABLE)
 	srv.lp.RemoveFileEvent(cli.fd, FE_WRITABLE)
 }
 
+// RegisterSendReply queues the client to be written before next epoll wait,
+// so all the replies generated in one loop are sent with as few syscalls as possible.
 func (srv *GodisServer) RegisterSendReply(cli *GodisClient) {
-	srv.lp.AddFileEvent(cli.fd, FE_WRITABLE, cli.SendReply, cli)
+	if !cli.pendingWrite {
+		cli.pendingWrite = true
+		srv.pendingWrite = append(srv.pendingWrite, cli)
+	}
 }
 
 func (srv *GodisServer) UnRegisterSendReply(cli *GodisClient) {
 	srv.lp.RemoveFileEvent(cli.fd, FE_WRITABLE)
 }
 
+func (srv *GodisServer) Clients() map[int]*GodisClient {
+	return srv.clients
+}
+
+// clientsPaused reports whether the clients are paused by CLIENT PAUSE or a shutdown in progress.
+func (srv *GodisServer) clientsPaused() bool {
+	return !srv.pauseEnd.IsZero() || srv.shuttingDown()
+}
+
+// pausedFor reports whether cmd should wait for the end of the pause,
+// CLIENT is never paused so the pause can be ended by CLIENT UNPAUSE.
+func (srv *GodisServer) pausedFor(cmd *GodisCommand) bool {
+	if !srv.clientsPaused() || cmd.name == GodisCmdClient || cmd.name == GodisCmdShutdown {
+		return false
+	}
+	return srv.pauseAll || cmd.flags&CmdWrite != 0
+}
+
+// PauseClients pauses the clients until end, the longer end and the more restrictive mode
+// are kept if the clients are already paused.
+func (srv *GodisServer) PauseClients(end time.Time, all bool) {
+	if srv.pauseEnd.IsZero() {
+		srv.pauseEnd, srv.pauseAll = end, all
+		return
+	}
+	if end.After(srv.pauseEnd) {
+		srv.pauseEnd = end
+	}
+	srv.pauseAll = srv.pauseAll || all
+}
+
+func (srv *GodisServer) UnpauseClients() {
+	srv.pauseEnd, srv.pauseAll = time.Time{}, false
+	srv.resumePausedClients()
+}
+
+// resumePausedClients executes the paused commands again, the ones still paused wait again.
+func (srv *GodisServer) resumePausedClients() {
+	srv.unblocked = append(srv.unblocked, srv.pausedClients...)
+	srv.pausedClients = nil
+}
+
+// handleUnblockedClients executes the blocked commands again and goes on with the input received meanwhile.
+func (srv *GodisServer) handleUnblockedClients() {
+	for len(srv.unblocked) > 0 {
+		cli := srv.unblocked[0]
+		srv.unblocked = srv.unblocked[1:]
+		if cli.closed || !cli.blocked {
+			continue
+		}
+
+		cli.blocked = false
+		if bs := cli.bstate; bs != nil && bs.timedOut {
+			cli.bstate = nil
+			cli.asking = false
+			cli.AddReply(ReplyNilArray)
+		} else {
+			if !cli.execCommand() || cli.blocked {
+				continue
+			}
+			cli.bstate = nil
+		}
+		if srv.io != nil {
+			cli.processQueued()
+			if !cli.closed && !cli.blocked && cli.protoErr != nil {
+				cli.protocolError(cli.protoErr)
+			}
+		} else if err := cli.ProcessQuery(); err != nil {
+			cli.protocolError(err)
+		}
+	}
+}
+
+func (srv *GodisServer) beforeSleep(lp *EventLoop) {
+	if srv.io != nil {
+		srv.handleClientsWithPendingReads()
+	}
+	srv.freeClientsInAsyncFreeQueue()
+	srv.handleTlsPendingData()
+	if !srv.pauseEnd.IsZero() && time.Now().After(srv.pauseEnd) {
+		srv.UnpauseClients()
+	}
+	srv.handleBlockedTimeouts()
+	srv.handleUnblockedClients()
+	srv.tracking.Limit(srv.config.TrackingTableMaxKeys)
+	srv.tracking.Broadcast()
+	srv.handleClientsWithPendingWrites()
+	srv.shutdownCron()
+}
+
+func (srv *GodisServer) handleClientsWithPendingWrites() {
+	clients := srv.pendingWrite[:0]
+	for _, cli := range srv.pendingWrite {
+		cli.pendingWrite = false
+		// clients waiting for the socket to be writable are handled by SendReply
+		if !cli.closed && !cli.closeAsap && srv.lp.searchFileEvent(cli.fd, FE_WRITABLE) == nil {
+			clients = append(clients, cli)
+		}
+	}
+	srv.pendingWrite = nil
+	if len(clients) == 0 {
+		return
+	}
+
+	write := func(cli *GodisClient) {
+		cli.ioErr = cli.writeToSocket()
+	}
+	if srv.io != nil {
+		srv.io.Run(clients, write)
+	} else {
+		for _, cli := range clients {
+			write(cli)
+		}
+	}
+
+	for _, cli := range clients {
+		if cli.ioErr != nil {
+			logWarning("send reply failed: %v\n", cli.ioErr)
+			cli.free()
+			continue
+		}
+		// the socket is full, wait for it to be writable
+		if cli.hasPendingReplies() {
+			srv.lp.AddFileEvent(cli.fd, FE_WRITABLE, cli.SendReply, cli)
+		} else if cli.closeAfterReply {
+			cli.free()
+		}
+	}
+}
+
 func min[T constraints.Ordered](a, b T) T {
 	if a < b {
 		return a
 	}
 	return b
 }
+
+func max[T constraints.Ordered](a, b T) T {
+	if a > b {
+		return a
+	}
+	return b
+}
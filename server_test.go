@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// newTestServer creates a server with its db file in a temporary directory.
+func newTestServer(t *testing.T, port int) *GodisServer {
+	config := NewGodisConfig()
+	config.Port = port
+	config.Dir = t.TempDir()
+	config.LogLevel = "warning"
+	return NewGodisServer(config)
+}
+
+// testServers are the exit channels of the servers started by startServer.
+var testServers sync.Map
+
+func startServer(t *testing.T, srv *GodisServer) {
+	done := make(chan struct{})
+	testServers.Store(srv, done)
+	go func() {
+		defer close(done)
+		assert.Nil(t, srv.Run())
+	}()
+	time.Sleep(100 * time.Millisecond)
+}
+
+// stopServer sends SHUTDOWN NOSAVE to the server started by startServer, so the loop is stopped
+// on its own goroutine, and waits for the server to exit.
+func stopServer(srv *GodisServer) {
+	done, _ := testServers.LoadAndDelete(srv)
+	for {
+		// the connection may be rejected by maxclients before the other clients are closed
+		fd, err := Connect([4]byte{127, 0, 0, 1}, srv.config.Port)
+		if err != nil {
+			break
+		}
+		Write(fd, []byte("shutdown nosave\r\n"))
+		n, _ := Read(fd, make([]byte, 64))
+		Close(fd)
+		if n == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	<-done.(chan struct{})
+}
+
+// waitServer waits for the server started by startServer to exit on its own.
+func waitServer(t *testing.T, srv *GodisServer) {
+	done, _ := testServers.LoadAndDelete(srv)
+	select {
+	case <-done.(chan struct{}):
+	case <-time.After(3 * time.Second):
+		t.Fatal("the server doesn't exit")
+	}
+}
+
+// roundTrip sends query and reads until the expected reply is received.
+func roundTrip(t *testing.T, fd int, query, expected string) {
+	_, err := Write(fd, []byte(query))
+	assert.Nil(t, err)
+
+	var reply []byte
+	buf := make([]byte, 1024)
+	for len(reply) < len(expected) {
+		n, err := Read(fd, buf)
+		if !assert.Nil(t, err) || !assert.NotZero(t, n) {
+			return
+		}
+		reply = append(reply, buf[:n]...)
+	}
+	assert.Equal(t, expected, string(reply))
+}
+
+// freePort returns a tcp port nobody listens on.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// SetTimeout sets both send and receive timeout of a blocking socket.
+func SetTimeout(fd int, ms int64) error {
+	tv := unix.NsecToTimeval(ms * 1000 * 1000)
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return fmt.Errorf("set SO_RCVTIMEO failed: %v", err)
+	}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_SNDTIMEO, &tv); err != nil {
+		return fmt.Errorf("set SO_SNDTIMEO failed: %v", err)
+	}
+	return nil
+}
+
+func TestIOThreads(t *testing.T) {
+	port := 6681
+	srv := newTestServer(t, port)
+	srv.config.IOThreads = 4
+	startServer(t, srv)
+
+	var fds []int
+	for i := 0; i < 8; i++ {
+		fd, err := Connect([4]byte{127, 0, 0, 1}, port)
+		assert.Nil(t, err)
+		fds = append(fds, fd)
+	}
+
+	for i, fd := range fds {
+		var query, expected strings.Builder
+		for j := 0; j < 100; j++ {
+			val := fmt.Sprintf("val-%d-%d", i, j)
+			query.WriteString(fmt.Sprintf("set key%d %v\r\nget key%d\r\n", i, val, i))
+			expected.WriteString(ReplyOK + replyBulk(val))
+		}
+		roundTrip(t, fd, query.String(), expected.String())
+	}
+
+	for _, fd := range fds {
+		Close(fd)
+	}
+
+	// the io threads exit with the server
+	stopServer(srv)
+	assert.Eventually(t, func() bool {
+		buf := make([]byte, 1<<20)
+		return !strings.Contains(string(buf[:runtime.Stack(buf, true)]), "(*IOThreads).loop")
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestPipelineReplies(t *testing.T) {
+	port := 6682
+	srv := newTestServer(t, port)
+	startServer(t, srv)
+	defer stopServer(srv)
+
+	fd, err := Connect([4]byte{127, 0, 0, 1}, port)
+	assert.Nil(t, err)
+	defer Close(fd)
+
+	var query, expected strings.Builder
+	for i := 0; i < 1000; i++ {
+		query.WriteString(fmt.Sprintf("*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$4\r\n%04d\r\n*2\r\n$3\r\nget\r\n$3\r\nkey\r\n", i))
+		expected.WriteString(ReplyOK + replyBulk(fmt.Sprintf("%04d", i)))
+	}
+	roundTrip(t, fd, query.String(), expected.String())
+}
+
+func TestMaxClients(t *testing.T) {
+	port := 6683
+	srv := newTestServer(t, port)
+	srv.config.MaxClients = 1
+	startServer(t, srv)
+	defer stopServer(srv)
+
+	fd1, err := Connect([4]byte{127, 0, 0, 1}, port)
+	assert.Nil(t, err)
+	defer Close(fd1)
+	roundTrip(t, fd1, "set key val\r\n", ReplyOK)
+
+	fd2, err := Connect([4]byte{127, 0, 0, 1}, port)
+	assert.Nil(t, err)
+	defer Close(fd2)
+	roundTrip(t, fd2, "get key\r\n", ReplyMaxClients)
+
+	// the listening socket is still alive
+	roundTrip(t, fd1, "get key\r\n", replyBulk("val"))
+}
+
+func TestProtocolError(t *testing.T) {
+	port := 6684
+	srv := newTestServer(t, port)
+	startServer(t, srv)
+	defer stopServer(srv)
+
+	fd, err := Connect([4]byte{127, 0, 0, 1}, port)
+	assert.Nil(t, err)
+	defer Close(fd)
+
+	// large values are accepted
+	val := strings.Repeat("v", 1024*1024)
+	roundTrip(t, fd, string(appendCommand(nil, "set", "key", val)), ReplyOK)
+	roundTrip(t, fd, "get key\r\n", replyBulk(val))
+
+	// the commands before the error are still executed
+	roundTrip(t, fd, "*2\r\n$3\r\nget\r\n$3\r\nkey\r\n*1\r\n$x\r\n",
+		replyBulk(val)+replyErr("Protocol error: "+ErrInvalidBulkLength.Error()))
+	_, err = Read(fd, make([]byte, 16))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestClientLimits(t *testing.T) {
+	port := 6688
+	srv := newTestServer(t, port)
+	srv.config.Timeout = 1
+	srv.config.ClientOutputBufferLimits[ClientClassNormal].Hard = 4096
+	startServer(t, srv)
+	defer stopServer(srv)
+
+	fd1, err := Connect([4]byte{127, 0, 0, 1}, port)
+	assert.Nil(t, err)
+	defer Close(fd1)
+	fd2, err := Connect([4]byte{127, 0, 0, 1}, port)
+	assert.Nil(t, err)
+	defer Close(fd2)
+	fd3, err := Connect([4]byte{127, 0, 0, 1}, port)
+	assert.Nil(t, err)
+	defer Close(fd3)
+	roundTrip(t, fd3, "subscribe ch\r\n", subscription("subscribe", strPtr("ch"), 1))
+
+	// the replies of the pipeline exceed the hard limit
+	val := strings.Repeat("v", 1024)
+	roundTrip(t, fd1, "set key "+val+"\r\n", ReplyOK)
+	_, err = Write(fd1, []byte(strings.Repeat("get key\r\n", 10)))
+	assert.Nil(t, err)
+	_, err = Read(fd1, make([]byte, 16))
+	assert.Equal(t, io.EOF, err)
+
+	// the idle client is closed in 2 seconds
+	start := time.Now()
+	assert.Nil(t, SetTimeout(fd2, 3000))
+	_, err = Read(fd2, make([]byte, 16))
+	assert.Equal(t, io.EOF, err)
+	assert.Less(t, time.Since(start), 2500*time.Millisecond)
+
+	// the subscriber outlives the timeout
+	time.Sleep(time.Second)
+	roundTrip(t, fd3, "unsubscribe\r\n", subscription("unsubscribe", strPtr("ch"), 0))
+}
+
+func TestListeners(t *testing.T) {
+	port := 6691
+	path := filepath.Join(t.TempDir(), "godis.sock")
+	srv := newTestServer(t, port)
+	srv.config.Bind = "127.0.0.1 ::1"
+	srv.config.UnixSocket = path
+	srv.config.UnixSocketPerm = 0700
+	startServer(t, srv)
+	defer stopServer(srv)
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.ModeSocket|0700, info.Mode())
+
+	for _, addr := range []string{"127.0.0.1:6691", "[::1]:6691", path} {
+		network := "tcp"
+		if addr == path {
+			network = "unix"
+		}
+		conn, err := net.Dial(network, addr)
+		if !assert.Nil(t, err, addr) {
+			continue
+		}
+		_, err = conn.Write([]byte("client info\r\n"))
+		assert.Nil(t, err)
+		reply := make([]byte, 1024)
+		n, err := conn.Read(reply)
+		assert.Nil(t, err)
+		if addr == path {
+			addr = path + ":0"
+		}
+		assert.Contains(t, string(reply[:n]), " laddr="+addr+" ", addr)
+		conn.Close()
+	}
+}
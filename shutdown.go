@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const DefaultShutdownTimeout = 10 // seconds
+
+var ReplyShutdownFailed = replyErr("Errors trying to SHUTDOWN. Check logs.")
+
+// Shutdown stops accepting connections and pauses the writes, the server exits once the pending replies
+// are sent or the shutdown-timeout is reached. cli is the client of SHUTDOWN, nil if shutdown by a signal.
+// It returns false if a shutdown is already in progress.
+func (srv *GodisServer) Shutdown(cli *GodisClient, save bool) bool {
+	if srv.shuttingDown() {
+		return false
+	}
+	logWarning("user requested shutdown...")
+	srv.shutdownDeadline = time.Now().Add(time.Duration(srv.config.ShutdownTimeout) * time.Second)
+	srv.shutdownSave = save
+	srv.shutdownClient = cli
+	srv.removeAcceptHandlers()
+	return true
+}
+
+func (srv *GodisServer) shuttingDown() bool {
+	return !srv.shutdownDeadline.IsZero()
+}
+
+// AbortShutdown resumes the server, the client of SHUTDOWN gets an error.
+// It returns false if no shutdown is in progress.
+func (srv *GodisServer) AbortShutdown() bool {
+	if !srv.shuttingDown() {
+		return false
+	}
+	logWarning("shutdown aborted")
+	if cli := srv.shutdownClient; cli != nil && !cli.closed {
+		cli.AddReply(ReplyShutdownFailed)
+	}
+	srv.shutdownDeadline, srv.shutdownClient = time.Time{}, nil
+	srv.addAcceptHandlers()
+	// the pause of CLIENT PAUSE is kept
+	srv.resumePausedClients()
+	return true
+}
+
+// shutdownCron finishes the shutdown in progress once all the replies are sent or the grace period is over.
+func (srv *GodisServer) shutdownCron() {
+	if !srv.shuttingDown() {
+		return
+	}
+	if time.Now().Before(srv.shutdownDeadline) {
+		for _, cli := range srv.clients {
+			if cli.hasPendingReplies() {
+				return
+			}
+		}
+	}
+	srv.finishShutdown()
+}
+
+// finishShutdown saves the db if needed, closes all the clients and the listening sockets and stops the loop.
+func (srv *GodisServer) finishShutdown() {
+	if srv.shutdownSave {
+		if err := srv.saveSnapshot(); err != nil {
+			logWarning("error trying to save the db: %v", err)
+			srv.AbortShutdown()
+			return
+		}
+		logNotice("db saved on disk")
+	}
+
+	for _, cli := range srv.clients {
+		cli.free()
+	}
+	for _, fd := range append(srv.fds, srv.tlsFds...) {
+		Close(fd)
+	}
+	if srv.config.UnixSocket != "" {
+		Close(srv.unixFd)
+		os.Remove(srv.config.UnixSocket)
+	}
+	logWarning("godis is now ready to exit, bye bye...")
+	srv.lp.Stop()
+}
+
+// handleSignals shuts down the server on SIGTERM and SIGINT, a second signal exits without waiting.
+func (srv *GodisServer) handleSignals() (stop func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		for sig := range ch {
+			name := unix.SignalName(sig.(syscall.Signal))
+			srv.lp.Post(func() {
+				if srv.shuttingDown() {
+					logWarning("received %v during shutdown, exiting now", name)
+					srv.finishShutdown()
+					return
+				}
+				logWarning("received %v scheduling shutdown...", name)
+				srv.Shutdown(nil, srv.config.SaveOnShutdown)
+			})
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(ch)
+	}
+}
+
+// shutdown [NOSAVE|SAVE|ABORT]
+func shutdownCmd(cli *GodisClient) string {
+	save := cli.srv.Config().SaveOnShutdown
+	if len(cli.args) > 2 {
+		return ReplySyntaxErr
+	}
+	if len(cli.args) == 2 {
+		switch strings.ToLower(cli.args[1].StrVal()) {
+		case "nosave":
+			save = false
+		case "save":
+			save = true
+		case "abort":
+			if !cli.srv.AbortShutdown() {
+				return replyErr("No shutdown in progress.")
+			}
+			return ReplyOK
+		default:
+			return ReplySyntaxErr
+		}
+	}
+
+	if !cli.srv.Shutdown(cli, save) {
+		return replyErr("Shutdown already in progress.")
+	}
+	// the connection is closed without a reply if the shutdown succeeds
+	return ""
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.gdb")
+	db := NewGodisDB()
+	for key, ttl := range map[string]int64{"k1": 0, "k2": 100000, "expired": -1} {
+		keyObj, val := NewObject(String, key), NewObject(String, "val-"+key)
+		db.Set(keyObj, val)
+		if ttl != 0 {
+			db.Expire(keyObj, NewObjectInt(time.Now().UnixMilli()+ttl))
+		}
+	}
+	assert.Nil(t, writeFileAtomic(path, EncodeSnapshot(db)))
+
+	loaded := NewGodisDB()
+	n, err := LoadSnapshot(loaded, path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "val-k1", loaded.Lookup(NewObject(String, "k1")).StrVal())
+	assert.Equal(t, int64(-1), loaded.ExpireAt(NewObject(String, "k1")))
+	assert.Equal(t, db.ExpireAt(NewObject(String, "k2")), loaded.ExpireAt(NewObject(String, "k2")))
+	assert.Nil(t, loaded.Lookup(NewObject(String, "expired")))
+
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	data[len(SnapshotMagic)+3] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, data, 0600))
+	_, err = LoadSnapshot(NewGodisDB(), path)
+	assert.Equal(t, ErrSnapshotFormat, err)
+}
+
+func TestShutdown(t *testing.T) {
+	port := 6693
+	srv := newTestServer(t, port)
+	startServer(t, srv)
+
+	fd, err := Connect([4]byte{127, 0, 0, 1}, port)
+	assert.Nil(t, err)
+	defer Close(fd)
+	roundTrip(t, fd, "set key val\r\n", ReplyOK)
+	roundTrip(t, fd, "shutdown abort\r\n", replyErr("No shutdown in progress."))
+	roundTrip(t, fd, "shutdown now\r\n", ReplySyntaxErr)
+
+	_, err = Write(fd, []byte("shutdown save\r\n"))
+	assert.Nil(t, err)
+	_, err = Read(fd, make([]byte, 16))
+	assert.Equal(t, io.EOF, err)
+	waitServer(t, srv)
+
+	// the db is loaded by next start
+	dir := srv.config.Dir
+	srv = newTestServer(t, port)
+	srv.config.Dir = dir
+	assert.Nil(t, srv.loadSnapshot())
+	assert.Equal(t, "val", srv.db.Lookup(NewObject(String, "key")).StrVal())
+	assert.Equal(t, int64(0), srv.db.dirty)
+}
+
+func TestShutdownAbort(t *testing.T) {
+	port := 6694
+	srv := newTestServer(t, port)
+	srv.config.ShutdownTimeout = 2
+	startServer(t, srv)
+
+	var fds []int
+	for i := 0; i < 3; i++ {
+		fd, err := Connect([4]byte{127, 0, 0, 1}, port)
+		assert.Nil(t, err)
+		defer Close(fd)
+		fds = append(fds, fd)
+	}
+
+	// the replies of fds[0] are never read, so the shutdown waits for them
+	val := strings.Repeat("v", 1024*1024)
+	roundTrip(t, fds[0], string(appendCommand(nil, "set", "key", val)), ReplyOK)
+	_, err := Write(fds[0], []byte(strings.Repeat("get key\r\n", 64)))
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	roundTrip(t, fds[2], "client pause 10000 write\r\n", ReplyOK)
+	_, err = Write(fds[1], []byte("shutdown nosave\r\n"))
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	roundTrip(t, fds[2], "shutdown\r\n", replyErr("Shutdown already in progress."))
+	roundTrip(t, fds[2], "shutdown abort\r\n", ReplyOK)
+	roundTrip(t, fds[1], "", ReplyShutdownFailed)
+
+	// the pause of CLIENT PAUSE is kept after the abort
+	_, err = Write(fds[2], []byte("set key val\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, SetTimeout(fds[2], 100))
+	n, _ := Read(fds[2], make([]byte, 16))
+	assert.Equal(t, 0, n)
+
+	// the server goes on after the abort
+	fd, err := Connect([4]byte{127, 0, 0, 1}, port)
+	assert.Nil(t, err)
+	defer Close(fd)
+	roundTrip(t, fd, "client unpause\r\n", ReplyOK)
+	roundTrip(t, fds[2], "", ReplyOK)
+	roundTrip(t, fd, "get key\r\n", replyBulk("val"))
+
+	// the signal shuts down the server once the grace period is over
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	waitServer(t, srv)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultSlowLogSlowerThan = 10000 // us
+	DefaultSlowLogMaxLen     = 128
+
+	SlowLogMaxArgc   = 32  // args beyond are summarized in the last arg
+	SlowLogMaxArgLen = 128 // bytes of an arg beyond are truncated
+	SlowLogGetCount  = 10  // entries returned by SLOWLOG GET without count
+)
+
+type SlowLogEntry struct {
+	id       int64
+	time     time.Time
+	duration int64 // us
+	args     []string
+	addr     string
+	name     string
+}
+
+// SlowLog keeps the recent slow commands in a ring, the oldest entry is overwritten once it's full.
+type SlowLog struct {
+	entries []*SlowLogEntry
+	next    int // the index of the next entry in the ring
+	len     int
+	nextId  int64
+}
+
+func NewSlowLog(maxLen int) *SlowLog {
+	return &SlowLog{entries: make([]*SlowLogEntry, maxLen)}
+}
+
+// Add logs the command of cli executed in duration.
+func (sl *SlowLog) Add(cli *GodisClient, cmd *GodisCommand, duration time.Duration) {
+	if len(sl.entries) == 0 {
+		return
+	}
+	sl.entries[sl.next] = &SlowLogEntry{
+		id:       sl.nextId,
+		time:     time.Now(),
+		duration: duration.Microseconds(),
+		args:     slowLogArgs(cmd, cli.args),
+		addr:     cli.addr,
+		name:     cli.name,
+	}
+	sl.nextId++
+	sl.next = (sl.next + 1) % len(sl.entries)
+	sl.len = min(sl.len+1, len(sl.entries))
+}
+
+// slowLogArgs truncates the args to keep the log small, the secrets are redacted by argRedacted.
+func slowLogArgs(cmd *GodisCommand, args []*Obj) []string {
+	argc := min(len(args), SlowLogMaxArgc)
+	strs := make([]string, argc)
+	for i := 0; i < argc; i++ {
+		arg := args[i].StrVal()
+		switch {
+		case i == argc-1 && argc < len(args):
+			arg = fmt.Sprintf("... (%d more arguments)", len(args)-argc+1)
+		case argRedacted(cmd, args, i):
+			arg = "(redacted)"
+		case len(arg) > SlowLogMaxArgLen:
+			arg = fmt.Sprintf("%s... (%d more bytes)", arg[:SlowLogMaxArgLen], len(arg)-SlowLogMaxArgLen)
+		}
+		strs[i] = arg
+	}
+	return strs
+}
+
+// sensitiveParams are the config params whose values are redacted from CONFIG SET by argRedacted.
+var sensitiveParams = map[string]bool{"requirepass": true}
+
+// argRedacted reports whether the i-th arg is a secret to hide from the slow log and the monitors.
+func argRedacted(cmd *GodisCommand, args []*Obj, i int) bool {
+	switch cmd.name {
+	case GodisCmdAuth:
+		return i > 0
+	case GodisCmdAcl:
+		return i > 2 && strings.EqualFold(args[1].StrVal(), "setuser")
+	case GodisCmdConfig:
+		// the values of the sensitive params set by CONFIG SET param value [param value ...]
+		return i > 2 && i%2 == 1 && strings.EqualFold(args[1].StrVal(), "set") &&
+			sensitiveParams[strings.ToLower(args[i-1].StrVal())]
+	case GodisCmdMigrate:
+		// the password of AUTH password and the username and password of AUTH2 username password,
+		// MIGRATE rejects them but the args are logged anyway
+		for j := 6; j < len(args) && j < i; j++ {
+			switch strings.ToLower(args[j].StrVal()) {
+			case "auth":
+				if i == j+1 {
+					return true
+				}
+				j++
+			case "auth2":
+				if i <= j+2 {
+					return true
+				}
+				j += 2
+			case "keys":
+				return false
+			}
+		}
+	case GodisCmdHello:
+		// the username and password of AUTH, the options are walked like helloCmd does
+		for j := 2; j < len(args) && j < i; j++ {
+			switch strings.ToLower(args[j].StrVal()) {
+			case "auth":
+				if i <= j+2 {
+					return true
+				}
+				j += 2
+			case "setname":
+				j++
+			}
+		}
+	}
+	return false
+}
+
+// Get returns at most n entries, the newest first.
+func (sl *SlowLog) Get(n int) []*SlowLogEntry {
+	n = min(n, sl.len)
+	entries := make([]*SlowLogEntry, n)
+	for i := range entries {
+		entries[i] = sl.entries[(sl.next-1-i+2*len(sl.entries))%len(sl.entries)]
+	}
+	return entries
+}
+
+func (sl *SlowLog) Len() int {
+	return sl.len
+}
+
+// Reset removes all the entries, the ids keep increasing.
+func (sl *SlowLog) Reset() {
+	for i := range sl.entries {
+		sl.entries[i] = nil
+	}
+	sl.len, sl.next = 0, 0
+}
+
+// SetMaxLen resizes the ring, the newest entries are kept.
+func (sl *SlowLog) SetMaxLen(maxLen int) {
+	entries := sl.Get(maxLen)
+	sl.entries = make([]*SlowLogEntry, maxLen)
+	// the oldest kept entry goes first
+	for i, e := range entries {
+		sl.entries[len(entries)-1-i] = e
+	}
+	sl.len = len(entries)
+	sl.next = 0
+	if maxLen > 0 {
+		sl.next = sl.len % maxLen
+	}
+}
+
+func replySlowLog(entries []*SlowLogEntry) string {
+	replies := make([]string, len(entries))
+	for i, e := range entries {
+		replies[i] = replyArray([]string{
+			replyInt(e.id),
+			replyInt(e.time.Unix()),
+			replyInt(e.duration),
+			replyBulkArray(e.args),
+			replyBulk(e.addr),
+			replyBulk(e.name),
+		})
+	}
+	return replyArray(replies)
+}
+
+// slowlog GET [count] | LEN | RESET
+func slowlogCmd(cli *GodisClient) string {
+	args := cli.args
+	sl := cli.srv.SlowLog()
+	switch sub := strings.ToLower(args[1].StrVal()); {
+	case sub == "get" && len(args) <= 3:
+		count := SlowLogGetCount
+		if len(args) == 3 {
+			n, err := strconv.Atoi(args[2].StrVal())
+			if err != nil || n < -1 {
+				return replyErr("count should be greater than or equal to -1")
+			}
+			count = n
+			if n == -1 {
+				count = sl.Len()
+			}
+		}
+		return replySlowLog(sl.Get(count))
+	case sub == "len" && len(args) == 2:
+		return replyInt(int64(sl.Len()))
+	case sub == "reset" && len(args) == 2:
+		sl.Reset()
+		return ReplyOK
+	}
+	return replyErr(fmt.Sprintf("unknown subcommand or wrong number of arguments for 'slowlog|%v'", args[1].StrVal()))
+}
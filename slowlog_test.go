@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowLogRing(t *testing.T) {
+	cmd := CmdTable[GodisCmdSet]
+	cli := NewGodisClient(0, nil, &MockIGodisServer{})
+	sl := NewSlowLog(3)
+	ids := func(entries []*SlowLogEntry) []int64 {
+		var ids []int64
+		for _, e := range entries {
+			ids = append(ids, e.id)
+		}
+		return ids
+	}
+
+	for i := 0; i < 5; i++ {
+		cli.args = strArgs("set", "key", fmt.Sprint(i))
+		sl.Add(cli, cmd, 0)
+	}
+	assert.Equal(t, 3, sl.Len())
+	assert.Equal(t, []int64{4, 3, 2}, ids(sl.Get(10)))
+	assert.Equal(t, []int64{4}, ids(sl.Get(1)))
+
+	sl.SetMaxLen(2)
+	assert.Equal(t, []int64{4, 3}, ids(sl.Get(10)))
+	sl.SetMaxLen(4)
+	sl.Add(cli, cmd, 0)
+	assert.Equal(t, []int64{5, 4, 3}, ids(sl.Get(10)))
+
+	sl.Reset()
+	assert.Equal(t, 0, sl.Len())
+	sl.Add(cli, cmd, 0)
+	assert.Equal(t, []int64{6}, ids(sl.Get(10)))
+
+	sl.SetMaxLen(0)
+	sl.Add(cli, cmd, 0)
+	assert.Equal(t, 0, sl.Len())
+}
+
+func TestSlowLogArgs(t *testing.T) {
+	long := strings.Repeat("v", SlowLogMaxArgLen+10)
+	assert.Equal(t, []string{"set", "key", strings.Repeat("v", SlowLogMaxArgLen) + "... (10 more bytes)"},
+		slowLogArgs(CmdTable[GodisCmdSet], strArgs("set", "key", long)))
+
+	args := []string{"client", "list", "id"}
+	for i := 0; i < SlowLogMaxArgc; i++ {
+		args = append(args, fmt.Sprint(i))
+	}
+	strs := slowLogArgs(CmdTable[GodisCmdClient], strArgs(args...))
+	assert.Equal(t, SlowLogMaxArgc, len(strs))
+	assert.Equal(t, "... (4 more arguments)", strs[SlowLogMaxArgc-1])
+
+	assert.Equal(t, []string{"auth", "(redacted)", "(redacted)"},
+		slowLogArgs(CmdTable[GodisCmdAuth], strArgs("auth", "user", "pass")))
+	assert.Equal(t, []string{"acl", "setuser", "user", "(redacted)"},
+		slowLogArgs(CmdTable[GodisCmdAcl], strArgs("acl", "setuser", "user", ">pass")))
+	assert.Equal(t, []string{"config", "set", "maxclients", "10", "REQUIREPASS", "(redacted)"},
+		slowLogArgs(CmdTable[GodisCmdConfig], strArgs("config", "set", "maxclients", "10", "REQUIREPASS", "pass")))
+	assert.Equal(t, []string{"migrate", "host", "6379", "", "0", "1000", "auth", "(redacted)", "auth2", "(redacted)", "(redacted)", "keys", "auth"},
+		slowLogArgs(CmdTable[GodisCmdMigrate], strArgs("migrate", "host", "6379", "", "0", "1000", "auth", "pass", "auth2", "user", "pass", "keys", "auth")))
+	assert.Equal(t, []string{"hello", "3", "setname", "auth", "auth", "(redacted)", "(redacted)"},
+		slowLogArgs(CmdTable[GodisCmdHello], strArgs("hello", "3", "setname", "auth", "auth", "user", "pass")))
+}
+
+func TestSlowLogCmd(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli := srv.newClient(0)
+	cli.addr, cli.name = "127.0.0.1:1234", "conn"
+
+	// commands faster than the threshold are not logged
+	execCmd(cli, "set", "key", "val")
+	assert.Equal(t, replyInt(0), execCmd(cli, "slowlog", "len"))
+
+	assert.Equal(t, ReplyOK, execCmd(cli, "config", "set", "slowlog-log-slower-than", "0"))
+	execCmd(cli, "set", "key", "val")
+	reply := execCmd(cli, "slowlog", "get", "1")
+	assert.True(t, strings.HasPrefix(reply, "*1\r\n*6\r\n:1\r\n"), reply)
+	assert.True(t, strings.HasSuffix(reply, replyBulkArray([]string{"set", "key", "val"})+
+		replyBulk("127.0.0.1:1234")+replyBulk("conn")), reply)
+	// CONFIG SET and SLOWLOG GET are logged too
+	assert.Equal(t, replyInt(3), execCmd(cli, "slowlog", "len"))
+	assert.True(t, strings.HasPrefix(execCmd(cli, "slowlog", "get", "-1"), "*4\r\n"))
+	assert.Equal(t, replyErr("count should be greater than or equal to -1"), execCmd(cli, "slowlog", "get", "-2"))
+
+	assert.Equal(t, ReplyOK, execCmd(cli, "slowlog", "reset"))
+	assert.Equal(t, replyInt(1), execCmd(cli, "slowlog", "len"))
+
+	assert.Equal(t, ReplyOK, execCmd(cli, "config", "set", "slowlog-max-len", "0"))
+	assert.Equal(t, replyInt(0), execCmd(cli, "slowlog", "len"))
+	assert.Equal(t, replyErr("unknown subcommand or wrong number of arguments for 'slowlog|foo'"),
+		execCmd(cli, "slowlog", "foo"))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc64"
+	"os"
+	"time"
+)
+
+// Snapshot file layout:
+//
+//	| "GODIS" | version (2 bytes LE) | entry ... | SnapshotEOF | crc64 of the preceding bytes (8 bytes LE) |
+//
+// an entry is SnapshotEntry + key + expire in unix ms (0 if none) + DUMP payload of the value,
+// encoded like the values of the DUMP payload.
+const (
+	SnapshotMagic   = "GODIS"
+	SnapshotVersion = 1
+
+	SnapshotEntry byte = 1
+	SnapshotEOF   byte = 0xff
+)
+
+var ErrSnapshotFormat = errors.New("bad snapshot format")
+
+// EncodeSnapshot encodes all the keys of db, expired keys are skipped.
+func EncodeSnapshot(db *GodisDB) []byte {
+	w := &dumpWriter{buf: []byte(SnapshotMagic)}
+	w.buf = binary.LittleEndian.AppendUint16(w.buf, SnapshotVersion)
+
+	now := time.Now().UnixMilli()
+	db.data.ForEach(func(entry *Entry) {
+		when := db.ExpireAt(entry.Key)
+		if when >= 0 && when <= now {
+			return
+		}
+		w.buf = append(w.buf, SnapshotEntry)
+		w.writeString(entry.Key.StrVal())
+		w.writeUint(uint64(max(when, 0)))
+		w.writeString(string(DumpObject(entry.Val)))
+	})
+
+	w.buf = append(w.buf, SnapshotEOF)
+	return binary.LittleEndian.AppendUint64(w.buf, crc64.Checksum(w.buf, crcTable))
+}
+
+// LoadSnapshot loads the keys saved in path into db, returns the number of keys loaded.
+func LoadSnapshot(db *GodisDB, path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	header := len(SnapshotMagic) + 2
+	if len(data) < header+9 || !bytes.HasPrefix(data, []byte(SnapshotMagic)) {
+		return 0, ErrSnapshotFormat
+	}
+	if binary.LittleEndian.Uint16(data[len(SnapshotMagic):]) > SnapshotVersion {
+		return 0, ErrSnapshotFormat
+	}
+	body := data[:len(data)-8]
+	if crc64.Checksum(body, crcTable) != binary.LittleEndian.Uint64(data[len(body):]) {
+		return 0, ErrSnapshotFormat
+	}
+
+	r := &dumpReader{buf: body[header:]}
+	now := time.Now().UnixMilli()
+	n := 0
+	for len(r.buf) > 0 && r.buf[0] == SnapshotEntry {
+		r.buf = r.buf[1:]
+		key := r.readString()
+		when := int64(r.readUint())
+		payload := r.readString()
+		if r.err != nil {
+			return n, r.err
+		}
+		val, err := RestoreObject([]byte(payload))
+		if err != nil {
+			return n, err
+		}
+		if when > 0 && when <= now {
+			val.DecrRefCount()
+			continue
+		}
+
+		keyObj := NewObject(String, key)
+		db.Set(keyObj, val)
+		if when > 0 {
+			expObj := NewObjectInt(when)
+			db.Expire(keyObj, expObj)
+			expObj.DecrRefCount()
+		}
+		keyObj.DecrRefCount()
+		val.DecrRefCount()
+		n++
+	}
+	if len(r.buf) != 1 || r.buf[0] != SnapshotEOF {
+		return n, ErrSnapshotFormat
+	}
+	return n, nil
+}
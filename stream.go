@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultStreamNodeMaxEntries = 100
+	StreamEntryOverhead         = 48 // StreamEntry and its slot in the node
+	StreamNodeOverhead          = 32
+)
+
+// StreamID is the id of a stream entry, the ms part is a unix ms time and seq orders the entries of the same ms.
+type StreamID struct {
+	ms  uint64
+	seq uint64
+}
+
+var (
+	StreamMinID = StreamID{0, 0}
+	StreamMaxID = StreamID{math.MaxUint64, math.MaxUint64}
+)
+
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id StreamID) Less(other StreamID) bool {
+	return id.ms < other.ms || id.ms == other.ms && id.seq < other.seq
+}
+
+// incr returns the next id, false if id is the max id.
+func (id StreamID) incr() (StreamID, bool) {
+	switch {
+	case id.seq < math.MaxUint64:
+		return StreamID{id.ms, id.seq + 1}, true
+	case id.ms < math.MaxUint64:
+		return StreamID{id.ms + 1, 0}, true
+	}
+	return id, false
+}
+
+// decr returns the previous id, false if id is the min id.
+func (id StreamID) decr() (StreamID, bool) {
+	switch {
+	case id.seq > 0:
+		return StreamID{id.ms, id.seq - 1}, true
+	case id.ms > 0:
+		return StreamID{id.ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// parseStreamID parses an id like "ms-seq" or "ms", the seq of "ms" is missingSeq.
+func parseStreamID(s string, missingSeq uint64) (StreamID, bool) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return StreamID{}, false
+	}
+	seq := missingSeq
+	if hasSeq {
+		if seq, err = strconv.ParseUint(seqPart, 10, 64); err != nil {
+			return StreamID{}, false
+		}
+	}
+	return StreamID{ms, seq}, true
+}
+
+type StreamEntry struct {
+	id     StreamID
+	fields []string // field value pairs
+}
+
+func (e *StreamEntry) size() int64 {
+	size := int64(StreamEntryOverhead)
+	for _, f := range e.fields {
+		size += int64(len(f)) + 16
+	}
+	return size
+}
+
+// streamNode keeps the entries of a range of ids in order, like the listpacks in the radix tree of redis.
+type streamNode struct {
+	entries []*StreamEntry
+}
+
+func (n *streamNode) last() StreamID {
+	return n.entries[len(n.entries)-1].id
+}
+
+// StreamLog is an append only log of entries ordered by id. The entries are kept in nodes of bounded size,
+// which are indexed by their ids, so the appending and the trimming of whole nodes are cheap.
+type StreamLog struct {
+	nodes        []*streamNode
+	length       int64
+	lastId       StreamID // the id of the last entry added, even if it's deleted
+	maxDeletedId StreamID
+	entriesAdded int64
+	groups       map[string]*StreamGroup // the consumer groups, see stream_group.go
+	memory       int64                   // estimated bytes of the entries and the groups
+}
+
+func NewStreamLog() *StreamLog {
+	return &StreamLog{groups: make(map[string]*StreamGroup)}
+}
+
+// NextID returns the id generated for a new entry at now.
+func (s *StreamLog) NextID(now time.Time) (StreamID, bool) {
+	ms := uint64(now.UnixMilli())
+	if ms > s.lastId.ms {
+		return StreamID{ms, 0}, true
+	}
+	return s.lastId.incr()
+}
+
+// Add appends the entry, id must be greater than the last id.
+func (s *StreamLog) Add(id StreamID, fields []string, nodeMaxEntries int) {
+	entry := &StreamEntry{id, fields}
+	if len(s.nodes) == 0 || len(s.nodes[len(s.nodes)-1].entries) >= max(nodeMaxEntries, 1) {
+		s.nodes = append(s.nodes, &streamNode{})
+		s.memory += StreamNodeOverhead
+	}
+	node := s.nodes[len(s.nodes)-1]
+	node.entries = append(node.entries, entry)
+	s.length++
+	s.entriesAdded++
+	s.lastId = id
+	s.memory += entry.size()
+}
+
+// seek returns the position of the first entry whose id >= id.
+func (s *StreamLog) seek(id StreamID) (node, idx int) {
+	node = sort.Search(len(s.nodes), func(i int) bool { return !s.nodes[i].last().Less(id) })
+	if node == len(s.nodes) {
+		return node, 0
+	}
+	entries := s.nodes[node].entries
+	idx = sort.Search(len(entries), func(i int) bool { return !entries[i].id.Less(id) })
+	return node, idx
+}
+
+// Range returns at most count entries between start and end inclusive, count <= 0 means no limit.
+func (s *StreamLog) Range(start, end StreamID, count int, rev bool) []*StreamEntry {
+	var entries []*StreamEntry
+	if end.Less(start) {
+		return nil
+	}
+	full := func() bool { return count > 0 && len(entries) >= count }
+	if !rev {
+		for n, i := s.seek(start); n < len(s.nodes) && !full(); n, i = n+1, 0 {
+			for _, e := range s.nodes[n].entries[i:] {
+				if end.Less(e.id) || full() {
+					return entries
+				}
+				entries = append(entries, e)
+			}
+		}
+		return entries
+	}
+
+	// start from the last entry <= end
+	n, i := s.seek(end)
+	if n == len(s.nodes) || s.nodes[n].entries[i].id != end {
+		n, i = s.prev(n, i)
+	}
+	for ; n >= 0 && !full(); n, i = s.prev(n, i) {
+		e := s.nodes[n].entries[i]
+		if e.id.Less(start) {
+			break
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// Get returns the entry of id, nil if it doesn't exist.
+func (s *StreamLog) Get(id StreamID) *StreamEntry {
+	n, i := s.seek(id)
+	if n == len(s.nodes) || s.nodes[n].entries[i].id != id {
+		return nil
+	}
+	return s.nodes[n].entries[i]
+}
+
+// firstId returns the id of the first entry, 0-0 if the stream is empty.
+func (s *StreamLog) firstId() StreamID {
+	if len(s.nodes) == 0 {
+		return StreamMinID
+	}
+	return s.nodes[0].entries[0].id
+}
+
+// prev returns the position before the entry at i of node n, n is -1 if there is none.
+func (s *StreamLog) prev(n, i int) (int, int) {
+	if i > 0 && n < len(s.nodes) {
+		return n, i - 1
+	}
+	if n--; n >= 0 {
+		return n, len(s.nodes[n].entries) - 1
+	}
+	return n, 0
+}
+
+// Delete removes the entry of id, returns false if it doesn't exist.
+func (s *StreamLog) Delete(id StreamID) bool {
+	n, i := s.seek(id)
+	if n == len(s.nodes) || s.nodes[n].entries[i].id != id {
+		return false
+	}
+	node := s.nodes[n]
+	s.memory -= node.entries[i].size()
+	node.entries = append(node.entries[:i], node.entries[i+1:]...)
+	if len(node.entries) == 0 {
+		s.removeNode(n)
+	}
+	s.length--
+	if s.maxDeletedId.Less(id) {
+		s.maxDeletedId = id
+	}
+	return true
+}
+
+func (s *StreamLog) removeNode(n int) {
+	s.nodes = append(s.nodes[:n], s.nodes[n+1:]...)
+	s.memory -= StreamNodeOverhead
+}
+
+// Trim removes the oldest entries until the length is at most maxLen, or the first id is at least minId
+// if byId. In approximate mode only whole nodes are removed, so fewer entries may be removed.
+// limit bounds the entries removed in approximate mode, 0 means no limit. It returns the entries removed.
+func (s *StreamLog) Trim(maxLen int64, minId StreamID, byId, approx bool, limit int64) int64 {
+	var removed int64
+	for len(s.nodes) > 0 {
+		node := s.nodes[0]
+		// the whole node can be removed
+		if byId && node.last().Less(minId) || !byId && s.length-int64(len(node.entries)) >= maxLen {
+			if approx && limit > 0 && removed+int64(len(node.entries)) > limit {
+				break
+			}
+			for _, e := range node.entries {
+				s.memory -= e.size()
+			}
+			removed += int64(len(node.entries))
+			s.length -= int64(len(node.entries))
+			if s.maxDeletedId.Less(node.last()) {
+				s.maxDeletedId = node.last()
+			}
+			s.removeNode(0)
+			continue
+		}
+		if approx {
+			break
+		}
+
+		i := 0
+		for i < len(node.entries) && (byId && node.entries[i].id.Less(minId) || !byId && s.length-int64(i) > maxLen) {
+			s.memory -= node.entries[i].size()
+			i++
+		}
+		if i > 0 {
+			if s.maxDeletedId.Less(node.entries[i-1].id) {
+				s.maxDeletedId = node.entries[i-1].id
+			}
+			node.entries = append([]*StreamEntry(nil), node.entries[i:]...)
+			removed += int64(i)
+			s.length -= int64(i)
+		}
+		break
+	}
+	return removed
+}
+
+func (s *StreamLog) Len() int64 {
+	return s.length
+}
@@ -0,0 +1,1134 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StreamTrimLimitFactor bounds the entries removed by an approximate trim without LIMIT, in nodes.
+const StreamTrimLimitFactor = 100
+
+var (
+	ReplyInvalidStreamID  = replyErr("Invalid stream ID specified as stream command argument")
+	ReplyStreamIDTooSmall = replyErr("The ID specified in XADD is equal or smaller than the target stream top item")
+	ReplyStreamIDZero     = replyErr("The ID specified in XADD must be greater than 0-0")
+	ReplyStreamExhausted  = replyErr("The stream has exhausted the last possible ID, unable to add more items")
+)
+
+// lookupStream looks up the stream of key, returns the error reply if key holds another type.
+func lookupStream(cli *GodisClient, key *Obj) (*Obj, string) {
+	val := cli.db.Lookup(key)
+	if val != nil && val.Type != Stream {
+		return nil, ReplyWrongType
+	}
+	return val, ""
+}
+
+func replyStreamEntry(e *StreamEntry) string {
+	return replyArray([]string{replyBulk(e.id.String()), replyBulkArray(e.fields)})
+}
+
+func replyStreamEntries(entries []*StreamEntry) string {
+	replies := make([]string, len(entries))
+	for i, e := range entries {
+		replies[i] = replyStreamEntry(e)
+	}
+	return replyArray(replies)
+}
+
+// streamTrim is the MAXLEN or MINID option of XADD and XTRIM.
+type streamTrim struct {
+	byId   bool
+	maxLen int64
+	minId  StreamID
+	approx bool  // only whole nodes are removed with ~
+	limit  int64 // the max entries removed in approximate mode, 0 means no limit
+}
+
+func (t *streamTrim) apply(s *StreamLog) int64 {
+	return s.Trim(t.maxLen, t.minId, t.byId, t.approx, t.limit)
+}
+
+// parseStreamTrim parses MAXLEN|MINID [=|~] threshold [LIMIT count] from args[i],
+// returns the position after it or the error reply if failed.
+func parseStreamTrim(cli *GodisClient, args []*Obj, i int) (*streamTrim, int, string) {
+	trim := &streamTrim{byId: strings.EqualFold(args[i].StrVal(), "minid"), limit: -1}
+	i++
+	if i < len(args) && (args[i].StrVal() == "~" || args[i].StrVal() == "=") {
+		trim.approx = args[i].StrVal() == "~"
+		i++
+	}
+	if i >= len(args) {
+		return nil, 0, ReplySyntaxErr
+	}
+	if trim.byId {
+		id, ok := parseStreamID(args[i].StrVal(), 0)
+		if !ok {
+			return nil, 0, ReplyInvalidStreamID
+		}
+		trim.minId = id
+	} else {
+		n, err := strconv.ParseInt(args[i].StrVal(), 10, 64)
+		if err != nil {
+			return nil, 0, ReplyNotInteger
+		}
+		if n < 0 {
+			return nil, 0, replyErr("The MAXLEN argument must be >= 0.")
+		}
+		trim.maxLen = n
+	}
+	i++
+
+	if i+1 < len(args) && strings.EqualFold(args[i].StrVal(), "limit") {
+		n, err := strconv.ParseInt(args[i+1].StrVal(), 10, 64)
+		if err != nil || n < 0 {
+			return nil, 0, replyErr("The LIMIT argument must be >= 0.")
+		}
+		if !trim.approx {
+			return nil, 0, replyErr("syntax error, LIMIT cannot be used without the special ~ option")
+		}
+		trim.limit = n
+		i += 2
+	}
+	if trim.limit < 0 {
+		trim.limit = StreamTrimLimitFactor * int64(cli.srv.Config().StreamNodeMaxEntries)
+	}
+	return trim, i, ""
+}
+
+// xadd key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] *|id field value [field value ...]
+func xaddCmd(cli *GodisClient) string {
+	args := cli.args
+	noMkStream := false
+	var trim *streamTrim
+	i := 2
+	for i < len(args) {
+		opt := strings.ToLower(args[i].StrVal())
+		if opt == "nomkstream" {
+			noMkStream = true
+			i++
+		} else if opt == "maxlen" || opt == "minid" {
+			var errReply string
+			if trim, i, errReply = parseStreamTrim(cli, args, i); errReply != "" {
+				return errReply
+			}
+		} else {
+			break
+		}
+	}
+	if len(args)-i < 3 || (len(args)-i)%2 == 0 {
+		return ReplyWrongNumberOfArgs
+	}
+
+	// the ms or the seq of the id is generated for * or ms-*
+	idArg := args[i].StrVal()
+	var id StreamID
+	autoMs, autoSeq := idArg == "*", strings.HasSuffix(idArg, "-*")
+	if !autoMs {
+		msArg := strings.TrimSuffix(idArg, "-*")
+		var ok bool
+		if id, ok = parseStreamID(msArg, 0); !ok || autoSeq && strings.Contains(msArg, "-") {
+			return ReplyInvalidStreamID
+		}
+		if !autoSeq && id == StreamMinID {
+			return ReplyStreamIDZero
+		}
+	}
+	fields := make([]string, 0, len(args)-i-1)
+	for _, arg := range args[i+1:] {
+		fields = append(fields, arg.StrVal())
+	}
+
+	key := args[1]
+	val, errReply := lookupStream(cli, key)
+	if errReply != "" {
+		return errReply
+	}
+	created := val == nil
+	if created {
+		if noMkStream {
+			return ReplyNil
+		}
+		val = NewObject(Stream, NewStreamLog())
+		defer val.DecrRefCount()
+	}
+	s := val.Val.(*StreamLog)
+
+	switch {
+	case autoMs:
+		var ok bool
+		if id, ok = s.NextID(time.Now()); !ok {
+			return ReplyStreamExhausted
+		}
+	case autoSeq:
+		if id.ms < s.lastId.ms || id.ms == s.lastId.ms && s.lastId.seq == math.MaxUint64 {
+			return ReplyStreamIDTooSmall
+		}
+		if id.ms == s.lastId.ms {
+			id.seq = s.lastId.seq + 1
+		}
+	case !s.lastId.Less(id):
+		return ReplyStreamIDTooSmall
+	}
+
+	oldSize := objSize(val)
+	s.Add(id, fields, cli.srv.Config().StreamNodeMaxEntries)
+	var trimmed int64
+	if trim != nil {
+		trimmed = trim.apply(s)
+	}
+	if created {
+		cli.db.Set(key, val)
+	} else {
+		cli.db.Modified(val, oldSize)
+	}
+	cli.db.Notify(NotifyStream, "xadd", key)
+	if trimmed > 0 {
+		cli.db.Notify(NotifyStream, "xtrim", key)
+	}
+	cli.srv.SignalKeyAsReady(key.StrVal())
+	return replyBulk(id.String())
+}
+
+// parseRangeID parses the start or end of XRANGE, which may be - or +, or exclusive with the ( prefix.
+// The missing seq of the end is the max one.
+func parseRangeID(s string, isEnd bool) (StreamID, string) {
+	switch s {
+	case "-":
+		return StreamMinID, ""
+	case "+":
+		return StreamMaxID, ""
+	}
+	var missingSeq uint64
+	if isEnd {
+		missingSeq = math.MaxUint64
+	}
+	id, ok := parseStreamID(strings.TrimPrefix(s, "("), missingSeq)
+	if !ok {
+		return id, ReplyInvalidStreamID
+	}
+	if strings.HasPrefix(s, "(") {
+		if isEnd {
+			if id, ok = id.decr(); !ok {
+				return id, replyErr("invalid end ID for the interval")
+			}
+		} else if id, ok = id.incr(); !ok {
+			return id, replyErr("invalid start ID for the interval")
+		}
+	}
+	return id, ""
+}
+
+// xrange key start end [COUNT count], or xrevrange key end start [COUNT count]
+func xrangeCmd(cli *GodisClient) string {
+	args := cli.args
+	rev := strings.EqualFold(args[0].StrVal(), GodisCmdXRevRange)
+	startArg, endArg := args[2].StrVal(), args[3].StrVal()
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+	start, errReply := parseRangeID(startArg, false)
+	if errReply != "" {
+		return errReply
+	}
+	end, errReply := parseRangeID(endArg, true)
+	if errReply != "" {
+		return errReply
+	}
+
+	count := int64(-1)
+	if len(args) == 6 && strings.EqualFold(args[4].StrVal(), "count") {
+		n, err := strconv.ParseInt(args[5].StrVal(), 10, 64)
+		if err != nil {
+			return ReplyNotInteger
+		}
+		count = max(n, 0)
+	} else if len(args) != 4 {
+		return ReplySyntaxErr
+	}
+
+	val, errReply := lookupStream(cli, args[1])
+	if errReply != "" {
+		return errReply
+	}
+	if val == nil || count == 0 {
+		return replyArray(nil)
+	}
+	return replyStreamEntries(val.Val.(*StreamLog).Range(start, end, int(count), rev))
+}
+
+// xlen key
+func xlenCmd(cli *GodisClient) string {
+	val, errReply := lookupStream(cli, cli.args[1])
+	if errReply != "" {
+		return errReply
+	}
+	if val == nil {
+		return replyInt(0)
+	}
+	return replyInt(val.Val.(*StreamLog).Len())
+}
+
+// xdel key id [id ...]
+func xdelCmd(cli *GodisClient) string {
+	ids := make([]StreamID, 0, len(cli.args)-2)
+	for _, arg := range cli.args[2:] {
+		id, ok := parseStreamID(arg.StrVal(), 0)
+		if !ok {
+			return ReplyInvalidStreamID
+		}
+		ids = append(ids, id)
+	}
+
+	key := cli.args[1]
+	val, errReply := lookupStream(cli, key)
+	if errReply != "" {
+		return errReply
+	}
+	if val == nil {
+		return replyInt(0)
+	}
+	s := val.Val.(*StreamLog)
+	oldSize := objSize(val)
+	var deleted int64
+	for _, id := range ids {
+		if s.Delete(id) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		cli.db.Modified(val, oldSize)
+		cli.db.Notify(NotifyStream, "xdel", key)
+	}
+	return replyInt(deleted)
+}
+
+// xtrim key MAXLEN|MINID [=|~] threshold [LIMIT count]
+func xtrimCmd(cli *GodisClient) string {
+	args := cli.args
+	if opt := strings.ToLower(args[2].StrVal()); opt != "maxlen" && opt != "minid" {
+		return ReplySyntaxErr
+	}
+	trim, i, errReply := parseStreamTrim(cli, args, 2)
+	if errReply != "" {
+		return errReply
+	}
+	if i != len(args) {
+		return ReplySyntaxErr
+	}
+
+	key := args[1]
+	val, errReply := lookupStream(cli, key)
+	if errReply != "" {
+		return errReply
+	}
+	if val == nil {
+		return replyInt(0)
+	}
+	oldSize := objSize(val)
+	trimmed := trim.apply(val.Val.(*StreamLog))
+	if trimmed > 0 {
+		cli.db.Modified(val, oldSize)
+		cli.db.Notify(NotifyStream, "xtrim", key)
+	}
+	return replyInt(trimmed)
+}
+
+// xreadKeys returns the positions of the keys of XREAD and XREADGROUP, which follow STREAMS and are followed by as many ids.
+func xreadKeys(args []*Obj) []int {
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(args[i].StrVal()) {
+		case "group":
+			i += 2 // the group and the consumer
+		case "streams":
+			n := (len(args) - i - 1) / 2
+			return keyRange(i+1, i+n, 1)(args)
+		}
+	}
+	return nil
+}
+
+// xread [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...], or
+// xreadgroup GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+func xreadCmd(cli *GodisClient) string {
+	args := cli.args
+	xreadgroup := strings.EqualFold(args[0].StrVal(), GodisCmdXReadGroup)
+	count, block, streamsAt := int64(0), int64(-1), 0
+	var groupName, consumerName string
+	noack := false
+	for i := 1; i < len(args) && streamsAt == 0; i++ {
+		switch opt := strings.ToLower(args[i].StrVal()); {
+		case opt == "count" && i+1 < len(args):
+			i++
+			n, err := strconv.ParseInt(args[i].StrVal(), 10, 64)
+			if err != nil {
+				return ReplyNotInteger
+			}
+			count = n
+		case opt == "block" && i+1 < len(args):
+			i++
+			ms, err := strconv.ParseInt(args[i].StrVal(), 10, 64)
+			if err != nil {
+				return replyErr("timeout is not an integer or out of range")
+			}
+			if ms < 0 {
+				return replyErr("timeout is negative")
+			}
+			block = ms
+		case opt == "group" && i+2 < len(args):
+			if !xreadgroup {
+				return replyErr("The GROUP option is only supported by XREADGROUP. You called XREAD instead.")
+			}
+			groupName, consumerName = args[i+1].StrVal(), args[i+2].StrVal()
+			i += 2
+		case opt == "noack" && xreadgroup:
+			noack = true
+		case opt == "streams":
+			streamsAt = i
+		default:
+			return ReplySyntaxErr
+		}
+	}
+	if streamsAt == 0 {
+		return ReplySyntaxErr
+	}
+	if xreadgroup && groupName == "" {
+		return replyErr("Missing GROUP option for XREADGROUP")
+	}
+	n := len(args) - streamsAt - 1
+	if n == 0 || n%2 != 0 {
+		return replyErr(fmt.Sprintf("Unbalanced '%v' list of streams: for each stream key an ID or '$' must be specified.",
+			strings.ToLower(args[0].StrVal())))
+	}
+	n /= 2
+	keys, ids := args[streamsAt+1:streamsAt+1+n], args[streamsAt+1+n:]
+
+	// the entries after the ids are read, $ is the last id of the stream and > is the last id delivered to the group
+	vals := make([]*Obj, n)
+	groups := make([]*StreamGroup, n)
+	after := make([]StreamID, n)
+	for i, key := range keys {
+		val, errReply := lookupStream(cli, key)
+		if errReply != "" {
+			return errReply
+		}
+		vals[i] = val
+		idArg := ids[i].StrVal()
+		if xreadgroup {
+			if val != nil {
+				groups[i] = val.Val.(*StreamLog).groups[groupName]
+			}
+			if groups[i] == nil {
+				return fmt.Sprintf("-NOGROUP No such key '%v' or consumer group '%v' in XREADGROUP with GROUP option\r\n",
+					key.StrVal(), groupName)
+			}
+			switch idArg {
+			case "$":
+				return replyErr("The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this " +
+					"consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.")
+			case ">":
+				after[i] = groups[i].lastId
+				continue
+			}
+		} else if idArg == "$" {
+			if val != nil {
+				after[i] = val.Val.(*StreamLog).lastId
+			}
+			continue
+		}
+		id, ok := parseStreamID(idArg, 0)
+		if !ok {
+			return ReplyInvalidStreamID
+		}
+		after[i] = id
+	}
+
+	now := time.Now()
+	var results []string
+	for i, val := range vals {
+		var entries string
+		if xreadgroup {
+			entries = readGroup(cli, keys[i], val, groups[i], consumerName, after[i], ids[i].StrVal() == ">", noack, count, now)
+		} else if start, ok := after[i].incr(); val != nil && ok {
+			if found := val.Val.(*StreamLog).Range(start, StreamMaxID, int(count), false); len(found) > 0 {
+				entries = replyStreamEntries(found)
+			}
+		}
+		if entries != "" {
+			results = append(results, replyBulk(keys[i].StrVal()), entries)
+		}
+	}
+	if len(results) > 0 {
+		if cli.resp == 3 {
+			return replyMap(cli, results)
+		}
+		replies := make([]string, 0, len(results)/2)
+		for i := 0; i < len(results); i += 2 {
+			replies = append(replies, replyArray(results[i:i+2]))
+		}
+		return replyArray(replies)
+	}
+	if block < 0 {
+		return ReplyNilArray
+	}
+
+	// $ is replaced by the id it means now, so only the entries added later are read when executed again
+	blockKeys := make([]string, n)
+	for i, key := range keys {
+		blockKeys[i] = key.StrVal()
+		if ids[i].StrVal() == "$" {
+			ids[i].DecrRefCount()
+			ids[i] = NewObject(String, after[i].String())
+		}
+	}
+	cli.srv.BlockForKeys(cli, blockKeys, time.Duration(block)*time.Millisecond)
+	return ""
+}
+
+// readGroup delivers the new entries after id to the consumer of the group, or replies the pending entries of the
+// consumer after id to read its history. It returns "" if there are no new entries.
+func readGroup(cli *GodisClient, key, val *Obj, g *StreamGroup, consumerName string, after StreamID,
+	newEntries, noack bool, count int64, now time.Time) string {
+	s := val.Val.(*StreamLog)
+	oldSize := objSize(val)
+	defer cli.db.Modified(val, oldSize)
+	c, created := g.Consumer(consumerName)
+	if created {
+		cli.db.Notify(NotifyStream, "xgroup-createconsumer", key)
+	}
+	c.seenTime = now
+
+	var replies []string
+	start, ok := after.incr()
+	if newEntries {
+		if !ok {
+			return ""
+		}
+		for _, e := range s.Range(start, StreamMaxID, int(count), false) {
+			g.advance(e.id)
+			if !noack {
+				nack := g.addPending(e.id, c)
+				nack.deliveryTime, nack.deliveryCount = now, 1
+			}
+			replies = append(replies, replyStreamEntry(e))
+		}
+		if len(replies) == 0 {
+			return ""
+		}
+		c.activeTime = now
+		return replyArray(replies)
+	}
+
+	if ok {
+		for _, nack := range g.pel[g.seekPending(start):] {
+			if count > 0 && int64(len(replies)) >= count {
+				break
+			}
+			if nack.consumer != c {
+				continue
+			}
+			nack.deliveryTime = now
+			nack.deliveryCount++
+			// the entry may be deleted while pending
+			if e := s.Get(nack.id); e != nil {
+				replies = append(replies, replyStreamEntry(e))
+			} else {
+				replies = append(replies, replyArray([]string{replyBulk(nack.id.String()), ReplyNilArray}))
+			}
+		}
+	}
+	return replyArray(replies)
+}
+
+var (
+	ReplyBusyGroup = "-BUSYGROUP Consumer Group name already exists\r\n"
+	ReplyNoSuchKey = replyErr("no such key")
+)
+
+func replyNoGroup(key, group string) string {
+	return fmt.Sprintf("-NOGROUP No such key '%v' or consumer group '%v'\r\n", key, group)
+}
+
+// lookupGroup looks up the group of the stream of key, returns the error reply if key holds another type
+// or the group doesn't exist.
+func lookupGroup(cli *GodisClient, key *Obj, name string) (*Obj, *StreamGroup, string) {
+	val, errReply := lookupStream(cli, key)
+	if errReply != "" {
+		return nil, nil, errReply
+	}
+	if val == nil || val.Val.(*StreamLog).groups[name] == nil {
+		return nil, nil, replyNoGroup(key.StrVal(), name)
+	}
+	return val, val.Val.(*StreamLog).groups[name], ""
+}
+
+// msSince returns the milliseconds from t to now.
+func msSince(now, t time.Time) int64 {
+	return max(now.Sub(t).Milliseconds(), 0)
+}
+
+// xgroup CREATE key group id|$ [MKSTREAM] [ENTRIESREAD entries-read] | SETID key group id|$ [ENTRIESREAD entries-read] |
+// DESTROY key group | CREATECONSUMER key group consumer | DELCONSUMER key group consumer
+func xgroupCmd(cli *GodisClient) string {
+	args := cli.args
+	switch sub := strings.ToLower(args[1].StrVal()); {
+	case (sub == "create" || sub == "setid") && len(args) >= 5:
+	case sub == "destroy" && len(args) == 4:
+	case (sub == "createconsumer" || sub == "delconsumer") && len(args) == 5:
+	default:
+		return replyErr(fmt.Sprintf("unknown subcommand or wrong number of arguments for 'xgroup|%v'", args[1].StrVal()))
+	}
+	sub, key, groupName := strings.ToLower(args[1].StrVal()), args[2], args[3].StrVal()
+
+	// the id and the options of CREATE and SETID
+	var id StreamID
+	mkStream, entriesRead := false, int64(StreamInvalidEntriesRead)
+	if sub == "create" || sub == "setid" {
+		if args[4].StrVal() != "$" {
+			var ok bool
+			if id, ok = parseStreamID(args[4].StrVal(), 0); !ok {
+				return ReplyInvalidStreamID
+			}
+		}
+		for i := 5; i < len(args); i++ {
+			switch opt := strings.ToLower(args[i].StrVal()); {
+			case opt == "mkstream" && sub == "create":
+				mkStream = true
+			case opt == "entriesread" && i+1 < len(args):
+				i++
+				n, err := strconv.ParseInt(args[i].StrVal(), 10, 64)
+				if err != nil {
+					return ReplyNotInteger
+				}
+				if n < StreamInvalidEntriesRead {
+					return replyErr("value for ENTRIESREAD must be positive or -1")
+				}
+				entriesRead = n
+			default:
+				return ReplySyntaxErr
+			}
+		}
+	}
+
+	val, errReply := lookupStream(cli, key)
+	if errReply != "" {
+		return errReply
+	}
+	if val == nil {
+		if !mkStream {
+			return replyErr("The XGROUP subcommand requires the key to exist. " +
+				"Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+		}
+		val = NewObject(Stream, NewStreamLog())
+		cli.db.Set(key, val)
+		val.DecrRefCount()
+	}
+	s := val.Val.(*StreamLog)
+	if (sub == "create" || sub == "setid") && args[4].StrVal() == "$" {
+		id = s.lastId
+	}
+	g := s.groups[groupName]
+	if g == nil && sub != "create" && sub != "destroy" {
+		return replyNoGroup(key.StrVal(), groupName)
+	}
+
+	oldSize := objSize(val)
+	reply := ReplyOK
+	switch sub {
+	case "create":
+		if s.CreateGroup(groupName, id, entriesRead) == nil {
+			return ReplyBusyGroup
+		}
+		cli.db.Notify(NotifyStream, "xgroup-create", key)
+	case "setid":
+		g.SetID(id, entriesRead)
+		cli.db.Notify(NotifyStream, "xgroup-setid", key)
+	case "destroy":
+		if !s.DestroyGroup(groupName) {
+			return replyInt(0)
+		}
+		cli.db.Notify(NotifyStream, "xgroup-destroy", key)
+		// the clients blocked for the group get the error
+		cli.srv.SignalKeyAsReady(key.StrVal())
+		reply = replyInt(1)
+	case "createconsumer":
+		_, created := g.Consumer(args[4].StrVal())
+		if !created {
+			return replyInt(0)
+		}
+		cli.db.Notify(NotifyStream, "xgroup-createconsumer", key)
+		reply = replyInt(1)
+	case "delconsumer":
+		pending := g.DeleteConsumer(args[4].StrVal())
+		if pending < 0 {
+			return replyInt(0)
+		}
+		cli.db.Notify(NotifyStream, "xgroup-delconsumer", key)
+		reply = replyInt(int64(pending))
+	}
+	cli.db.Modified(val, oldSize)
+	return reply
+}
+
+// xack key group id [id ...]
+func xackCmd(cli *GodisClient) string {
+	ids := make([]StreamID, 0, len(cli.args)-3)
+	for _, arg := range cli.args[3:] {
+		id, ok := parseStreamID(arg.StrVal(), 0)
+		if !ok {
+			return ReplyInvalidStreamID
+		}
+		ids = append(ids, id)
+	}
+
+	val, g, errReply := lookupGroup(cli, cli.args[1], cli.args[2].StrVal())
+	if errReply == ReplyWrongType {
+		return errReply
+	}
+	if g == nil {
+		return replyInt(0)
+	}
+	oldSize := objSize(val)
+	var acked int64
+	for _, id := range ids {
+		if g.Ack(id) {
+			acked++
+		}
+	}
+	if acked > 0 {
+		cli.db.Modified(val, oldSize)
+	}
+	return replyInt(acked)
+}
+
+// xpending key group [[IDLE min-idle-time] start end count [consumer]]
+func xpendingCmd(cli *GodisClient) string {
+	args := cli.args
+	var minIdle, count int64
+	var start, end StreamID
+	var consumerName string
+	summary := len(args) == 3
+	if !summary {
+		i := 3
+		if strings.EqualFold(args[i].StrVal(), "idle") && i+1 < len(args) {
+			ms, err := strconv.ParseInt(args[i+1].StrVal(), 10, 64)
+			if err != nil {
+				return ReplyNotInteger
+			}
+			minIdle = ms
+			i += 2
+		}
+		if len(args)-i != 3 && len(args)-i != 4 {
+			return ReplySyntaxErr
+		}
+		var errReply string
+		if start, errReply = parseRangeID(args[i].StrVal(), false); errReply != "" {
+			return errReply
+		}
+		if end, errReply = parseRangeID(args[i+1].StrVal(), true); errReply != "" {
+			return errReply
+		}
+		n, err := strconv.ParseInt(args[i+2].StrVal(), 10, 64)
+		if err != nil {
+			return ReplyNotInteger
+		}
+		count = max(n, 0)
+		if len(args)-i == 4 {
+			consumerName = args[i+3].StrVal()
+		}
+	}
+
+	_, g, errReply := lookupGroup(cli, args[1], args[2].StrVal())
+	if errReply != "" {
+		return errReply
+	}
+	if summary {
+		if len(g.pel) == 0 {
+			return replyArray([]string{replyInt(0), ReplyNil, ReplyNil, ReplyNilArray})
+		}
+		var consumers []string
+		for _, name := range sortedKeys(g.consumers) {
+			if pending := g.consumers[name].pending; pending > 0 {
+				consumers = append(consumers, replyBulkArray([]string{name, strconv.Itoa(pending)}))
+			}
+		}
+		return replyArray([]string{replyInt(int64(len(g.pel))), replyBulk(g.pel[0].id.String()),
+			replyBulk(g.pel[len(g.pel)-1].id.String()), replyArray(consumers)})
+	}
+
+	now := time.Now()
+	var replies []string
+	for _, nack := range g.pel[g.seekPending(start):] {
+		if end.Less(nack.id) || int64(len(replies)) >= count {
+			break
+		}
+		idle := msSince(now, nack.deliveryTime)
+		if consumerName != "" && nack.consumer.name != consumerName || idle < minIdle {
+			continue
+		}
+		replies = append(replies, replyArray([]string{replyBulk(nack.id.String()), replyBulk(nack.consumer.name),
+			replyInt(idle), replyInt(nack.deliveryCount)}))
+	}
+	return replyArray(replies)
+}
+
+// claim moves the pending entry to consumer c, the entry is acknowledged instead if it's deleted from the stream.
+// It returns the claimed entry, nil if it's deleted.
+func claim(s *StreamLog, g *StreamGroup, nack *StreamNACK, c *StreamConsumer, deliveryTime time.Time,
+	retryCount int64, justId bool) *StreamEntry {
+	e := s.Get(nack.id)
+	if e == nil {
+		g.Ack(nack.id)
+		return nil
+	}
+	g.assign(nack, c)
+	nack.deliveryTime = deliveryTime
+	if retryCount >= 0 {
+		nack.deliveryCount = retryCount
+	} else if !justId {
+		nack.deliveryCount++
+	}
+	c.activeTime = deliveryTime
+	return e
+}
+
+// xclaim key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-milliseconds] [RETRYCOUNT count]
+// [FORCE] [JUSTID] [LASTID lastid]
+func xclaimCmd(cli *GodisClient) string {
+	args := cli.args
+	minIdle, err := strconv.ParseInt(args[4].StrVal(), 10, 64)
+	if err != nil {
+		return replyErr("Invalid min-idle-time argument for XCLAIM")
+	}
+	i := 5
+	var ids []StreamID
+	for ; i < len(args); i++ {
+		id, ok := parseStreamID(args[i].StrVal(), 0)
+		if !ok {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return ReplyInvalidStreamID
+	}
+
+	now := time.Now()
+	deliveryTime, retryCount, lastId := now, int64(-1), StreamMinID
+	force, justId := false, false
+	for ; i < len(args); i++ {
+		opt := strings.ToLower(args[i].StrVal())
+		if opt == "force" || opt == "justid" {
+			force, justId = force || opt == "force", justId || opt == "justid"
+			continue
+		}
+		if i+1 == len(args) || opt != "idle" && opt != "time" && opt != "retrycount" && opt != "lastid" {
+			return replyErr(fmt.Sprintf("Unrecognized XCLAIM option '%v'", args[i].StrVal()))
+		}
+		i++
+		if opt == "lastid" {
+			var ok bool
+			if lastId, ok = parseStreamID(args[i].StrVal(), 0); !ok {
+				return ReplyInvalidStreamID
+			}
+			continue
+		}
+		n, err := strconv.ParseInt(args[i].StrVal(), 10, 64)
+		if err != nil {
+			return ReplyNotInteger
+		}
+		switch opt {
+		case "idle":
+			deliveryTime = now.Add(-time.Duration(n) * time.Millisecond)
+		case "time":
+			deliveryTime = time.UnixMilli(n)
+		case "retrycount":
+			retryCount = n
+		}
+	}
+	if deliveryTime.After(now) {
+		deliveryTime = now
+	}
+
+	key := args[1]
+	val, g, errReply := lookupGroup(cli, key, args[2].StrVal())
+	if errReply != "" {
+		return errReply
+	}
+	s := val.Val.(*StreamLog)
+	oldSize := objSize(val)
+	defer cli.db.Modified(val, oldSize)
+	if g.lastId.Less(lastId) {
+		g.lastId = lastId
+	}
+	c, created := g.Consumer(args[3].StrVal())
+	if created {
+		cli.db.Notify(NotifyStream, "xgroup-createconsumer", key)
+	}
+	c.seenTime = now
+
+	var replies []string
+	for _, id := range ids {
+		nack := g.Pending(id)
+		if nack == nil {
+			// FORCE claims the entries not pending
+			if !force || s.Get(id) == nil {
+				continue
+			}
+			nack = g.addPending(id, c)
+		}
+		if msSince(now, nack.deliveryTime) < minIdle {
+			continue
+		}
+		if e := claim(s, g, nack, c, deliveryTime, retryCount, justId); e != nil {
+			if justId {
+				replies = append(replies, replyBulk(e.id.String()))
+			} else {
+				replies = append(replies, replyStreamEntry(e))
+			}
+		}
+	}
+	return replyArray(replies)
+}
+
+// xautoclaim key group consumer min-idle-time start [COUNT count] [JUSTID]
+func xautoclaimCmd(cli *GodisClient) string {
+	args := cli.args
+	minIdle, err := strconv.ParseInt(args[4].StrVal(), 10, 64)
+	if err != nil {
+		return replyErr("Invalid min-idle-time argument for XAUTOCLAIM")
+	}
+	start, errReply := parseRangeID(args[5].StrVal(), false)
+	if errReply != "" {
+		return errReply
+	}
+	count, justId := int64(100), false
+	for i := 6; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i].StrVal()); {
+		case opt == "count" && i+1 < len(args):
+			i++
+			n, err := strconv.ParseInt(args[i].StrVal(), 10, 64)
+			if err != nil {
+				return ReplyNotInteger
+			}
+			if n < 1 || n > math.MaxInt64/10 {
+				return replyErr("COUNT must be > 0")
+			}
+			count = n
+		case opt == "justid":
+			justId = true
+		default:
+			return ReplySyntaxErr
+		}
+	}
+
+	key := args[1]
+	val, g, errReply := lookupGroup(cli, key, args[2].StrVal())
+	if errReply != "" {
+		return errReply
+	}
+	s := val.Val.(*StreamLog)
+	oldSize := objSize(val)
+	defer cli.db.Modified(val, oldSize)
+	c, created := g.Consumer(args[3].StrVal())
+	if created {
+		cli.db.Notify(NotifyStream, "xgroup-createconsumer", key)
+	}
+	now := time.Now()
+	c.seenTime = now
+
+	// the pending entries are scanned up to 10 times of count, the deleted entries are acknowledged
+	var claimed, deleted []string
+	i, attempts := g.seekPending(start), count*10
+	for ; i < len(g.pel) && attempts > 0 && int64(len(claimed)) < count; attempts-- {
+		nack := g.pel[i]
+		if msSince(now, nack.deliveryTime) < minIdle {
+			i++
+			continue
+		}
+		e := claim(s, g, nack, c, now, -1, justId)
+		if e == nil {
+			deleted = append(deleted, nack.id.String())
+			continue
+		}
+		if justId {
+			claimed = append(claimed, replyBulk(e.id.String()))
+		} else {
+			claimed = append(claimed, replyStreamEntry(e))
+		}
+		i++
+	}
+	next := StreamMinID
+	if i < len(g.pel) {
+		next = g.pel[i].id
+	}
+	return replyArray([]string{replyBulk(next.String()), replyArray(claimed), replyBulkArray(deleted)})
+}
+
+func replyEntriesRead(g *StreamGroup) string {
+	if g.entriesRead == StreamInvalidEntriesRead {
+		return ReplyNil
+	}
+	return replyInt(g.entriesRead)
+}
+
+func replyLag(g *StreamGroup) string {
+	lag, ok := g.Lag()
+	if !ok {
+		return ReplyNil
+	}
+	return replyInt(lag)
+}
+
+// xinfo STREAM key [FULL [COUNT count]] | GROUPS key | CONSUMERS key group
+func xinfoCmd(cli *GodisClient) string {
+	args := cli.args
+	switch sub := strings.ToLower(args[1].StrVal()); {
+	case sub == "stream" && len(args) >= 3:
+	case sub == "groups" && len(args) == 3:
+	case sub == "consumers" && len(args) == 4:
+	default:
+		return replyErr(fmt.Sprintf("unknown subcommand or wrong number of arguments for 'xinfo|%v'", args[1].StrVal()))
+	}
+	sub := strings.ToLower(args[1].StrVal())
+	full, count := false, int64(10)
+	if sub == "stream" && len(args) > 3 {
+		if !strings.EqualFold(args[3].StrVal(), "full") || len(args) != 4 && len(args) != 6 ||
+			len(args) == 6 && !strings.EqualFold(args[4].StrVal(), "count") {
+			return ReplySyntaxErr
+		}
+		full = true
+		if len(args) == 6 {
+			n, err := strconv.ParseInt(args[5].StrVal(), 10, 64)
+			if err != nil {
+				return ReplyNotInteger
+			}
+			count = max(n, 0)
+		}
+	}
+
+	val, errReply := lookupStream(cli, args[2])
+	if errReply != "" {
+		return errReply
+	}
+	if val == nil {
+		return ReplyNoSuchKey
+	}
+	s := val.Val.(*StreamLog)
+	now := time.Now()
+	switch sub {
+	case "groups":
+		var replies []string
+		for _, name := range sortedKeys(s.groups) {
+			g := s.groups[name]
+			replies = append(replies, replyMap(cli, []string{
+				replyBulk("name"), replyBulk(name),
+				replyBulk("consumers"), replyInt(int64(len(g.consumers))),
+				replyBulk("pending"), replyInt(int64(len(g.pel))),
+				replyBulk("last-delivered-id"), replyBulk(g.lastId.String()),
+				replyBulk("entries-read"), replyEntriesRead(g),
+				replyBulk("lag"), replyLag(g),
+			}))
+		}
+		return replyArray(replies)
+	case "consumers":
+		g := s.groups[args[3].StrVal()]
+		if g == nil {
+			return replyNoGroup(args[2].StrVal(), args[3].StrVal())
+		}
+		var replies []string
+		for _, name := range sortedKeys(g.consumers) {
+			c := g.consumers[name]
+			inactive := int64(-1)
+			if !c.activeTime.IsZero() {
+				inactive = msSince(now, c.activeTime)
+			}
+			replies = append(replies, replyMap(cli, []string{
+				replyBulk("name"), replyBulk(name),
+				replyBulk("pending"), replyInt(int64(c.pending)),
+				replyBulk("idle"), replyInt(msSince(now, c.seenTime)),
+				replyBulk("inactive"), replyInt(inactive),
+			}))
+		}
+		return replyArray(replies)
+	}
+
+	pairs := []string{
+		replyBulk("length"), replyInt(s.length),
+		replyBulk("radix-tree-keys"), replyInt(int64(len(s.nodes))),
+		replyBulk("last-generated-id"), replyBulk(s.lastId.String()),
+		replyBulk("max-deleted-entry-id"), replyBulk(s.maxDeletedId.String()),
+		replyBulk("entries-added"), replyInt(s.entriesAdded),
+		replyBulk("recorded-first-entry-id"), replyBulk(s.firstId().String()),
+	}
+	if !full {
+		first, last := ReplyNil, ReplyNil
+		if s.length > 0 {
+			first = replyStreamEntry(s.Range(StreamMinID, StreamMaxID, 1, false)[0])
+			last = replyStreamEntry(s.Range(StreamMinID, StreamMaxID, 1, true)[0])
+		}
+		return replyMap(cli, append(pairs,
+			replyBulk("groups"), replyInt(int64(len(s.groups))),
+			replyBulk("first-entry"), first,
+			replyBulk("last-entry"), last,
+		))
+	}
+
+	// FULL replies at most count entries and pending entries of each group and consumer, 0 means all
+	limit := func(n int) int {
+		if count == 0 || int64(n) < count {
+			return n
+		}
+		return int(count)
+	}
+	var groups []string
+	for _, name := range sortedKeys(s.groups) {
+		g := s.groups[name]
+		var pending []string
+		for _, nack := range g.pel[:limit(len(g.pel))] {
+			pending = append(pending, replyArray([]string{replyBulk(nack.id.String()), replyBulk(nack.consumer.name),
+				replyInt(nack.deliveryTime.UnixMilli()), replyInt(nack.deliveryCount)}))
+		}
+		var consumers []string
+		for _, cname := range sortedKeys(g.consumers) {
+			c := g.consumers[cname]
+			activeTime := int64(-1)
+			if !c.activeTime.IsZero() {
+				activeTime = c.activeTime.UnixMilli()
+			}
+			var cpending []string
+			for _, nack := range g.pel {
+				if len(cpending) == limit(c.pending) {
+					break
+				}
+				if nack.consumer == c {
+					cpending = append(cpending, replyArray([]string{replyBulk(nack.id.String()),
+						replyInt(nack.deliveryTime.UnixMilli()), replyInt(nack.deliveryCount)}))
+				}
+			}
+			consumers = append(consumers, replyMap(cli, []string{
+				replyBulk("name"), replyBulk(cname),
+				replyBulk("seen-time"), replyInt(c.seenTime.UnixMilli()),
+				replyBulk("active-time"), replyInt(activeTime),
+				replyBulk("pel-count"), replyInt(int64(c.pending)),
+				replyBulk("pending"), replyArray(cpending),
+			}))
+		}
+		groups = append(groups, replyMap(cli, []string{
+			replyBulk("name"), replyBulk(name),
+			replyBulk("last-delivered-id"), replyBulk(g.lastId.String()),
+			replyBulk("entries-read"), replyEntriesRead(g),
+			replyBulk("lag"), replyLag(g),
+			replyBulk("pel-count"), replyInt(int64(len(g.pel))),
+			replyBulk("pending"), replyArray(pending),
+			replyBulk("consumers"), replyArray(consumers),
+		}))
+	}
+	return replyMap(cli, append(pairs,
+		replyBulk("entries"), replyStreamEntries(s.Range(StreamMinID, StreamMaxID, int(count), false)),
+		replyBulk("groups"), replyArray(groups),
+	))
+}
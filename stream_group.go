@@ -0,0 +1,217 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	StreamInvalidEntriesRead = -1 // the entries read by a group is unknown
+
+	StreamGroupOverhead    = 64
+	StreamConsumerOverhead = 48
+	StreamNACKOverhead     = 48
+)
+
+// StreamNACK is an entry delivered to a consumer of a group but not acknowledged yet.
+type StreamNACK struct {
+	id            StreamID
+	consumer      *StreamConsumer
+	deliveryTime  time.Time
+	deliveryCount int64
+}
+
+type StreamConsumer struct {
+	name       string
+	seenTime   time.Time // the last time it read or claimed entries
+	activeTime time.Time // the last time entries were delivered to it, zero if never
+	pending    int       // the entries delivered to it but not acknowledged
+}
+
+// StreamGroup is a consumer group of a stream, each entry is delivered to one of its consumers
+// and kept pending until it's acknowledged.
+type StreamGroup struct {
+	name        string
+	lastId      StreamID      // the last entry delivered
+	entriesRead int64         // the entries delivered up to lastId, StreamInvalidEntriesRead if unknown
+	pel         []*StreamNACK // the pending entries ordered by id
+	consumers   map[string]*StreamConsumer
+	stream      *StreamLog
+}
+
+// CreateGroup creates the group reading the entries after id, returns nil if it exists.
+func (s *StreamLog) CreateGroup(name string, id StreamID, entriesRead int64) *StreamGroup {
+	if s.groups[name] != nil {
+		return nil
+	}
+	g := &StreamGroup{
+		name:        name,
+		lastId:      id,
+		entriesRead: entriesRead,
+		consumers:   make(map[string]*StreamConsumer),
+		stream:      s,
+	}
+	s.groups[name] = g
+	s.memory += StreamGroupOverhead + int64(len(name))
+	return g
+}
+
+func (s *StreamLog) DestroyGroup(name string) bool {
+	g := s.groups[name]
+	if g == nil {
+		return false
+	}
+	for _, c := range g.consumers {
+		g.DeleteConsumer(c.name)
+	}
+	delete(s.groups, name)
+	s.memory -= StreamGroupOverhead + int64(len(name))
+	return true
+}
+
+// entriesReadOf estimates the entries added up to id, which is exact if no entry is deleted before id.
+// It returns StreamInvalidEntriesRead if it can't be known.
+func (s *StreamLog) entriesReadOf(id StreamID) int64 {
+	if s.entriesAdded == 0 {
+		return 0
+	}
+	if s.length == 0 && !s.lastId.Less(id) || id == s.lastId {
+		return s.entriesAdded
+	}
+	if s.lastId.Less(id) {
+		return StreamInvalidEntriesRead
+	}
+	first := s.firstId()
+	if s.maxDeletedId == StreamMinID || s.maxDeletedId.Less(first) {
+		// no entry is deleted among the entries left
+		if id.Less(first) {
+			return s.entriesAdded - s.length
+		}
+		if id == first {
+			return s.entriesAdded - s.length + 1
+		}
+	}
+	return StreamInvalidEntriesRead
+}
+
+// hasTombstones reports whether an entry after start is deleted, which makes the counting of entries read unreliable.
+func (s *StreamLog) hasTombstones(start StreamID) bool {
+	if s.length == 0 || s.maxDeletedId == StreamMinID {
+		return false
+	}
+	return !s.maxDeletedId.Less(start)
+}
+
+// Lag returns the entries not delivered to the group yet, false if it can't be known.
+func (g *StreamGroup) Lag() (int64, bool) {
+	s := g.stream
+	if s.entriesAdded == 0 {
+		return 0, true
+	}
+	if g.entriesRead != StreamInvalidEntriesRead && !s.hasTombstones(g.lastId) {
+		return s.entriesAdded - g.entriesRead, true
+	}
+	if read := s.entriesReadOf(g.lastId); read != StreamInvalidEntriesRead {
+		return s.entriesAdded - read, true
+	}
+	return 0, false
+}
+
+// SetID moves the last delivered id of the group.
+func (g *StreamGroup) SetID(id StreamID, entriesRead int64) {
+	g.lastId, g.entriesRead = id, entriesRead
+}
+
+// advance moves the last delivered id to the new entry of id.
+func (g *StreamGroup) advance(id StreamID) {
+	s := g.stream
+	if g.entriesRead != StreamInvalidEntriesRead && !s.hasTombstones(id) {
+		g.entriesRead++
+	} else if s.entriesAdded > 0 {
+		g.entriesRead = s.entriesReadOf(id)
+	}
+	g.lastId = id
+}
+
+// Consumer returns the consumer of name, which is created if it doesn't exist.
+func (g *StreamGroup) Consumer(name string) (c *StreamConsumer, created bool) {
+	if c = g.consumers[name]; c != nil {
+		return c, false
+	}
+	c = &StreamConsumer{name: name}
+	g.consumers[name] = c
+	g.stream.memory += StreamConsumerOverhead + int64(len(name))
+	return c, true
+}
+
+// DeleteConsumer deletes the consumer and its pending entries, returns the number of the pending entries
+// or -1 if it doesn't exist.
+func (g *StreamGroup) DeleteConsumer(name string) int {
+	c := g.consumers[name]
+	if c == nil {
+		return -1
+	}
+	pending := c.pending
+	pel := g.pel[:0]
+	for _, nack := range g.pel {
+		if nack.consumer == c {
+			g.stream.memory -= StreamNACKOverhead
+		} else {
+			pel = append(pel, nack)
+		}
+	}
+	g.pel = pel
+	delete(g.consumers, name)
+	g.stream.memory -= StreamConsumerOverhead + int64(len(name))
+	return pending
+}
+
+// seekPending returns the position of the first pending entry whose id >= id.
+func (g *StreamGroup) seekPending(id StreamID) int {
+	return sort.Search(len(g.pel), func(i int) bool { return !g.pel[i].id.Less(id) })
+}
+
+// Pending returns the pending entry of id, nil if it's not pending.
+func (g *StreamGroup) Pending(id StreamID) *StreamNACK {
+	if i := g.seekPending(id); i < len(g.pel) && g.pel[i].id == id {
+		return g.pel[i]
+	}
+	return nil
+}
+
+// addPending adds the entry of id to the pending entries of c, or moves it to c if it's pending already.
+func (g *StreamGroup) addPending(id StreamID, c *StreamConsumer) *StreamNACK {
+	i := g.seekPending(id)
+	if i == len(g.pel) || g.pel[i].id != id {
+		g.pel = append(g.pel, nil)
+		copy(g.pel[i+1:], g.pel[i:])
+		g.pel[i] = &StreamNACK{id: id}
+		g.stream.memory += StreamNACKOverhead
+	}
+	g.assign(g.pel[i], c)
+	return g.pel[i]
+}
+
+// assign moves the pending entry to consumer c.
+func (g *StreamGroup) assign(nack *StreamNACK, c *StreamConsumer) {
+	if nack.consumer == c {
+		return
+	}
+	if nack.consumer != nil {
+		nack.consumer.pending--
+	}
+	nack.consumer = c
+	c.pending++
+}
+
+// Ack removes the entry of id from the pending entries, returns false if it's not pending.
+func (g *StreamGroup) Ack(id StreamID) bool {
+	i := g.seekPending(id)
+	if i == len(g.pel) || g.pel[i].id != id {
+		return false
+	}
+	g.pel[i].consumer.pending--
+	g.pel = append(g.pel[:i], g.pel[i+1:]...)
+	g.stream.memory -= StreamNACKOverhead
+	return true
+}
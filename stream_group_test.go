@@ -0,0 +1,300 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamGroupLag(t *testing.T) {
+	s := NewStreamLog()
+	g := s.CreateGroup("g", StreamMinID, StreamInvalidEntriesRead)
+	assert.Nil(t, s.CreateGroup("g", StreamMinID, 0))
+	lag, ok := g.Lag()
+	assert.True(t, ok)
+	assert.Equal(t, int64(0), lag)
+
+	for i := 1; i <= 5; i++ {
+		s.Add(StreamID{uint64(i), 0}, []string{"f", "v"}, 3)
+	}
+	lag, ok = g.Lag()
+	assert.True(t, ok)
+	assert.Equal(t, int64(5), lag)
+	g.advance(StreamID{1, 0})
+	g.advance(StreamID{2, 0})
+	assert.Equal(t, int64(2), g.entriesRead)
+	lag, _ = g.Lag()
+	assert.Equal(t, int64(3), lag)
+
+	// the lag can't be known with a deleted entry after the last delivered one
+	s.Delete(StreamID{4, 0})
+	_, ok = g.Lag()
+	assert.False(t, ok)
+	g.advance(StreamID{3, 0})
+	g.advance(StreamID{5, 0})
+	lag, ok = g.Lag()
+	assert.True(t, ok)
+	assert.Equal(t, int64(0), lag)
+
+	s.Trim(0, StreamID{5, 0}, true, false, 0)
+	assert.Equal(t, int64(4), s.entriesReadOf(StreamID{4, 0}))
+	assert.Equal(t, int64(StreamInvalidEntriesRead), s.entriesReadOf(StreamID{6, 0}))
+}
+
+func TestStreamGroupPending(t *testing.T) {
+	s := newTestStream(5)
+	g := s.CreateGroup("g", StreamMinID, 0)
+	c1, created := g.Consumer("c1")
+	assert.True(t, created)
+	c2, _ := g.Consumer("c2")
+	memory := s.memory
+
+	g.addPending(StreamID{3, 0}, c1)
+	g.addPending(StreamID{1, 0}, c2)
+	g.addPending(StreamID{2, 0}, c1)
+	g.addPending(StreamID{1, 0}, c1)
+	assert.Equal(t, []string{"1-0", "2-0", "3-0"}, []string{g.pel[0].id.String(), g.pel[1].id.String(), g.pel[2].id.String()})
+	assert.Equal(t, 3, c1.pending)
+	assert.Equal(t, 0, c2.pending)
+	assert.Equal(t, memory+3*StreamNACKOverhead, s.memory)
+
+	assert.True(t, g.Ack(StreamID{2, 0}))
+	assert.False(t, g.Ack(StreamID{2, 0}))
+	assert.Nil(t, g.Pending(StreamID{2, 0}))
+	assert.Equal(t, 2, g.DeleteConsumer("c1"))
+	assert.Equal(t, -1, g.DeleteConsumer("c1"))
+	assert.Empty(t, g.pel)
+	assert.True(t, s.DestroyGroup("g"))
+	assert.Equal(t, entriesSize(s), s.memory)
+}
+
+func TestXGroupCmd(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli := srv.newClient(0)
+
+	assert.Contains(t, execCmd(cli, "xgroup", "create", "s", "g", "$"), "requires the key to exist")
+	assert.Equal(t, ReplyOK, execCmd(cli, "xgroup", "create", "s", "g", "$", "mkstream"))
+	assert.Equal(t, replyInt(0), execCmd(cli, "xlen", "s"))
+	assert.Equal(t, ReplyBusyGroup, execCmd(cli, "xgroup", "create", "s", "g", "0"))
+	assert.Equal(t, ReplyInvalidStreamID, execCmd(cli, "xgroup", "create", "s", "g2", "x"))
+	assert.Equal(t, ReplySyntaxErr, execCmd(cli, "xgroup", "create", "s", "g2", "0", "foo"))
+	assert.Equal(t, "-ERR: value for ENTRIESREAD must be positive or -1\r\n",
+		execCmd(cli, "xgroup", "create", "s", "g2", "0", "entriesread", "-2"))
+	assert.Contains(t, execCmd(cli, "xgroup", "foo", "s"), "unknown subcommand")
+
+	execCmd(cli, "xadd", "s", "1", "f", "v")
+	assert.Equal(t, ReplyOK, execCmd(cli, "xgroup", "setid", "s", "g", "$", "entriesread", "1"))
+	g := srv.db.Lookup(NewObject(String, "s")).Val.(*StreamLog).groups["g"]
+	assert.Equal(t, StreamID{1, 0}, g.lastId)
+	assert.Equal(t, int64(1), g.entriesRead)
+	assert.Equal(t, replyNoGroup("s", "nogroup"), execCmd(cli, "xgroup", "setid", "s", "nogroup", "0"))
+
+	assert.Equal(t, replyInt(1), execCmd(cli, "xgroup", "createconsumer", "s", "g", "c"))
+	assert.Equal(t, replyInt(0), execCmd(cli, "xgroup", "createconsumer", "s", "g", "c"))
+	execCmd(cli, "xgroup", "setid", "s", "g", "0")
+	execCmd(cli, "xreadgroup", "group", "g", "c", "streams", "s", ">")
+	assert.Equal(t, replyInt(1), execCmd(cli, "xgroup", "delconsumer", "s", "g", "c"))
+	assert.Equal(t, replyInt(0), execCmd(cli, "xgroup", "delconsumer", "s", "g", "c"))
+	assert.Empty(t, g.pel)
+
+	assert.Equal(t, replyInt(1), execCmd(cli, "xgroup", "destroy", "s", "g"))
+	assert.Equal(t, replyInt(0), execCmd(cli, "xgroup", "destroy", "s", "g"))
+}
+
+func TestXReadGroup(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli := srv.newClient(0)
+	for _, id := range []string{"1", "2", "3"} {
+		execCmd(cli, "xadd", "s", id, "f", "v"+id)
+	}
+	execCmd(cli, "xgroup", "create", "s", "g", "0")
+
+	entry := func(id, val string) string {
+		return replyArray([]string{replyBulk(id), replyBulkArray([]string{"f", val})})
+	}
+	stream := func(entries ...string) string {
+		return replyArray([]string{replyArray([]string{replyBulk("s"), replyArray(entries)})})
+	}
+	assert.Equal(t, stream(entry("1-0", "v1"), entry("2-0", "v2")),
+		execCmd(cli, "xreadgroup", "group", "g", "c1", "count", "2", "streams", "s", ">"))
+	assert.Equal(t, stream(entry("3-0", "v3")), execCmd(cli, "xreadgroup", "group", "g", "c2", "streams", "s", ">"))
+	assert.Equal(t, ReplyNilArray, execCmd(cli, "xreadgroup", "group", "g", "c1", "streams", "s", ">"))
+
+	// the history of the consumer is its pending entries
+	execCmd(cli, "xdel", "s", "2-0")
+	assert.Equal(t, stream(entry("1-0", "v1"), replyArray([]string{replyBulk("2-0"), ReplyNilArray})),
+		execCmd(cli, "xreadgroup", "group", "g", "c1", "streams", "s", "0"))
+	assert.Equal(t, stream(), execCmd(cli, "xreadgroup", "group", "g", "c1", "streams", "s", "2"))
+	g := srv.db.Lookup(NewObject(String, "s")).Val.(*StreamLog).groups["g"]
+	assert.Equal(t, int64(2), g.Pending(StreamID{1, 0}).deliveryCount)
+
+	assert.Equal(t, replyInt(2), execCmd(cli, "xack", "s", "g", "1-0", "2-0", "9-0"))
+	assert.Equal(t, replyInt(0), execCmd(cli, "xack", "s", "nogroup", "3-0"))
+	assert.Equal(t, stream(), execCmd(cli, "xreadgroup", "group", "g", "c1", "streams", "s", "0"))
+
+	execCmd(cli, "xadd", "s", "4", "f", "v4")
+	assert.Equal(t, stream(entry("4-0", "v4")), execCmd(cli, "xreadgroup", "group", "g", "c1", "noack", "streams", "s", ">"))
+	assert.Nil(t, g.Pending(StreamID{4, 0}))
+	assert.Equal(t, int64(4), g.entriesRead)
+
+	assert.Equal(t, "-NOGROUP No such key 's' or consumer group 'nogroup' in XREADGROUP with GROUP option\r\n",
+		execCmd(cli, "xreadgroup", "group", "nogroup", "c", "streams", "s", ">"))
+	assert.Contains(t, execCmd(cli, "xreadgroup", "group", "g", "c", "streams", "s", "$"), "The $ ID is meaningless")
+	assert.Equal(t, "-ERR: Missing GROUP option for XREADGROUP\r\n",
+		execCmd(cli, "xreadgroup", "count", "1", "noack", "streams", "s", ">"))
+	assert.Contains(t, execCmd(cli, "xread", "group", "g", "c", "streams", "s", ">"), "only supported by XREADGROUP")
+	assert.Equal(t, []int{5}, xreadKeys(strArgs("xreadgroup", "group", "streams", "c", "streams", "s", ">")))
+}
+
+func TestXReadGroupBlock(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli, other := srv.newClient(0), srv.newClient(0)
+	execCmd(other, "xgroup", "create", "s", "g", "$", "mkstream")
+
+	assert.Equal(t, "", execCmd(cli, "xreadgroup", "group", "g", "c", "block", "0", "streams", "s", ">"))
+	execCmd(other, "xadd", "s", "1", "f", "v")
+	srv.handleUnblockedClients()
+	assert.False(t, cli.blocked)
+	assert.Equal(t, replyArray([]string{replyArray([]string{replyBulk("s"),
+		replyArray([]string{replyArray([]string{replyBulk("1-0"), replyBulkArray([]string{"f", "v"})})})})}),
+		string(cli.reply[0]))
+	cli.reply = cli.reply[1:]
+
+	// the blocked clients get the error if the group is destroyed
+	assert.Equal(t, "", execCmd(cli, "xreadgroup", "group", "g", "c", "block", "0", "streams", "s", ">"))
+	execCmd(other, "xgroup", "destroy", "s", "g")
+	srv.handleUnblockedClients()
+	assert.False(t, cli.blocked)
+	assert.Contains(t, string(cli.reply[0]), "-NOGROUP")
+}
+
+func TestXPendingAndClaim(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli := srv.newClient(0)
+	for _, id := range []string{"1", "2", "3", "4"} {
+		execCmd(cli, "xadd", "s", id, "f", "v"+id)
+	}
+	execCmd(cli, "xgroup", "create", "s", "g", "0")
+	assert.Equal(t, replyArray([]string{replyInt(0), ReplyNil, ReplyNil, ReplyNilArray}), execCmd(cli, "xpending", "s", "g"))
+	execCmd(cli, "xreadgroup", "group", "g", "c1", "count", "3", "streams", "s", ">")
+	execCmd(cli, "xreadgroup", "group", "g", "c2", "streams", "s", ">")
+
+	assert.Equal(t, replyArray([]string{replyInt(4), replyBulk("1-0"), replyBulk("4-0"),
+		replyArray([]string{replyBulkArray([]string{"c1", "3"}), replyBulkArray([]string{"c2", "1"})})}),
+		execCmd(cli, "xpending", "s", "g"))
+	assert.Equal(t, replyArray([]string{replyArray([]string{replyBulk("2-0"), replyBulk("c1"), replyInt(0), replyInt(1)})}),
+		execCmd(cli, "xpending", "s", "g", "(1-0", "+", "1", "c1"))
+	assert.Equal(t, replyArray(nil), execCmd(cli, "xpending", "s", "g", "idle", "1000", "-", "+", "10"))
+	assert.Equal(t, ReplySyntaxErr, execCmd(cli, "xpending", "s", "g", "-", "+"))
+	assert.Equal(t, replyNoGroup("s", "nogroup"), execCmd(cli, "xpending", "s", "nogroup"))
+
+	// the entries of c1 idle for a while are claimed by c2
+	g := srv.db.Lookup(NewObject(String, "s")).Val.(*StreamLog).groups["g"]
+	for _, nack := range g.pel[:3] {
+		nack.deliveryTime = time.Now().Add(-time.Minute)
+	}
+	assert.Equal(t, replyArray([]string{replyArray([]string{replyBulk("1-0"), replyBulkArray([]string{"f", "v1"})})}),
+		execCmd(cli, "xclaim", "s", "g", "c2", "10000", "1-0", "4-0"))
+	assert.Equal(t, "c2", g.Pending(StreamID{1, 0}).consumer.name)
+	assert.Equal(t, int64(2), g.Pending(StreamID{1, 0}).deliveryCount)
+	assert.Equal(t, replyArray([]string{replyBulk("2-0")}),
+		execCmd(cli, "xclaim", "s", "g", "c3", "0", "2-0", "justid", "retrycount", "5", "idle", "5000", "lastid", "9"))
+	assert.Equal(t, int64(5), g.Pending(StreamID{2, 0}).deliveryCount)
+	assert.Equal(t, StreamID{9, 0}, g.lastId)
+	assert.Equal(t, "-ERR: Unrecognized XCLAIM option 'foo'\r\n", execCmd(cli, "xclaim", "s", "g", "c3", "0", "2-0", "foo"))
+
+	// FORCE claims an entry not pending, and the deleted entries are dropped
+	execCmd(cli, "xack", "s", "g", "4-0")
+	assert.Equal(t, replyArray([]string{replyBulk("4-0")}), execCmd(cli, "xclaim", "s", "g", "c1", "0", "4-0", "force", "justid"))
+	execCmd(cli, "xdel", "s", "4-0")
+	assert.Equal(t, replyArray(nil), execCmd(cli, "xclaim", "s", "g", "c1", "0", "4-0"))
+	assert.Nil(t, g.Pending(StreamID{4, 0}))
+
+	// 2-0 is idle for 5s, 3-0 for a minute and 1-0 is just claimed
+	assert.Equal(t, replyArray([]string{replyBulk("3-0"), replyArray([]string{replyBulk("2-0")}), replyBulkArray(nil)}),
+		execCmd(cli, "xautoclaim", "s", "g", "c4", "1000", "-", "count", "1", "justid"))
+	execCmd(cli, "xdel", "s", "3-0")
+	assert.Equal(t, replyArray([]string{replyBulk("0-0"), replyArray(nil), replyBulkArray([]string{"3-0"})}),
+		execCmd(cli, "xautoclaim", "s", "g", "c4", "1000", "3-0"))
+	assert.Equal(t, "-ERR: COUNT must be > 0\r\n", execCmd(cli, "xautoclaim", "s", "g", "c4", "0", "0", "count", "0"))
+	assert.Equal(t, 2, len(g.pel))
+}
+
+func TestXInfo(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli := srv.newClient(0)
+	execCmd(cli, "xadd", "s", "1", "f", "v1")
+	execCmd(cli, "xadd", "s", "2", "f", "v2")
+	execCmd(cli, "xgroup", "create", "s", "g", "0")
+	execCmd(cli, "xreadgroup", "group", "g", "c", "count", "1", "streams", "s", ">")
+
+	entry := func(id, val string) string {
+		return replyArray([]string{replyBulk(id), replyBulkArray([]string{"f", val})})
+	}
+	info := []string{
+		replyBulk("length"), replyInt(2),
+		replyBulk("radix-tree-keys"), replyInt(1),
+		replyBulk("last-generated-id"), replyBulk("2-0"),
+		replyBulk("max-deleted-entry-id"), replyBulk("0-0"),
+		replyBulk("entries-added"), replyInt(2),
+		replyBulk("recorded-first-entry-id"), replyBulk("1-0"),
+	}
+	assert.Equal(t, replyArray(append(info,
+		replyBulk("groups"), replyInt(1),
+		replyBulk("first-entry"), entry("1-0", "v1"),
+		replyBulk("last-entry"), entry("2-0", "v2"))), execCmd(cli, "xinfo", "stream", "s"))
+	assert.Equal(t, replyArray([]string{replyArray([]string{
+		replyBulk("name"), replyBulk("g"),
+		replyBulk("consumers"), replyInt(1),
+		replyBulk("pending"), replyInt(1),
+		replyBulk("last-delivered-id"), replyBulk("1-0"),
+		replyBulk("entries-read"), replyInt(1),
+		replyBulk("lag"), replyInt(1),
+	})}), execCmd(cli, "xinfo", "groups", "s"))
+	assert.Equal(t, replyArray([]string{replyArray([]string{
+		replyBulk("name"), replyBulk("c"),
+		replyBulk("pending"), replyInt(1),
+		replyBulk("idle"), replyInt(0),
+		replyBulk("inactive"), replyInt(0),
+	})}), execCmd(cli, "xinfo", "consumers", "s", "g"))
+
+	full := execCmd(cli, "xinfo", "stream", "s", "full", "count", "1")
+	assert.Contains(t, full, replyBulk("entries")+replyArray([]string{entry("1-0", "v1")}))
+	assert.Contains(t, full, replyBulk("pel-count")+replyInt(1))
+	assert.Equal(t, ReplyNoSuchKey, execCmd(cli, "xinfo", "stream", "nokey"))
+	assert.Equal(t, replyNoGroup("s", "nogroup"), execCmd(cli, "xinfo", "consumers", "s", "nogroup"))
+	assert.Equal(t, ReplySyntaxErr, execCmd(cli, "xinfo", "stream", "s", "foo"))
+}
+
+func TestStreamGroupDump(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli := srv.newClient(0)
+	execCmd(cli, "xadd", "s", "1", "f", "v1")
+	execCmd(cli, "xadd", "s", "2", "f", "v2")
+	execCmd(cli, "xgroup", "create", "s", "g1", "0")
+	execCmd(cli, "xgroup", "create", "s", "g2", "$")
+	execCmd(cli, "xgroup", "createconsumer", "s", "g2", "idle")
+	execCmd(cli, "xreadgroup", "group", "g1", "c1", "count", "1", "streams", "s", ">")
+	execCmd(cli, "xreadgroup", "group", "g1", "c2", "streams", "s", ">")
+
+	s := srv.db.Lookup(NewObject(String, "s")).Val.(*StreamLog)
+	val, err := RestoreObject(DumpObject(NewObject(Stream, s)))
+	assert.Nil(t, err)
+	restored := val.Val.(*StreamLog)
+	assert.Equal(t, s.memory, restored.memory)
+	assert.Equal(t, []string{"g1", "g2"}, sortedKeys(restored.groups))
+	g, restoredG := s.groups["g1"], restored.groups["g1"]
+	assert.Equal(t, g.lastId, restoredG.lastId)
+	assert.Equal(t, g.entriesRead, restoredG.entriesRead)
+	assert.Equal(t, int64(StreamInvalidEntriesRead), restored.groups["g2"].entriesRead)
+	assert.Equal(t, 2, len(restoredG.pel))
+	for i, nack := range restoredG.pel {
+		assert.Equal(t, g.pel[i].id, nack.id)
+		assert.Equal(t, g.pel[i].consumer.name, nack.consumer.name)
+		assert.Equal(t, g.pel[i].deliveryTime.UnixMilli(), nack.deliveryTime.UnixMilli())
+		assert.Equal(t, g.pel[i].deliveryCount, nack.deliveryCount)
+	}
+	assert.Equal(t, 1, restoredG.consumers["c1"].pending)
+	assert.True(t, restored.groups["g2"].consumers["idle"].activeTime.IsZero())
+}
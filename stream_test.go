@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func entryIds(entries []*StreamEntry) []string {
+	var ids []string
+	for _, e := range entries {
+		ids = append(ids, e.id.String())
+	}
+	return ids
+}
+
+// entriesSize recomputes the memory of s to check the accounting.
+func entriesSize(s *StreamLog) int64 {
+	size := int64(len(s.nodes)) * StreamNodeOverhead
+	for _, e := range s.Range(StreamMinID, StreamMaxID, 0, false) {
+		size += e.size()
+	}
+	return size
+}
+
+func newTestStream(n int) *StreamLog {
+	s := NewStreamLog()
+	for i := 1; i <= n; i++ {
+		s.Add(StreamID{uint64(i), 0}, []string{"f", fmt.Sprint(i)}, 3)
+	}
+	return s
+}
+
+func TestStreamID(t *testing.T) {
+	id, ok := parseStreamID("5", 0)
+	assert.True(t, ok)
+	assert.Equal(t, StreamID{5, 0}, id)
+	id, _ = parseStreamID("5-3", 0)
+	assert.Equal(t, "5-3", id.String())
+	_, ok = parseStreamID("5-x", 0)
+	assert.False(t, ok)
+	_, ok = parseStreamID("-1", 0)
+	assert.False(t, ok)
+
+	id, ok = StreamID{5, 3}.incr()
+	assert.True(t, ok)
+	assert.Equal(t, StreamID{5, 4}, id)
+	_, ok = StreamMaxID.incr()
+	assert.False(t, ok)
+	id, _ = StreamID{5, 0}.decr()
+	assert.True(t, id.Less(StreamID{5, 0}))
+	assert.Equal(t, uint64(4), id.ms)
+}
+
+func TestStreamRange(t *testing.T) {
+	s := newTestStream(10)
+	assert.Equal(t, int64(10), s.Len())
+	assert.Equal(t, 4, len(s.nodes))
+	assert.Equal(t, entriesSize(s), s.memory)
+
+	assert.Equal(t, []string{"3-0", "4-0", "5-0"}, entryIds(s.Range(StreamID{3, 0}, StreamID{5, 0}, 0, false)))
+	assert.Equal(t, []string{"3-0", "4-0"}, entryIds(s.Range(StreamID{2, 1}, StreamMaxID, 2, false)))
+	assert.Equal(t, []string{"5-0", "4-0", "3-0"}, entryIds(s.Range(StreamID{3, 0}, StreamID{5, 0}, 0, true)))
+	assert.Equal(t, []string{"10-0", "9-0"}, entryIds(s.Range(StreamMinID, StreamMaxID, 2, true)))
+	assert.Equal(t, []string{"4-0", "3-0"}, entryIds(s.Range(StreamID{2, 5}, StreamID{4, 5}, 0, true)))
+	assert.Empty(t, s.Range(StreamID{5, 0}, StreamID{3, 0}, 0, false))
+	assert.Empty(t, s.Range(StreamID{11, 0}, StreamMaxID, 0, true))
+
+	assert.True(t, s.Delete(StreamID{4, 0}))
+	assert.True(t, s.Delete(StreamID{5, 0}))
+	assert.True(t, s.Delete(StreamID{6, 0}))
+	assert.False(t, s.Delete(StreamID{6, 0}))
+	assert.Equal(t, int64(7), s.Len())
+	assert.Equal(t, 3, len(s.nodes))
+	assert.Equal(t, StreamID{6, 0}, s.maxDeletedId)
+	assert.Equal(t, StreamID{10, 0}, s.lastId)
+	assert.Equal(t, entriesSize(s), s.memory)
+	assert.Equal(t, []string{"7-0", "3-0", "2-0"}, entryIds(s.Range(StreamID{2, 0}, StreamID{7, 0}, 0, true)))
+}
+
+func TestStreamTrim(t *testing.T) {
+	s := newTestStream(10)
+	// only the whole nodes 1-3 and 4-6 can be removed
+	assert.Equal(t, int64(6), s.Trim(2, StreamMinID, false, true, 0))
+	assert.Equal(t, []string{"7-0", "8-0", "9-0", "10-0"}, entryIds(s.Range(StreamMinID, StreamMaxID, 0, false)))
+	assert.Equal(t, int64(2), s.Trim(2, StreamMinID, false, false, 0))
+	assert.Equal(t, []string{"9-0", "10-0"}, entryIds(s.Range(StreamMinID, StreamMaxID, 0, false)))
+	assert.Equal(t, StreamID{8, 0}, s.maxDeletedId)
+	assert.Equal(t, entriesSize(s), s.memory)
+
+	s = newTestStream(10)
+	assert.Equal(t, int64(0), s.Trim(0, StreamID{3, 0}, true, true, 0))
+	assert.Equal(t, int64(2), s.Trim(0, StreamID{3, 0}, true, false, 0))
+	// the node 3 is left by the exact trim
+	assert.Equal(t, int64(4), s.Trim(0, StreamID{8, 0}, true, true, 0))
+	assert.Equal(t, []string{"7-0", "8-0", "9-0", "10-0"}, entryIds(s.Range(StreamMinID, StreamMaxID, 0, false)))
+
+	// the limit stops before a node which would exceed it
+	s = newTestStream(10)
+	assert.Equal(t, int64(3), s.Trim(0, StreamMinID, false, true, 5))
+	assert.Equal(t, int64(7), s.Len())
+	assert.Equal(t, entriesSize(s), s.memory)
+}
+
+func TestStreamCommands(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli := srv.newClient(0)
+
+	assert.Equal(t, replyBulk("1-1"), execCmd(cli, "xadd", "s", "1-1", "f", "v1"))
+	assert.Equal(t, replyBulk("1-2"), execCmd(cli, "xadd", "s", "1-*", "f", "v2"))
+	assert.Equal(t, replyBulk("2-0"), execCmd(cli, "xadd", "s", "2", "f", "v3", "g", "w"))
+	assert.Equal(t, ReplyStreamIDTooSmall, execCmd(cli, "xadd", "s", "2-0", "f", "v"))
+	assert.Equal(t, ReplyStreamIDTooSmall, execCmd(cli, "xadd", "s", "1-*", "f", "v"))
+	assert.Equal(t, ReplyStreamIDZero, execCmd(cli, "xadd", "s2", "0-0", "f", "v"))
+	assert.Equal(t, ReplyInvalidStreamID, execCmd(cli, "xadd", "s", "x", "f", "v"))
+	assert.Equal(t, ReplyWrongNumberOfArgs, execCmd(cli, "xadd", "s", "*", "f", "v", "g"))
+	assert.Equal(t, ReplyNil, execCmd(cli, "xadd", "s2", "nomkstream", "*", "f", "v"))
+	assert.Equal(t, replyBulk("0-1"), execCmd(cli, "xadd", "s3", "0-*", "f", "v"))
+	assert.Equal(t, ReplyWrongType, execCmd(cli, "get", "s"))
+	execCmd(cli, "set", "str", "v")
+	assert.Equal(t, ReplyWrongType, execCmd(cli, "xadd", "str", "*", "f", "v"))
+	assert.Equal(t, replyInt(3), execCmd(cli, "xlen", "s"))
+	assert.Equal(t, replyInt(0), execCmd(cli, "xlen", "s2"))
+
+	entry := func(id string, fields ...string) string {
+		return replyArray([]string{replyBulk(id), replyBulkArray(fields)})
+	}
+	assert.Equal(t, replyArray([]string{entry("1-1", "f", "v1"), entry("1-2", "f", "v2"), entry("2-0", "f", "v3", "g", "w")}),
+		execCmd(cli, "xrange", "s", "-", "+"))
+	assert.Equal(t, replyArray([]string{entry("1-1", "f", "v1"), entry("1-2", "f", "v2")}), execCmd(cli, "xrange", "s", "1", "1"))
+	assert.Equal(t, replyArray([]string{entry("1-2", "f", "v2")}), execCmd(cli, "xrange", "s", "(1-1", "(2-0"))
+	assert.Equal(t, replyArray([]string{entry("2-0", "f", "v3", "g", "w")}), execCmd(cli, "xrevrange", "s", "+", "-", "count", "1"))
+	assert.Equal(t, replyArray(nil), execCmd(cli, "xrange", "s", "-", "+", "count", "0"))
+	assert.Equal(t, replyArray(nil), execCmd(cli, "xrange", "nokey", "-", "+"))
+	assert.Equal(t, ReplyInvalidStreamID, execCmd(cli, "xrange", "s", "(-", "+"))
+	assert.Equal(t, ReplySyntaxErr, execCmd(cli, "xrange", "s", "-", "+", "limit", "1"))
+
+	assert.Equal(t, replyInt(1), execCmd(cli, "xdel", "s", "1-2", "5-0"))
+	assert.Equal(t, ReplyInvalidStreamID, execCmd(cli, "xdel", "s", "x"))
+	assert.Equal(t, replyInt(2), execCmd(cli, "xlen", "s"))
+	// the last id is kept after deletion
+	assert.Equal(t, ReplyStreamIDTooSmall, execCmd(cli, "xadd", "s", "2-0", "f", "v"))
+
+	for i := 3; i <= 10; i++ {
+		execCmd(cli, "xadd", "s", fmt.Sprint(i), "f", "v")
+	}
+	assert.Equal(t, replyInt(5), execCmd(cli, "xtrim", "s", "maxlen", "5"))
+	assert.Equal(t, replyInt(5), execCmd(cli, "xlen", "s"))
+	assert.Equal(t, replyInt(2), execCmd(cli, "xtrim", "s", "minid", "=", "8"))
+	assert.Equal(t, replyInt(0), execCmd(cli, "xtrim", "s", "maxlen", "~", "1"))
+	assert.Equal(t, "-ERR: syntax error, LIMIT cannot be used without the special ~ option\r\n",
+		execCmd(cli, "xtrim", "s", "maxlen", "1", "limit", "10"))
+	assert.Equal(t, ReplySyntaxErr, execCmd(cli, "xtrim", "s", "size", "1"))
+	assert.Equal(t, replyBulk("11-0"), execCmd(cli, "xadd", "s", "maxlen", "2", "11", "f", "v"))
+	assert.Equal(t, replyArray([]string{entry("10-0", "f", "v"), entry("11-0", "f", "v")}), execCmd(cli, "xrange", "s", "-", "+"))
+
+	// the memory is updated by the changes in place
+	val := srv.db.Lookup(NewObject(String, "s"))
+	size, memory := objSize(val), srv.db.memory
+	execCmd(cli, "xdel", "s", "10-0")
+	assert.Less(t, objSize(val), size)
+	assert.Equal(t, memory-size+objSize(val), srv.db.memory)
+}
+
+func TestXRead(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli := srv.newClient(0)
+	execCmd(cli, "xadd", "s1", "1", "f", "v1")
+	execCmd(cli, "xadd", "s1", "2", "f", "v2")
+	execCmd(cli, "xadd", "s2", "3", "f", "v3")
+
+	stream := func(key string, entries ...string) string {
+		return replyArray([]string{replyBulk(key), replyArray(entries)})
+	}
+	entry := func(id, val string) string {
+		return replyArray([]string{replyBulk(id), replyBulkArray([]string{"f", val})})
+	}
+	assert.Equal(t, replyArray([]string{stream("s1", entry("2-0", "v2")), stream("s2", entry("3-0", "v3"))}),
+		execCmd(cli, "xread", "streams", "s1", "s2", "1", "0"))
+	assert.Equal(t, replyArray([]string{stream("s1", entry("1-0", "v1"))}),
+		execCmd(cli, "xread", "count", "1", "streams", "s1", "s2", "0", "3"))
+	assert.Equal(t, ReplyNilArray, execCmd(cli, "xread", "streams", "s1", "nokey", "$", "0"))
+	assert.Equal(t, ReplyInvalidStreamID, execCmd(cli, "xread", "streams", "s1", "x"))
+	assert.Equal(t, "-ERR: Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.\r\n",
+		execCmd(cli, "xread", "streams", "s1", "s2", "0"))
+	assert.Equal(t, ReplySyntaxErr, execCmd(cli, "xread", "count", "1", "s1", "0"))
+	assert.Equal(t, []int{4, 5}, xreadKeys(strArgs("xread", "block", "0", "streams", "s1", "s2", "0", "0")))
+
+	cli.resp = 3
+	assert.Equal(t, "%1\r\n"+replyBulk("s2")+replyArray([]string{entry("3-0", "v3")}),
+		execCmd(cli, "xread", "streams", "s2", "0"))
+}
+
+func TestXReadBlock(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli, other := srv.newClient(0), srv.newClient(0)
+	execCmd(other, "xadd", "s", "1", "f", "v1")
+
+	// $ only reads the entries added after blocking
+	assert.Equal(t, "", execCmd(cli, "xread", "block", "0", "streams", "nokey", "s", "$", "$"))
+	assert.True(t, cli.blocked)
+	assert.Equal(t, "1-0", cli.args[len(cli.args)-1].StrVal())
+	assert.Equal(t, 1, len(srv.blockingKeys["s"]))
+	execCmd(other, "xadd", "s", "2", "f", "v2")
+	assert.Empty(t, srv.blockingKeys)
+	srv.handleUnblockedClients()
+	assert.False(t, cli.blocked)
+	assert.Nil(t, cli.bstate)
+	assert.Equal(t, replyArray([]string{replyArray([]string{replyBulk("s"),
+		replyArray([]string{replyArray([]string{replyBulk("2-0"), replyBulkArray([]string{"f", "v2"})})})})}),
+		string(cli.reply[0]))
+	cli.reply = cli.reply[1:]
+
+	// blocks again if the entries added don't match, and times out without any entry
+	assert.Equal(t, "", execCmd(cli, "xread", "block", "50", "streams", "s", "5"))
+	deadline := cli.bstate.deadline
+	execCmd(other, "xadd", "s", "3", "f", "v3")
+	srv.handleUnblockedClients()
+	assert.True(t, cli.blocked)
+	assert.Equal(t, deadline, cli.bstate.deadline)
+	srv.handleBlockedTimeouts()
+	assert.True(t, cli.blocked)
+	time.Sleep(60 * time.Millisecond)
+	srv.handleBlockedTimeouts()
+	srv.handleUnblockedClients()
+	assert.False(t, cli.blocked)
+	assert.Empty(t, srv.blockingKeys)
+	assert.Equal(t, ReplyNilArray, string(cli.reply[0]))
+}
+
+func TestStreamDump(t *testing.T) {
+	s := newTestStream(5)
+	s.Delete(StreamID{5, 0})
+	payload := DumpObject(NewObject(Stream, s))
+	val, err := RestoreObject(payload)
+	assert.Nil(t, err)
+	restored := val.Val.(*StreamLog)
+	assert.Equal(t, []string{"1-0", "2-0", "3-0", "4-0"}, entryIds(restored.Range(StreamMinID, StreamMaxID, 0, false)))
+	assert.Equal(t, []string{"f", "3"}, restored.Range(StreamID{3, 0}, StreamID{3, 0}, 0, false)[0].fields)
+	assert.Equal(t, s.lastId, restored.lastId)
+	assert.Equal(t, s.maxDeletedId, restored.maxDeletedId)
+	assert.Equal(t, s.entriesAdded, restored.entriesAdded)
+	assert.Equal(t, entriesSize(restored), restored.memory)
+}
+
+func TestXReadBlockServer(t *testing.T) {
+	port := 6697
+	srv := newTestServer(t, port)
+	startServer(t, srv)
+	defer stopServer(srv)
+
+	fd, err := Connect([4]byte{127, 0, 0, 1}, port)
+	assert.Nil(t, err)
+	defer Close(fd)
+	other, err := Connect([4]byte{127, 0, 0, 1}, port)
+	assert.Nil(t, err)
+	defer Close(other)
+
+	_, err = Write(fd, []byte("xread block 0 streams s $\r\n"))
+	assert.Nil(t, err)
+	time.Sleep(50 * time.Millisecond)
+	roundTrip(t, other, "xadd s 5 f v\r\n", replyBulk("5-0"))
+	// the commands after the blocked one are executed once it's unblocked
+	roundTrip(t, fd, "xlen s\r\n", replyArray([]string{replyArray([]string{replyBulk("s"),
+		replyArray([]string{replyArray([]string{replyBulk("5-0"), replyBulkArray([]string{"f", "v"})})})})})+replyInt(1))
+	roundTrip(t, fd, "xread block 50 streams s $\r\nxlen s\r\n", ReplyNilArray+replyInt(1))
+}
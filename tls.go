@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const TlsHandshakeTimeout = 10 * 1000 // ms
+
+const (
+	TlsAuthNo       = "no"
+	TlsAuthYes      = "yes"
+	TlsAuthOptional = "optional"
+)
+
+var TlsAuthClients = []string{TlsAuthNo, TlsAuthYes, TlsAuthOptional}
+
+var (
+	ErrTlsTimeout = errors.New("tls handshake timeout")
+
+	// errWouldBlock is temporary, so tls.Conn keeps the partial record and can be read again
+	errWouldBlock net.Error = wouldBlockError{}
+)
+
+type wouldBlockError struct{}
+
+func (wouldBlockError) Error() string   { return "operation would block" }
+func (wouldBlockError) Timeout() bool   { return true }
+func (wouldBlockError) Temporary() bool { return true }
+
+// loadTlsConfig loads the certificates of the tls-* params.
+func loadTlsConfig(config *GodisConfig) (*tls.Config, error) {
+	if config.TlsCertFile == "" || config.TlsKeyFile == "" {
+		return nil, errors.New("tls-cert-file and tls-key-file are required by tls-port")
+	}
+	cert, err := tls.LoadX509KeyPair(config.TlsCertFile, config.TlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load tls certificate failed: %v", err)
+	}
+
+	tc := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	switch config.TlsAuthClients {
+	case TlsAuthYes:
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	case TlsAuthOptional:
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if config.TlsCaCertFile != "" {
+		pem, err := os.ReadFile(config.TlsCaCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("load tls ca certificate failed: %v", err)
+		}
+		tc.ClientCAs = x509.NewCertPool()
+		if !tc.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %v", config.TlsCaCertFile)
+		}
+	} else if tc.ClientAuth != tls.NoClientCert {
+		return nil, errors.New("tls-ca-cert-file is required to authenticate clients")
+	}
+	return tc, nil
+}
+
+// fdConn adapts a non-blocking socket to the net.Conn wanted by tls.Conn. During the handshake the reads
+// and writes wait for the socket until the deadline, then reads fail with errWouldBlock
+// and writes are buffered until the socket is writable.
+type fdConn struct {
+	fd       int
+	nonBlock bool
+	deadline time.Time // of the handshake, covering all its reads and writes
+	out      []byte    // the records not sent yet
+}
+
+// wait polls the socket for events until the deadline.
+func (c *fdConn) wait(events int16) error {
+	for {
+		timeout := time.Until(c.deadline).Milliseconds()
+		if timeout <= 0 {
+			return ErrTlsTimeout
+		}
+		n, err := unix.Poll([]unix.PollFd{{Fd: int32(c.fd), Events: events}}, int(timeout))
+		switch {
+		case err == unix.EINTR:
+			continue
+		case err != nil:
+			return err
+		case n == 0:
+			return ErrTlsTimeout
+		}
+		return nil
+	}
+}
+
+func (c *fdConn) Read(buf []byte) (int, error) {
+	for {
+		n, err := unix.Read(c.fd, buf)
+		switch {
+		case err == unix.EINTR:
+			continue
+		case err == unix.EAGAIN && c.nonBlock:
+			return 0, errWouldBlock
+		case err == unix.EAGAIN:
+			if err := c.wait(unix.POLLIN); err != nil {
+				return 0, err
+			}
+			continue
+		case err != nil:
+			return 0, err
+		case n == 0 && len(buf) > 0:
+			return 0, io.EOF
+		}
+		return n, nil
+	}
+}
+
+func (c *fdConn) Write(buf []byte) (int, error) {
+	if c.nonBlock {
+		c.out = append(c.out, buf...)
+		return len(buf), c.flush()
+	}
+
+	for sent := 0; sent < len(buf); {
+		n, err := Write(c.fd, buf[sent:])
+		if err != nil {
+			return sent, err
+		}
+		if n == 0 {
+			if err := c.wait(unix.POLLOUT); err != nil {
+				return sent, err
+			}
+		}
+		sent += n
+	}
+	return len(buf), nil
+}
+
+// flush writes the buffered records until all sent or the socket is full.
+func (c *fdConn) flush() error {
+	for len(c.out) > 0 {
+		n, err := Write(c.fd, c.out)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		c.out = c.out[:copy(c.out, c.out[n:])]
+	}
+	return nil
+}
+
+func (c *fdConn) Close() error {
+	return unix.Close(c.fd)
+}
+
+func (c *fdConn) LocalAddr() net.Addr                { return sockAddr(SockName(c.fd)) }
+func (c *fdConn) RemoteAddr() net.Addr               { return sockAddr(PeerName(c.fd)) }
+func (c *fdConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *fdConn) SetReadDeadline(t time.Time) error  { c.deadline = t; return nil }
+func (c *fdConn) SetWriteDeadline(t time.Time) error { c.deadline = t; return nil }
+
+type sockAddr string
+
+func (a sockAddr) Network() string { return "tcp" }
+func (a sockAddr) String() string  { return string(a) }
+
+// tlsConn is a tls connection over a non-blocking socket.
+type tlsConn struct {
+	raw     *fdConn
+	conn    *tls.Conn
+	plain   []byte // reused to encrypt the replies into as few records as possible
+	pending bool
+}
+
+// newTlsConn does the handshake on the socket fd waiting for it, since tls.Conn can't resume a handshake
+// interrupted by a would block error. The whole handshake must finish in TlsHandshakeTimeout,
+// so a peer trickling bytes can't hold the connection.
+func newTlsConn(fd int, config *tls.Config) (*tlsConn, error) {
+	raw := &fdConn{fd: fd, deadline: time.Now().Add(TlsHandshakeTimeout * time.Millisecond)}
+	conn := tls.Server(raw, config)
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	raw.nonBlock = true
+	return &tlsConn{raw: raw, conn: conn}, nil
+}
+
+// Read reads records until the socket is drained or buf is full,
+// tls.Conn may still buffer some records in the latter case.
+func (c *tlsConn) Read(buf []byte) (int, error) {
+	c.pending = false
+	n := 0
+	for n < len(buf) {
+		m, err := c.conn.Read(buf[n:])
+		n += m
+		if errors.Is(err, errWouldBlock) {
+			return n, nil
+		}
+		if err != nil {
+			// the error is permanent, so it's returned again by next read
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+	}
+	c.pending = true
+	return n, nil
+}
+
+// Writev encrypts all the bufs once the previous records are sent.
+func (c *tlsConn) Writev(bufs [][]byte) (int, error) {
+	if err := c.Flush(); err != nil || c.Buffered() > 0 {
+		return 0, err
+	}
+
+	c.plain = c.plain[:0]
+	for _, buf := range bufs {
+		c.plain = append(c.plain, buf...)
+	}
+	if _, err := c.conn.Write(c.plain); err != nil {
+		return 0, err
+	}
+	return len(c.plain), nil
+}
+
+func (c *tlsConn) Flush() error {
+	return c.raw.flush()
+}
+
+func (c *tlsConn) Buffered() int {
+	return len(c.raw.out)
+}
+
+func (c *tlsConn) HasPendingData() bool {
+	return c.pending
+}
+
+func (c *tlsConn) Close() {
+	// best effort to send close_notify
+	c.conn.Close()
+}
+
+// acceptTls does the handshake in a new goroutine, the client is created in the loop once it's done.
+// The handshakes in progress count as clients for maxclients.
+func (srv *GodisServer) acceptTls(cfd int) {
+	if srv.numClients() >= srv.config.MaxClients {
+		srv.stats.numConnections++
+		srv.stats.rejectedConnections++
+		logWarning("exceed max client limit, close tls conn...")
+		Close(cfd)
+		return
+	}
+
+	srv.setTcpOptions(cfd)
+	srv.tlsHandshakes++
+	config, lp := srv.tlsConfig, srv.lp
+	go func() {
+		conn, err := newTlsConn(cfd, config)
+		if err != nil {
+			logVerbose("tls handshake with %v failed: %v", PeerName(cfd), err)
+			Close(cfd)
+			lp.Post(func() { srv.tlsHandshakes-- })
+			return
+		}
+		posted := lp.Post(func() {
+			srv.tlsHandshakes--
+			if cli := srv.acceptClient(cfd, conn); cli != nil {
+				srv.tlsClients[cfd] = cli
+			}
+		})
+		if !posted {
+			// the server has exited
+			conn.Close()
+		}
+	}()
+}
+
+// handleTlsPendingData reads the input buffered by tls connections, which epoll doesn't report.
+func (srv *GodisServer) handleTlsPendingData() {
+	for _, cli := range srv.tlsClients {
+		for cli.conn.HasPendingData() && !cli.closed && !cli.closeAfterReply && !cli.closeAsap && !cli.blocked {
+			cli.ReadQuery(srv.lp, cli.fd, nil)
+		}
+	}
+}
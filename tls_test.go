@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	tls  tls.Certificate
+}
+
+// newTestCert creates a certificate signed by ca, or a self-signed ca if ca is nil.
+func newTestCert(t *testing.T, name string, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, parentKey := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		parent, parentKey = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return &testCert{cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}
+}
+
+// writePem writes the certificate and the key into dir, returns their paths.
+func (c *testCert) writePem(t *testing.T, dir, name string) (string, string) {
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	assert.Nil(t, os.WriteFile(certFile, certPem, 0600))
+	der, err := x509.MarshalECPrivateKey(c.key)
+	assert.Nil(t, err)
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	assert.Nil(t, os.WriteFile(keyFile, keyPem, 0600))
+	return certFile, keyFile
+}
+
+func TestLoadTlsConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	caFile, _ := ca.writePem(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "server", ca).writePem(t, dir, "server")
+
+	config := NewGodisConfig()
+	_, err := loadTlsConfig(config)
+	assert.NotNil(t, err)
+
+	config.TlsCertFile, config.TlsKeyFile = certFile, keyFile
+	_, err = loadTlsConfig(config)
+	assert.EqualError(t, err, "tls-ca-cert-file is required to authenticate clients")
+
+	assert.Nil(t, config.Set("tls-auth-clients", "no"))
+	tc, err := loadTlsConfig(config)
+	assert.Nil(t, err)
+	assert.Equal(t, tls.NoClientCert, tc.ClientAuth)
+
+	config.TlsCaCertFile = caFile
+	assert.Nil(t, config.Set("tls-auth-clients", "optional"))
+	tc, err = loadTlsConfig(config)
+	assert.Nil(t, err)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, tc.ClientAuth)
+
+	assert.NotNil(t, config.Set("tls-auth-clients", "maybe"))
+	assert.NotNil(t, config.Set("tls-port", "6379"))
+}
+
+func TestTlsServer(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	caFile, _ := ca.writePem(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "server", ca).writePem(t, dir, "server")
+
+	port := 6690
+	srv := newTestServer(t, 6689)
+	srv.config.TlsPort = port
+	srv.config.TlsCertFile, srv.config.TlsKeyFile, srv.config.TlsCaCertFile = certFile, keyFile, caFile
+	srv.config.MaxClients = 2
+	startServer(t, srv)
+	defer stopServer(srv)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(certs ...tls.Certificate) (*tls.Conn, error) {
+		return tls.Dial("tcp", "127.0.0.1:6690", &tls.Config{RootCAs: roots, Certificates: certs})
+	}
+
+	// the replies are larger than a tls record, and the pipeline is larger than the query buffer
+	conn, err := dial(newTestCert(t, "client", ca).tls)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	val := strings.Repeat("v", 100*1024)
+	var query []byte
+	var expected strings.Builder
+	for i := 0; i < 10; i++ {
+		query = appendCommand(query, "set", "key", val)
+		query = appendCommand(query, "get", "key")
+		expected.WriteString(ReplyOK + replyBulk(val))
+	}
+	_, err = conn.Write(query)
+	assert.Nil(t, err)
+	reply := make([]byte, expected.Len())
+	_, err = io.ReadFull(conn, reply)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.String(), string(reply))
+
+	// the handshake in progress counts for maxclients
+	fd, err := Connect([4]byte{127, 0, 0, 1}, port)
+	assert.Nil(t, err)
+	time.Sleep(50 * time.Millisecond)
+	fd2, err := Connect([4]byte{127, 0, 0, 1}, 6689)
+	assert.Nil(t, err)
+	buf := make([]byte, 64)
+	n, _ := Read(fd2, buf)
+	assert.Equal(t, ReplyMaxClients, string(buf[:n]))
+	Close(fd2)
+	Close(fd)
+	time.Sleep(50 * time.Millisecond)
+
+	// the client without a certificate is rejected
+	conn, err = dial()
+	if err == nil {
+		defer conn.Close()
+		conn.Write([]byte("get key\r\n"))
+		_, err = conn.Read(make([]byte, 16))
+	}
+	assert.NotNil(t, err)
+
+	// the client with a certificate of another ca is rejected
+	conn, err = dial(newTestCert(t, "client", newTestCert(t, "ca", nil)).tls)
+	if err == nil {
+		defer conn.Close()
+		conn.Write([]byte("get key\r\n"))
+		_, err = conn.Read(make([]byte, 16))
+	}
+	assert.NotNil(t, err)
+}
+
+func TestFdConnDeadline(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_NONBLOCK, 0)
+	assert.Nil(t, err)
+	defer Close(fds[1])
+	c := &fdConn{fd: fds[0], deadline: time.Now().Add(100 * time.Millisecond)}
+	defer c.Close()
+
+	// the deadline covers all the reads, a peer trickling bytes can't extend it
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			time.Sleep(30 * time.Millisecond)
+			Write(fds[1], []byte("x"))
+		}
+	}()
+	n, buf := 0, make([]byte, 1)
+	for ; n < 10; n++ {
+		if _, err = c.Read(buf); err != nil {
+			break
+		}
+	}
+	assert.Equal(t, ErrTlsTimeout, err)
+	assert.Less(t, n, 10)
+	<-done
+
+	// the bytes left are read, then the socket would block
+	c.nonBlock = true
+	for err = nil; err == nil; {
+		_, err = c.Read(buf)
+	}
+	assert.Equal(t, errWouldBlock, err)
+}
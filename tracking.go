@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	TrackingChannel = "__redis__:invalidate" // the channel of invalidations for the RESP2 redirect clients
+
+	DefaultTrackingTableMaxKeys = 1000000
+)
+
+// trackingState is the CLIENT TRACKING options of a client.
+type trackingState struct {
+	redirect *GodisClient // the client receiving the invalidations, nil to receive them itself
+	bcast    bool
+	optin    bool
+	optout   bool
+	noloop   bool     // not invalidated for the keys modified by itself
+	caching  bool     // CLIENT CACHING yes/no is called for the next command
+	prefixes []string // the prefixes of bcast mode
+}
+
+// bcastPrefix is a prefix of bcast mode, with the keys modified since the last broadcast.
+type bcastPrefix struct {
+	clients map[int64]bool
+	keys    map[string]int64 // the id of the client modified the key, 0 if modified by the server
+}
+
+// Tracking remembers the keys the clients may cache, to invalidate them when they are modified.
+type Tracking struct {
+	clients  map[int64]*GodisClient    // the clients with tracking on
+	keys     map[string]map[int64]bool // the keys read by the clients of default mode
+	prefixes map[string]*bcastPrefix   // the prefixes registered by the clients of bcast mode
+}
+
+func NewTracking() *Tracking {
+	return &Tracking{
+		clients:  make(map[int64]*GodisClient),
+		keys:     make(map[string]map[int64]bool),
+		prefixes: make(map[string]*bcastPrefix),
+	}
+}
+
+// Enable turns on tracking for cli, or updates it if it's on already.
+func (t *Tracking) Enable(cli *GodisClient, state *trackingState) {
+	if cli.tracking != nil {
+		state.prefixes = append(cli.tracking.prefixes, state.prefixes...)
+	}
+	cli.tracking = state
+	t.clients[cli.id] = cli
+	for _, prefix := range state.prefixes {
+		bp := t.prefixes[prefix]
+		if bp == nil {
+			bp = &bcastPrefix{clients: make(map[int64]bool), keys: make(map[string]int64)}
+			t.prefixes[prefix] = bp
+		}
+		bp.clients[cli.id] = true
+	}
+}
+
+// Disable turns off tracking for cli, its keys in the table are dropped lazily on invalidation.
+func (t *Tracking) Disable(cli *GodisClient) {
+	if cli.tracking == nil {
+		return
+	}
+	for _, prefix := range cli.tracking.prefixes {
+		if bp := t.prefixes[prefix]; bp != nil {
+			delete(bp.clients, cli.id)
+			if len(bp.clients) == 0 {
+				delete(t.prefixes, prefix)
+			}
+		}
+	}
+	delete(t.clients, cli.id)
+	cli.tracking = nil
+}
+
+// afterCommand remembers the keys read by cmd, the CLIENT CACHING flag only applies to one command.
+func (t *Tracking) afterCommand(cli *GodisClient, cmd *GodisCommand) {
+	state := cli.tracking
+	if cmd.name == GodisCmdClient && strings.EqualFold(cli.args[1].StrVal(), "caching") {
+		return
+	}
+	caching := state.caching
+	state.caching = false
+	if state.bcast || cmd.flags&CmdWrite != 0 || cmd.keys == nil ||
+		state.optin && !caching || state.optout && caching {
+		return
+	}
+	for _, i := range cmd.keys(cli.args) {
+		key := cli.args[i].StrVal()
+		ids := t.keys[key]
+		if ids == nil {
+			ids = make(map[int64]bool)
+			t.keys[key] = ids
+		}
+		ids[cli.id] = true
+	}
+}
+
+// Invalidate sends the invalidation of key to the clients read it, modifier is nil if not modified by a client.
+// The clients of bcast mode get it in the next broadcast.
+func (t *Tracking) Invalidate(key string, modifier *GodisClient) {
+	var modifierId int64
+	if modifier != nil {
+		modifierId = modifier.id
+	}
+	for prefix, bp := range t.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			bp.keys[key] = modifierId
+		}
+	}
+
+	ids := t.keys[key]
+	if ids == nil {
+		return
+	}
+	delete(t.keys, key)
+	for id := range ids {
+		cli := t.clients[id]
+		if cli == nil || cli.tracking.bcast || cli.tracking.noloop && id == modifierId {
+			continue
+		}
+		sendInvalidation(cli, []string{key})
+	}
+}
+
+// Broadcast sends the keys modified since the last broadcast to the clients of bcast mode.
+func (t *Tracking) Broadcast() {
+	for _, bp := range t.prefixes {
+		if len(bp.keys) == 0 {
+			continue
+		}
+		keys := sortedKeys(bp.keys)
+		for id := range bp.clients {
+			cli := t.clients[id]
+			sent := keys
+			if cli.tracking.noloop {
+				sent = nil
+				for _, key := range keys {
+					if bp.keys[key] != id {
+						sent = append(sent, key)
+					}
+				}
+			}
+			if len(sent) > 0 {
+				sendInvalidation(cli, sent)
+			}
+		}
+		bp.keys = make(map[string]int64)
+	}
+}
+
+// Limit invalidates the keys beyond maxKeys in the table, so the memory of tracking is bounded.
+func (t *Tracking) Limit(maxKeys int) {
+	if maxKeys == 0 {
+		return
+	}
+	for key := range t.keys {
+		if len(t.keys) <= maxKeys {
+			return
+		}
+		t.Invalidate(key, nil)
+	}
+}
+
+func (t *Tracking) TotalKeys() int {
+	return len(t.keys)
+}
+
+func (t *Tracking) TotalPrefixes() int {
+	return len(t.prefixes)
+}
+
+func (t *Tracking) Clients() int {
+	return len(t.clients)
+}
+
+// sendInvalidation sends the invalidated keys to cli or its redirect client, as a push message in RESP3
+// or a message of TrackingChannel in RESP2.
+func sendInvalidation(cli *GodisClient, keys []string) {
+	target := cli
+	if redirect := cli.tracking.redirect; redirect != nil {
+		if redirect.closed {
+			if cli.resp == 3 {
+				cli.AddReply(replyPush(cli, []string{replyBulk("tracking-redir-broken"), replyInt(redirect.id)}))
+			}
+			return
+		}
+		target = redirect
+	}
+
+	if target.resp == 3 {
+		target.AddReply(replyPush(target, []string{replyBulk("invalidate"), replyBulkArray(keys)}))
+	} else if target != cli && target.channels[TrackingChannel] {
+		target.AddReply(replyArray([]string{replyBulk("message"), replyBulk(TrackingChannel), replyBulkArray(keys)}))
+	}
+}
+
+// parseTracking parses the options of CLIENT TRACKING ON, returns the error reply if failed.
+func parseTracking(cli *GodisClient, args []*Obj) (*trackingState, string) {
+	state := &trackingState{}
+	for i := 0; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i].StrVal()); {
+		case opt == "redirect" && i+1 < len(args):
+			i++
+			id, err := strconv.ParseInt(args[i].StrVal(), 10, 64)
+			if err != nil {
+				return nil, ReplyNotInteger
+			}
+			for _, c := range cli.srv.Clients() {
+				if c.id == id {
+					state.redirect = c
+				}
+			}
+			if state.redirect == nil {
+				return nil, replyErr("The client ID you want redirect to does not exist")
+			}
+		case opt == "prefix" && i+1 < len(args):
+			i++
+			state.prefixes = append(state.prefixes, args[i].StrVal())
+		case opt == "bcast":
+			state.bcast = true
+		case opt == "optin":
+			state.optin = true
+		case opt == "optout":
+			state.optout = true
+		case opt == "noloop":
+			state.noloop = true
+		default:
+			return nil, ReplySyntaxErr
+		}
+	}
+
+	switch old := cli.tracking; {
+	case len(state.prefixes) > 0 && !state.bcast:
+		return nil, replyErr("PREFIX option requires BCAST mode to be enabled")
+	case state.optin && state.optout:
+		return nil, replyErr("You can't use both OPTIN and OPTOUT")
+	case state.bcast && (state.optin || state.optout):
+		return nil, replyErr("OPTIN and OPTOUT are not compatible with BCAST")
+	case old != nil && old.bcast != state.bcast:
+		return nil, replyErr("You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.")
+	case old != nil && (old.optin != state.optin || old.optout != state.optout):
+		return nil, replyErr("You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, and then re-enabling it with a different mode.")
+	}
+	if state.bcast && len(state.prefixes) == 0 && cli.tracking == nil {
+		state.prefixes = []string{""}
+	}
+
+	// a key must match one prefix at most, so it's not sent twice
+	var existing []string
+	if cli.tracking != nil {
+		existing = cli.tracking.prefixes
+	}
+	for i, prefix := range state.prefixes {
+		for _, other := range append(existing, state.prefixes[:i]...) {
+			if strings.HasPrefix(prefix, other) || strings.HasPrefix(other, prefix) {
+				return nil, replyErr(fmt.Sprintf("Prefix '%v' overlaps with an existing prefix '%v'. "+
+					"Prefixes for a single client must not overlap.", prefix, other))
+			}
+		}
+	}
+	return state, ""
+}
+
+// trackingInfo replies CLIENT TRACKINGINFO.
+func trackingInfo(cli *GodisClient) string {
+	state := cli.tracking
+	if state == nil {
+		return replyMap(cli, []string{
+			replyBulk("flags"), replyBulkArray([]string{"off"}),
+			replyBulk("redirect"), replyInt(-1),
+			replyBulk("prefixes"), replyArray(nil),
+		})
+	}
+
+	flags := []string{"on"}
+	if state.bcast {
+		flags = append(flags, "bcast")
+	}
+	if state.optin {
+		flags = append(flags, "optin")
+		if state.caching {
+			flags = append(flags, "caching-yes")
+		}
+	}
+	if state.optout {
+		flags = append(flags, "optout")
+		if state.caching {
+			flags = append(flags, "caching-no")
+		}
+	}
+	if state.noloop {
+		flags = append(flags, "noloop")
+	}
+	var redirect int64
+	if state.redirect != nil {
+		redirect = state.redirect.id
+		if state.redirect.closed {
+			flags = append(flags, "broken_redirect")
+		}
+	}
+	var prefixes []string
+	if state.bcast && (len(state.prefixes) > 1 || state.prefixes[0] != "") {
+		prefixes = state.prefixes
+	}
+	return replyMap(cli, []string{
+		replyBulk("flags"), replyBulkArray(flags),
+		replyBulk("redirect"), replyInt(redirect),
+		replyBulk("prefixes"), replyBulkArray(prefixes),
+	})
+}
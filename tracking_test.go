@@ -0,0 +1,163 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pushes pops the replies queued for cli, the oldest first.
+func pushes(cli *GodisClient) []string {
+	var replies []string
+	for len(cli.reply) > 0 {
+		replies = append(replies, string(cli.reply[0]))
+		cli.reply = cli.reply[1:]
+	}
+	return replies
+}
+
+func invalidate(keys ...string) string {
+	return ">2\r\n" + replyBulk("invalidate") + replyBulkArray(keys)
+}
+
+func TestHello(t *testing.T) {
+	srv := newTestServer(t, 0)
+	srv.config.RequirePass = "pass"
+	srv.acl.SetRequirePass("pass")
+	cli := srv.newClient(0)
+
+	assert.Equal(t, ReplyHelloNoAuth, execCmd(cli, "hello", "3"))
+	assert.Equal(t, ReplyNoProto, execCmd(cli, "hello", "4"))
+	assert.Equal(t, ReplyWrongPass, execCmd(cli, "hello", "3", "auth", "default", "wrong"))
+	reply := execCmd(cli, "hello", "3", "auth", "default", "pass", "setname", "conn")
+	assert.Equal(t, "%7\r\n$6\r\nserver\r\n$5\r\ngodis\r\n", reply[:len("%7\r\n$6\r\nserver\r\n$5\r\ngodis\r\n")])
+	assert.Contains(t, reply, replyBulk("proto")+replyInt(3))
+	assert.Equal(t, 3, cli.resp)
+	assert.Equal(t, "conn", cli.name)
+
+	// RESP3 clients can execute any command while subscribing
+	execCmd(cli, "subscribe", "ch")
+	assert.Equal(t, ReplyNil, execCmd(cli, "get", "key"))
+	assert.Equal(t, replyInt(1), execCmd(cli, "publish", "ch", "msg"))
+	assert.Equal(t, []string{">3\r\n" + replyBulk("message") + replyBulk("ch") + replyBulk("msg")}, pushes(cli))
+
+	assert.True(t, len(execCmd(cli, "hello", "2")) > 0)
+	assert.Equal(t, 2, cli.resp)
+}
+
+func TestTrackingDefault(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli, other := srv.newClient(0), srv.newClient(1)
+	execCmd(cli, "hello", "3")
+
+	assert.Equal(t, ReplyOK, execCmd(cli, "client", "tracking", "on"))
+	assert.Equal(t, "t", cli.flags())
+	assert.Equal(t, replyInt(0), execCmd(cli, "client", "getredir"))
+	execCmd(cli, "get", "k1")
+	execCmd(cli, "get", "k2")
+	assert.Equal(t, 2, srv.tracking.TotalKeys())
+
+	execCmd(other, "set", "k1", "v")
+	execCmd(other, "set", "k1", "v")
+	assert.Equal(t, []string{invalidate("k1")}, pushes(cli))
+
+	// NOLOOP skips the keys modified by the client itself
+	assert.Equal(t, ReplyOK, execCmd(cli, "client", "tracking", "on", "noloop"))
+	execCmd(cli, "set", "k2", "v")
+	assert.Nil(t, pushes(cli))
+
+	// expirations are invalidated too
+	execCmd(other, "set", "k1", "v")
+	execCmd(cli, "get", "k1")
+	expire := NewObjectInt(time.Now().UnixMilli() - 1)
+	srv.db.Expire(NewObject(String, "k1"), expire)
+	assert.Equal(t, ReplyNil, execCmd(cli, "get", "k1"))
+	assert.Equal(t, []string{invalidate("k1")}, pushes(cli))
+
+	assert.Equal(t, ReplyOK, execCmd(cli, "client", "tracking", "off"))
+	assert.Equal(t, replyInt(-1), execCmd(cli, "client", "getredir"))
+	execCmd(other, "set", "k2", "v")
+	assert.Nil(t, pushes(cli))
+}
+
+func TestTrackingOptInRedirect(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli, redir, other := srv.newClient(0), srv.newClient(1), srv.newClient(2)
+	srv.clients = map[int]*GodisClient{0: cli, 1: redir, 2: other}
+
+	assert.Equal(t, replyErr("The client ID you want redirect to does not exist"),
+		execCmd(cli, "client", "tracking", "on", "redirect", "100"))
+	assert.Equal(t, replyErr("You can't use both OPTIN and OPTOUT"),
+		execCmd(cli, "client", "tracking", "on", "optin", "optout"))
+	assert.Equal(t, replyErr("CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled"),
+		execCmd(cli, "client", "caching", "yes"))
+
+	execCmd(redir, "subscribe", TrackingChannel)
+	pushes(redir)
+	assert.Equal(t, ReplyOK, execCmd(cli, "client", "tracking", "on", "redirect", "2", "optin"))
+	assert.Equal(t, replyInt(2), execCmd(cli, "client", "getredir"))
+	assert.Equal(t, replyErr("CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode."),
+		execCmd(cli, "client", "caching", "no"))
+
+	// only the keys read right after CLIENT CACHING yes are tracked
+	execCmd(cli, "get", "k1")
+	assert.Equal(t, ReplyOK, execCmd(cli, "client", "caching", "yes"))
+	assert.Equal(t, replyArray([]string{
+		replyBulk("flags"), replyBulkArray([]string{"on", "optin", "caching-yes"}),
+		replyBulk("redirect"), replyInt(2),
+		replyBulk("prefixes"), replyArray(nil),
+	}), execCmd(cli, "client", "trackinginfo"))
+	assert.Equal(t, ReplyOK, execCmd(cli, "client", "caching", "yes"))
+	execCmd(cli, "get", "k2")
+	execCmd(cli, "get", "k3")
+	execCmd(other, "set", "k1", "v")
+	execCmd(other, "set", "k2", "v")
+	execCmd(other, "set", "k3", "v")
+	assert.Equal(t, []string{replyArray([]string{replyBulk("message"), replyBulk(TrackingChannel), replyBulkArray([]string{"k2"})})},
+		pushes(redir))
+	assert.Nil(t, pushes(cli))
+}
+
+func TestTrackingBcast(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli, other := srv.newClient(0), srv.newClient(1)
+	execCmd(cli, "hello", "3")
+
+	assert.Equal(t, replyErr("PREFIX option requires BCAST mode to be enabled"),
+		execCmd(cli, "client", "tracking", "on", "prefix", "a"))
+	assert.Equal(t, replyErr("Prefix 'ab' overlaps with an existing prefix 'a'. Prefixes for a single client must not overlap."),
+		execCmd(cli, "client", "tracking", "on", "bcast", "prefix", "a", "prefix", "ab"))
+	assert.Equal(t, ReplyOK, execCmd(cli, "client", "tracking", "on", "bcast", "prefix", "user:", "prefix", "job:", "noloop"))
+	assert.Equal(t, "tB", cli.flags())
+
+	execCmd(other, "set", "user:2", "v")
+	execCmd(other, "set", "user:1", "v")
+	execCmd(other, "set", "user:1", "v")
+	execCmd(other, "set", "other", "v")
+	execCmd(cli, "set", "job:1", "v")
+	assert.Nil(t, pushes(cli))
+	srv.tracking.Broadcast()
+	assert.Equal(t, []string{invalidate("user:1", "user:2")}, pushes(cli))
+	srv.tracking.Broadcast()
+	assert.Nil(t, pushes(cli))
+
+	assert.Equal(t, replyErr("You can't switch BCAST mode on/off before disabling tracking for this client, "+
+		"and then re-enabling it with a different mode."), execCmd(cli, "client", "tracking", "on"))
+	assert.Equal(t, 2, srv.tracking.TotalPrefixes())
+	assert.Equal(t, ReplyOK, execCmd(cli, "client", "tracking", "off"))
+	assert.Equal(t, 0, srv.tracking.TotalPrefixes())
+}
+
+func TestTrackingLimit(t *testing.T) {
+	srv := newTestServer(t, 0)
+	cli := srv.newClient(0)
+	execCmd(cli, "hello", "3")
+	execCmd(cli, "client", "tracking", "on")
+	for _, key := range []string{"k1", "k2", "k3"} {
+		execCmd(cli, "get", key)
+	}
+	srv.tracking.Limit(1)
+	assert.Equal(t, 1, srv.tracking.TotalKeys())
+	assert.Equal(t, 2, len(pushes(cli)))
+}
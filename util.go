@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var ErrUnbalancedQuotes = errors.New("unbalanced quotes in request")
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexDigitToInt(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// splitArgs splits a line into arguments the same way as redis-cli:
+//
+//	foo bar "newline are supported\n" and "\xff\x00otherstuff" 'single \'quoted\''
+//
+// double quoted arguments support \xHH, \n, \r, \t, \b, \a escapes, single quoted arguments only support \'.
+// A closing quote must be followed by a space or the end of the line.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	p := 0
+	for {
+		for p < len(line) && isSpace(line[p]) {
+			p++
+		}
+		if p == len(line) {
+			return args, nil
+		}
+
+		var (
+			inq, insq, done bool
+			cur             strings.Builder
+		)
+		for !done {
+			if p == len(line) {
+				if inq || insq {
+					return nil, ErrUnbalancedQuotes
+				}
+				break
+			}
+
+			c := line[p]
+			switch {
+			case inq:
+				if c == '\\' && p+3 < len(line) && line[p+1] == 'x' && isHexDigit(line[p+2]) && isHexDigit(line[p+3]) {
+					cur.WriteByte(hexDigitToInt(line[p+2])*16 + hexDigitToInt(line[p+3]))
+					p += 3
+				} else if c == '\\' && p+1 < len(line) {
+					p++
+					switch line[p] {
+					case 'n':
+						cur.WriteByte('\n')
+					case 'r':
+						cur.WriteByte('\r')
+					case 't':
+						cur.WriteByte('\t')
+					case 'b':
+						cur.WriteByte('\b')
+					case 'a':
+						cur.WriteByte('\a')
+					default:
+						cur.WriteByte(line[p])
+					}
+				} else if c == '"' {
+					// closing quote must be followed by a space or nothing at all
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, ErrUnbalancedQuotes
+					}
+					done = true
+				} else {
+					cur.WriteByte(c)
+				}
+			case insq:
+				if c == '\\' && p+1 < len(line) && line[p+1] == '\'' {
+					p++
+					cur.WriteByte('\'')
+				} else if c == '\'' {
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, ErrUnbalancedQuotes
+					}
+					done = true
+				} else {
+					cur.WriteByte(c)
+				}
+			default:
+				switch c {
+				case ' ', '\n', '\r', '\t', '\v', '\f':
+					done = true
+				case '"':
+					inq = true
+				case '\'':
+					insq = true
+				default:
+					cur.WriteByte(c)
+				}
+			}
+			if p < len(line) {
+				p++
+			}
+		}
+		args = append(args, cur.String())
+	}
+}
+
+// stringMatch reports whether s matches the glob style pattern, which supports *, ?, [abc], [^a-z] and \ escape.
+// A mismatch only backtracks to the last *, since the earlier ones can't match more than it does,
+// so the patterns of untrusted clients can't make it exponential.
+func stringMatch(pattern, s string, nocase bool) bool {
+	if nocase {
+		pattern, s = strings.ToLower(pattern), strings.ToLower(s)
+	}
+
+	p, i := 0, 0
+	star, starI := -1, 0 // the position of the last * and the position of s it matches up to
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			star, starI = p, i
+			p++
+			continue
+		}
+		if p < len(pattern) {
+			if n, ok := matchByte(pattern[p:], s[i]); ok {
+				p += n
+				i++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// the last * matches one more byte
+		starI++
+		p, i = star+1, starI
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchByte reports whether c matches the first element of pattern which isn't *, n is the length of the element.
+func matchByte(pattern string, c byte) (n int, ok bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		p := 1
+		not := p < len(pattern) && pattern[p] == '^'
+		if not {
+			p++
+		}
+
+		match := false
+		for p < len(pattern) && pattern[p] != ']' {
+			switch {
+			case pattern[p] == '\\' && p+1 < len(pattern):
+				p++
+				match = match || pattern[p] == c
+			case p+2 < len(pattern) && pattern[p+1] == '-':
+				start, end := pattern[p], pattern[p+2]
+				if start > end {
+					start, end = end, start
+				}
+				match = match || (c >= start && c <= end)
+				p += 2
+			default:
+				match = match || pattern[p] == c
+			}
+			p++
+		}
+		// an unterminated [ ends the pattern
+		if p < len(pattern) {
+			p++
+		}
+		return p, match != not
+	case '\\':
+		if len(pattern) >= 2 {
+			return 2, pattern[1] == c
+		}
+	}
+	return 1, pattern[0] == c
+}
+
+// quoteArg quotes s if needed, so splitArgs can split it back.
+func quoteArg(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\r\n\v\f\"'\\") && strings.IndexFunc(s, func(r rune) bool { return r < 0x20 || r >= 0x7f }) < 0 {
+		return s
+	}
+	return reprArg(s)
+}
+
+// reprArg quotes s always, escaping the special and non-printable bytes.
+func reprArg(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString("\\n")
+		case '\r':
+			b.WriteString("\\r")
+		case '\t':
+			b.WriteString("\\t")
+		default:
+			if c < 0x20 || c >= 0x7f {
+				b.WriteString(fmt.Sprintf("\\x%02x", c))
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
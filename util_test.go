@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitArgs(t *testing.T) {
+	for line, expected := range map[string][]string{
+		"set key val":                    {"set", "key", "val"},
+		"  set   key\tval  ":             {"set", "key", "val"},
+		`set "hello world" 'it\'s'`:      {"set", "hello world", "it's"},
+		`set key "a\nb\r\t\x41\x7a\"\\"`: {"set", "key", "a\nb\r\tAz\"\\"},
+		`set key 'no \n escape'`:         {"set", "key", `no \n escape`},
+		`set key ""`:                     {"set", "key", ""},
+		`set key "\xzz"`:                 {"set", "key", "xzz"},
+		"":                               nil,
+	} {
+		args, err := splitArgs(line)
+		assert.Nil(t, err, line)
+		assert.Equal(t, expected, args, line)
+	}
+
+	for _, line := range []string{`set "key`, `set 'key`, `set "key"val`, `set 'key'val`} {
+		_, err := splitArgs(line)
+		assert.Equal(t, ErrUnbalancedQuotes, err, line)
+	}
+}
+
+func TestStringMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, s string
+		nocase     bool
+		expected   bool
+	}{
+		{"*", "anything", false, true},
+		{"h?llo", "hello", false, true},
+		{"h*o", "hello", false, true},
+		{"h*x", "hello", false, false},
+		{"h[ae]llo", "hallo", false, true},
+		{"h[^e]llo", "hello", false, false},
+		{"h[a-z]llo", "hbllo", false, true},
+		{`h\*llo`, "h*llo", false, true},
+		{`h\*llo`, "hello", false, false},
+		{"HELLO", "hello", false, false},
+		{"HELLO", "hello", true, true},
+		{"*a*b", "xaybzb", false, true},
+		{"a*b*c", "abcbc", false, true},
+		{"a*b*c", "abcbd", false, false},
+		{"a**", "a", false, true},
+		{"?*", "", false, false},
+		{"h[a-", "hb", false, false},
+		{"h[ab", "hb", false, true},
+	} {
+		assert.Equal(t, c.expected, stringMatch(c.pattern, c.s, c.nocase), c.pattern+" "+c.s)
+	}
+
+	// the backtracking of many * is linear
+	start := time.Now()
+	assert.False(t, stringMatch(strings.Repeat("*a", 12)+"b", strings.Repeat("a", 40), false))
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestQuoteArg(t *testing.T) {
+	for _, s := range []string{"plain", "", "with space", `quote"s`, "it's", "a\nb\x00\xff", `back\slash`} {
+		args, err := splitArgs("key " + quoteArg(s))
+		assert.Nil(t, err, s)
+		assert.Equal(t, []string{"key", s}, args)
+	}
+	assert.Equal(t, "plain", quoteArg("plain"))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math/rand"
+)
+
+const (
+	ZSkipListMaxLevel = 32
+	ZSkipListP        = 0.25
+	ZSetNodeOverhead  = 64 // the skiplist node with the map entry of the member
+)
+
+type ZSkipListNode struct {
+	member string
+	score  float64
+	next   []*ZSkipListNode
+}
+
+// SortedSet is the members ordered by score then member, with a skiplist for the order and a map for the scores.
+type SortedSet struct {
+	scores map[string]float64
+	head   *ZSkipListNode
+	level  int
+	memory int64
+}
+
+func NewSortedSet() *SortedSet {
+	return &SortedSet{
+		scores: make(map[string]float64),
+		head:   &ZSkipListNode{next: make([]*ZSkipListNode, ZSkipListMaxLevel)},
+		level:  1,
+	}
+}
+
+func zslRandomLevel() int {
+	level := 1
+	for level < ZSkipListMaxLevel && rand.Float64() < ZSkipListP {
+		level++
+	}
+	return level
+}
+
+// zslLess reports whether the element of score and member is ordered before n.
+func zslLess(n *ZSkipListNode, score float64, member string) bool {
+	return n.score < score || n.score == score && n.member < member
+}
+
+func (z *SortedSet) Len() int {
+	return len(z.scores)
+}
+
+func (z *SortedSet) Score(member string) (float64, bool) {
+	score, ok := z.scores[member]
+	return score, ok
+}
+
+// Add sets the score of member, returns false if it exists already.
+func (z *SortedSet) Add(member string, score float64) bool {
+	old, exists := z.scores[member]
+	if exists {
+		if old == score {
+			return false
+		}
+		z.zslDelete(member, old)
+	} else {
+		z.memory += ZSetNodeOverhead + int64(len(member))
+	}
+	z.scores[member] = score
+	z.zslInsert(member, score)
+	return !exists
+}
+
+// Remove deletes member, returns false if it doesn't exist.
+func (z *SortedSet) Remove(member string) bool {
+	score, ok := z.scores[member]
+	if !ok {
+		return false
+	}
+	z.zslDelete(member, score)
+	delete(z.scores, member)
+	z.memory -= ZSetNodeOverhead + int64(len(member))
+	return true
+}
+
+// zslUpdates returns the last node before score and member of every level.
+func (z *SortedSet) zslUpdates(score float64, member string) []*ZSkipListNode {
+	update := make([]*ZSkipListNode, ZSkipListMaxLevel)
+	x := z.head
+	for i := z.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && zslLess(x.next[i], score, member) {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+	return update
+}
+
+func (z *SortedSet) zslInsert(member string, score float64) {
+	update := z.zslUpdates(score, member)
+	level := zslRandomLevel()
+	for i := z.level; i < level; i++ {
+		update[i] = z.head
+	}
+	z.level = max(z.level, level)
+
+	n := &ZSkipListNode{member: member, score: score, next: make([]*ZSkipListNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+}
+
+func (z *SortedSet) zslDelete(member string, score float64) {
+	update := z.zslUpdates(score, member)
+	n := update[0].next[0]
+	if n == nil || n.member != member {
+		return
+	}
+	for i := 0; i < z.level; i++ {
+		if update[i].next[i] == n {
+			update[i].next[i] = n.next[i]
+		}
+	}
+	for z.level > 1 && z.head.next[z.level-1] == nil {
+		z.level--
+	}
+}
+
+// RangeByScore calls fn with the members whose score is in [min, max] in order, stops if fn returns false.
+func (z *SortedSet) RangeByScore(min, max float64, fn func(member string, score float64) bool) {
+	x := z.head
+	for i := z.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].score < min {
+			x = x.next[i]
+		}
+	}
+	for x = x.next[0]; x != nil && x.score <= max; x = x.next[0] {
+		if !fn(x.member, x.score) {
+			return
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func zsetMembers(z *SortedSet, min, max float64) []string {
+	var members []string
+	z.RangeByScore(min, max, func(member string, score float64) bool {
+		members = append(members, member)
+		return true
+	})
+	return members
+}
+
+func TestSortedSet(t *testing.T) {
+	z := NewSortedSet()
+	assert.True(t, z.Add("c", 3))
+	assert.True(t, z.Add("a", 1))
+	assert.True(t, z.Add("b", 2))
+	assert.True(t, z.Add("b2", 2))
+	assert.False(t, z.Add("a", 1))
+	assert.Equal(t, 4, z.Len())
+	assert.Equal(t, []string{"a", "b", "b2", "c"}, zsetMembers(z, math.Inf(-1), math.Inf(1)))
+	assert.Equal(t, []string{"b", "b2"}, zsetMembers(z, 1.5, 2))
+
+	// the member is moved by the new score
+	assert.False(t, z.Add("a", 4))
+	score, ok := z.Score("a")
+	assert.True(t, ok)
+	assert.Equal(t, 4.0, score)
+	assert.Equal(t, []string{"b", "b2", "c", "a"}, zsetMembers(z, math.Inf(-1), math.Inf(1)))
+
+	assert.True(t, z.Remove("b"))
+	assert.False(t, z.Remove("b"))
+	_, ok = z.Score("b")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"b2", "c", "a"}, zsetMembers(z, math.Inf(-1), math.Inf(1)))
+	assert.Equal(t, int64(3*ZSetNodeOverhead+4), z.memory)
+
+	// stops when fn returns false
+	var first []string
+	z.RangeByScore(0, 10, func(member string, score float64) bool {
+		first = append(first, member)
+		return false
+	})
+	assert.Equal(t, []string{"b2"}, first)
+
+	for i := 0; i < 1000; i++ {
+		z.Add(fmt.Sprint("m", i), float64(i%100))
+	}
+	for i := 0; i < 1000; i += 2 {
+		z.Remove(fmt.Sprint("m", i))
+	}
+	assert.Equal(t, 503, z.Len())
+	assert.Equal(t, []string{"m1", "m101", "m201", "m301", "m401", "m501", "m601", "m701", "m801", "m901"},
+		zsetMembers(z, 1, 1))
+}